@@ -1,34 +1,100 @@
 package app
 
 import (
+	"log"
+
+	"github.com/astrviktor/banner-rotation/internal/clicktoken"
 	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/events"
 	internalhttp "github.com/astrviktor/banner-rotation/internal/server/http"
 	"github.com/astrviktor/banner-rotation/internal/storage"
 	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
 	sqlstorage "github.com/astrviktor/banner-rotation/internal/storage/sql"
+	sqlitestorage "github.com/astrviktor/banner-rotation/internal/storage/sqlite"
 )
 
 type App struct {
-	config config.Config
-	server *internalhttp.Server
+	config   config.Config
+	server   *internalhttp.Server
+	consumer *events.Consumer
 }
 
 func New(conf config.Config) *App {
 	var stor storage.Storage
-	if conf.DB.Mode == config.DBMemoryMode {
-		stor = memorystorage.New()
-	} else {
-		stor = sqlstorage.New(conf)
+	var publisher events.Publisher
+	var err error
+	switch conf.DB.Mode {
+	case config.DBMemoryMode:
+		stor = memorystorage.NewPersistent(conf.DB.Memory, conf.Kafka.Consumer.DedupeRetention)
+		publisher, err = newBackgroundPublisher(conf)
+	case config.DBSQLiteMode:
+		stor = sqlitestorage.New(conf)
+		publisher, err = newBackgroundPublisher(conf)
+	default:
+		// события отправляются из outbox, записанного в одной транзакции с событием; событие отмечается
+		// отправленным после ответа kafka, поэтому отправка из outbox синхронная
+		outboxConf := conf
+		outboxConf.Kafka.Async = false
+
+		var outboxPublisher events.Publisher
+		outboxPublisher, err = events.New(outboxConf)
+		if events.Name(conf) != config.EventsPublisherNone {
+			stor = sqlstorage.NewWithOutbox(conf, outboxPublisher)
+			publisher = events.StatsOnly(outboxPublisher)
+		} else {
+			stor = sqlstorage.New(conf)
+			publisher = outboxPublisher
+		}
+	}
+	if err != nil {
+		log.Fatalf("Events publisher: %v", err)
+	}
+
+	strategies, err := core.NewStrategies(conf.Choice)
+	if err != nil {
+		log.Fatalf("Choice strategies: %v", err)
+	}
+
+	signer, err := clicktoken.NewSigner(conf.Click)
+	if err != nil {
+		log.Fatalf("Click token keys: %v", err)
 	}
 
-	server := internalhttp.NewServer(conf.HTTPServer.Host, conf.HTTPServer.Port, stor)
-	return &App{conf, server}
+	var consumer *events.Consumer
+	if conf.Kafka.Consumer.Use {
+		consumer, err = events.NewConsumer(conf, stor, strategies)
+		if err != nil {
+			log.Fatalf("Kafka consumer: %v", err)
+		}
+	}
+
+	server := internalhttp.NewServer(conf.HTTPServer.Host, conf.HTTPServer.Port, stor, strategies, conf.Click, signer,
+		conf.DB.Timeouts, publisher)
+	return &App{conf, server, consumer}
 }
 
+// newBackgroundPublisher - отправка событий, которую запрос не ждет.
+func newBackgroundPublisher(conf config.Config) (events.Publisher, error) {
+	publisher, err := events.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	return events.Background(publisher, conf.Events.QueueSize), nil
+}
+
+// Start запускает сервер, затем чтение событий из kafka: сервер подключает хранилище.
 func (a *App) Start() {
 	a.server.Start()
+	if a.consumer != nil {
+		a.consumer.Start()
+	}
 }
 
+// Stop останавливает чтение событий до закрытия хранилища сервером.
 func (a *App) Stop() {
+	if a.consumer != nil {
+		a.consumer.Close()
+	}
 	a.server.Stop()
 }
@@ -0,0 +1,148 @@
+package clicktoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+)
+
+// Токен перехода: base64url(JSON с Claims) + "." + base64url(HMAC-SHA256 первой части).
+// Подписывается активным ключом, проверяется любым ключом из конфигурации (по ID ключа),
+// поэтому при смене ключа токены, выданные до смены, остаются действительными.
+
+var (
+	ErrInvalidToken = errors.New("invalid click token")
+	ErrUnknownKey   = errors.New("unknown click token key")
+	ErrExpiredToken = errors.New("click token expired")
+	ErrInvalidKey   = errors.New("click token key must have id and secret")
+	ErrWeakKey      = errors.New("click token secret is too short or a placeholder")
+)
+
+// MinSecretLength - наименьшая длина секрета ключа в байтах: ключ HMAC-SHA256 не короче 256 бит.
+const MinSecretLength = 32
+
+// placeholders - части секретов из примеров конфигурации, с которыми токены может подделать любой.
+var placeholders = []string{"change-me", "changeme", "secret", "example"}
+
+// Claims - показ, по которому выдан токен.
+type Claims struct {
+	KeyID        string `json:"kid"`
+	ImpressionID string `json:"imp"`
+	SlotID       string `json:"slot"`
+	BannerID     string `json:"banner"`
+	SegmentID    string `json:"segment"`
+	ExpiresAt    int64  `json:"exp"` // unix time
+}
+
+type Signer struct {
+	keys      map[string][]byte
+	activeKey string
+}
+
+// NewSigner - подпись токенов ключами из click.keys, nil если ключи не заданы (проверка отключена).
+func NewSigner(conf config.ClickConfig) (*Signer, error) {
+	if len(conf.Keys) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	signer := &Signer{keys: make(map[string][]byte, len(conf.Keys)), activeKey: conf.ActiveKey}
+	for _, key := range conf.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, ErrInvalidKey
+		}
+		if err := checkSecret(key.Secret); err != nil {
+			return nil, fmt.Errorf("key %s: %w", key.ID, err)
+		}
+		signer.keys[key.ID] = []byte(key.Secret)
+	}
+
+	if signer.activeKey == "" {
+		signer.activeKey = conf.Keys[0].ID
+	}
+
+	if _, ok := signer.keys[signer.activeKey]; !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return signer, nil
+}
+
+// checkSecret - ErrWeakKey для короткого секрета и секрета из примера.
+func checkSecret(secret string) error {
+	if len(secret) < MinSecretLength {
+		return ErrWeakKey
+	}
+
+	lower := strings.ToLower(secret)
+	for _, placeholder := range placeholders {
+		if strings.Contains(lower, placeholder) {
+			return ErrWeakKey
+		}
+	}
+	return nil
+}
+
+// Sign подписывает показ активным ключом.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	claims.KeyID = s.activeKey
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(s.keys[s.activeKey], encoded)), nil
+}
+
+// Verify проверяет подпись и срок действия токена. Для токена с верной подписью и истекшим сроком
+// вместе с ErrExpiredToken возвращаются его данные.
+func (s *Signer) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	key, ok := s.keys[claims.KeyID]
+	if !ok {
+		return Claims{}, ErrUnknownKey
+	}
+
+	if !hmac.Equal(signature, s.sign(key, parts[0])) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrExpiredToken
+	}
+
+	return claims, nil
+}
+
+func (s *Signer) sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
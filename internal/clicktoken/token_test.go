@@ -0,0 +1,108 @@
+package clicktoken
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+// тесты токенов перехода:
+// - подписанный токен проверяется, поддельный и с измененными данными - нет
+// - после смены активного ключа старые токены действительны, пока старый ключ в списке
+// - истекший токен не проверяется
+// - короткий секрет и секрет из примера конфигурации не принимаются
+
+// Секреты ключей для тестов (openssl rand -base64 32).
+const (
+	secret1 = "q3Jr0mZ8v1yQb6Yp9xW2tL5nK7dF4hS0aE1cU3iO8gM="
+	secret2 = "Xk9Tn2Pq5Wz8Lr1Vb4Hm7Jc0Fd3Sg6Ya9Ue2Io5Kt8Q="
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	signer, err := NewSigner(config.ClickConfig{Keys: []config.ClickKeyConfig{{ID: "k1", Secret: secret1}}})
+	require.NoError(t, err)
+
+	claims := Claims{ImpressionID: "imp", SlotID: "slot", BannerID: "banner", SegmentID: "segment",
+		ExpiresAt: now.Add(time.Hour).Unix()}
+
+	token, err := signer.Sign(claims)
+	require.NoError(t, err)
+
+	verified, err := signer.Verify(token, now)
+	require.NoError(t, err)
+	claims.KeyID = "k1"
+	require.Equal(t, claims, verified)
+
+	parts := strings.Split(token, ".")
+	forged, err := signer.Sign(Claims{ImpressionID: "imp", SlotID: "slot", BannerID: "other", SegmentID: "segment",
+		ExpiresAt: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	_, err = signer.Verify(strings.Split(forged, ".")[0]+"."+parts[1], now)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = signer.Verify("imp", now)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	other, err := NewSigner(config.ClickConfig{Keys: []config.ClickKeyConfig{{ID: "k1", Secret: secret2}}})
+	require.NoError(t, err)
+
+	_, err = other.Verify(token, now)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	expired, err := signer.Verify(token, now.Add(time.Hour))
+	require.ErrorIs(t, err, ErrExpiredToken)
+	require.Equal(t, claims, expired)
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	claims := Claims{ImpressionID: "imp", ExpiresAt: now.Add(time.Hour).Unix()}
+
+	before, err := NewSigner(config.ClickConfig{Keys: []config.ClickKeyConfig{{ID: "k1", Secret: secret1}}})
+	require.NoError(t, err)
+
+	oldToken, err := before.Sign(claims)
+	require.NoError(t, err)
+
+	after, err := NewSigner(config.ClickConfig{
+		Keys:      []config.ClickKeyConfig{{ID: "k1", Secret: secret1}, {ID: "k2", Secret: secret2}},
+		ActiveKey: "k2",
+	})
+	require.NoError(t, err)
+
+	newToken, err := after.Sign(claims)
+	require.NoError(t, err)
+
+	verified, err := after.Verify(oldToken, now)
+	require.NoError(t, err)
+	require.Equal(t, "k1", verified.KeyID)
+
+	verified, err = after.Verify(newToken, now)
+	require.NoError(t, err)
+	require.Equal(t, "k2", verified.KeyID)
+
+	_, err = before.Verify(newToken, now)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = NewSigner(config.ClickConfig{Keys: []config.ClickKeyConfig{{ID: "k1", Secret: secret1}}, ActiveKey: "k2"})
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	signer, err := NewSigner(config.ClickConfig{})
+	require.NoError(t, err)
+	require.Nil(t, signer)
+}
+
+func TestWeakKey(t *testing.T) {
+	for _, secret := range []string{"change-me", "0123456789", "change-me-change-me-change-me-change-me"} {
+		_, err := NewSigner(config.ClickConfig{Keys: []config.ClickKeyConfig{{ID: "k1", Secret: secret}}})
+		require.ErrorIs(t, err, ErrWeakKey, secret)
+	}
+
+	_, err := NewSigner(config.ClickConfig{Keys: []config.ClickKeyConfig{{ID: "k1", Secret: ""}}})
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
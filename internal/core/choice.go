@@ -1,66 +1,210 @@
 package core
 
 import (
+	"context"
 	"math"
+	"time"
 
 	"github.com/astrviktor/banner-rotation/internal/storage"
 )
 
-func GetBanner(s storage.Storage, slotID, segmentID string) (string, error) {
-	// 1. получить список баннеров в ротации с slotID
-	bannersID, err := s.GetBannersForSlot(slotID)
+// ChoiceRequest - параметры выбора баннера.
+type ChoiceRequest struct {
+	SlotID    string
+	SegmentID string
+	Features  []float64 // признаки запроса для контекстного алгоритма
+	PerSlot   bool      // статистика только по этому слоту, иначе по всем слотам
+}
+
+// Explanation - почему для слота и сегмента выбирается баннер, с оценками всех баннеров из ротации.
+type Explanation struct {
+	SlotID    string `json:"slotId"`
+	SegmentID string `json:"segmentId"`
+	Strategy  string `json:"strategy"`
+	PerSlot   bool   `json:"perSlot"`
+	Decision
+}
+
+func GetBanner(ctx context.Context, s storage.Storage, strategy Strategy, slotID, segmentID string) (string, error) {
+	return ChooseBanner(ctx, s, strategy, ChoiceRequest{SlotID: slotID, SegmentID: segmentID})
+}
+
+func ChooseBanner(ctx context.Context, s storage.Storage, strategy Strategy, req ChoiceRequest) (string, error) {
+	decision, err := decide(ctx, s, strategy, req)
 	if err != nil {
 		return storage.EmptyID, err
 	}
 
+	return decision.BannerID, nil
+}
+
+// ExplainBanner - то же, что ChooseBanner, но возвращает оценки баннеров и причину выбора.
+// Показ не записывается. Для случайных алгоритмов это один из возможных исходов.
+func ExplainBanner(ctx context.Context, s storage.Storage, strategy Strategy, req ChoiceRequest) (Explanation, error) {
+	decision, err := decide(ctx, s, strategy, req)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	if _, ok := strategy.(ContextualStrategy); ok {
+		// контекстный алгоритм не использует счетчики, показываем их для наглядности
+		stats, err := s.GetStatsForSlotAndSegment(ctx, req.SlotID, req.SegmentID, req.PerSlot)
+		if err != nil {
+			return Explanation{}, err
+		}
+
+		statsByBanner := make(map[string]storage.Stat, len(stats))
+		for _, stat := range stats {
+			statsByBanner[stat.BannerID] = stat
+		}
+
+		for idx := range decision.Scores {
+			stat := statsByBanner[decision.Scores[idx].BannerID]
+			decision.Scores[idx].Shows = float64(stat.ShowCount)
+			decision.Scores[idx].Clicks = float64(stat.ClickCount)
+		}
+	}
+
+	return Explanation{
+		SlotID:    req.SlotID,
+		SegmentID: req.SegmentID,
+		Strategy:  strategy.Name(),
+		PerSlot:   req.PerSlot,
+		Decision:  decision,
+	}, nil
+}
+
+func decide(ctx context.Context, s storage.Storage, strategy Strategy, req ChoiceRequest) (Decision, error) {
+	_, contextual := strategy.(ContextualStrategy)
+	windowedStrategy, windowed := strategy.(WindowedStrategy)
+	if !contextual && !windowed {
+		// баннеры из ротации и их статистика одним запросом
+		return decideWithStats(ctx, s, strategy, req)
+	}
+
+	// 1. получить список баннеров в ротации с slotID
+	bannersID, err := s.GetBannersForSlot(ctx, req.SlotID)
+	if err != nil {
+		return Decision{}, err
+	}
+
 	if len(bannersID) == 0 {
-		return storage.EmptyID, ErrTooFewBannersForSlot
+		return Decision{}, ErrTooFewBannersForSlot
 	}
 
-	// 2. для каждого баннера посчитать количество показов для сегмента (независимо от слотов)
-	// если для баннера 0 показов, можно сразу его вернуть для показа
+	if contextual, ok := strategy.(ContextualStrategy); ok {
+		return decideWithContext(ctx, s, contextual, bannersID, req.SegmentID, req.Features)
+	}
 
-	// 3. для каждого баннера посчитать количество переходов для сегмента (независимо от слотов)
+	// 2. для каждого баннера получить количество показов и переходов для сегмента
+	// по временным интервалам (в этом слоте или независимо от слотов)
+	arms, err := getWindowedArms(ctx, s, windowedStrategy, bannersID, req)
+	if err != nil {
+		return Decision{}, err
+	}
 
-	// 4. посчитать количество показов всех баннеров в слоте для сегмента (сумма из п.2)
+	// 3. выбрать баннер заданным алгоритмом
+	return strategy.Decide(arms)
+}
 
-	stats := make(map[string]storage.Stat)
-	showsAmount := 0
-	for _, bannerID := range bannersID {
-		stat, err := s.GetStatForBannerAndSegment(bannerID, segmentID)
-		if err != nil {
-			return storage.EmptyID, err
-		}
+func decideWithStats(ctx context.Context, s storage.Storage, strategy Strategy, req ChoiceRequest) (Decision, error) {
+	stats, err := s.GetStatsForSlotAndSegment(ctx, req.SlotID, req.SegmentID, req.PerSlot)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if len(stats) == 0 {
+		return Decision{}, ErrTooFewBannersForSlot
+	}
+
+	arms, err := statArms(stats)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	return strategy.Decide(arms)
+}
 
+// statArms - варианты для алгоритма по статистике баннеров.
+func statArms(stats []storage.Stat) ([]Arm, error) {
+	arms := make([]Arm, 0, len(stats))
+	for _, stat := range stats {
 		if stat.ClickCount > stat.ShowCount {
-			return storage.EmptyID, ErrBannerClicksMoreThenShows
+			return nil, ErrBannerClicksMoreThenShows
 		}
 
-		if stat.ShowCount == 0 {
-			return bannerID, nil
-		}
+		arms = append(arms, Arm{
+			BannerID: stat.BannerID,
+			Shows:    float64(stat.ShowCount),
+			Clicks:   float64(stat.ClickCount),
+		})
+	}
+	return arms, nil
+}
+
+func getWindowedArms(ctx context.Context, s storage.Storage, strategy WindowedStrategy, bannersID []string,
+	req ChoiceRequest) ([]Arm, error) {
+	now := time.Now().UTC()
+	since := strategy.Since(now)
 
-		stats[bannerID] = stat
-		showsAmount += stat.ShowCount
+	slotID := storage.AllSlots
+	if req.PerSlot {
+		slotID = req.SlotID
 	}
 
-	// 5. weight = xi + sqrt(2 * Ln(n) / ni)
-	// нужно взять баннер с максимальным весом
+	// интервалы всех баннеров ротации одним запросом
+	buckets, err := s.GetStatBucketsForSlotAndSegment(ctx, slotID, bannersID, req.SegmentID, since)
+	if err != nil {
+		return nil, err
+	}
 
-	var weightMax float64
-	resultID := ""
+	arms := strategy.Arms(buckets, bannersID, now)
+	for idx := range arms {
+		// переход в окне может относиться к показу до окна, поэтому ограничиваем, а не возвращаем ошибку
+		arms[idx].Clicks = math.Min(arms[idx].Clicks, arms[idx].Shows)
+	}
 
-	ln := math.Log(float64(showsAmount)) / math.Log(math.E)
-	for _, bannerID := range bannersID {
-		stat := stats[bannerID]
+	return arms, nil
+}
 
-		weight := float64(stat.ClickCount)/float64(stat.ShowCount) + math.Sqrt(2*ln/float64(stat.ShowCount))
+func decideWithContext(ctx context.Context, s storage.Storage, strategy ContextualStrategy, bannersID []string,
+	segmentID string, requestFeatures []float64) (Decision, error) {
+	x, err := getContextVector(ctx, s, strategy, segmentID, requestFeatures)
+	if err != nil {
+		return Decision{}, err
+	}
 
-		if weight > weightMax {
-			weightMax = weight
-			resultID = bannerID
-		}
+	// модели всех баннеров ротации одним запросом
+	models, err := s.GetModels(ctx, bannersID)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	return strategy.DecideWithContext(models, x)
+}
+
+func getContextVector(ctx context.Context, s storage.Storage, strategy ContextualStrategy, segmentID string,
+	requestFeatures []float64) ([]float64, error) {
+	segmentFeatures, err := s.GetSegmentFeatures(ctx, segmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return contextVector(strategy.Dimension(), segmentFeatures, requestFeatures), nil
+}
+
+// UpdateContext обучает модель баннера после показа или перехода, если алгоритм контекстный.
+func UpdateContext(ctx context.Context, s storage.Storage, strategy Strategy, bannerID, segmentID string,
+	requestFeatures []float64, action storage.ActionType) error {
+	contextual, ok := strategy.(ContextualStrategy)
+	if !ok {
+		return nil
+	}
+
+	x, err := getContextVector(ctx, s, contextual, segmentID, requestFeatures)
+	if err != nil {
+		return err
 	}
 
-	return resultID, nil
+	return s.UpdateModel(ctx, bannerID, x, action)
 }
@@ -1,7 +1,9 @@
 package core
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/astrviktor/banner-rotation/internal/storage"
 	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
@@ -17,43 +19,51 @@ import (
 // - 3 баннера, переходы при каждом показе - должна быть одинаковая статистика показов
 // - 3 баннера, по 1 переходят, по 2 и 3 нет - по первому показов сильно больше, но и по остальным есть
 
+// - 2 слота со статистикой по слоту, в каждом переходят по своему баннеру - в каждом слоте показывается свой баннер
+
+// - объяснение выбора: показ вне очереди, затем максимальный вес; показы не записываются
+
+// - статистика всей ротации получается одним запросом, без запросов по каждому баннеру
+
 // тесты с ошибками:
 // - для слота не создано ротаций
 // - количество переходов по какой то причине стало больше чем количество показов
 
 func TestGetBannerTwoOK(t *testing.T) {
+	ctx := context.Background()
+
 	t.Run("test 2 banners and no clicks", func(t *testing.T) {
 		s := memorystorage.New()
-		err := s.Connect()
+		err := s.Connect(ctx)
 		require.NoError(t, err)
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
-		bannerB, err := s.CreateBanner("bannerB")
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerB})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
 		require.NoError(t, err)
 
 		for i := 0; i < 1000; i++ {
-			bannerID, err := GetBanner(s, slot, segment)
+			bannerID, err := GetBanner(ctx, s, NewUCB1(), slot, segment)
 			require.NoError(t, err)
 
-			err = s.CreateEvent(slot, bannerID, segment, storage.Show)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
 			require.NoError(t, err)
 		}
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
-		statBannerB, err := s.GetStatForBannerAndSegment(bannerB, segment)
+		statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 500, statBannerA.ShowCount)
@@ -66,38 +76,38 @@ func TestGetBannerTwoOK(t *testing.T) {
 
 	t.Run("test 2 banners and all clicks", func(t *testing.T) {
 		s := memorystorage.New()
-		err := s.Connect()
+		err := s.Connect(ctx)
 		require.NoError(t, err)
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
-		bannerB, err := s.CreateBanner("bannerB")
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerB})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
 		require.NoError(t, err)
 
 		for i := 0; i < 1000; i++ {
-			bannerID, err := GetBanner(s, slot, segment)
+			bannerID, err := GetBanner(ctx, s, NewUCB1(), slot, segment)
 			require.NoError(t, err)
 
-			err = s.CreateEvent(slot, bannerID, segment, storage.Show)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
 			require.NoError(t, err)
-			err = s.CreateEvent(slot, bannerID, segment, storage.Click)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
 			require.NoError(t, err)
 		}
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
-		statBannerB, err := s.GetStatForBannerAndSegment(bannerB, segment)
+		statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 500, statBannerA.ShowCount)
@@ -110,41 +120,41 @@ func TestGetBannerTwoOK(t *testing.T) {
 
 	t.Run("test 2 banners and clicks on bannerA", func(t *testing.T) {
 		s := memorystorage.New()
-		err := s.Connect()
+		err := s.Connect(ctx)
 		require.NoError(t, err)
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
-		bannerB, err := s.CreateBanner("bannerB")
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerB})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
 		require.NoError(t, err)
 
 		for i := 0; i < 1000; i++ {
-			bannerID, err := GetBanner(s, slot, segment)
+			bannerID, err := GetBanner(ctx, s, NewUCB1(), slot, segment)
 			require.NoError(t, err)
 
-			err = s.CreateEvent(slot, bannerID, segment, storage.Show)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
 			require.NoError(t, err)
 
 			if bannerID == bannerA {
-				err = s.CreateEvent(slot, bannerID, segment, storage.Click)
+				err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
 				require.NoError(t, err)
 			}
 		}
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
-		statBannerB, err := s.GetStatForBannerAndSegment(bannerB, segment)
+		statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 988, statBannerA.ShowCount)
@@ -155,42 +165,44 @@ func TestGetBannerTwoOK(t *testing.T) {
 }
 
 func TestGetBannerThreeOK(t *testing.T) {
+	ctx := context.Background()
+
 	t.Run("test 3 banners and no clicks", func(t *testing.T) {
 		s := memorystorage.New()
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
-		bannerB, err := s.CreateBanner("bannerB")
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
 		require.NoError(t, err)
-		bannerC, err := s.CreateBanner("bannerC")
+		bannerC, err := s.CreateBanner(ctx, "bannerC")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerB})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerC})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerC})
 		require.NoError(t, err)
 
 		for i := 0; i < 900; i++ {
-			bannerID, err := GetBanner(s, slot, segment)
+			bannerID, err := GetBanner(ctx, s, NewUCB1(), slot, segment)
 			require.NoError(t, err)
 
-			err = s.CreateEvent(slot, bannerID, segment, storage.Show)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
 			require.NoError(t, err)
 		}
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
-		statBannerB, err := s.GetStatForBannerAndSegment(bannerB, segment)
+		statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
 		require.NoError(t, err)
-		statBannerC, err := s.GetStatForBannerAndSegment(bannerC, segment)
+		statBannerC, err := s.GetStatForBannerAndSegment(ctx, bannerC, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 300, statBannerA.ShowCount)
@@ -206,41 +218,41 @@ func TestGetBannerThreeOK(t *testing.T) {
 	t.Run("test 3 banners and all clicks", func(t *testing.T) {
 		s := memorystorage.New()
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
-		bannerB, err := s.CreateBanner("bannerB")
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
 		require.NoError(t, err)
-		bannerC, err := s.CreateBanner("bannerC")
+		bannerC, err := s.CreateBanner(ctx, "bannerC")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerB})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerC})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerC})
 		require.NoError(t, err)
 
 		for i := 0; i < 900; i++ {
-			bannerID, err := GetBanner(s, slot, segment)
+			bannerID, err := GetBanner(ctx, s, NewUCB1(), slot, segment)
 			require.NoError(t, err)
 
-			err = s.CreateEvent(slot, bannerID, segment, storage.Show)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
 			require.NoError(t, err)
-			err = s.CreateEvent(slot, bannerID, segment, storage.Click)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
 			require.NoError(t, err)
 		}
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
-		statBannerB, err := s.GetStatForBannerAndSegment(bannerB, segment)
+		statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
 		require.NoError(t, err)
-		statBannerC, err := s.GetStatForBannerAndSegment(bannerC, segment)
+		statBannerC, err := s.GetStatForBannerAndSegment(ctx, bannerC, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 300, statBannerA.ShowCount)
@@ -256,44 +268,44 @@ func TestGetBannerThreeOK(t *testing.T) {
 	t.Run("test 3 banners and clicks on bannerA", func(t *testing.T) {
 		s := memorystorage.New()
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
-		bannerB, err := s.CreateBanner("bannerB")
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
 		require.NoError(t, err)
-		bannerC, err := s.CreateBanner("bannerC")
+		bannerC, err := s.CreateBanner(ctx, "bannerC")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerB})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
 		require.NoError(t, err)
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerC})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerC})
 		require.NoError(t, err)
 
 		for i := 0; i < 1000; i++ {
-			bannerID, err := GetBanner(s, slot, segment)
+			bannerID, err := GetBanner(ctx, s, NewUCB1(), slot, segment)
 			require.NoError(t, err)
 
-			err = s.CreateEvent(slot, bannerID, segment, storage.Show)
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
 			require.NoError(t, err)
 
 			if bannerID == bannerA {
-				err = s.CreateEvent(slot, bannerID, segment, storage.Click)
+				err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
 				require.NoError(t, err)
 			}
 		}
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
-		statBannerB, err := s.GetStatForBannerAndSegment(bannerB, segment)
+		statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
 		require.NoError(t, err)
-		statBannerC, err := s.GetStatForBannerAndSegment(bannerC, segment)
+		statBannerC, err := s.GetStatForBannerAndSegment(ctx, bannerC, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 976, statBannerA.ShowCount)
@@ -308,30 +320,32 @@ func TestGetBannerThreeOK(t *testing.T) {
 }
 
 func TestGetBannerErrors(t *testing.T) {
+	ctx := context.Background()
+
 	t.Run("no rotations created for slot", func(t *testing.T) {
 		s := memorystorage.New()
-		err := s.Connect()
+		err := s.Connect(ctx)
 		require.NoError(t, err)
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
 
-		_, err = GetBanner(s, slot, segment)
+		_, err = GetBanner(ctx, s, NewUCB1(), slot, segment)
 		require.NoError(t, err)
 
-		err = s.DeleteRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.DeleteRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
 
-		_, err = GetBanner(s, slot, segment)
+		_, err = GetBanner(ctx, s, NewUCB1(), slot, segment)
 		require.ErrorIs(t, err, ErrTooFewBannersForSlot)
 
 		s.Close()
@@ -339,42 +353,309 @@ func TestGetBannerErrors(t *testing.T) {
 
 	t.Run("number of clicks more than number of shows", func(t *testing.T) {
 		s := memorystorage.New()
-		err := s.Connect()
+		err := s.Connect(ctx)
 		require.NoError(t, err)
 
-		segment, err := s.CreateSegment("segment")
+		segment, err := s.CreateSegment(ctx, "segment")
 		require.NoError(t, err)
 
-		slot, err := s.CreateSlot("slot")
+		slot, err := s.CreateSlot(ctx, "slot")
 		require.NoError(t, err)
 
-		bannerA, err := s.CreateBanner("bannerA")
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
 		require.NoError(t, err)
 
-		err = s.CreateRotation(storage.Rotation{SlotID: slot, BannerID: bannerA})
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
 		require.NoError(t, err)
 
-		statBannerA, err := s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 0, statBannerA.ShowCount)
 		require.Equal(t, 0, statBannerA.ClickCount)
 
-		_, err = GetBanner(s, slot, segment)
+		_, err = GetBanner(ctx, s, NewUCB1(), slot, segment)
 		require.NoError(t, err)
 
-		err = s.CreateEvent(slot, bannerA, segment, storage.Click)
+		err = s.CreateEvent(ctx, slot, bannerA, segment, storage.Click)
 		require.NoError(t, err)
 
-		statBannerA, err = s.GetStatForBannerAndSegment(bannerA, segment)
+		statBannerA, err = s.GetStatForBannerAndSegment(ctx, bannerA, segment)
 		require.NoError(t, err)
 
 		require.Equal(t, 0, statBannerA.ShowCount)
 		require.Equal(t, 1, statBannerA.ClickCount)
 
-		_, err = GetBanner(s, slot, segment)
+		_, err = GetBanner(ctx, s, NewUCB1(), slot, segment)
 		require.ErrorIs(t, err, ErrBannerClicksMoreThenShows)
 
 		s.Close()
 	})
 }
+
+func TestGetBannerPerSlot(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("header and footer with different favorites", func(t *testing.T) {
+		s := memorystorage.New()
+		err := s.Connect(ctx)
+		require.NoError(t, err)
+
+		segment, err := s.CreateSegment(ctx, "segment")
+		require.NoError(t, err)
+
+		header, err := s.CreateSlot(ctx, "header")
+		require.NoError(t, err)
+		footer, err := s.CreateSlot(ctx, "footer")
+		require.NoError(t, err)
+
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
+		require.NoError(t, err)
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
+		require.NoError(t, err)
+
+		for _, slot := range []string{header, footer} {
+			err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
+			require.NoError(t, err)
+			err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
+			require.NoError(t, err)
+		}
+
+		// в шапке переходят по bannerA, в подвале по bannerB
+		clickOn := map[string]string{header: bannerA, footer: bannerB}
+
+		for i := 0; i < 1000; i++ {
+			for _, slot := range []string{header, footer} {
+				bannerID, err := ChooseBanner(ctx, s, NewUCB1(), ChoiceRequest{SlotID: slot, SegmentID: segment, PerSlot: true})
+				require.NoError(t, err)
+
+				err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
+				require.NoError(t, err)
+
+				if bannerID == clickOn[slot] {
+					err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
+					require.NoError(t, err)
+				}
+			}
+		}
+
+		headerA, err := s.GetStatForSlotBannerAndSegment(ctx, header, bannerA, segment)
+		require.NoError(t, err)
+		footerB, err := s.GetStatForSlotBannerAndSegment(ctx, footer, bannerB, segment)
+		require.NoError(t, err)
+
+		require.Equal(t, 988, headerA.ShowCount)
+		require.Equal(t, 988, footerB.ShowCount)
+
+		pooledA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
+		require.NoError(t, err)
+		pooledB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
+		require.NoError(t, err)
+
+		require.Equal(t, 2000, pooledA.ShowCount+pooledB.ShowCount)
+		require.Equal(t, headerA.ClickCount+footerB.ClickCount, pooledA.ClickCount+pooledB.ClickCount)
+
+		s.Close()
+	})
+}
+
+func TestExplainBanner(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("forced init, then max weight, without show events", func(t *testing.T) {
+		s := memorystorage.New()
+		err := s.Connect(ctx)
+		require.NoError(t, err)
+
+		segment, err := s.CreateSegment(ctx, "segment")
+		require.NoError(t, err)
+
+		slot, err := s.CreateSlot(ctx, "slot")
+		require.NoError(t, err)
+
+		bannerA, err := s.CreateBanner(ctx, "bannerA")
+		require.NoError(t, err)
+		bannerB, err := s.CreateBanner(ctx, "bannerB")
+		require.NoError(t, err)
+
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
+		require.NoError(t, err)
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
+		require.NoError(t, err)
+
+		req := ChoiceRequest{SlotID: slot, SegmentID: segment}
+
+		explanation, err := ExplainBanner(ctx, s, NewUCB1(), req)
+		require.NoError(t, err)
+		require.Equal(t, bannerA, explanation.BannerID)
+		require.Equal(t, ReasonForcedInit, explanation.Reason)
+		require.Equal(t, "ucb1", explanation.Strategy)
+		require.Len(t, explanation.Scores, 2)
+
+		err = s.CreateEvent(ctx, slot, bannerA, segment, storage.Show)
+		require.NoError(t, err)
+		err = s.CreateEvent(ctx, slot, bannerA, segment, storage.Click)
+		require.NoError(t, err)
+		err = s.CreateEvent(ctx, slot, bannerB, segment, storage.Show)
+		require.NoError(t, err)
+
+		explanation, err = ExplainBanner(ctx, s, NewUCB1(), req)
+		require.NoError(t, err)
+		require.Equal(t, bannerA, explanation.BannerID)
+		require.Equal(t, ReasonMaxWeight, explanation.Reason)
+
+		// weight = xi + sqrt(2 * Ln(n) / ni): 1 + 1,18 и 0 + 1,18
+		require.Equal(t, Score{BannerID: bannerA, Shows: 1, Clicks: 1, Mean: 1, Bonus: 1.1774100225154747,
+			Weight: 2.1774100225154747}, explanation.Scores[0])
+		require.Equal(t, Score{BannerID: bannerB, Shows: 1, Clicks: 0, Mean: 0, Bonus: 1.1774100225154747,
+			Weight: 1.1774100225154747}, explanation.Scores[1])
+
+		statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
+		require.NoError(t, err)
+		require.Equal(t, 1, statBannerA.ShowCount)
+
+		s.Close()
+	})
+}
+
+// batchOnlyStorage - хранилище, в котором статистику можно получить только сразу для всей ротации.
+type batchOnlyStorage struct {
+	storage.Storage
+	t *testing.T
+}
+
+func (s batchOnlyStorage) GetBannersForSlot(context.Context, string) ([]string, error) {
+	s.t.Fatal("unexpected GetBannersForSlot")
+	return nil, nil
+}
+
+func (s batchOnlyStorage) GetStatForBannerAndSegment(context.Context, string, string) (storage.Stat, error) {
+	s.t.Fatal("unexpected GetStatForBannerAndSegment")
+	return storage.Stat{}, nil
+}
+
+func (s batchOnlyStorage) GetStatForSlotBannerAndSegment(context.Context, string, string,
+	string) (storage.Stat, error) {
+	s.t.Fatal("unexpected GetStatForSlotBannerAndSegment")
+	return storage.Stat{}, nil
+}
+
+func TestGetBannerBatchStats(t *testing.T) {
+	ctx := context.Background()
+
+	s := memorystorage.New()
+	require.NoError(t, s.Connect(ctx))
+	defer s.Close()
+
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	bannerA, err := s.CreateBanner(ctx, "bannerA")
+	require.NoError(t, err)
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
+	require.NoError(t, err)
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
+	require.NoError(t, err)
+
+	// баннер A уже показан, B показывается вне очереди
+	err = s.CreateEvent(ctx, slot, bannerA, segment, storage.Show)
+	require.NoError(t, err)
+
+	bannerID, err := GetBanner(ctx, batchOnlyStorage{Storage: s, t: t}, NewUCB1(), slot, segment)
+	require.NoError(t, err)
+	require.Equal(t, bannerB, bannerID)
+
+	emptySlot, err := s.CreateSlot(ctx, "empty")
+	require.NoError(t, err)
+
+	_, err = GetBanner(ctx, batchOnlyStorage{Storage: s, t: t}, NewUCB1(), emptySlot, segment)
+	require.ErrorIs(t, err, ErrTooFewBannersForSlot)
+
+	// статистика только по слоту: баннер B показан в другом слоте, в этом слоте вне очереди показывается он
+	otherSlot, err := s.CreateSlot(ctx, "other")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = s.CreateEvent(ctx, otherSlot, bannerB, segment, storage.Show)
+		require.NoError(t, err)
+	}
+
+	bannerID, err = GetBanner(ctx, batchOnlyStorage{Storage: s, t: t}, NewUCB1(), slot, segment)
+	require.NoError(t, err)
+	require.Equal(t, bannerA, bannerID)
+
+	bannerID, err = ChooseBanner(ctx, batchOnlyStorage{Storage: s, t: t}, NewUCB1(),
+		ChoiceRequest{SlotID: slot, SegmentID: segment, PerSlot: true})
+	require.NoError(t, err)
+	require.Equal(t, bannerB, bannerID)
+
+	explanation, err := ExplainBanner(ctx, batchOnlyStorage{Storage: s, t: t}, NewUCB1(),
+		ChoiceRequest{SlotID: slot, SegmentID: segment, PerSlot: true})
+	require.NoError(t, err)
+	require.Equal(t, bannerB, explanation.BannerID)
+}
+
+// rotationReadsStorage - хранилище, в котором интервалы статистики и модели можно получить
+// только сразу для всей ротации.
+type rotationReadsStorage struct {
+	storage.Storage
+	t *testing.T
+}
+
+func (s rotationReadsStorage) GetStatBuckets(context.Context, string, string, string,
+	time.Time) ([]storage.StatBucket, error) {
+	s.t.Fatal("unexpected GetStatBuckets")
+	return nil, nil
+}
+
+func (s rotationReadsStorage) GetModel(context.Context, string) (storage.Model, error) {
+	s.t.Fatal("unexpected GetModel")
+	return storage.Model{}, nil
+}
+
+func TestGetBannerRotationReads(t *testing.T) {
+	ctx := context.Background()
+
+	s := memorystorage.New()
+	require.NoError(t, s.Connect(ctx))
+	defer s.Close()
+
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+	require.NoError(t, s.SetSegmentFeatures(ctx, segment, []float64{1, 0}))
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	bannerA, err := s.CreateBanner(ctx, "bannerA")
+	require.NoError(t, err)
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	for _, bannerID := range []string{bannerA, bannerB} {
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerID})
+		require.NoError(t, err)
+	}
+
+	// баннер A уже показан, B показывается вне очереди
+	err = s.CreateEvent(ctx, slot, bannerA, segment, storage.Show)
+	require.NoError(t, err)
+	err = s.UpdateModel(ctx, bannerA, []float64{1, 0}, storage.Show)
+	require.NoError(t, err)
+
+	for _, strategy := range []Strategy{
+		NewSlidingWindowUCB(time.Hour, 0),
+		NewDiscountedUCB(time.Hour),
+		NewLinUCB(1, 2),
+	} {
+		for _, perSlot := range []bool{false, true} {
+			bannerID, err := ChooseBanner(ctx, rotationReadsStorage{Storage: s, t: t}, strategy,
+				ChoiceRequest{SlotID: slot, SegmentID: segment, PerSlot: perSlot})
+			require.NoError(t, err)
+			require.Equal(t, bannerB, bannerID, strategy.Name())
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"math/rand"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+)
+
+// EpsilonGreedy - с вероятностью epsilon показывается случайный баннер (исследование),
+// в остальных случаях баннер с максимальным средним "доходом".
+type EpsilonGreedy struct {
+	epsilon float64
+	rnd     *rand.Rand
+}
+
+func NewEpsilonGreedy(epsilon float64, rnd *rand.Rand) *EpsilonGreedy {
+	return &EpsilonGreedy{epsilon: epsilon, rnd: rnd}
+}
+
+func (e *EpsilonGreedy) Name() string {
+	return config.StrategyEpsilonGreedy
+}
+
+func (e *EpsilonGreedy) Decide(arms []Arm) (Decision, error) {
+	if decision, ok := notShownDecision(arms); ok {
+		return decision, nil
+	}
+
+	scores := newScores(arms)
+	for idx := range scores {
+		scores[idx].Weight = scores[idx].Mean
+	}
+
+	if e.rnd.Float64() < e.epsilon {
+		bannerID := arms[e.rnd.Intn(len(arms))].BannerID
+		return Decision{BannerID: bannerID, Reason: ReasonExploration, Scores: scores}, nil
+	}
+
+	return maxWeight(scores, ReasonExploitation), nil
+}
@@ -5,4 +5,7 @@ import "errors"
 var (
 	ErrTooFewBannersForSlot      = errors.New("для слота недостаточное количество баннеров в ротации")
 	ErrBannerClicksMoreThenShows = errors.New("для баннера количество кликов больше чем количество показов")
+	ErrUnknownStrategy           = errors.New("неизвестный алгоритм выбора баннера")
+	ErrInvalidStrategyParam      = errors.New("недопустимый параметр алгоритма выбора баннера")
+	ErrInvalidModel              = errors.New("некорректные параметры модели баннера")
 )
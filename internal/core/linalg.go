@@ -0,0 +1,63 @@
+package core
+
+import (
+	"math"
+)
+
+// solve решает систему A * y = v для симметричной положительно определенной матрицы A
+// (по строкам, размер len(v) x len(v)) разложением Холецкого.
+func solve(a []float64, v []float64) ([]float64, error) {
+	n := len(v)
+	if len(a) != n*n {
+		return nil, ErrInvalidModel
+	}
+
+	// A = L * L^T
+	l := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			sum := a[i*n+j]
+			for k := 0; k < j; k++ {
+				sum -= l[i*n+k] * l[j*n+k]
+			}
+			if i == j {
+				if sum <= 0 {
+					return nil, ErrInvalidModel
+				}
+				l[i*n+i] = math.Sqrt(sum)
+			} else {
+				l[i*n+j] = sum / l[j*n+j]
+			}
+		}
+	}
+
+	// L * z = v
+	z := make([]float64, n)
+	for i := 0; i < n; i++ {
+		sum := v[i]
+		for k := 0; k < i; k++ {
+			sum -= l[i*n+k] * z[k]
+		}
+		z[i] = sum / l[i*n+i]
+	}
+
+	// L^T * y = z
+	y := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		sum := z[i]
+		for k := i + 1; k < n; k++ {
+			sum -= l[k*n+i] * y[k]
+		}
+		y[i] = sum / l[i*n+i]
+	}
+
+	return y, nil
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
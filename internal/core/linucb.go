@@ -0,0 +1,84 @@
+package core
+
+import (
+	"math"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// LinUCB - контекстный алгоритм: для каждого баннера по его модели (A, b) оценивается
+// CTR как линейная функция от вектора признаков x (признаки сегмента и запроса),
+// weight = theta^T * x + alpha * sqrt(x^T * A^-1 * x), где theta = A^-1 * b.
+// Так сегмент "девушки 26-30" использует то, что узнали о сегменте "девушки 20-25".
+type LinUCB struct {
+	alpha     float64
+	dimension int
+}
+
+func NewLinUCB(alpha float64, dimension int) *LinUCB {
+	return &LinUCB{alpha: alpha, dimension: dimension}
+}
+
+func (l *LinUCB) Name() string {
+	return config.StrategyLinUCB
+}
+
+// Decide без признаков выбирает баннер по формуле UCB1.
+func (l *LinUCB) Decide(arms []Arm) (Decision, error) {
+	return decideUCB(arms), nil
+}
+
+func (l *LinUCB) Dimension() int {
+	return l.dimension
+}
+
+// DecideWithContext - в Score.Mean прогноз CTR theta^T * x, в Score.Bonus бонус за исследование.
+func (l *LinUCB) DecideWithContext(models []storage.Model, x []float64) (Decision, error) {
+	scores := make([]Score, 0, len(models))
+
+	for _, model := range models {
+		if model.Dimension != len(x) {
+			// по баннеру еще не было наблюдений с такими признаками
+			model = storage.NewModel(model.BannerID, len(x))
+		}
+
+		ainvX, err := solve(model.A, x)
+		if err != nil {
+			return Decision{}, err
+		}
+		theta, err := solve(model.A, model.B)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		score := Score{BannerID: model.BannerID, Mean: dot(theta, x)}
+		score.Bonus = l.alpha * math.Sqrt(math.Max(dot(x, ainvX), 0))
+		score.Weight = score.Mean + score.Bonus
+		scores = append(scores, score)
+	}
+
+	return maxWeight(scores, ReasonMaxPrediction), nil
+}
+
+// contextVector - вектор признаков размерности dimension:
+// 1 (свободный член), признаки сегмента, признаки запроса; лишнее отбрасывается, недостающее - нули.
+func contextVector(dimension int, segmentFeatures, requestFeatures []float64) []float64 {
+	x := make([]float64, dimension)
+	if dimension == 0 {
+		return x
+	}
+
+	x[0] = 1
+	idx := 1
+	for _, features := range [][]float64{segmentFeatures, requestFeatures} {
+		for _, feature := range features {
+			if idx >= dimension {
+				return x
+			}
+			x[idx] = feature
+			idx++
+		}
+	}
+	return x
+}
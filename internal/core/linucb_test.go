@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// тесты контекстного алгоритма:
+// - решение системы A * y = v
+// - девушки переходят по bannerA, мужчины по bannerB:
+//   новый сегмент "девушки 26-30" без показов сразу получает bannerA
+
+func TestSolve(t *testing.T) {
+	a := []float64{
+		4, 2, 0,
+		2, 5, 1,
+		0, 1, 3,
+	}
+	v := []float64{2, 1, 3}
+
+	y, err := solve(a, v)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.InDelta(t, v[i], a[i*3]*y[0]+a[i*3+1]*y[1]+a[i*3+2]*y[2], 1e-9)
+	}
+
+	_, err = solve([]float64{1, 2, 2, 1}, []float64{1, 1})
+	require.ErrorIs(t, err, ErrInvalidModel)
+}
+
+func TestLinUCBSimilarSegments(t *testing.T) {
+	ctx := context.Background()
+
+	s := memorystorage.New()
+	err := s.Connect(ctx)
+	require.NoError(t, err)
+
+	women20, err := s.CreateSegment(ctx, "women 20-25")
+	require.NoError(t, err)
+	women26, err := s.CreateSegment(ctx, "women 26-30")
+	require.NoError(t, err)
+	men, err := s.CreateSegment(ctx, "men 20-25")
+	require.NoError(t, err)
+
+	// признаки: девушки, мужчины, возраст / 100
+	require.NoError(t, s.SetSegmentFeatures(ctx, women20, []float64{1, 0, 0.22}))
+	require.NoError(t, s.SetSegmentFeatures(ctx, women26, []float64{1, 0, 0.28}))
+	require.NoError(t, s.SetSegmentFeatures(ctx, men, []float64{0, 1, 0.22}))
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	bannerA, err := s.CreateBanner(ctx, "bannerA")
+	require.NoError(t, err)
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
+	require.NoError(t, err)
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
+	require.NoError(t, err)
+
+	strategy := NewLinUCB(0.5, 4)
+	clickOn := map[string]string{women20: bannerA, men: bannerB}
+
+	for i := 0; i < 500; i++ {
+		for _, segment := range []string{women20, men} {
+			bannerID, err := GetBanner(ctx, s, strategy, slot, segment)
+			require.NoError(t, err)
+
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
+			require.NoError(t, err)
+			err = UpdateContext(ctx, s, strategy, bannerID, segment, nil, storage.Show)
+			require.NoError(t, err)
+
+			if bannerID == clickOn[segment] {
+				err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
+				require.NoError(t, err)
+				err = UpdateContext(ctx, s, strategy, bannerID, segment, nil, storage.Click)
+				require.NoError(t, err)
+			}
+		}
+	}
+
+	statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, women20)
+	require.NoError(t, err)
+	require.Greater(t, statBannerA.ShowCount, 450)
+
+	statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, men)
+	require.NoError(t, err)
+	require.Greater(t, statBannerB.ShowCount, 450)
+
+	bannerID, err := GetBanner(ctx, s, strategy, slot, women26)
+	require.NoError(t, err)
+	require.Equal(t, bannerA, bannerID)
+
+	model, err := s.GetModel(ctx, bannerA)
+	require.NoError(t, err)
+	require.Equal(t, 4, model.Dimension)
+	require.Len(t, model.A, 16)
+	require.Len(t, model.B, 4)
+
+	s.Close()
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// Варианты UCB1 для нестационарного CTR (сезонность, "выгорание" креатива):
+// статистика берется по временным интервалам (storage.StatBucket), а не за все время.
+
+// SlidingWindowUCB - UCB1 только по событиям из скользящего окна:
+// за последние window и/или последние impressions показов баннеров слота для сегмента.
+// Баннер, который не показывался в окне, показывается вне очереди, как новый.
+type SlidingWindowUCB struct {
+	window      time.Duration
+	impressions int
+}
+
+func NewSlidingWindowUCB(window time.Duration, impressions int) *SlidingWindowUCB {
+	return &SlidingWindowUCB{window: window, impressions: impressions}
+}
+
+func (u *SlidingWindowUCB) Name() string {
+	return config.StrategySlidingWindowUCB
+}
+
+func (u *SlidingWindowUCB) Decide(arms []Arm) (Decision, error) {
+	return decideUCB(arms), nil
+}
+
+func (u *SlidingWindowUCB) Since(now time.Time) time.Time {
+	if u.window == 0 {
+		return time.Time{}
+	}
+	return now.Add(-u.window)
+}
+
+func (u *SlidingWindowUCB) Arms(buckets map[string][]storage.StatBucket, bannersID []string, now time.Time) []Arm {
+	if u.impressions == 0 {
+		return sumBuckets(buckets, bannersID, func(storage.StatBucket) float64 { return 1 })
+	}
+
+	// интервалы от новых к старым, берем пока не наберется impressions показов,
+	// самый старый из попавших в окно интервалов учитывается частично
+	starts := make([]time.Time, 0)
+	showsByStart := make(map[time.Time]int)
+	for _, bannerID := range bannersID {
+		for _, bucket := range buckets[bannerID] {
+			if _, ok := showsByStart[bucket.Start]; !ok {
+				starts = append(starts, bucket.Start)
+			}
+			showsByStart[bucket.Start] += bucket.ShowCount
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].After(starts[j]) })
+
+	fraction := make(map[time.Time]float64, len(starts))
+	left := u.impressions
+	for _, start := range starts {
+		if left <= 0 {
+			break
+		}
+		shows := showsByStart[start]
+		if shows <= left {
+			fraction[start] = 1
+		} else {
+			fraction[start] = float64(left) / float64(shows)
+		}
+		left -= shows
+	}
+
+	return sumBuckets(buckets, bannersID, func(bucket storage.StatBucket) float64 { return fraction[bucket.Start] })
+}
+
+// DiscountedUCB - UCB1 по статистике с экспоненциальным затуханием:
+// вес событий уменьшается вдвое каждые halfLife.
+type DiscountedUCB struct {
+	halfLife time.Duration
+}
+
+// discountedHalfLives - сколько периодов полураспада учитывать, вес более старых событий меньше 0.001.
+const discountedHalfLives = 10
+
+func NewDiscountedUCB(halfLife time.Duration) *DiscountedUCB {
+	return &DiscountedUCB{halfLife: halfLife}
+}
+
+func (u *DiscountedUCB) Name() string {
+	return config.StrategyDiscountedUCB
+}
+
+func (u *DiscountedUCB) Decide(arms []Arm) (Decision, error) {
+	return decideUCB(arms), nil
+}
+
+func (u *DiscountedUCB) Since(now time.Time) time.Time {
+	return now.Add(-discountedHalfLives * u.halfLife)
+}
+
+func (u *DiscountedUCB) Arms(buckets map[string][]storage.StatBucket, bannersID []string, now time.Time) []Arm {
+	return sumBuckets(buckets, bannersID, func(bucket storage.StatBucket) float64 {
+		// возраст считаем от середины интервала
+		age := now.Sub(bucket.Start.Add(storage.StatBucketSize / 2))
+		if age < 0 {
+			age = 0
+		}
+		return math.Pow(0.5, float64(age)/float64(u.halfLife))
+	})
+}
+
+func sumBuckets(buckets map[string][]storage.StatBucket, bannersID []string,
+	weight func(storage.StatBucket) float64) []Arm {
+	arms := make([]Arm, 0, len(bannersID))
+	for _, bannerID := range bannersID {
+		arm := Arm{BannerID: bannerID}
+		for _, bucket := range buckets[bannerID] {
+			w := weight(bucket)
+			arm.Shows += w * float64(bucket.ShowCount)
+			arm.Clicks += w * float64(bucket.ClickCount)
+		}
+		arms = append(arms, arm)
+	}
+	return arms
+}
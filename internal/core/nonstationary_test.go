@@ -0,0 +1,139 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// тесты алгоритмов для нестационарного CTR:
+// - окно по количеству показов учитывает самый старый интервал частично
+// - при затухании вес интервала уменьшается вдвое за halfLife
+// - CTR сменился: UCB1 продолжает показывать баннер с лучшей историей, discounted-ucb переключается
+// - sliding-window-ucb работает со статистикой из хранилища
+
+func TestSlidingWindowUCBImpressions(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 30, 0, 0, time.UTC)
+	buckets := map[string][]storage.StatBucket{
+		"A": {
+			{Start: now.Add(-2 * time.Hour).Truncate(time.Hour), ShowCount: 100, ClickCount: 50},
+			{Start: now.Truncate(time.Hour), ShowCount: 10, ClickCount: 0},
+		},
+		"B": {
+			{Start: now.Add(-2 * time.Hour).Truncate(time.Hour), ShowCount: 100, ClickCount: 0},
+			{Start: now.Truncate(time.Hour), ShowCount: 10, ClickCount: 10},
+		},
+	}
+
+	arms := NewSlidingWindowUCB(0, 60).Arms(buckets, []string{"A", "B"}, now)
+
+	// последний час: 20 показов, из предыдущего интервала берется 40 из 200 показов
+	require.Equal(t, []Arm{
+		{BannerID: "A", Shows: 10 + 20, Clicks: 10},
+		{BannerID: "B", Shows: 10 + 20, Clicks: 10},
+	}, arms)
+}
+
+func TestDiscountedUCBArms(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 30, 0, 0, time.UTC)
+	buckets := map[string][]storage.StatBucket{
+		"A": {{Start: time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC), ShowCount: 100, ClickCount: 40}},
+		"B": {{Start: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC), ShowCount: 100, ClickCount: 40}},
+	}
+
+	arms := NewDiscountedUCB(3*time.Hour).Arms(buckets, []string{"A", "B"}, now)
+
+	require.InDelta(t, 50, arms[0].Shows, 1e-9)
+	require.InDelta(t, 20, arms[0].Clicks, 1e-9)
+	require.InDelta(t, 100, arms[1].Shows, 1e-9)
+	require.InDelta(t, 40, arms[1].Clicks, 1e-9)
+}
+
+func TestDiscountedUCBDrift(t *testing.T) {
+	now := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-72 * time.Hour)
+	buckets := map[string][]storage.StatBucket{
+		"A": {
+			{Start: old, ShowCount: 1000, ClickCount: 300},
+			{Start: now, ShowCount: 100, ClickCount: 1},
+		},
+		"B": {
+			{Start: old, ShowCount: 1000, ClickCount: 100},
+			{Start: now, ShowCount: 100, ClickCount: 30},
+		},
+	}
+	bannersID := []string{"A", "B"}
+
+	discounted := NewDiscountedUCB(6 * time.Hour)
+	decision, err := discounted.Decide(discounted.Arms(buckets, bannersID, now))
+	require.NoError(t, err)
+	require.Equal(t, "B", decision.BannerID)
+
+	lifetime := NewSlidingWindowUCB(0, 0)
+	decision, err = NewUCB1().Decide(lifetime.Arms(buckets, bannersID, now))
+	require.NoError(t, err)
+	require.Equal(t, "A", decision.BannerID)
+}
+
+func TestSlidingWindowUCBStorage(t *testing.T) {
+	ctx := context.Background()
+
+	s := memorystorage.New()
+	err := s.Connect(ctx)
+	require.NoError(t, err)
+
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	bannerA, err := s.CreateBanner(ctx, "bannerA")
+	require.NoError(t, err)
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
+	require.NoError(t, err)
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
+	require.NoError(t, err)
+
+	strategy := NewSlidingWindowUCB(time.Hour, 0)
+	for i := 0; i < 1000; i++ {
+		bannerID, err := GetBanner(ctx, s, strategy, slot, segment)
+		require.NoError(t, err)
+
+		err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
+		require.NoError(t, err)
+
+		if bannerID == bannerA {
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
+			require.NoError(t, err)
+		}
+	}
+
+	statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
+	require.NoError(t, err)
+	statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
+	require.NoError(t, err)
+
+	require.Greater(t, statBannerA.ShowCount, 900)
+	require.Greater(t, statBannerB.ShowCount, 0)
+
+	buckets, err := s.GetStatBuckets(ctx, storage.AllSlots, bannerA, segment, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+
+	var shows, clicks int
+	for _, bucket := range buckets {
+		shows += bucket.ShowCount
+		clicks += bucket.ClickCount
+	}
+	require.Equal(t, statBannerA.ShowCount, shows)
+	require.Equal(t, statBannerA.ClickCount, clicks)
+
+	s.Close()
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+)
+
+// Softmax - распределение Больцмана: баннер выбирается случайно с вероятностью,
+// пропорциональной exp(xi / temperature). Чем ниже temperature, тем "жаднее" выбор.
+type Softmax struct {
+	temperature float64
+	rnd         *rand.Rand
+}
+
+func NewSoftmax(temperature float64, rnd *rand.Rand) *Softmax {
+	return &Softmax{temperature: temperature, rnd: rnd}
+}
+
+func (s *Softmax) Name() string {
+	return config.StrategySoftmax
+}
+
+func (s *Softmax) Decide(arms []Arm) (Decision, error) {
+	scores := s.probabilities(arms)
+	decision := Decision{BannerID: arms[len(arms)-1].BannerID, Reason: ReasonSampled, Scores: scores}
+
+	point := s.rnd.Float64()
+	for _, score := range scores {
+		point -= score.Weight
+		if point < 0 {
+			decision.BannerID = score.BannerID
+			break
+		}
+	}
+
+	return decision, nil
+}
+
+func (s *Softmax) probabilities(arms []Arm) []Score {
+	scores := newScores(arms)
+
+	// вычитаем максимум, чтобы exp не переполнялся при малой температуре
+	var ctrMax float64
+	for _, score := range scores {
+		ctrMax = math.Max(ctrMax, score.Mean)
+	}
+
+	var sum float64
+	for idx := range scores {
+		scores[idx].Weight = math.Exp((scores[idx].Mean - ctrMax) / s.temperature)
+		sum += scores[idx].Weight
+	}
+
+	for idx := range scores {
+		scores[idx].Weight /= sum
+	}
+
+	return scores
+}
@@ -0,0 +1,277 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// Arm - статистика баннера из ротации слота, по которой алгоритм выбирает баннер.
+// Значения дробные: алгоритмы для нестационарного CTR взвешивают показы и переходы по времени.
+type Arm struct {
+	BannerID string
+	Shows    float64
+	Clicks   float64
+}
+
+// Score - оценка баннера алгоритмом: вес = средний "доход" + бонус за исследование
+// (для случайных алгоритмов вес - вероятность или сэмпл).
+type Score struct {
+	BannerID string  `json:"bannerId"`
+	Shows    float64 `json:"shows"`
+	Clicks   float64 `json:"clicks"`
+	Mean     float64 `json:"mean"`
+	Bonus    float64 `json:"bonus"`
+	Weight   float64 `json:"weight"`
+}
+
+// Decision - выбранный баннер, почему он выбран и оценки всех баннеров из ротации.
+type Decision struct {
+	BannerID string  `json:"bannerId"`
+	Reason   string  `json:"reason"`
+	Scores   []Score `json:"scores"`
+}
+
+// Strategy - алгоритм выбора баннера для показа по статистике баннеров из ротации слота.
+type Strategy interface {
+	Name() string
+	Decide(arms []Arm) (Decision, error)
+}
+
+// WindowedStrategy - алгоритм, которому нужна статистика по временным интервалам
+// (storage.StatBucket) начиная с Since, а не накопленная за все время.
+type WindowedStrategy interface {
+	Strategy
+	Since(now time.Time) time.Time
+	Arms(buckets map[string][]storage.StatBucket, bannersID []string, now time.Time) []Arm
+}
+
+// ContextualStrategy - алгоритм, который выбирает баннер по моделям баннеров (storage.Model)
+// и вектору признаков сегмента и запроса размерности Dimension.
+type ContextualStrategy interface {
+	Strategy
+	Dimension() int
+	DecideWithContext(models []storage.Model, x []float64) (Decision, error)
+}
+
+const (
+	DefaultWindow      time.Duration = 24 * time.Hour
+	DefaultHalfLife    time.Duration = 24 * time.Hour
+	DefaultEpsilon     float64       = 0.1
+	DefaultTemperature float64       = 0.1
+	DefaultPriorAlpha  float64       = 1
+	DefaultPriorBeta   float64       = 1
+	DefaultAlpha       float64       = 1
+	DefaultDimension   int           = 8
+)
+
+// Strategies - алгоритм выбора по умолчанию и алгоритмы, заданные для отдельных слотов.
+type Strategies struct {
+	def     Strategy
+	slots   map[string]Strategy
+	perSlot bool
+}
+
+// NewStrategies создает алгоритмы по настройкам. Если choice.seed не задан,
+// источник случайных чисел инициализируется текущим временем.
+func NewStrategies(conf config.ChoiceConfig) (*Strategies, error) {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return NewStrategiesWithRand(conf, NewRand(seed))
+}
+
+// NewStrategiesWithRand создает алгоритмы по настройкам с заданным источником случайных чисел.
+func NewStrategiesWithRand(conf config.ChoiceConfig, rnd *rand.Rand) (*Strategies, error) {
+	var perSlot bool
+	switch conf.StatScope {
+	case "", config.StatScopePooled:
+	case config.StatScopeSlot:
+		perSlot = true
+	default:
+		return nil, fmt.Errorf("%w: stat scope %s", ErrInvalidStrategyParam, conf.StatScope)
+	}
+
+	def, err := NewStrategy(conf.Strategy, rnd)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make(map[string]Strategy, len(conf.Slots))
+	for slotID, slotConf := range conf.Slots {
+		strategy, err := NewStrategy(slotConf, rnd)
+		if err != nil {
+			return nil, fmt.Errorf("slot %s: %w", slotID, err)
+		}
+		slots[slotID] = strategy
+	}
+
+	return &Strategies{def: def, slots: slots, perSlot: perSlot}, nil
+}
+
+// ForSlot возвращает алгоритм, заданный для слота, или алгоритм по умолчанию.
+func (s *Strategies) ForSlot(slotID string) Strategy {
+	if strategy, ok := s.slots[slotID]; ok {
+		return strategy
+	}
+	return s.def
+}
+
+// PerSlot - выбирать баннер по статистике слота (choice.statScope: slot), а не по всем слотам.
+func (s *Strategies) PerSlot() bool {
+	return s.perSlot
+}
+
+func NewStrategy(conf config.StrategyConfig, rnd *rand.Rand) (Strategy, error) {
+	switch conf.Name {
+	case "", config.StrategyUCB1:
+		return NewUCB1(), nil
+	case config.StrategySlidingWindowUCB:
+		window := conf.Window
+		if window == 0 && conf.WindowImpressions == 0 {
+			window = DefaultWindow
+		}
+		if window < 0 || conf.WindowImpressions < 0 {
+			return nil, fmt.Errorf("%w: window %v, %d impressions", ErrInvalidStrategyParam, window, conf.WindowImpressions)
+		}
+		return NewSlidingWindowUCB(window, conf.WindowImpressions), nil
+	case config.StrategyDiscountedUCB:
+		halfLife := conf.HalfLife
+		if halfLife == 0 {
+			halfLife = DefaultHalfLife
+		}
+		if halfLife < 0 {
+			return nil, fmt.Errorf("%w: half-life %v", ErrInvalidStrategyParam, halfLife)
+		}
+		return NewDiscountedUCB(halfLife), nil
+	case config.StrategyEpsilonGreedy:
+		// epsilon: 0 - всегда баннер с максимальным CTR
+		epsilon := valueOr(conf.Epsilon, DefaultEpsilon)
+		if !(epsilon >= 0 && epsilon <= 1) {
+			return nil, fmt.Errorf("%w: epsilon %v", ErrInvalidStrategyParam, epsilon)
+		}
+		return NewEpsilonGreedy(epsilon, rnd), nil
+	case config.StrategySoftmax:
+		temperature := valueOr(conf.Temperature, DefaultTemperature)
+		if !(temperature > 0) {
+			return nil, fmt.Errorf("%w: temperature %v", ErrInvalidStrategyParam, temperature)
+		}
+		return NewSoftmax(temperature, rnd), nil
+	case config.StrategyThompson:
+		// нулевые параметры - априорное распределение без псевдонаблюдений
+		alpha, beta := valueOr(conf.PriorAlpha, DefaultPriorAlpha), valueOr(conf.PriorBeta, DefaultPriorBeta)
+		if !(alpha >= 0) || !(beta >= 0) {
+			return nil, fmt.Errorf("%w: prior Beta(%v, %v)", ErrInvalidStrategyParam, alpha, beta)
+		}
+		return NewThompson(alpha, beta, rnd), nil
+	case config.StrategyLinUCB:
+		// alpha: 0 - без исследования, по предсказанному CTR
+		alpha, dimension := valueOr(conf.Alpha, DefaultAlpha), conf.Dimension
+		if dimension == 0 {
+			dimension = DefaultDimension
+		}
+		if !(alpha >= 0) || dimension < 0 {
+			return nil, fmt.Errorf("%w: alpha %v, dimension %d", ErrInvalidStrategyParam, alpha, dimension)
+		}
+		return NewLinUCB(alpha, dimension), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, conf.Name)
+}
+
+// valueOr - значение параметра или def, если параметр не задан.
+func valueOr(value *float64, def float64) float64 {
+	if value == nil {
+		return def
+	}
+	return *value
+}
+
+// NewRand - источник случайных чисел, который можно использовать из нескольких горутин.
+// Фиксированный seed дает воспроизводимую последовательность выборов (для тестов).
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)}) //nolint:gosec
+}
+
+type lockedSource struct {
+	mutex sync.Mutex
+	src   rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.src.Seed(seed)
+}
+
+// Причины выбора баннера для Decision.
+const (
+	ReasonForcedInit    = "never shown, forced init"
+	ReasonMaxWeight     = "max weight: mean + exploration bonus"
+	ReasonExploration   = "exploration: random banner with probability epsilon"
+	ReasonExploitation  = "exploitation: max mean"
+	ReasonSampled       = "sampled with probability equal to weight"
+	ReasonMaxSample     = "max sample from Beta posterior"
+	ReasonMaxPrediction = "max weight: predicted CTR for features + exploration bonus"
+)
+
+// notShownDecision - если баннер ни разу не показывался, его надо показать вне очереди.
+func notShownDecision(arms []Arm) (Decision, bool) {
+	for _, arm := range arms {
+		if arm.Shows == 0 {
+			// вес не считается: при 0 показов формула UCB1 стремится к бесконечности
+			return Decision{BannerID: arm.BannerID, Reason: ReasonForcedInit, Scores: newScores(arms)}, true
+		}
+	}
+	return Decision{}, false
+}
+
+// newScores - оценки баннеров с заполненной статистикой и средним "доходом".
+func newScores(arms []Arm) []Score {
+	scores := make([]Score, 0, len(arms))
+	for _, arm := range arms {
+		scores = append(scores, Score{BannerID: arm.BannerID, Shows: arm.Shows, Clicks: arm.Clicks, Mean: ctr(arm)})
+	}
+	return scores
+}
+
+// maxWeight - баннер с максимальным весом, при равенстве первый.
+func maxWeight(scores []Score, reason string) Decision {
+	decision := Decision{BannerID: storage.EmptyID, Reason: reason, Scores: scores}
+
+	var weightMax float64
+	for idx, score := range scores {
+		if idx == 0 || score.Weight > weightMax {
+			weightMax = score.Weight
+			decision.BannerID = score.BannerID
+		}
+	}
+
+	return decision
+}
+
+// ctr - средний "доход" от баннера (переходы / показы).
+func ctr(arm Arm) float64 {
+	if arm.Shows == 0 {
+		return 0
+	}
+	return arm.Clicks / arm.Shows
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// тесты алгоритмов выбора:
+// - 2 баннера, переходы только по bannerA - bannerA должен показываться заметно чаще
+// - выбор алгоритма для слота по настройкам
+// - сэмплирование Томпсона с одинаковым seed дает одинаковый результат
+// - среднее Beta(alpha, beta) сходится к alpha / (alpha + beta)
+
+func showWithClicksOnFirst(t *testing.T, strategy Strategy, shows int) (storage.Stat, storage.Stat) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	s := memorystorage.New()
+	err := s.Connect(ctx)
+	require.NoError(t, err)
+	defer s.Close()
+
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	bannerA, err := s.CreateBanner(ctx, "bannerA")
+	require.NoError(t, err)
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerA})
+	require.NoError(t, err)
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: bannerB})
+	require.NoError(t, err)
+
+	for i := 0; i < shows; i++ {
+		bannerID, err := GetBanner(ctx, s, strategy, slot, segment)
+		require.NoError(t, err)
+
+		err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Show)
+		require.NoError(t, err)
+
+		if bannerID == bannerA {
+			err = s.CreateEvent(ctx, slot, bannerID, segment, storage.Click)
+			require.NoError(t, err)
+		}
+	}
+
+	statBannerA, err := s.GetStatForBannerAndSegment(ctx, bannerA, segment)
+	require.NoError(t, err)
+	statBannerB, err := s.GetStatForBannerAndSegment(ctx, bannerB, segment)
+	require.NoError(t, err)
+
+	return statBannerA, statBannerB
+}
+
+func TestStrategiesClicksOnBannerA(t *testing.T) {
+	strategies := map[string]Strategy{
+		"epsilon-greedy": NewEpsilonGreedy(0.1, NewRand(1)),
+		"softmax":        NewSoftmax(0.1, NewRand(1)),
+		"thompson":       NewThompson(DefaultPriorAlpha, DefaultPriorBeta, NewRand(1)),
+	}
+
+	for name, strategy := range strategies {
+		strategy := strategy
+		t.Run(name, func(t *testing.T) {
+			statBannerA, statBannerB := showWithClicksOnFirst(t, strategy, 1000)
+
+			require.Equal(t, 1000, statBannerA.ShowCount+statBannerB.ShowCount)
+			require.Greater(t, statBannerA.ShowCount, 900)
+			require.Greater(t, statBannerB.ShowCount, 0)
+			require.Equal(t, statBannerA.ShowCount, statBannerA.ClickCount)
+			require.Equal(t, 0, statBannerB.ClickCount)
+		})
+	}
+}
+
+func TestNewStrategies(t *testing.T) {
+	t.Run("strategy for slot", func(t *testing.T) {
+		strategies, err := NewStrategies(config.ChoiceConfig{
+			Strategy: config.StrategyConfig{Name: config.StrategyUCB1},
+			Slots: map[string]config.StrategyConfig{
+				"slot": {Name: config.StrategyThompson},
+			},
+		})
+		require.NoError(t, err)
+
+		require.IsType(t, &Thompson{}, strategies.ForSlot("slot"))
+		require.IsType(t, &UCB1{}, strategies.ForSlot("other"))
+	})
+
+	t.Run("ucb1 by default", func(t *testing.T) {
+		strategies, err := NewStrategies(config.ChoiceConfig{})
+		require.NoError(t, err)
+
+		require.IsType(t, &UCB1{}, strategies.ForSlot("slot"))
+	})
+
+	t.Run("unknown strategy", func(t *testing.T) {
+		_, err := NewStrategies(config.ChoiceConfig{Strategy: config.StrategyConfig{Name: "random"}})
+		require.ErrorIs(t, err, ErrUnknownStrategy)
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		for _, conf := range []config.StrategyConfig{
+			{Name: config.StrategyEpsilonGreedy, Epsilon: param(1.5)},
+			{Name: config.StrategyEpsilonGreedy, Epsilon: param(-0.1)},
+			{Name: config.StrategySoftmax, Temperature: param(0)},
+			{Name: config.StrategySoftmax, Temperature: param(-1)},
+			{Name: config.StrategyLinUCB, Alpha: param(-1)},
+		} {
+			_, err := NewStrategies(config.ChoiceConfig{Strategy: conf})
+			require.ErrorIs(t, err, ErrInvalidStrategyParam, conf.Name)
+		}
+	})
+
+	t.Run("zero params", func(t *testing.T) {
+		strategy, err := NewStrategy(config.StrategyConfig{Name: config.StrategyEpsilonGreedy, Epsilon: param(0)}, nil)
+		require.NoError(t, err)
+		require.Equal(t, 0.0, strategy.(*EpsilonGreedy).epsilon)
+
+		strategy, err = NewStrategy(config.StrategyConfig{Name: config.StrategyLinUCB, Alpha: param(0)}, nil)
+		require.NoError(t, err)
+		require.Equal(t, 0.0, strategy.(*LinUCB).alpha)
+	})
+
+	t.Run("default params", func(t *testing.T) {
+		strategy, err := NewStrategy(config.StrategyConfig{Name: config.StrategyEpsilonGreedy}, nil)
+		require.NoError(t, err)
+		require.Equal(t, DefaultEpsilon, strategy.(*EpsilonGreedy).epsilon)
+
+		strategy, err = NewStrategy(config.StrategyConfig{Name: config.StrategySoftmax}, nil)
+		require.NoError(t, err)
+		require.Equal(t, DefaultTemperature, strategy.(*Softmax).temperature)
+	})
+}
+
+func param(value float64) *float64 {
+	return &value
+}
+
+func TestThompsonSeeded(t *testing.T) {
+	t.Run("same seed same result", func(t *testing.T) {
+		firstA, firstB := showWithClicksOnFirst(t, NewThompson(2, 50, NewRand(42)), 300)
+		secondA, secondB := showWithClicksOnFirst(t, NewThompson(2, 50, NewRand(42)), 300)
+
+		require.Equal(t, firstA.ShowCount, secondA.ShowCount)
+		require.Equal(t, firstB.ShowCount, secondB.ShowCount)
+	})
+
+	t.Run("beta sample mean", func(t *testing.T) {
+		rnd := NewRand(7)
+		priors := [][2]float64{{1, 1}, {2, 50}, {0.5, 0.5}, {30, 10}}
+
+		for _, prior := range priors {
+			var sum float64
+			for i := 0; i < 20000; i++ {
+				sample := sampleBeta(rnd, prior[0], prior[1])
+				require.GreaterOrEqual(t, sample, 0.0)
+				require.LessOrEqual(t, sample, 1.0)
+				sum += sample
+			}
+			require.InDelta(t, prior[0]/(prior[0]+prior[1]), sum/20000, 0.01)
+		}
+	})
+
+	t.Run("priors for slot", func(t *testing.T) {
+		strategies, err := NewStrategiesWithRand(config.ChoiceConfig{
+			Slots: map[string]config.StrategyConfig{
+				"slot":  {Name: config.StrategyThompson, PriorAlpha: param(2), PriorBeta: param(50)},
+				"other": {Name: config.StrategyThompson, PriorAlpha: param(0), PriorBeta: param(0)},
+			},
+		}, NewRand(1))
+		require.NoError(t, err)
+
+		thompson, ok := strategies.ForSlot("slot").(*Thompson)
+		require.True(t, ok)
+		require.Equal(t, 2.0, thompson.alpha)
+		require.Equal(t, 50.0, thompson.beta)
+
+		// нулевые параметры задаются явно и не заменяются значениями по умолчанию
+		thompson, ok = strategies.ForSlot("other").(*Thompson)
+		require.True(t, ok)
+		require.Zero(t, thompson.alpha)
+		require.Zero(t, thompson.beta)
+	})
+
+	t.Run("invalid priors", func(t *testing.T) {
+		_, err := NewStrategies(config.ChoiceConfig{
+			Strategy: config.StrategyConfig{Name: config.StrategyThompson, PriorAlpha: param(-1)},
+		})
+		require.ErrorIs(t, err, ErrInvalidStrategyParam)
+	})
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+)
+
+// Thompson - сэмплирование Томпсона: для каждого баннера CTR сэмплируется
+// из апостериорного распределения Beta(переходы + alpha, показы - переходы + beta),
+// показывается баннер с максимальным значением.
+// alpha и beta - априорное распределение CTR, Beta(1, 1) - равномерное.
+type Thompson struct {
+	alpha float64
+	beta  float64
+	rnd   *rand.Rand
+}
+
+func NewThompson(alpha, beta float64, rnd *rand.Rand) *Thompson {
+	return &Thompson{alpha: alpha, beta: beta, rnd: rnd}
+}
+
+func (t *Thompson) Name() string {
+	return config.StrategyThompson
+}
+
+func (t *Thompson) Decide(arms []Arm) (Decision, error) {
+	scores := newScores(arms)
+	for idx, arm := range arms {
+		alpha := arm.Clicks + t.alpha
+		beta := arm.Shows - arm.Clicks + t.beta
+
+		scores[idx].Weight = sampleBeta(t.rnd, alpha, beta)
+		scores[idx].Bonus = scores[idx].Weight - scores[idx].Mean
+	}
+
+	return maxWeight(scores, ReasonMaxSample), nil
+}
+
+// sampleBeta - случайная величина из Beta(alpha, beta) через два гамма-распределения.
+func sampleBeta(rnd *rand.Rand, alpha, beta float64) float64 {
+	x := sampleGamma(rnd, alpha)
+	y := sampleGamma(rnd, beta)
+	if x+y == 0 {
+		return 0
+	}
+	return x / (x + y)
+}
+
+// sampleGamma - случайная величина из Gamma(shape, 1), метод Marsaglia-Tsang.
+func sampleGamma(rnd *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		// Gamma(a) = Gamma(a + 1) * U^(1/a)
+		return sampleGamma(rnd, shape+1) * math.Pow(rnd.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rnd.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rnd.Float64()
+		if u < 1-0.0331*x*x*x*x {
+			return d * v
+		}
+		if math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"math"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+)
+
+// UCB1 - алгоритм "многорукого бандита" UCB1, описание в info.go.
+type UCB1 struct{}
+
+func NewUCB1() *UCB1 {
+	return &UCB1{}
+}
+
+func (u *UCB1) Name() string {
+	return config.StrategyUCB1
+}
+
+func (u *UCB1) Decide(arms []Arm) (Decision, error) {
+	return decideUCB(arms), nil
+}
+
+// decideUCB - выбор по формуле UCB1, общий для UCB1 и его вариантов для нестационарного CTR.
+func decideUCB(arms []Arm) Decision {
+	if decision, ok := notShownDecision(arms); ok {
+		return decision
+	}
+
+	var showsAmount float64
+	for _, arm := range arms {
+		showsAmount += arm.Shows
+	}
+
+	// weight = xi + sqrt(2 * Ln(n) / ni)
+	// нужно взять баннер с максимальным весом
+	// при взвешенной статистике n может быть меньше 1, тогда бонус за исследование нулевой
+
+	ln := math.Max(math.Log(showsAmount), 0)
+	scores := newScores(arms)
+	for idx := range scores {
+		scores[idx].Bonus = math.Sqrt(2 * ln / scores[idx].Shows)
+		scores[idx].Weight = scores[idx].Mean + scores[idx].Bonus
+	}
+
+	return maxWeight(scores, ReasonMaxWeight)
+}
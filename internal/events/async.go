@@ -0,0 +1,178 @@
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+const defaultAsyncQueueSize = 10000
+
+// asyncBatch - события одного вызова Publish и время постановки в очередь.
+type asyncBatch struct {
+	events   []storage.Event
+	enqueued time.Time
+}
+
+// Async отправляет события через publisher в фоне, чтобы запрос не ждал медленной отправки
+// (webhook, файл, kafka без kafka.async). События ставятся в очередь на events.queueSize событий
+// и отправляются по порядку с фоновым контекстом, события одного Publish - одной отправкой.
+// При заполненной очереди события отбрасываются. При Close очередь дописывается.
+type Async struct {
+	publisher Publisher
+	capacity  int
+
+	queue   chan asyncBatch
+	running bool
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	statsMutex sync.Mutex
+	stats      Stats
+}
+
+// Background - отправка publisher вне запроса: сам publisher, если он уже отправляет в фоне
+// (kafka.async) или ничего не отправляет, иначе Async с очередью на queueSize событий.
+func Background(publisher Publisher, queueSize int) Publisher {
+	switch p := publisher.(type) {
+	case Nop:
+		return p
+	case *Kafka:
+		if p.async {
+			return p
+		}
+	}
+	return NewAsync(publisher, queueSize)
+}
+
+// NewAsync - фоновая отправка через publisher, queueSize <= 0 - очередь по умолчанию.
+func NewAsync(publisher Publisher, queueSize int) *Async {
+	if queueSize <= 0 {
+		queueSize = defaultAsyncQueueSize
+	}
+
+	return &Async{
+		publisher: publisher,
+		capacity:  queueSize,
+		// в очереди не больше queueSize событий, значит и не больше queueSize пачек
+		queue: make(chan asyncBatch, queueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		stats: Stats{QueueCapacity: queueSize},
+	}
+}
+
+// Connect подключает publisher и запускает фоновую отправку.
+func (a *Async) Connect(ctx context.Context) error {
+	if err := a.publisher.Connect(ctx); err != nil {
+		return err
+	}
+
+	a.running = true
+	go a.run()
+	return nil
+}
+
+// Close отправляет события, оставшиеся в очереди, и закрывает publisher.
+// Вызывается после того, как Publish больше не вызывается.
+func (a *Async) Close() {
+	a.once.Do(func() {
+		close(a.stop)
+		if a.running {
+			<-a.done
+		}
+		a.publisher.Close()
+	})
+}
+
+// Publish ставит события в очередь, ctx запроса в отправку не передается. Если места в очереди
+// не хватает для всех событий, ни одно не ставится в очередь и возвращается ErrQueueFull.
+func (a *Async) Publish(_ context.Context, events ...storage.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	select {
+	case <-a.stop:
+		return ErrClosed
+	default:
+	}
+
+	a.statsMutex.Lock()
+	if a.stats.Queued+len(events) > a.capacity {
+		a.stats.Dropped += int64(len(events))
+		a.statsMutex.Unlock()
+		return ErrQueueFull
+	}
+	a.stats.Queued += len(events)
+	a.statsMutex.Unlock()
+
+	// место занято под блокировкой статистики, поэтому запись в канал не ждет
+	a.queue <- asyncBatch{events: append([]storage.Event(nil), events...), enqueued: time.Now()}
+	return nil
+}
+
+// run отправляет пачки из очереди, пока не вызван Close, после Close отправляет оставшиеся.
+func (a *Async) run() {
+	defer close(a.done)
+
+	for {
+		select {
+		case batch := <-a.queue:
+			a.publish(batch)
+		case <-a.stop:
+			for {
+				select {
+				case batch := <-a.queue:
+					a.publish(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *Async) publish(batch asyncBatch) {
+	// ошибка учитывается в статистике, событие не вернуть в запрос
+	err := a.publisher.Publish(context.Background(), batch.events...)
+	if err != nil {
+		log.Printf("failed to publish events: %s", err)
+	}
+
+	lag := time.Since(batch.enqueued)
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+
+	a.stats.Queued -= len(batch.events)
+	if err != nil {
+		a.stats.Failed += int64(len(batch.events))
+		a.stats.LastError = err.Error()
+		return
+	}
+	a.stats.Published += int64(len(batch.events))
+	a.stats.LagSeconds = lag.Seconds()
+}
+
+// Stats - статистика очереди; отправленные, повторы и ошибки - из publisher, если он ведет статистику.
+func (a *Async) Stats() Stats {
+	a.statsMutex.Lock()
+	stats := a.stats
+	a.statsMutex.Unlock()
+
+	reporter, ok := a.publisher.(StatsReporter)
+	if !ok {
+		return stats
+	}
+
+	published := reporter.Stats()
+	published.Queued = stats.Queued
+	published.QueueCapacity = stats.QueueCapacity
+	published.LagSeconds = stats.LagSeconds
+	published.Dropped += stats.Dropped
+	return published
+}
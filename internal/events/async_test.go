@@ -0,0 +1,133 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// slowPublisher - отправка, которая ждет release и запоминает отправленные пачки.
+type slowPublisher struct {
+	release chan struct{}
+	fail    bool
+
+	mutex   sync.Mutex
+	batches [][]storage.Event
+	closed  bool
+}
+
+func (p *slowPublisher) Connect(context.Context) error { return nil }
+
+func (p *slowPublisher) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+}
+
+func (p *slowPublisher) Publish(ctx context.Context, events ...storage.Event) error {
+	<-p.release
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if p.fail {
+		return errors.New("webhook is down")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.batches = append(p.batches, events)
+	return nil
+}
+
+func (p *slowPublisher) published() [][]storage.Event {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([][]storage.Event(nil), p.batches...)
+}
+
+func TestBackground(t *testing.T) {
+	require.Equal(t, Nop{}, Background(Nop{}, 0))
+
+	asyncKafka, err := newKafka(config.KafkaConfig{Async: true}, testCodec(t, ""), newFakeWriter(0))
+	require.NoError(t, err)
+	require.Same(t, asyncKafka, Background(asyncKafka, 0))
+
+	syncKafka, err := newKafka(config.KafkaConfig{}, testCodec(t, ""), newFakeWriter(0))
+	require.NoError(t, err)
+	require.IsType(t, &Async{}, Background(syncKafka, 0))
+
+	webhook := NewWebhook(config.WebhookConfig{URL: "http://127.0.0.1:1"}, testCodec(t, ""))
+	require.IsType(t, &Async{}, Background(webhook, 0))
+}
+
+func TestAsync(t *testing.T) {
+	inner := &slowPublisher{release: make(chan struct{})}
+	async := NewAsync(inner, 10)
+	require.NoError(t, async.Connect(context.Background()))
+
+	// запрос не ждет отправки, отмена его контекста не отменяет отправку
+	ctx, cancel := context.WithCancel(context.Background())
+	events := newEvents(3)
+	require.NoError(t, async.Publish(ctx, events[:2]...))
+	require.NoError(t, async.Publish(ctx, events[2]))
+	cancel()
+	require.Equal(t, 3, async.Stats().Queued)
+
+	close(inner.release)
+	async.Close()
+
+	require.Equal(t, [][]storage.Event{events[:2], events[2:]}, inner.published())
+	require.True(t, inner.closed)
+
+	stats := async.Stats()
+	require.Zero(t, stats.Queued)
+	require.Equal(t, 10, stats.QueueCapacity)
+	require.Equal(t, int64(3), stats.Published)
+
+	require.ErrorIs(t, async.Publish(context.Background(), events...), ErrClosed)
+}
+
+func TestAsyncQueueFull(t *testing.T) {
+	inner := &slowPublisher{release: make(chan struct{})}
+	async := NewAsync(inner, 3)
+	require.NoError(t, async.Connect(context.Background()))
+
+	events := newEvents(4)
+	require.NoError(t, async.Publish(context.Background(), events[:2]...))
+
+	// в очереди одно свободное место: пачка из двух событий отбрасывается целиком
+	require.ErrorIs(t, async.Publish(context.Background(), events[2:]...), ErrQueueFull)
+	require.NoError(t, async.Publish(context.Background(), events[2]))
+
+	stats := async.Stats()
+	require.Equal(t, 3, stats.Queued)
+	require.Equal(t, int64(2), stats.Dropped)
+
+	close(inner.release)
+	async.Close()
+	require.Equal(t, [][]storage.Event{events[:2], events[2:3]}, inner.published())
+}
+
+func TestAsyncFailed(t *testing.T) {
+	inner := &slowPublisher{release: make(chan struct{}), fail: true}
+	close(inner.release)
+
+	async := NewAsync(inner, 0)
+	require.NoError(t, async.Connect(context.Background()))
+	require.NoError(t, async.Publish(context.Background(), newEvents(2)...))
+	require.Eventually(t, func() bool { return async.Stats().Failed == 2 }, 5*time.Second, time.Millisecond)
+	async.Close()
+
+	stats := async.Stats()
+	require.Equal(t, defaultAsyncQueueSize, stats.QueueCapacity)
+	require.Equal(t, "webhook is down", stats.LastError)
+}
@@ -0,0 +1,197 @@
+// Package codec кодирует события по схеме api/events/v1/event.proto: protobuf или JSON.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/astrviktor/banner-rotation/internal/events/eventpb"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SchemaVersion - версия схемы, с которой кодируются события. Увеличивается при добавлении полей.
+const SchemaVersion = 1
+
+const (
+	FormatProtobuf string = "protobuf"
+	FormatJSON     string = "json"
+)
+
+// Типы содержимого для заголовка content-type сообщения.
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeJSON     = "application/json"
+)
+
+var ErrInvalidEvent = errors.New("invalid event")
+
+// Envelope - событие и поля схемы, которые заполняет отправитель.
+type Envelope struct {
+	SchemaVersion uint32
+	InstanceID    string
+	Event         storage.Event
+}
+
+// Codec кодирует события в формате format, подписывая их instanceID.
+type Codec struct {
+	format     string
+	instanceID string
+}
+
+func New(format, instanceID string) (*Codec, error) {
+	switch format {
+	case "":
+		format = FormatProtobuf
+	case FormatProtobuf, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown events format %q", format)
+	}
+
+	return &Codec{format: format, instanceID: instanceID}, nil
+}
+
+// ContentType - тип содержимого закодированных событий.
+func (c *Codec) ContentType() string {
+	if c.format == FormatJSON {
+		return ContentTypeJSON
+	}
+	return ContentTypeProtobuf
+}
+
+// Encode кодирует событие в формате кодека.
+func (c *Codec) Encode(event storage.Event) ([]byte, error) {
+	if c.format == FormatJSON {
+		return c.EncodeJSON(event)
+	}
+
+	message, err := c.message(event)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(message)
+}
+
+// EncodeJSON кодирует событие в JSON независимо от формата кодека.
+func (c *Codec) EncodeJSON(event storage.Event) ([]byte, error) {
+	message, err := c.message(event)
+	if err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(message)
+}
+
+func (c *Codec) message(event storage.Event) (*eventpb.Event, error) {
+	action, err := toAction(event.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventpb.Event{
+		EventId:       event.ID,
+		SchemaVersion: SchemaVersion,
+		InstanceId:    c.instanceID,
+		SlotId:        event.SlotID,
+		BannerId:      event.BannerID,
+		SegmentId:     event.SegmentID,
+		Action:        action,
+		Time:          timestamppb.New(event.Date),
+		ImpressionId:  event.ImpressionID,
+	}, nil
+}
+
+// Decode декодирует событие по типу содержимого. Без типа содержимого (сообщения, записанные
+// до появления схемы) JSON по схеме отличается от прежнего JSON storage.Event по полю schemaVersion,
+// для прежнего формата SchemaVersion - 0. Неизвестные поля (из более новых версий схемы) пропускаются.
+func Decode(contentType string, data []byte) (Envelope, error) {
+	switch contentType {
+	case ContentTypeProtobuf:
+		var message eventpb.Event
+		if err := proto.Unmarshal(data, &message); err != nil {
+			return Envelope{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+		}
+		return fromMessage(&message)
+	case ContentTypeJSON:
+		return decodeJSON(data)
+	case "":
+		var probe struct {
+			SchemaVersion json.RawMessage `json:"schemaVersion"`
+		}
+		if err := json.Unmarshal(data, &probe); err != nil {
+			return Envelope{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+		}
+		if probe.SchemaVersion != nil {
+			return decodeJSON(data)
+		}
+		return decodeLegacy(data)
+	default:
+		return Envelope{}, fmt.Errorf("%w: unknown content type %q", ErrInvalidEvent, contentType)
+	}
+}
+
+func decodeJSON(data []byte) (Envelope, error) {
+	var message eventpb.Event
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, &message); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+	return fromMessage(&message)
+}
+
+// decodeLegacy декодирует JSON storage.Event, который отправлялся до появления схемы.
+func decodeLegacy(data []byte) (Envelope, error) {
+	var event storage.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	if _, err := toAction(event.Action); err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Event: event}, nil
+}
+
+func fromMessage(message *eventpb.Event) (Envelope, error) {
+	var action storage.ActionType
+	switch message.GetAction() {
+	case eventpb.Action_ACTION_SHOW:
+		action = storage.Show
+	case eventpb.Action_ACTION_CLICK:
+		action = storage.Click
+	case eventpb.Action_ACTION_UNSPECIFIED:
+		return Envelope{}, fmt.Errorf("%w: action is not set", ErrInvalidEvent)
+	default:
+		return Envelope{}, fmt.Errorf("%w: unknown action %d", ErrInvalidEvent, message.GetAction())
+	}
+
+	event := storage.Event{
+		ID:           message.GetEventId(),
+		SlotID:       message.GetSlotId(),
+		BannerID:     message.GetBannerId(),
+		SegmentID:    message.GetSegmentId(),
+		Action:       action,
+		ImpressionID: message.GetImpressionId(),
+	}
+	if message.GetTime() != nil {
+		event.Date = message.GetTime().AsTime()
+	}
+
+	return Envelope{
+		SchemaVersion: message.GetSchemaVersion(),
+		InstanceID:    message.GetInstanceId(),
+		Event:         event,
+	}, nil
+}
+
+func toAction(action storage.ActionType) (eventpb.Action, error) {
+	switch action {
+	case storage.Show:
+		return eventpb.Action_ACTION_SHOW, nil
+	case storage.Click:
+		return eventpb.Action_ACTION_CLICK, nil
+	default:
+		return eventpb.Action_ACTION_UNSPECIFIED, fmt.Errorf("%w: unknown action %d", ErrInvalidEvent, action)
+	}
+}
@@ -0,0 +1,160 @@
+package codec
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testEvent - событие, закодированное в testdata/event_v1.*.
+var testEvent = storage.Event{
+	ID:           "8c1ee6c2-4fa4-4c1a-9b33-0f4ad7f6d1a1",
+	SlotID:       "0b6a5f36-3e0c-4f43-9a59-0e8a6a7b0a11",
+	BannerID:     "5b0c6f0e-8d4e-4b7f-a1a4-7c2f3f2d9b22",
+	SegmentID:    "d2e7f3b4-1c6a-4d8e-9f0b-3a5c7e9d1f33",
+	Action:       storage.Click,
+	Date:         time.Date(2024, 5, 1, 12, 30, 15, 123000000, time.UTC),
+	ImpressionID: "f4a9b8c7-6d5e-4f3a-8b2c-1d0e9f8a7b44",
+}
+
+const testInstanceID = "banner-rotation-1"
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return data
+}
+
+func testCodec(t *testing.T, format string) *Codec {
+	t.Helper()
+
+	codec, err := New(format, testInstanceID)
+	require.NoError(t, err)
+	return codec
+}
+
+func TestNew(t *testing.T) {
+	require.Equal(t, ContentTypeProtobuf, testCodec(t, "").ContentType())
+	require.Equal(t, ContentTypeProtobuf, testCodec(t, FormatProtobuf).ContentType())
+	require.Equal(t, ContentTypeJSON, testCodec(t, FormatJSON).ContentType())
+
+	_, err := New("avro", testInstanceID)
+	require.Error(t, err)
+}
+
+// TestGolden - кодирование версии схемы 1 не меняется: получатели разбирают уже записанные события.
+func TestGolden(t *testing.T) {
+	data, err := testCodec(t, FormatProtobuf).Encode(testEvent)
+	require.NoError(t, err)
+	require.Equal(t, readTestdata(t, "event_v1.pb"), data)
+
+	// protojson не гарантирует одинаковых пробелов, сравнивается содержимое
+	data, err = testCodec(t, FormatJSON).Encode(testEvent)
+	require.NoError(t, err)
+	require.JSONEq(t, string(readTestdata(t, "event_v1.json")), string(data))
+
+	want := Envelope{SchemaVersion: 1, InstanceID: testInstanceID, Event: testEvent}
+	for contentType, name := range map[string]string{
+		ContentTypeProtobuf: "event_v1.pb",
+		ContentTypeJSON:     "event_v1.json",
+		"":                  "event_v1.json",
+	} {
+		envelope, err := Decode(contentType, readTestdata(t, name))
+		require.NoError(t, err, name)
+		require.Equal(t, want, envelope, name)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	events := []storage.Event{
+		testEvent,
+		{SlotID: storage.NewID(), BannerID: storage.NewID(), SegmentID: storage.NewID(), Action: storage.Show},
+	}
+
+	for _, format := range []string{FormatProtobuf, FormatJSON} {
+		codec := testCodec(t, format)
+		for _, event := range events {
+			data, err := codec.Encode(event)
+			require.NoError(t, err)
+
+			envelope, err := Decode(codec.ContentType(), data)
+			require.NoError(t, err)
+			require.Equal(t, event.ID, envelope.Event.ID)
+			require.Equal(t, event.Action, envelope.Event.Action)
+			require.True(t, event.Date.Equal(envelope.Event.Date), format)
+		}
+	}
+}
+
+// TestUnknownFields - события более новой версии схемы разбираются, новые поля пропускаются.
+func TestUnknownFields(t *testing.T) {
+	want := Envelope{SchemaVersion: 2, InstanceID: testInstanceID, Event: testEvent}
+
+	data := readTestdata(t, "event_v1.pb")
+	data = protowire.AppendTag(data, 2, protowire.VarintType)
+	data = protowire.AppendVarint(data, 2)
+	data = protowire.AppendTag(data, 100, protowire.BytesType)
+	data = protowire.AppendString(data, "field from a future version")
+
+	envelope, err := Decode(ContentTypeProtobuf, data)
+	require.NoError(t, err)
+	require.Equal(t, want, envelope)
+
+	var message map[string]interface{}
+	require.NoError(t, json.Unmarshal(readTestdata(t, "event_v1.json"), &message))
+	message["schemaVersion"] = 2
+	message["placement"] = map[string]interface{}{"position": 1}
+	data, err = json.Marshal(message)
+	require.NoError(t, err)
+
+	for _, contentType := range []string{ContentTypeJSON, ""} {
+		envelope, err = Decode(contentType, data)
+		require.NoError(t, err)
+		require.Equal(t, want, envelope)
+	}
+}
+
+// TestLegacy - JSON storage.Event, который отправлялся до появления схемы, без заголовка content-type.
+func TestLegacy(t *testing.T) {
+	envelope, err := Decode("", readTestdata(t, "event_legacy.json"))
+	require.NoError(t, err)
+	require.Zero(t, envelope.SchemaVersion)
+	require.Empty(t, envelope.InstanceID)
+	require.Equal(t, storage.Event{
+		SlotID:    testEvent.SlotID,
+		BannerID:  testEvent.BannerID,
+		SegmentID: testEvent.SegmentID,
+		Action:    storage.Click,
+		Date:      time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC),
+	}, envelope.Event)
+}
+
+func TestInvalid(t *testing.T) {
+	_, err := testCodec(t, FormatProtobuf).Encode(storage.Event{Action: storage.ActionType(7)})
+	require.ErrorIs(t, err, ErrInvalidEvent)
+
+	for _, tt := range []struct {
+		contentType string
+		data        string
+	}{
+		{contentType: ContentTypeProtobuf, data: "\xff\xff"},
+		{contentType: ContentTypeProtobuf, data: ""}, // action не задан
+		{contentType: ContentTypeJSON, data: `{"schemaVersion":1,"action":"ACTION_SHOW"`},
+		{contentType: ContentTypeJSON, data: `{"schemaVersion":1,"action":"ACTION_VIEW"}`},
+		{contentType: ContentTypeJSON, data: `{"schemaVersion":1,"action":5}`},
+		{contentType: "", data: `not json`},
+		{contentType: "", data: `{"slotId":"x","action":7}`},
+		{contentType: "text/plain", data: `{}`},
+	} {
+		_, err := Decode(tt.contentType, []byte(tt.data))
+		require.ErrorIs(t, err, ErrInvalidEvent, "%s %s", tt.contentType, tt.data)
+	}
+}
@@ -0,0 +1,2 @@
+
+$8c1ee6c2-4fa4-4c1a-9b33-0f4ad7f6d1a1banner-rotation-1"$0b6a5f36-3e0c-4f43-9a59-0e8a6a7b0a11*$5b0c6f0e-8d4e-4b7f-a1a4-7c2f3f2d9b222$d2e7f3b4-1c6a-4d8e-9f0b-3a5c7e9d1f338Bȱ:J$f4a9b8c7-6d5e-4f3a-8b2c-1d0e9f8a7b44
\ No newline at end of file
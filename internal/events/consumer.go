@@ -0,0 +1,300 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultConsumerRetryBackoff    = 100 * time.Millisecond
+	defaultConsumerMaxRetryBackoff = 5 * time.Second
+
+	// dedupeCleanupInterval - как часто удаляются ID событий старше kafka.consumer.dedupeRetention.
+	dedupeCleanupInterval = time.Hour
+)
+
+// messageReader - чтение сообщений группой потребителей, kafka.Reader.
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Consumer читает события показов и переходов из kafka.consumer.topic группой kafka.consumer.groupId
+// и записывает их в хранилище так же, как POST /click: событие в статистику по времени события
+// и обновление модели баннера. Смещение сообщения фиксируется только после записи события, поэтому после
+// сбоя сообщение читается повторно; хранилище запоминает ID записанных событий, и повторно доставленное
+// событие не учитывается. Некорректные события, повторы, переходы сверх показов и события неизвестных
+// слотов, баннеров и сегментов пропускаются, ошибка хранилища повторяется с паузой, пока событие
+// не будет записано. Прочитанные события никуда не отправляются (см. storage.Storage.RecordEvent).
+// ID записанных событий хранятся kafka.consumer.dedupeRetention: повтор после этого срока учитывается.
+type Consumer struct {
+	reader          messageReader
+	storage         storage.Storage
+	strategies      *core.Strategies
+	timeout         time.Duration
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	dedupeRetention time.Duration
+	cleanupInterval time.Duration
+
+	once   sync.Once
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewConsumer - чтение событий по настройкам kafka.consumer в хранилище stor.
+func NewConsumer(conf config.Config, stor storage.Storage, strategies *core.Strategies) (*Consumer, error) {
+	consumerConf := conf.Kafka.Consumer
+	if consumerConf.GroupID == "" {
+		return nil, fmt.Errorf("kafka consumer group id is empty")
+	}
+	if Name(conf) == config.EventsPublisherKafka && consumerConf.Topic == conf.Kafka.Topic {
+		return nil, fmt.Errorf("kafka consumer topic %q is the events topic", consumerConf.Topic)
+	}
+
+	readerConf := kafka.ReaderConfig{
+		Brokers:  []string{conf.Kafka.BrokerAddress},
+		GroupID:  consumerConf.GroupID,
+		Topic:    consumerConf.Topic,
+		MinBytes: consumerConf.MinBytes,
+		MaxBytes: consumerConf.MaxBytes,
+		MaxWait:  consumerConf.MaxWait,
+	}
+	if err := readerConf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return newConsumer(consumerConf, conf.DB.Timeouts.Write, kafka.NewReader(readerConf), stor, strategies), nil
+}
+
+// newConsumer - чтение событий через reader, timeout - ограничение времени записи события.
+func newConsumer(conf config.KafkaConsumerConfig, timeout time.Duration, reader messageReader,
+	stor storage.Storage, strategies *core.Strategies) *Consumer {
+	return &Consumer{
+		reader:          reader,
+		storage:         stor,
+		strategies:      strategies,
+		timeout:         timeout,
+		retryBackoff:    positive(conf.RetryBackoff, defaultConsumerRetryBackoff),
+		maxRetryBackoff: positive(conf.MaxRetryBackoff, defaultConsumerMaxRetryBackoff),
+		dedupeRetention: conf.DedupeRetention,
+		cleanupInterval: dedupeCleanupInterval,
+	}
+}
+
+// Start запускает чтение и удаление старых ID событий в фоне. Хранилище должно быть подключено.
+func (c *Consumer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run(ctx)
+	}()
+
+	if c.dedupeRetention > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.cleanup(ctx)
+		}()
+	}
+}
+
+// Close останавливает чтение: записываемое событие дописывается, и его смещение фиксируется.
+func (c *Consumer) Close() {
+	c.once.Do(func() {
+		if c.cancel != nil {
+			c.cancel()
+			c.wg.Wait()
+		}
+
+		if err := c.reader.Close(); err != nil {
+			log.Printf("failed to close kafka consumer: %s", err)
+		}
+	})
+}
+
+func (c *Consumer) run(ctx context.Context) {
+	log.Println("kafka consumer started")
+
+	backoff := c.retryBackoff
+	for {
+		message, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("failed to read kafka events: %s", err)
+			if wait(ctx, backoff) != nil {
+				return
+			}
+			backoff = c.nextBackoff(backoff)
+			continue
+		}
+		backoff = c.retryBackoff
+
+		if !c.handle(ctx, message) {
+			return
+		}
+	}
+}
+
+// cleanup удаляет ID событий старше kafka.consumer.dedupeRetention при запуске и раз в cleanupInterval.
+func (c *Consumer) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(c.cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		c.deleteEventIDs(ctx, time.Now().UTC())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Consumer) deleteEventIDs(ctx context.Context, now time.Time) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	err := c.storage.DeleteEventIDs(ctx, now.Add(-c.dedupeRetention))
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("failed to delete kafka event ids: %s", err)
+	}
+}
+
+// handle записывает событие сообщения и фиксирует смещение, false - чтение остановлено до записи
+// события или фиксации смещения.
+func (c *Consumer) handle(ctx context.Context, message kafka.Message) bool {
+	backoff := c.retryBackoff
+	for {
+		err := c.apply(message)
+		if err == nil || !retryable(err) {
+			if err != nil {
+				log.Printf("skipped kafka event %s/%d/%d: %s", message.Topic, message.Partition, message.Offset, err)
+			}
+			break
+		}
+
+		log.Printf("failed to save kafka event: %s", err)
+		if wait(ctx, backoff) != nil {
+			return false
+		}
+		backoff = c.nextBackoff(backoff)
+	}
+
+	backoff = c.retryBackoff
+	for {
+		// смещение фиксируется и при остановке: событие уже записано
+		err := c.reader.CommitMessages(context.Background(), message)
+		if err == nil {
+			return true
+		}
+
+		log.Printf("failed to commit kafka event offset: %s", err)
+		if wait(ctx, backoff) != nil {
+			return false
+		}
+		backoff = c.nextBackoff(backoff)
+	}
+}
+
+// apply записывает событие сообщения. Ошибка обновления модели не повторяется: событие уже записано.
+func (c *Consumer) apply(message kafka.Message) error {
+	envelope, err := codec.Decode(contentType(message), message.Value)
+	if err != nil {
+		return err
+	}
+
+	event := envelope.Event
+	event.ID = eventID(message, event)
+	if event.Date.IsZero() {
+		event.Date = time.Now().UTC()
+	}
+	if err = storage.ValidateIDs(event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	if err = c.storage.RecordEvent(ctx, event); err != nil {
+		return err
+	}
+
+	err = core.UpdateContext(ctx, c.storage, c.strategies.ForSlot(event.SlotID), event.BannerID, event.SegmentID,
+		nil, event.Action)
+	if err != nil {
+		log.Printf("error when updating banner model %s", err)
+	}
+	return nil
+}
+
+// eventID - ID события из сообщения. У событий до появления схемы ID нет, для них ID строится
+// по топику, разделу и смещению: у повторно доставленного сообщения они те же.
+func eventID(message kafka.Message, event storage.Event) string {
+	if event.ID != "" {
+		return event.ID
+	}
+
+	name := fmt.Sprintf("kafka:%s/%d/%d", message.Topic, message.Partition, message.Offset)
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(name)).String()
+}
+
+// retryable - ошибка хранилища, после которой запись события повторяется. Некорректное событие,
+// уже записанное событие, переход сверх показов и событие удаленных слота, баннера или сегмента
+// не запишутся и при повторе.
+func retryable(err error) bool {
+	return !errors.Is(err, codec.ErrInvalidEvent) &&
+		!errors.Is(err, storage.ErrInvalidID) &&
+		!errors.Is(err, storage.ErrNotFound) &&
+		!errors.Is(err, storage.ErrAlreadyExists) &&
+		!errors.Is(err, storage.ErrClicksExceedShows)
+}
+
+func (c *Consumer) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > c.maxRetryBackoff {
+		backoff = c.maxRetryBackoff
+	}
+	return backoff
+}
+
+// contentType - тип содержимого из заголовка content-type (имя без учета регистра) без параметров.
+func contentType(message kafka.Message) string {
+	for _, h := range message.Headers {
+		if strings.EqualFold(h.Key, ContentTypeHeader) {
+			if mediaType, _, err := mime.ParseMediaType(string(h.Value)); err == nil {
+				return mediaType
+			}
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,260 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReader отдает сообщения по порядку и запоминает зафиксированные смещения.
+type fakeReader struct {
+	mutex     sync.Mutex
+	messages  []kafka.Message
+	committed []int64
+	commits   chan int64
+}
+
+func newFakeReader(messages ...kafka.Message) *fakeReader {
+	for idx := range messages {
+		messages[idx].Offset = int64(idx)
+	}
+	return &fakeReader{messages: messages, commits: make(chan int64, len(messages))}
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mutex.Lock()
+	if len(r.messages) > 0 {
+		message := r.messages[0]
+		r.messages = r.messages[1:]
+		r.mutex.Unlock()
+		return message, nil
+	}
+	r.mutex.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, message := range msgs {
+		r.committed = append(r.committed, message.Offset)
+		r.commits <- message.Offset
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+// failingStorage - хранилище, в котором первые failures записей событий завершаются ошибкой.
+type failingStorage struct {
+	storage.Storage
+	failures int32
+	attempts int32
+}
+
+func (s *failingStorage) RecordEvent(ctx context.Context, event storage.Event) error {
+	atomic.AddInt32(&s.attempts, 1)
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("database is down")
+	}
+	return s.Storage.RecordEvent(ctx, event)
+}
+
+func encodeMessage(t *testing.T, format string, event storage.Event) kafka.Message {
+	t.Helper()
+
+	data, err := testCodec(t, format).Encode(event)
+	require.NoError(t, err)
+	return kafka.Message{
+		Value:   data,
+		Headers: []kafka.Header{{Key: ContentTypeHeader, Value: []byte(testCodec(t, format).ContentType())}},
+	}
+}
+
+func newTestConsumer(t *testing.T, reader messageReader, stor storage.Storage) *Consumer {
+	t.Helper()
+
+	strategies, err := core.NewStrategies(config.ChoiceConfig{
+		Seed:     1,
+		Strategy: config.StrategyConfig{Name: config.StrategyLinUCB, Dimension: 2},
+	})
+	require.NoError(t, err)
+
+	conf := config.KafkaConsumerConfig{RetryBackoff: time.Millisecond, MaxRetryBackoff: 5 * time.Millisecond}
+	return newConsumer(conf, time.Second, reader, stor, strategies)
+}
+
+func waitCommits(t *testing.T, reader *fakeReader, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-reader.commits:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d offsets are committed", i, count)
+		}
+	}
+}
+
+func TestNewConsumer(t *testing.T) {
+	conf := config.DefaultConfig()
+	stor := memorystorage.New()
+
+	consumer, err := NewConsumer(conf, stor, nil)
+	require.NoError(t, err)
+	consumer.Close()
+
+	for _, update := range []func(conf *config.Config){
+		func(conf *config.Config) { conf.Kafka.Consumer.GroupID = "" },
+		func(conf *config.Config) { conf.Kafka.Consumer.Topic = "" },
+		func(conf *config.Config) { conf.Kafka.Consumer.MinBytes = 2e6 },
+		// сервис не читает события, которые отправляет сам
+		func(conf *config.Config) {
+			conf.Events.Publisher = config.EventsPublisherKafka
+			conf.Kafka.Consumer.Topic = conf.Kafka.Topic
+		},
+	} {
+		conf := config.DefaultConfig()
+		update(&conf)
+		_, err = NewConsumer(conf, stor, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	ctx := context.Background()
+	stor := &failingStorage{Storage: memorystorage.New(), failures: 2}
+
+	slot, err := stor.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := stor.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := stor.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+	require.NoError(t, stor.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: banner}))
+	require.NoError(t, stor.SetSegmentFeatures(ctx, segment, []float64{1, 0.5}))
+
+	show := storage.Event{ID: storage.NewID(), SlotID: slot, BannerID: banner, SegmentID: segment, Action: storage.Show}
+	click := show
+	click.ID = storage.NewID()
+	click.Action = storage.Click
+	secondClick := click
+	secondClick.ID = storage.NewID()
+	extraClick := click
+	extraClick.ID = storage.NewID()
+	unknown := click
+	unknown.ID = storage.NewID()
+	unknown.BannerID = storage.NewID()
+
+	jsonClick := encodeMessage(t, codec.FormatJSON, click)
+	jsonClick.Headers[0] = kafka.Header{Key: "Content-Type", Value: []byte("application/json; charset=utf-8")}
+
+	reader := newFakeReader(
+		encodeMessage(t, codec.FormatProtobuf, show),
+		jsonClick,
+		// JSON до появления схемы, без заголовка
+		kafka.Message{Value: []byte(`{"slotId":"` + slot + `","bannerId":"` + banner + `","segmentId":"` + segment +
+			`","action":1,"date":"2024-05-01T12:00:00Z"}`)},
+		// повторная доставка показа
+		encodeMessage(t, codec.FormatProtobuf, show),
+		encodeMessage(t, codec.FormatProtobuf, secondClick),
+		// переход сверх показов
+		encodeMessage(t, codec.FormatProtobuf, extraClick),
+		kafka.Message{Value: []byte("not an event")},
+		encodeMessage(t, codec.FormatProtobuf, unknown),
+		kafka.Message{Value: []byte(`{"slotId":"x","bannerId":"y","segmentId":"z","action":2}`)},
+	)
+
+	consumer := newTestConsumer(t, reader, stor)
+	consumer.Start()
+	waitCommits(t, reader, 9)
+	consumer.Close()
+
+	// запись первого события повторялась, пока хранилище не ответило, смещения зафиксированы по порядку,
+	// некорректные события, повтор показа, переход сверх показов и событие неизвестного баннера пропущены
+	require.Equal(t, int32(9), atomic.LoadInt32(&stor.attempts))
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8}, reader.committed)
+
+	stat, err := stor.GetStatForSlotBannerAndSegment(ctx, slot, banner, segment)
+	require.NoError(t, err)
+	require.Equal(t, 2, stat.ShowCount)
+	require.Equal(t, 2, stat.ClickCount)
+
+	// событие учтено в интервале своего времени, а не времени чтения
+	buckets, err := stor.GetStatBuckets(ctx, slot, banner, segment, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, buckets, 2)
+	require.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), buckets[0].Start)
+	require.Equal(t, 1, buckets[0].ShowCount)
+	require.Equal(t, 0, buckets[0].ClickCount)
+
+	model, err := stor.GetModel(ctx, banner)
+	require.NoError(t, err)
+	require.NotEqual(t, storage.NewModel(banner, model.Dimension), model)
+}
+
+func TestConsumerCommitAfterSave(t *testing.T) {
+	ctx := context.Background()
+	stor := &failingStorage{Storage: memorystorage.New(), failures: 1 << 30}
+
+	slot, err := stor.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := stor.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := stor.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	event := storage.Event{SlotID: slot, BannerID: banner, SegmentID: segment, Action: storage.Click}
+	reader := newFakeReader(encodeMessage(t, codec.FormatProtobuf, event))
+
+	consumer := newTestConsumer(t, reader, stor)
+	consumer.Start()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&stor.attempts) > 2 }, 5*time.Second, time.Millisecond)
+	consumer.Close()
+
+	// событие не записано: смещение не фиксируется, после перезапуска сообщение читается снова
+	require.Empty(t, reader.committed)
+}
+
+func TestConsumerDedupeRetention(t *testing.T) {
+	ctx := context.Background()
+	stor := memorystorage.New()
+
+	slot, err := stor.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := stor.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := stor.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	show := storage.Event{ID: storage.NewID(), SlotID: slot, BannerID: banner, SegmentID: segment,
+		Action: storage.Show, Date: time.Now().UTC()}
+	require.NoError(t, stor.RecordEvent(ctx, show))
+
+	consumer := newTestConsumer(t, newFakeReader(), stor)
+	consumer.dedupeRetention = 10 * time.Millisecond
+	consumer.cleanupInterval = 5 * time.Millisecond
+	consumer.Start()
+	defer consumer.Close()
+
+	// ID события забыт после dedupeRetention: повтор снова учитывается
+	require.Eventually(t, func() bool { return stor.RecordEvent(ctx, show) == nil }, 5*time.Second, time.Millisecond)
+
+	stat, err := stor.GetStatForSlotBannerAndSegment(ctx, slot, banner, segment)
+	require.NoError(t, err)
+	require.Equal(t, 2, stat.ShowCount)
+}
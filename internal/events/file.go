@@ -0,0 +1,73 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// File дописывает события в файл по одному JSON на строку (JSON Lines) по схеме событий.
+type File struct {
+	path  string
+	codec *codec.Codec
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFile(conf config.FileConfig, eventCodec *codec.Codec) *File {
+	return &File{path: conf.Path, codec: eventCodec}
+}
+
+func (f *File) Connect(context.Context) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.file = file
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *File) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			log.Printf("failed to close events file: %s", err)
+		}
+		f.file = nil
+	}
+}
+
+// Publish записывает события одной записью, чтобы строки параллельных отправок не перемешивались.
+func (f *File) Publish(_ context.Context, events ...storage.Event) error {
+	var buf bytes.Buffer
+	for _, event := range events {
+		line, err := f.codec.EncodeJSON(event)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	_, err := f.file.Write(buf.Bytes())
+	return err
+}
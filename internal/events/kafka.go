@@ -0,0 +1,480 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultKafkaQueueSize       = 10000
+	defaultKafkaBatchSize       = 100
+	defaultKafkaBatchTimeout    = 100 * time.Millisecond
+	defaultKafkaMaxAttempts     = 5
+	defaultKafkaRetryBackoff    = 100 * time.Millisecond
+	defaultKafkaMaxRetryBackoff = 5 * time.Second
+	defaultKafkaWriteTimeout    = 10 * time.Second
+)
+
+// Заголовки сообщения: тип содержимого (codec.ContentTypeProtobuf или codec.ContentTypeJSON)
+// и версия схемы события.
+const (
+	ContentTypeHeader   = "content-type"
+	SchemaVersionHeader = "schema-version"
+)
+
+var (
+	ErrQueueFull = errors.New("events queue is full")
+	ErrClosed    = errors.New("events publisher is closed")
+)
+
+// messageWriter - запись пачки сообщений в kafka (*kafka.Writer).
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// queued - сообщение в очереди и время постановки в очередь для подсчета задержки.
+type queued struct {
+	message  kafka.Message
+	enqueued time.Time
+}
+
+// Kafka отправляет события в топик kafka.topic. Раздел выбирается по ключу сообщения
+// (ID слота или баннера), сообщения без ключа распределяются по очереди.
+// С kafka.async события ставятся в ограниченную очередь, из которой пачками по kafka.batchSize
+// или раз в kafka.batchTimeout записываются в фоне, иначе записываются в Publish.
+// Неудачная запись повторяется до kafka.maxAttempts раз с паузой, растущей вдвое.
+type Kafka struct {
+	topic              string
+	brokerAddress      string
+	maxConnectAttempts int
+	async              bool
+	dropWhenFull       bool
+	batchSize          int
+	batchTimeout       time.Duration
+	partitionKey       string
+	maxAttempts        int
+	retryBackoff       time.Duration
+	maxRetryBackoff    time.Duration
+
+	codec   *codec.Codec
+	writer  messageWriter
+	queue   chan queued
+	running bool
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	// места в очереди для всех событий Publish проверяются и занимаются под блокировкой
+	enqueueMutex sync.Mutex
+	// run сообщает ждущим места Publish, что забрал сообщение из очереди
+	dequeued chan struct{}
+
+	statsMutex sync.Mutex
+	stats      Stats
+}
+
+func NewKafka(conf config.KafkaConfig, eventCodec *codec.Codec) (*Kafka, error) {
+	acks, err := requiredAcks(conf.RequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := compressionCodec(conf.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newKafka(conf, eventCodec, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	k.writer = &kafka.Writer{
+		Addr:     kafka.TCP(conf.BrokerAddress),
+		Topic:    conf.Topic,
+		Balancer: &kafka.Hash{},
+		// повторы с паузами делает write
+		MaxAttempts: 1,
+		BatchSize:   k.batchSize,
+		// пачки собирает run, запись не должна ждать заполнения пачки раздела
+		BatchTimeout: time.Millisecond,
+		WriteTimeout: positive(conf.WriteTimeout, defaultKafkaWriteTimeout),
+		RequiredAcks: acks,
+		Compression:  compression,
+	}
+	return k, nil
+}
+
+// newKafka - отправка через writer без проверки настроек записи.
+func newKafka(conf config.KafkaConfig, eventCodec *codec.Codec, writer messageWriter) (*Kafka, error) {
+	switch conf.QueuePolicy {
+	case "", config.KafkaQueueBlock, config.KafkaQueueDrop:
+	default:
+		return nil, fmt.Errorf("unknown kafka queue policy %q", conf.QueuePolicy)
+	}
+
+	switch conf.PartitionKey {
+	case "", config.KafkaPartitionBySlot, config.KafkaPartitionByBanner, config.KafkaPartitionNone:
+	default:
+		return nil, fmt.Errorf("unknown kafka partition key %q", conf.PartitionKey)
+	}
+
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultKafkaQueueSize
+	}
+
+	maxAttempts := conf.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultKafkaMaxAttempts
+	}
+
+	batchSize := conf.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultKafkaBatchSize
+	}
+
+	var queue chan queued
+	if conf.Async {
+		queue = make(chan queued, queueSize)
+	}
+
+	return &Kafka{
+		topic:              conf.Topic,
+		brokerAddress:      conf.BrokerAddress,
+		maxConnectAttempts: conf.MaxConnectAttempts,
+		async:              conf.Async,
+		dropWhenFull:       conf.QueuePolicy == config.KafkaQueueDrop,
+		batchSize:          batchSize,
+		batchTimeout:       positive(conf.BatchTimeout, defaultKafkaBatchTimeout),
+		partitionKey:       conf.PartitionKey,
+		maxAttempts:        maxAttempts,
+		retryBackoff:       positive(conf.RetryBackoff, defaultKafkaRetryBackoff),
+		maxRetryBackoff:    positive(conf.MaxRetryBackoff, defaultKafkaMaxRetryBackoff),
+		codec:              eventCodec,
+		writer:             writer,
+		queue:              queue,
+		dequeued:           make(chan struct{}, 1),
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+		stats:              Stats{QueueCapacity: queueSize},
+	}, nil
+}
+
+func positive(value, def time.Duration) time.Duration {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+func requiredAcks(name string) (kafka.RequiredAcks, error) {
+	switch name {
+	case "", "all":
+		return kafka.RequireAll, nil
+	case "one":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka required acks %q", name)
+	}
+}
+
+func compressionCodec(name string) (kafka.Compression, error) {
+	switch name {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka compression %q", name)
+	}
+}
+
+// Connect проверяет, что kafka доступна, делая до kafka.maxConnectAttempts попыток,
+// и запускает фоновую отправку для kafka.async.
+func (k *Kafka) Connect(ctx context.Context) error {
+	var err error
+	for i := 0; i < k.maxConnectAttempts; i++ {
+		var conn *kafka.Conn
+		conn, err = kafka.DialLeader(ctx, "tcp", k.brokerAddress, k.topic, 0)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		log.Println("trying to connect to kafka...")
+
+		if waitErr := wait(ctx, 5*time.Second); waitErr != nil {
+			return waitErr
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("connect to kafka OK")
+	k.start()
+	return nil
+}
+
+// start запускает фоновую отправку для kafka.async.
+func (k *Kafka) start() {
+	if k.async {
+		k.running = true
+		go k.run()
+	}
+}
+
+// wait ждет перед следующей попыткой, ctx.Err(), если ожидание отменено.
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Close отправляет события, оставшиеся в очереди, и закрывает запись.
+// Вызывается после того, как Publish больше не вызывается.
+func (k *Kafka) Close() {
+	k.once.Do(func() {
+		close(k.stop)
+		if k.running {
+			<-k.done
+		}
+
+		if err := k.writer.Close(); err != nil {
+			log.Printf("failed to close kafka: %s", err)
+		}
+	})
+}
+
+// Publish для kafka.async ставит в очередь все события или ни одного: если места не хватает
+// для всех событий, ждет его или, для kafka.queuePolicy: drop, отбрасывает их все
+// и возвращает ErrQueueFull.
+func (k *Kafka) Publish(ctx context.Context, events ...storage.Event) error {
+	headers := []kafka.Header{
+		{Key: ContentTypeHeader, Value: []byte(k.codec.ContentType())},
+		{Key: SchemaVersionHeader, Value: []byte(strconv.Itoa(codec.SchemaVersion))},
+	}
+
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		bytes, err := k.codec.Encode(event)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{Key: k.key(event), Value: bytes, Headers: headers})
+	}
+
+	if !k.async {
+		return k.write(ctx, messages, time.Now())
+	}
+
+	select {
+	case <-k.stop:
+		return ErrClosed
+	default:
+	}
+
+	now := time.Now()
+	if k.dropWhenFull {
+		if !k.enqueue(messages, now) {
+			k.addStats(func(stats *Stats) { stats.Dropped += int64(len(messages)) })
+			return ErrQueueFull
+		}
+		return nil
+	}
+
+	for !k.enqueue(messages, now) {
+		select {
+		case <-k.dequeued:
+		case <-k.stop:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// enqueue ставит в очередь все сообщения или, если места не хватает, ни одного.
+// Очередь разбирает только run, поэтому под блокировкой свободных мест не становится меньше.
+func (k *Kafka) enqueue(messages []kafka.Message, enqueued time.Time) bool {
+	k.enqueueMutex.Lock()
+	defer k.enqueueMutex.Unlock()
+
+	if cap(k.queue)-len(k.queue) < len(messages) {
+		return false
+	}
+
+	for _, message := range messages {
+		k.queue <- queued{message: message, enqueued: enqueued}
+	}
+	return true
+}
+
+// notifyDequeued будит одного ждущего места Publish: он ставит свои сообщения в очередь
+// или ждет дальше, пока run разбирает очередь, так что следующие уведомления не теряются.
+func (k *Kafka) notifyDequeued() {
+	select {
+	case k.dequeued <- struct{}{}:
+	default:
+	}
+}
+
+// key - ключ сообщения по kafka.partitionKey, nil - без ключа.
+func (k *Kafka) key(event storage.Event) []byte {
+	switch k.partitionKey {
+	case config.KafkaPartitionBySlot, "":
+		return []byte(event.SlotID)
+	case config.KafkaPartitionByBanner:
+		return []byte(event.BannerID)
+	default:
+		return nil
+	}
+}
+
+// run собирает сообщения из очереди в пачки и записывает их, пока не вызван Close,
+// после Close записывает оставшиеся в очереди сообщения.
+func (k *Kafka) run() {
+	defer close(k.done)
+
+	batch := make([]queued, 0, k.batchSize)
+	var timer *time.Timer
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		messages := make([]kafka.Message, len(batch))
+		for idx := range batch {
+			messages[idx] = batch[idx].message
+		}
+
+		// ошибка уже учтена в статистике, событие не вернуть в запрос
+		if err := k.write(context.Background(), messages, batch[0].enqueued); err != nil {
+			log.Printf("failed to write events to kafka: %s", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case item := <-k.queue:
+			k.notifyDequeued()
+			batch = append(batch, item)
+			if len(batch) == 1 {
+				timer = time.NewTimer(k.batchTimeout)
+				timeout = timer.C
+			}
+			if len(batch) >= k.batchSize {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		case <-k.stop:
+			for {
+				select {
+				case item := <-k.queue:
+					k.notifyDequeued()
+					batch = append(batch, item)
+					if len(batch) >= k.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write записывает пачку, повторяя запись с паузой до kafka.maxAttempts раз.
+// enqueued - время постановки в очередь самого старого сообщения пачки.
+func (k *Kafka) write(ctx context.Context, messages []kafka.Message, enqueued time.Time) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	fail := func(err error) error {
+		k.addStats(func(stats *Stats) {
+			stats.Failed += int64(len(messages))
+			stats.LastError = err.Error()
+		})
+		return err
+	}
+
+	backoff := k.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := k.writer.WriteMessages(ctx, messages...)
+		if err == nil {
+			lag := time.Since(enqueued)
+			k.addStats(func(stats *Stats) {
+				stats.Published += int64(len(messages))
+				stats.LagSeconds = lag.Seconds()
+			})
+			return nil
+		}
+
+		if attempt >= k.maxAttempts {
+			return fail(err)
+		}
+
+		k.addStats(func(stats *Stats) { stats.Retries++ })
+		if waitErr := wait(ctx, backoff); waitErr != nil {
+			return fail(err)
+		}
+
+		backoff *= 2
+		if backoff > k.maxRetryBackoff {
+			backoff = k.maxRetryBackoff
+		}
+	}
+}
+
+func (k *Kafka) addStats(update func(stats *Stats)) {
+	k.statsMutex.Lock()
+	update(&k.stats)
+	k.statsMutex.Unlock()
+}
+
+func (k *Kafka) Stats() Stats {
+	k.statsMutex.Lock()
+	stats := k.stats
+	k.statsMutex.Unlock()
+
+	stats.Queued = len(k.queue)
+	return stats
+}
@@ -0,0 +1,257 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWriter запоминает записанные пачки, первые failures записей завершаются ошибкой.
+type fakeWriter struct {
+	mutex    sync.Mutex
+	batches  [][]kafka.Message
+	failures int
+	written  chan struct{}
+}
+
+func newFakeWriter(failures int) *fakeWriter {
+	return &fakeWriter{failures: failures, written: make(chan struct{}, 100)}
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.failures > 0 {
+		w.failures--
+		return errors.New("kafka is down")
+	}
+
+	w.batches = append(w.batches, append([]kafka.Message(nil), msgs...))
+	w.written <- struct{}{}
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+func (w *fakeWriter) sizes() []int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	sizes := make([]int, 0, len(w.batches))
+	for _, batch := range w.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func newEvents(count int) []storage.Event {
+	events := make([]storage.Event, count)
+	for idx := range events {
+		events[idx] = storage.Event{
+			SlotID:    storage.NewID(),
+			BannerID:  storage.NewID(),
+			SegmentID: storage.NewID(),
+			Action:    storage.Show,
+			Date:      time.Now().UTC(),
+		}
+	}
+	return events
+}
+
+func TestNewKafkaConfig(t *testing.T) {
+	for _, conf := range []config.KafkaConfig{
+		{RequiredAcks: "some"},
+		{Compression: "brotli"},
+		{QueuePolicy: "wait"},
+		{PartitionKey: "segment"},
+	} {
+		_, err := NewKafka(conf, testCodec(t, ""))
+		require.Error(t, err, "%+v", conf)
+	}
+
+	conf := config.KafkaConfig{RequiredAcks: "one", Compression: "gzip", QueuePolicy: "drop"}
+	k, err := NewKafka(conf, testCodec(t, ""))
+	require.NoError(t, err)
+	k.Close()
+}
+
+func TestKafkaBatchBySize(t *testing.T) {
+	writer := newFakeWriter(0)
+	k, err := newKafka(config.KafkaConfig{Async: true, BatchSize: 3, BatchTimeout: time.Hour}, testCodec(t, ""), writer)
+	require.NoError(t, err)
+	k.start()
+
+	events := newEvents(7)
+	require.NoError(t, k.Publish(context.Background(), events...))
+
+	<-writer.written
+	<-writer.written
+	require.Equal(t, []int{3, 3}, writer.sizes())
+
+	// оставшееся в очереди записывается при закрытии
+	k.Close()
+	require.Equal(t, []int{3, 3, 1}, writer.sizes())
+
+	// ключ - ID слота, порядок событий сохраняется, событие - protobuf по схеме
+	for idx, batch := range writer.batches {
+		for pos, message := range batch {
+			require.Equal(t, events[idx*3+pos].SlotID, string(message.Key))
+			require.Equal(t, []kafka.Header{
+				{Key: ContentTypeHeader, Value: []byte(codec.ContentTypeProtobuf)},
+				{Key: SchemaVersionHeader, Value: []byte("1")},
+			}, message.Headers)
+			require.Equal(t, events[idx*3+pos], decodeEvent(t, codec.ContentTypeProtobuf, message.Value))
+		}
+	}
+
+	stats := k.Stats()
+	require.Equal(t, int64(7), stats.Published)
+	require.Zero(t, stats.Queued)
+	require.ErrorIs(t, k.Publish(context.Background(), events[0]), ErrClosed)
+}
+
+func TestKafkaBatchByTimeout(t *testing.T) {
+	writer := newFakeWriter(0)
+	conf := config.KafkaConfig{Async: true, BatchSize: 100, BatchTimeout: 10 * time.Millisecond}
+	k, err := newKafka(conf, testCodec(t, ""), writer)
+	require.NoError(t, err)
+	k.start()
+	defer k.Close()
+
+	require.NoError(t, k.Publish(context.Background(), newEvents(2)...))
+
+	select {
+	case <-writer.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch is not written after batchTimeout")
+	}
+	require.Equal(t, []int{2}, writer.sizes())
+	require.Greater(t, k.Stats().LagSeconds, 0.0)
+}
+
+func TestKafkaPartitionKey(t *testing.T) {
+	event := newEvents(1)[0]
+
+	tests := []struct {
+		partitionKey string
+		key          []byte
+	}{
+		{partitionKey: "", key: []byte(event.SlotID)},
+		{partitionKey: config.KafkaPartitionBySlot, key: []byte(event.SlotID)},
+		{partitionKey: config.KafkaPartitionByBanner, key: []byte(event.BannerID)},
+		{partitionKey: config.KafkaPartitionNone, key: nil},
+	}
+
+	for _, tt := range tests {
+		writer := newFakeWriter(0)
+		k, err := newKafka(config.KafkaConfig{PartitionKey: tt.partitionKey}, testCodec(t, ""), writer)
+		require.NoError(t, err)
+
+		require.NoError(t, k.Publish(context.Background(), event))
+		require.Equal(t, tt.key, writer.batches[0][0].Key, tt.partitionKey)
+	}
+}
+
+func TestKafkaRetry(t *testing.T) {
+	conf := config.KafkaConfig{MaxAttempts: 3, RetryBackoff: time.Millisecond}
+
+	writer := newFakeWriter(2)
+	k, err := newKafka(conf, testCodec(t, ""), writer)
+	require.NoError(t, err)
+
+	require.NoError(t, k.Publish(context.Background(), newEvents(2)...))
+	stats := k.Stats()
+	require.Equal(t, int64(2), stats.Retries)
+	require.Equal(t, int64(2), stats.Published)
+	require.Zero(t, stats.Failed)
+
+	writer.failures = 3
+	require.Error(t, k.Publish(context.Background(), newEvents(1)...))
+	stats = k.Stats()
+	require.Equal(t, int64(4), stats.Retries)
+	require.Equal(t, int64(1), stats.Failed)
+	require.Equal(t, "kafka is down", stats.LastError)
+}
+
+func TestKafkaQueueFull(t *testing.T) {
+	// отправка не запущена: очередь не разбирается
+	conf := config.KafkaConfig{Async: true, QueueSize: 2, QueuePolicy: config.KafkaQueueDrop}
+	k, err := newKafka(conf, testCodec(t, ""), newFakeWriter(0))
+	require.NoError(t, err)
+
+	// пачка больше очереди отбрасывается целиком
+	require.ErrorIs(t, k.Publish(context.Background(), newEvents(3)...), ErrQueueFull)
+	stats := k.Stats()
+	require.Zero(t, stats.Queued)
+	require.Equal(t, 2, stats.QueueCapacity)
+	require.Equal(t, int64(3), stats.Dropped)
+
+	conf.QueuePolicy = config.KafkaQueueBlock
+	k, err = newKafka(conf, testCodec(t, ""), newFakeWriter(0))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, k.Publish(ctx, newEvents(3)...), context.DeadlineExceeded)
+	require.Zero(t, k.Stats().Dropped)
+}
+
+func TestKafkaQueueAlmostFull(t *testing.T) {
+	conf := config.KafkaConfig{Async: true, QueueSize: 4, QueuePolicy: config.KafkaQueueDrop}
+	k, err := newKafka(conf, testCodec(t, ""), newFakeWriter(0))
+	require.NoError(t, err)
+
+	require.NoError(t, k.Publish(context.Background(), newEvents(3)...))
+
+	// показ и переход не ставятся в очередь по отдельности: место есть только для одного
+	require.ErrorIs(t, k.Publish(context.Background(), newEvents(2)...), ErrQueueFull)
+	stats := k.Stats()
+	require.Equal(t, 3, stats.Queued)
+	require.Equal(t, int64(2), stats.Dropped)
+
+	require.NoError(t, k.Publish(context.Background(), newEvents(1)...))
+	require.Equal(t, 4, k.Stats().Queued)
+}
+
+func TestKafkaQueueBlockBatch(t *testing.T) {
+	// отправка не запущена: очередь не разбирается
+	conf := config.KafkaConfig{Async: true, QueueSize: 4, QueuePolicy: config.KafkaQueueBlock}
+	writer := newFakeWriter(0)
+	k, err := newKafka(conf, testCodec(t, ""), writer)
+	require.NoError(t, err)
+
+	require.NoError(t, k.Publish(context.Background(), newEvents(3)...))
+
+	// место есть только для одного события из двух: отмена не оставляет в очереди часть пачки
+	ctx, cancel := context.WithCancel(context.Background())
+	published := make(chan error, 1)
+	go func() { published <- k.Publish(ctx, newEvents(2)...) }()
+
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 3, k.Stats().Queued)
+	cancel()
+	require.ErrorIs(t, <-published, context.Canceled)
+	require.Equal(t, 3, k.Stats().Queued)
+
+	// ждущая пачка ставится в очередь целиком, когда run освобождает место
+	go func() { published <- k.Publish(context.Background(), newEvents(2)...) }()
+	time.Sleep(20 * time.Millisecond)
+	k.start()
+	require.NoError(t, <-published)
+	k.Close()
+
+	total := 0
+	for _, size := range writer.sizes() {
+		total += size
+	}
+	require.Equal(t, 5, total)
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// Publisher отправляет записанные события показов и переходов во внешнюю систему.
+type Publisher interface {
+	Connect(ctx context.Context) error
+	Close()
+	// Publish отправляет события по порядку, ошибка - ни одно событие не считается отправленным.
+	Publish(ctx context.Context, events ...storage.Event) error
+}
+
+// New - отправка событий по настройкам events (и kafka для events.publisher: kafka).
+func New(conf config.Config) (Publisher, error) {
+	instanceID := conf.Events.InstanceID
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
+
+	eventCodec, err := codec.New(conf.Events.Format, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch Name(conf) {
+	case config.EventsPublisherKafka:
+		return NewKafka(conf.Kafka, eventCodec)
+	case config.EventsPublisherFile:
+		return NewFile(conf.Events.File, eventCodec), nil
+	case config.EventsPublisherWebhook:
+		return NewWebhook(conf.Events.Webhook, eventCodec), nil
+	case config.EventsPublisherNone:
+		return Nop{}, nil
+	default:
+		return nil, fmt.Errorf("unknown events publisher %q", conf.Events.Publisher)
+	}
+}
+
+// Name - выбранная отправка событий с учетом kafka.use для пустого events.publisher.
+func Name(conf config.Config) string {
+	if conf.Events.Publisher != "" {
+		return conf.Events.Publisher
+	}
+	if conf.Kafka.Use {
+		return config.EventsPublisherKafka
+	}
+	return config.EventsPublisherNone
+}
+
+// Stats - статистика отправки событий.
+type Stats struct {
+	Queued        int     `json:"queued"`        // событий в очереди
+	QueueCapacity int     `json:"queueCapacity"` // размер очереди
+	LagSeconds    float64 `json:"lagSeconds"`    // от постановки в очередь до записи для последней пачки
+	Published     int64   `json:"published"`     // отправлено событий
+	Retries       int64   `json:"retries"`       // повторов записи
+	Failed        int64   `json:"failed"`        // не отправлено после всех попыток
+	Dropped       int64   `json:"dropped"`       // отброшено при заполненной очереди
+	LastError     string  `json:"lastError,omitempty"`
+}
+
+// StatsReporter - отправка, которая ведет статистику.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// StatsOnly - для хранилища, которое отправляет события через p само (outbox): Publish
+// ничего не делает, подключает и закрывает p хранилище, Stats - статистика p.
+func StatsOnly(p Publisher) Publisher {
+	return statsOnly{p}
+}
+
+type statsOnly struct {
+	publisher Publisher
+}
+
+func (statsOnly) Connect(context.Context) error { return nil }
+
+func (statsOnly) Close() {}
+
+func (statsOnly) Publish(context.Context, ...storage.Event) error { return nil }
+
+func (s statsOnly) Stats() Stats {
+	if reporter, ok := s.publisher.(StatsReporter); ok {
+		return reporter.Stats()
+	}
+	return Stats{}
+}
+
+// Nop - события никуда не отправляются.
+type Nop struct{}
+
+func (Nop) Connect(context.Context) error { return nil }
+
+func (Nop) Close() {}
+
+func (Nop) Publish(context.Context, ...storage.Event) error { return nil }
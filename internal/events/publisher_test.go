@@ -0,0 +1,179 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvents() []storage.Event {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return []storage.Event{
+		{
+			ID: storage.NewID(), SlotID: storage.NewID(), BannerID: storage.NewID(), SegmentID: storage.NewID(),
+			Action: storage.Show, Date: date, ImpressionID: storage.NewID(),
+		},
+		{
+			ID: storage.NewID(), SlotID: storage.NewID(), BannerID: storage.NewID(), SegmentID: storage.NewID(),
+			Action: storage.Click, Date: date,
+		},
+	}
+}
+
+func testCodec(t *testing.T, format string) *codec.Codec {
+	t.Helper()
+
+	eventCodec, err := codec.New(format, "test")
+	require.NoError(t, err)
+	return eventCodec
+}
+
+// decodeEvent декодирует событие и проверяет поля схемы.
+func decodeEvent(t *testing.T, contentType string, data []byte) storage.Event {
+	t.Helper()
+
+	envelope, err := codec.Decode(contentType, data)
+	require.NoError(t, err)
+	require.Equal(t, uint32(codec.SchemaVersion), envelope.SchemaVersion)
+	require.Equal(t, "test", envelope.InstanceID)
+	return envelope.Event
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.Config
+		want Publisher
+	}{
+		{name: "default", conf: config.Config{}, want: Nop{}},
+		{name: "kafka.use", conf: config.Config{Kafka: config.KafkaConfig{Use: true}}, want: &Kafka{}},
+		{
+			name: "none with kafka.use",
+			conf: config.Config{
+				Kafka:  config.KafkaConfig{Use: true},
+				Events: config.EventsConfig{Publisher: config.EventsPublisherNone},
+			},
+			want: Nop{},
+		},
+		{
+			name: "file",
+			conf: config.Config{Events: config.EventsConfig{Publisher: config.EventsPublisherFile}},
+			want: &File{},
+		},
+		{
+			name: "webhook",
+			conf: config.Config{Events: config.EventsConfig{Publisher: config.EventsPublisherWebhook}},
+			want: &Webhook{},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			publisher, err := New(tt.conf)
+			require.NoError(t, err)
+			require.IsType(t, tt.want, publisher)
+		})
+	}
+
+	_, err := New(config.Config{Events: config.EventsConfig{Publisher: "unknown"}})
+	require.Error(t, err)
+}
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	events := testEvents()
+
+	publisher := NewFile(config.FileConfig{Path: path}, testCodec(t, codec.FormatJSON))
+	require.NoError(t, publisher.Connect(ctx))
+	require.NoError(t, publisher.Publish(ctx, events[0]))
+	require.NoError(t, publisher.Publish(ctx, events[1:]...))
+	publisher.Close()
+
+	// после перезапуска события дописываются
+	publisher = NewFile(config.FileConfig{Path: path}, testCodec(t, codec.FormatJSON))
+	require.NoError(t, publisher.Connect(ctx))
+	require.NoError(t, publisher.Publish(ctx, events[0]))
+	publisher.Close()
+
+	require.ErrorIs(t, publisher.Publish(ctx, events[0]), os.ErrClosed)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var written []storage.Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		written = append(written, decodeEvent(t, codec.ContentTypeJSON, scanner.Bytes()))
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, append(events, events[0]), written)
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	events := testEvents()
+
+	// запросы приходят в другой горутине: тело и заголовок передаются через канал
+	type request struct {
+		method        string
+		contentType   string
+		schemaVersion string
+		body          []byte
+	}
+	requests := make(chan request, 2)
+	var status int32 = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{
+			method:        r.Method,
+			contentType:   r.Header.Get("Content-Type"),
+			schemaVersion: r.Header.Get(SchemaVersionHeader),
+			body:          body,
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	eventCodec := testCodec(t, codec.FormatProtobuf)
+	require.Error(t, NewWebhook(config.WebhookConfig{}, eventCodec).Connect(ctx))
+
+	// webhook отправляет JSON при любом формате
+	publisher := NewWebhook(config.WebhookConfig{URL: srv.URL, Timeout: time.Second}, eventCodec)
+	require.NoError(t, publisher.Connect(ctx))
+	defer publisher.Close()
+
+	require.NoError(t, publisher.Publish(ctx, events...))
+
+	req := <-requests
+	require.Equal(t, http.MethodPost, req.method)
+	require.Equal(t, codec.ContentTypeJSON, req.contentType)
+	require.Equal(t, "1", req.schemaVersion)
+
+	var batch []json.RawMessage
+	require.NoError(t, json.Unmarshal(req.body, &batch))
+	received := make([]storage.Event, 0, len(batch))
+	for _, message := range batch {
+		received = append(received, decodeEvent(t, codec.ContentTypeJSON, message))
+	}
+	require.Equal(t, events, received)
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	require.Error(t, publisher.Publish(ctx, events[0]))
+	<-requests
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events/codec"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// Webhook отправляет события POST-запросом на webhook.url: JSON-массив событий по схеме событий,
+// ответ не 2xx - ошибка.
+type Webhook struct {
+	url    string
+	client *http.Client
+	codec  *codec.Codec
+}
+
+func NewWebhook(conf config.WebhookConfig, eventCodec *codec.Codec) *Webhook {
+	return &Webhook{url: conf.URL, client: &http.Client{Timeout: conf.Timeout}, codec: eventCodec}
+}
+
+func (w *Webhook) Connect(context.Context) error {
+	if w.url == "" {
+		return fmt.Errorf("events webhook url is empty")
+	}
+	return nil
+}
+
+func (w *Webhook) Close() {
+	w.client.CloseIdleConnections()
+}
+
+func (w *Webhook) Publish(ctx context.Context, events ...storage.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	batch := make([]json.RawMessage, 0, len(events))
+	for _, event := range events {
+		message, err := w.codec.EncodeJSON(event)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, message)
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", codec.ContentTypeJSON)
+	req.Header.Set(SchemaVersionHeader, strconv.Itoa(codec.SchemaVersion))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("events webhook status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -5,10 +5,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/storage"
 )
 
 type Client struct {
@@ -16,6 +23,60 @@ type Client struct {
 	timeout time.Duration
 }
 
+// RequestOption - дополнительный параметр запроса (передается в query string).
+type RequestOption func(query url.Values)
+
+// WithFeatures - признаки запроса для контекстного алгоритма.
+func WithFeatures(features []float64) RequestOption {
+	return func(query url.Values) {
+		items := make([]string, 0, len(features))
+		for _, feature := range features {
+			items = append(items, strconv.FormatFloat(feature, 'g', -1, 64))
+		}
+		query.Set("features", strings.Join(items, ","))
+	}
+}
+
+// WithPreview - выбрать баннер без записи показа.
+func WithPreview() RequestOption {
+	return func(query url.Values) {
+		query.Set("preview", "true")
+	}
+}
+
+// WithPixel - показ засчитывается при загрузке пикселя (Client.Pixel), а не при выборе баннера.
+func WithPixel() RequestOption {
+	return func(query url.Values) {
+		query.Set("pixel", "true")
+	}
+}
+
+// WithCreative - вместе с ID вернуть баннер с содержимым (ResponseChoice.Creative).
+func WithCreative() RequestOption {
+	return func(query url.Values) {
+		query.Set("creative", "true")
+	}
+}
+
+// WithToken - подписанный токен перехода из ChoiceImpression.
+func WithToken(token string) RequestOption {
+	return func(query url.Values) {
+		query.Set("token", token)
+	}
+}
+
+func withOptions(rawURL string, opts []RequestOption) string {
+	if len(opts) == 0 {
+		return rawURL
+	}
+
+	query := url.Values{}
+	for _, opt := range opts {
+		opt(query)
+	}
+	return rawURL + "?" + query.Encode()
+}
+
 func NewClient(host string, port string, timeout time.Duration) *Client {
 	return &Client{net.JoinHostPort(host, port), timeout}
 }
@@ -49,6 +110,16 @@ func (c *Client) CreateBanner(description string) (string, error) {
 	return c.CreateItem(Banner, description)
 }
 
+// CreateBannerWithTargetURL - баннер с адресом перехода для /c/{token}.
+func (c *Client) CreateBannerWithTargetURL(description, targetURL string) (string, error) {
+	return c.CreateBannerWithCreative(description, storage.Creative{TargetURL: targetURL})
+}
+
+// CreateBannerWithCreative - баннер с содержимым для показа.
+func (c *Client) CreateBannerWithCreative(description string, creative storage.Creative) (string, error) {
+	return c.createItem(Banner, BannerDescription{Description: description, Creative: creative})
+}
+
 func (c *Client) CreateSlot(description string) (string, error) {
 	return c.CreateItem(Slot, description)
 }
@@ -58,7 +129,10 @@ func (c *Client) CreateSegment(description string) (string, error) {
 }
 
 func (c *Client) CreateItem(item ItemType, description string) (string, error) {
-	desc := Description{Description: description}
+	return c.createItem(item, Description{Description: description})
+}
+
+func (c *Client) createItem(item ItemType, desc interface{}) (string, error) {
 	b, err := json.Marshal(desc)
 	if err != nil {
 		return "", err
@@ -150,8 +224,8 @@ func (c *Client) DeleteRotation(slotID, bannerID string) error {
 	return nil
 }
 
-func (c *Client) Click(slotID, bannerID, segmentID string) error {
-	url := "http://" + c.addr + "/click/" + slotID + "/" + bannerID + "/" + segmentID
+func (c *Client) Click(slotID, bannerID, segmentID string, opts ...RequestOption) error {
+	url := withOptions("http://"+c.addr+"/click/"+slotID+"/"+bannerID+"/"+segmentID, opts)
 
 	req, err := http.NewRequestWithContext(context.Background(), "POST", url, nil)
 	if err != nil {
@@ -172,42 +246,194 @@ func (c *Client) Click(slotID, bannerID, segmentID string) error {
 	return nil
 }
 
-func (c *Client) Choice(slotID, segmentID string) (string, error) {
-	url := "http://" + c.addr + "/choice/" + slotID + "/" + segmentID
+// ClickImpression засчитывает переход по ID показа или по подписанному токену из ChoiceImpression.
+func (c *Client) ClickImpression(impressionID string, opts ...RequestOption) error {
+	url := withOptions("http://"+c.addr+"/click/"+impressionID, opts)
 
 	req, err := http.NewRequestWithContext(context.Background(), "POST", url, nil)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	client := &http.Client{Timeout: c.timeout}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error when counting click for the impression: %s", resp.Status)
+	}
+	return nil
+}
+
+// Pixel загружает пиксель показа по токену (или ID показа) из ChoiceImpression.
+func (c *Client) Pixel(token string) error {
+	req, err := http.NewRequestWithContext(context.Background(), "GET", "http://"+c.addr+"/i/"+token+".gif", nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error when loading pixel: %s", resp.Status)
+	}
+	return nil
+}
+
+// Redirect засчитывает переход по токену (или ID показа) и возвращает адрес, на который перенаправляет сервис.
+func (c *Client) Redirect(token string) (string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "GET", "http://"+c.addr+"/c/"+token, nil)
 	if err != nil {
 		return "", err
 	}
 
-	responseID := ResponseID{}
-	err = json.Unmarshal(body, &responseID)
+	client := &http.Client{
+		Timeout: c.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		return "", fmt.Errorf("error when following banner: %s", resp.Status)
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+func (c *Client) Choice(slotID, segmentID string, opts ...RequestOption) (string, error) {
+	choice, err := c.ChoiceImpression(slotID, segmentID, opts...)
+	if err != nil {
+		return "", err
+	}
+	return choice.ID, nil
+}
+
+// ChoiceImpression - выбранный баннер вместе с ID показа для ClickImpression.
+func (c *Client) ChoiceImpression(slotID, segmentID string, opts ...RequestOption) (ResponseChoice, error) {
+	url := withOptions("http://"+c.addr+"/choice/"+slotID+"/"+segmentID, opts)
+
+	req, err := http.NewRequestWithContext(context.Background(), "POST", url, nil)
+	if err != nil {
+		return ResponseChoice{}, err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ResponseChoice{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ResponseChoice{}, err
+	}
+
+	choice := ResponseChoice{}
+	err = json.Unmarshal(body, &choice)
+	if err != nil {
+		return ResponseChoice{}, err
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("error getting banner to show")
+		return ResponseChoice{}, errors.New("error getting banner to show")
 	}
-	return responseID.ID, nil
+	return choice, nil
+}
+
+func (c *Client) Explain(slotID, segmentID string, opts ...RequestOption) (core.Explanation, error) {
+	url := withOptions("http://"+c.addr+"/choice/"+slotID+"/"+segmentID+"/explain", opts)
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", url, nil)
+	if err != nil {
+		return core.Explanation{}, err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return core.Explanation{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return core.Explanation{}, err
+	}
+
+	explanation := core.Explanation{}
+	err = json.Unmarshal(body, &explanation)
+	if err != nil {
+		return core.Explanation{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return core.Explanation{}, errors.New("error getting banner choice explanation")
+	}
+	return explanation, nil
+}
+
+// GetCreative - баннер с содержимым для показа.
+func (c *Client) GetCreative(bannerID string) (storage.Banner, error) {
+	url := "http://" + c.addr + "/creative/" + bannerID
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", url, nil)
+	if err != nil {
+		return storage.Banner{}, err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return storage.Banner{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return storage.Banner{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return storage.Banner{}, fmt.Errorf("error getting banner creative: %s", resp.Status)
+	}
+
+	banner := storage.Banner{}
+	err = json.Unmarshal(body, &banner)
+	if err != nil {
+		return storage.Banner{}, err
+	}
+	return banner, nil
 }
 
 func (c *Client) GetStat(bannerID, segmentID string) (ResponseStat, error) {
-	url := "http://" + c.addr + "/stat/" + bannerID + "/" + segmentID
+	return c.getStat("http://" + c.addr + "/stat/" + bannerID + "/" + segmentID)
+}
+
+func (c *Client) GetSlotStat(slotID, bannerID, segmentID string) (ResponseStat, error) {
+	return c.getStat("http://" + c.addr + "/stat/" + slotID + "/" + bannerID + "/" + segmentID)
+}
 
+func (c *Client) getStat(url string) (ResponseStat, error) {
 	req, err := http.NewRequestWithContext(context.Background(), "GET", url, nil)
 	if err != nil {
 		return ResponseStat{}, err
@@ -237,3 +463,221 @@ func (c *Client) GetStat(bannerID, segmentID string) (ResponseStat, error) {
 	}
 	return responseStat, nil
 }
+
+func (c *Client) SetSegmentFeatures(segmentID string, features []float64) error {
+	b, err := json.Marshal(Features{Features: features})
+	if err != nil {
+		return err
+	}
+
+	url := "http://" + c.addr + "/features/" + segmentID
+
+	req, err := http.NewRequestWithContext(context.Background(), "PUT", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("error while setting segment features")
+	}
+	return nil
+}
+
+func (c *Client) GetSegmentFeatures(segmentID string) ([]float64, error) {
+	url := "http://" + c.addr + "/features/" + segmentID
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	features := Features{}
+	err = json.Unmarshal(body, &features)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("error while getting segment features")
+	}
+	return features.Features, nil
+}
+
+func (c *Client) GetBanner(bannerID string) (storage.Banner, error) {
+	banner := storage.Banner{}
+	err := c.doItem("GET", c.itemURL(Banner, bannerID), nil, &banner)
+	return banner, err
+}
+
+func (c *Client) GetSlot(slotID string) (storage.Slot, error) {
+	slot := storage.Slot{}
+	err := c.doItem("GET", c.itemURL(Slot, slotID), nil, &slot)
+	return slot, err
+}
+
+func (c *Client) GetSegment(segmentID string) (storage.Segment, error) {
+	segment := storage.Segment{}
+	err := c.doItem("GET", c.itemURL(Segment, segmentID), nil, &segment)
+	return segment, err
+}
+
+// UpdateBanner изменяет только переданные поля (description, format, targetUrl и т.д.).
+func (c *Client) UpdateBanner(bannerID string, fields map[string]interface{}) (storage.Banner, error) {
+	banner := storage.Banner{}
+	err := c.doItem("PATCH", c.itemURL(Banner, bannerID), fields, &banner)
+	return banner, err
+}
+
+func (c *Client) UpdateSlot(slotID string, fields map[string]interface{}) (storage.Slot, error) {
+	slot := storage.Slot{}
+	err := c.doItem("PATCH", c.itemURL(Slot, slotID), fields, &slot)
+	return slot, err
+}
+
+func (c *Client) UpdateSegment(segmentID string, fields map[string]interface{}) (storage.Segment, error) {
+	segment := storage.Segment{}
+	err := c.doItem("PATCH", c.itemURL(Segment, segmentID), fields, &segment)
+	return segment, err
+}
+
+func (c *Client) DeleteBanner(bannerID string) error {
+	return c.doItem("DELETE", c.itemURL(Banner, bannerID), nil, nil)
+}
+
+func (c *Client) DeleteSlot(slotID string) error {
+	return c.doItem("DELETE", c.itemURL(Slot, slotID), nil, nil)
+}
+
+func (c *Client) DeleteSegment(segmentID string) error {
+	return c.doItem("DELETE", c.itemURL(Segment, segmentID), nil, nil)
+}
+
+// ListBanners возвращает страницу баннеров и общее количество найденных, limit 0 - по умолчанию сервера.
+func (c *Client) ListBanners(search string, offset, limit int) ([]storage.Banner, int, error) {
+	banners := make([]storage.Banner, 0)
+	list := ResponseList{Items: &banners}
+	err := c.doItem("GET", c.listURL(Banner, search, offset, limit), nil, &list)
+	return banners, list.Total, err
+}
+
+func (c *Client) ListSlots(search string, offset, limit int) ([]storage.Slot, int, error) {
+	slots := make([]storage.Slot, 0)
+	list := ResponseList{Items: &slots}
+	err := c.doItem("GET", c.listURL(Slot, search, offset, limit), nil, &list)
+	return slots, list.Total, err
+}
+
+func (c *Client) ListSegments(search string, offset, limit int) ([]storage.Segment, int, error) {
+	segments := make([]storage.Segment, 0)
+	list := ResponseList{Items: &segments}
+	err := c.doItem("GET", c.listURL(Segment, search, offset, limit), nil, &list)
+	return segments, list.Total, err
+}
+
+func (c *Client) itemURL(item ItemType, id string) string {
+	return "http://" + c.addr + "/" + itemPath(item) + "/" + url.PathEscape(id)
+}
+
+func (c *Client) listURL(item ItemType, search string, offset, limit int) string {
+	query := url.Values{}
+	if search != "" {
+		query.Set("search", search)
+	}
+	if offset > 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	rawURL := "http://" + c.addr + "/" + itemPath(item)
+	if len(query) == 0 {
+		return rawURL
+	}
+	return rawURL + "?" + query.Encode()
+}
+
+// doItem отправляет запрос с body в JSON (если не nil) и разбирает ответ в result (если не nil).
+func (c *Client) doItem(method, rawURL string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), method, rawURL, reader)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: c.timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error while %s %s: %s", method, rawURL, resp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, result)
+}
+
+func itemPath(item ItemType) string {
+	switch item {
+	case Banner:
+		return "banner"
+	case Slot:
+		return "slot"
+	default:
+		return "segment"
+	}
+}
+
+func (c *Client) GetRotation(slotID string) ([]string, error) {
+	rotation := Rotation{}
+	err := c.doItem("GET", "http://"+c.addr+"/rotation/"+url.PathEscape(slotID), nil, &rotation)
+	return rotation.BannerIDs, err
+}
+
+// ReplaceRotation заменяет набор баннеров слота и возвращает добавленные и удаленные баннеры.
+func (c *Client) ReplaceRotation(slotID string, bannerIDs []string) (storage.RotationDiff, error) {
+	diff := storage.RotationDiff{}
+	rawURL := "http://" + c.addr + "/rotation/" + url.PathEscape(slotID)
+	err := c.doItem("PUT", rawURL, &Rotation{BannerIDs: bannerIDs}, &diff)
+	return diff, err
+}
@@ -1,15 +1,21 @@
 package internalhttp
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/astrviktor/banner-rotation/internal/clicktoken"
 	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/events"
 	"github.com/astrviktor/banner-rotation/internal/storage"
 )
 
@@ -17,6 +23,12 @@ type Description struct {
 	Description string `json:"description"`
 }
 
+// BannerDescription - описание баннера вместе с содержимым для показа.
+type BannerDescription struct {
+	Description string `json:"description"`
+	storage.Creative
+}
+
 type ResponseError struct {
 	Error string `json:"error"`
 }
@@ -25,11 +37,28 @@ type ResponseID struct {
 	ID string `json:"id"`
 }
 
+// ResponseChoice - выбранный баннер и ID показа для засчитывания перехода (пустой при предпросмотре).
+type ResponseChoice struct {
+	ID           string          `json:"id"`
+	ImpressionID string          `json:"impressionId,omitempty"`
+	Token        string          `json:"token,omitempty"`    // подписанный токен перехода, если заданы click.keys
+	Creative     *storage.Banner `json:"creative,omitempty"` // баннер с содержимым, если запрошен ?creative=true
+}
+
+// Rotation - баннеры в ротации слота.
+type Rotation struct {
+	BannerIDs []string `json:"bannerIds"`
+}
+
 type ResponseStat struct {
 	ShowCount  int `json:"showCount"`
 	ClickCount int `json:"clickCount"`
 }
 
+type Features struct {
+	Features []float64 `json:"features"`
+}
+
 func WriteResponse(w http.ResponseWriter, resp interface{}) {
 	resBuf, err := json.Marshal(resp)
 	if err != nil {
@@ -49,27 +78,6 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	_, _ = io.WriteString(w, "OK")
 }
 
-func (s *Server) handleCreateBanner(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		s.CreateItem(Banner, w, r)
-		return
-	}
-}
-
-func (s *Server) handleCreateSlot(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		s.CreateItem(Slot, w, r)
-		return
-	}
-}
-
-func (s *Server) handleCreateSegment(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		s.CreateItem(Segment, w, r)
-		return
-	}
-}
-
 /*
 curl --request POST 'http://127.0.0.1:8888/banner' \
 --header 'Content-Type: application/json' \
@@ -89,6 +97,8 @@ curl --request POST 'http://127.0.0.1:8888/segment' \
 */
 
 func (s *Server) CreateItem(item ItemType, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	buf := make([]byte, r.ContentLength)
 	_, err := r.Body.Read(buf)
 	if err != nil && !errors.Is(err, io.EOF) {
@@ -97,25 +107,34 @@ func (s *Server) CreateItem(item ItemType, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	description := Description{}
+	// содержимое учитывается только для баннера
+	description := BannerDescription{}
 	if err = json.Unmarshal(buf, &description); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		WriteResponse(w, &ResponseError{fmt.Sprintf("error while converting data from request %s", err)})
 		return
 	}
 
+	if item == Banner {
+		if err = description.Creative.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteResponse(w, &ResponseError{fmt.Sprintf("error while converting data from request %s", err)})
+			return
+		}
+	}
+
 	var id string
 	switch item {
 	case Banner:
-		id, err = s.storage.CreateBanner(description.Description)
+		id, err = s.storage.CreateBannerWithCreative(ctx, description.Description, description.Creative)
 	case Slot:
-		id, err = s.storage.CreateSlot(description.Description)
+		id, err = s.storage.CreateSlot(ctx, description.Description)
 	case Segment:
-		id, err = s.storage.CreateSegment(description.Description)
+		id, err = s.storage.CreateSegment(ctx, description.Description)
 	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(errorStatus(err))
 		WriteResponse(w, &ResponseError{fmt.Sprintf("error while creating %s", err)})
 		return
 	}
@@ -125,6 +144,16 @@ func (s *Server) CreateItem(item ItemType, w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) handleRotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.GetRotation(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		s.ReplaceRotation(w, r)
+		return
+	}
+
 	if r.Method == http.MethodPost {
 		s.CreateRotation(w, r)
 		return
@@ -137,6 +166,11 @@ func (s *Server) handleRotation(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleClick(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && len(strings.Split(r.URL.Path, "/")) == 3 {
+		s.ClickImpression(w, r)
+		return
+	}
+
 	if r.Method == http.MethodPost {
 		s.Click(w, r)
 	}
@@ -145,6 +179,42 @@ func (s *Server) handleClick(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleChoice(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		s.Choice(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/explain") {
+		s.Explain(w, r)
+		return
+	}
+}
+
+func (s *Server) handlePixel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.Pixel(w, r)
+	}
+}
+
+func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.Redirect(w, r)
+	}
+}
+
+func (s *Server) handleCreative(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.Creative(w, r)
+	}
+}
+
+func (s *Server) handleFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		s.SetFeatures(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.GetFeatures(w, r)
+		return
 	}
 }
 
@@ -154,9 +224,90 @@ func (s *Server) handleStat(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleEventsStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.EventsStats(w, r)
+	}
+}
+
+// curl --request GET 'http://127.0.0.1:8888/rotation/1'
+
+func (s *Server) GetRotation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	slotID := params[2]
+
+	if _, err := s.storage.GetSlot(ctx, slotID); err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error getting rotation %s", err)})
+		return
+	}
+
+	bannerIDs, err := s.storage.GetBannersForSlot(ctx, slotID)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error getting rotation %s", err)})
+		return
+	}
+
+	if bannerIDs == nil {
+		bannerIDs = []string{}
+	}
+	sort.Strings(bannerIDs)
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &Rotation{BannerIDs: bannerIDs})
+}
+
+/*
+curl --request PUT 'http://127.0.0.1:8888/rotation/1' \
+--header 'Content-Type: application/json' \
+--data-raw '{"bannerIds": ["2", "3"]}'
+*/
+
+// ReplaceRotation заменяет набор баннеров слота целиком и возвращает добавленные и удаленные баннеры.
+func (s *Server) ReplaceRotation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	rotation := Rotation{}
+	if err := json.NewDecoder(r.Body).Decode(&rotation); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while converting data from request %s", err)})
+		return
+	}
+
+	diff, err := s.storage.ReplaceRotations(ctx, params[2], rotation.BannerIDs)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error replacing rotation %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &diff)
+}
+
 // curl --request POST 'http://127.0.0.1:8888/rotation/1/2'
 
 func (s *Server) CreateRotation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	path := r.URL.Path
 	params := strings.Split(path, "/")
 	if len(params) != 4 {
@@ -170,9 +321,9 @@ func (s *Server) CreateRotation(w http.ResponseWriter, r *http.Request) {
 		BannerID: params[3],
 	}
 
-	err := s.storage.CreateRotation(rotation)
+	err := s.storage.CreateRotation(ctx, rotation)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
 		WriteResponse(w, &ResponseError{fmt.Sprintf("error creating rotation %s", err)})
 		return
 	}
@@ -183,6 +334,8 @@ func (s *Server) CreateRotation(w http.ResponseWriter, r *http.Request) {
 // curl --request DELETE 'http://127.0.0.1:8888/rotation/1/2'
 
 func (s *Server) DeleteRotation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	path := r.URL.Path
 	params := strings.Split(path, "/")
 	if len(params) != 4 {
@@ -196,9 +349,9 @@ func (s *Server) DeleteRotation(w http.ResponseWriter, r *http.Request) {
 		BannerID: params[3],
 	}
 
-	err := s.storage.DeleteRotation(rotation)
+	err := s.storage.DeleteRotation(ctx, rotation)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
 		WriteResponse(w, &ResponseError{fmt.Sprintf("error deleting rotation %s", err)})
 		return
 	}
@@ -206,9 +359,11 @@ func (s *Server) DeleteRotation(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// curl --request POST 'http://127.0.0.1:8888/click/1/2/3'
+// curl --request POST 'http://127.0.0.1:8888/click/1/2/3?features=0.5,1'
 
 func (s *Server) Click(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	path := r.URL.Path
 	params := strings.Split(path, "/")
 	if len(params) != 5 {
@@ -221,9 +376,83 @@ func (s *Server) Click(w http.ResponseWriter, r *http.Request) {
 	bannerID := params[3]
 	segmentID := params[4]
 
-	err := s.storage.CreateEvent(slotID, bannerID, segmentID, storage.Click)
+	features, err := parseFeatures(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	if s.signer != nil {
+		// переход засчитывается только по подписанному токену показа этого же баннера
+		claims, err := s.signer.Verify(r.URL.Query().Get("token"), time.Now())
+		if err == nil && (claims.SlotID != slotID || claims.BannerID != bannerID || claims.SegmentID != segmentID) {
+			err = clicktoken.ErrInvalidToken
+		}
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding click %s", err)})
+			return
+		}
+
+		s.clickImpression(ctx, w, claims.ImpressionID, features)
+		return
+	}
+
+	err = s.storage.CreateEvent(ctx, slotID, bannerID, segmentID, storage.Click)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding click %s", err)})
+		return
+	}
+	s.publishEvents(ctx, newEvent(slotID, bannerID, segmentID, storage.Click))
+
+	err = core.UpdateContext(ctx, s.storage, s.strategies.ForSlot(slotID), bannerID, segmentID, features, storage.Click)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when updating banner model %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// curl --request POST 'http://127.0.0.1:8888/click/1'
+
+func (s *Server) ClickImpression(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	impressionID := params[2]
+
+	features, err := parseFeatures(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	impressionID, err = s.impressionID(impressionID)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding click %s", err)})
+		return
+	}
+
+	s.clickImpression(ctx, w, impressionID, features)
+}
+
+// clickImpression засчитывает переход по показу, повторный переход или переход после срока отклоняется.
+func (s *Server) clickImpression(ctx context.Context, w http.ResponseWriter, impressionID string, features []float64) {
+	if _, err := s.countClick(ctx, impressionID, features); err != nil {
+		w.WriteHeader(errorStatus(err))
 		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding click %s", err)})
 		return
 	}
@@ -231,9 +460,173 @@ func (s *Server) Click(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// curl --request POST 'http://127.0.0.1:8888/choice/1/2'
+// countClick засчитывает переход по показу и обучает модель баннера.
+// Если показ не был засчитан (пиксель не загрузился), он засчитывается вместе с переходом.
+func (s *Server) countClick(ctx context.Context, impressionID string, features []float64) (storage.Impression, error) {
+	// показ засчитан вместе с переходом той же операцией хранилища, что и переход,
+	// поэтому параллельная загрузка пикселя не засчитает его второй раз
+	impression, shown, err := s.storage.ClickImpression(ctx, impressionID)
+	if err != nil {
+		return storage.Impression{}, err
+	}
+
+	click := newEvent(impression.SlotID, impression.BannerID, impression.SegmentID, storage.Click)
+	click.ImpressionID = impression.ID
+	if shown {
+		show := click
+		show.ID = storage.NewID()
+		show.Action = storage.Show
+		s.publishEvents(ctx, show, click)
+	} else {
+		s.publishEvents(ctx, click)
+	}
+
+	strategy := s.strategies.ForSlot(impression.SlotID)
+
+	if shown {
+		err = core.UpdateContext(ctx, s.storage, strategy, impression.BannerID, impression.SegmentID, features, storage.Show)
+		if err != nil {
+			return impression, err
+		}
+	}
+
+	err = core.UpdateContext(ctx, s.storage, strategy, impression.BannerID, impression.SegmentID, features, storage.Click)
+	return impression, err
+}
+
+// impressionID - ID показа из параметра запроса: из подписанного токена, если заданы click.keys, иначе сам параметр.
+func (s *Server) impressionID(param string) (string, error) {
+	if s.signer == nil {
+		return param, nil
+	}
+
+	claims, err := s.signer.Verify(param, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return claims.ImpressionID, nil
+}
+
+// <img src="http://127.0.0.1:8888/i/{token}.gif">
+
+func (s *Server) Pixel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 || !strings.HasSuffix(params[2], ".gif") {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	impressionID, err := s.impressionID(strings.TrimSuffix(params[2], ".gif"))
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding show %s", err)})
+		return
+	}
+
+	impression, err := s.storage.ShowImpression(ctx, impressionID)
+	switch {
+	case err == nil:
+		show := newEvent(impression.SlotID, impression.BannerID, impression.SegmentID, storage.Show)
+		show.ImpressionID = impression.ID
+		s.publishEvents(ctx, show)
+
+		err = core.UpdateContext(ctx, s.storage, s.strategies.ForSlot(impression.SlotID), impression.BannerID,
+			impression.SegmentID, nil, storage.Show)
+		if err != nil {
+			log.Printf("error when updating banner model %s", err)
+		}
+	case errors.Is(err, storage.ErrImpressionShown), errors.Is(err, storage.ErrImpressionExpired),
+		errors.Is(err, storage.ErrImpressionNotFound):
+		// повторная загрузка пикселя не засчитывается, но картинка отдается как обычно
+		log.Printf("show is not counted: %s", err)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding show %s", err)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(pixelGIF); err != nil {
+		log.Println(fmt.Sprintf("response write error: %s", err))
+	}
+}
+
+// redirectClick засчитывает переход по параметру /c/ и возвращает ID баннера для перенаправления.
+// Повторный переход и переход после истечения срока показа не засчитываются,
+// но пользователь все равно попадает на сайт.
+func (s *Server) redirectClick(ctx context.Context, param string) (string, error) {
+	impressionID := param
+	if s.signer != nil {
+		claims, err := s.signer.Verify(param, time.Now())
+		if errors.Is(err, clicktoken.ErrExpiredToken) {
+			log.Printf("click is not counted: %s", err)
+			return claims.BannerID, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		impressionID = claims.ImpressionID
+	}
+
+	impression, err := s.countClick(ctx, impressionID, nil)
+	if errors.Is(err, storage.ErrImpressionClicked) || errors.Is(err, storage.ErrImpressionExpired) {
+		log.Printf("click is not counted: %s", err)
+		impression, err = s.storage.GetImpression(ctx, impressionID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return impression.BannerID, nil
+}
+
+// <a href="http://127.0.0.1:8888/c/{token}">
+
+func (s *Server) Redirect(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	bannerID, err := s.redirectClick(ctx, params[2])
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding click %s", err)})
+		return
+	}
+
+	banner, err := s.storage.GetBanner(ctx, bannerID)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when getting banner %s", err)})
+		return
+	}
+
+	if banner.TargetURL == "" {
+		w.WriteHeader(http.StatusNotFound)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("banner %s has no target url", banner.ID)})
+		return
+	}
+
+	http.Redirect(w, r, banner.TargetURL, http.StatusFound)
+}
+
+// curl --request POST 'http://127.0.0.1:8888/choice/1/2?features=0.5,1'
 
 func (s *Server) Choice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	path := r.URL.Path
 	params := strings.Split(path, "/")
 	if len(params) != 4 {
@@ -245,45 +638,366 @@ func (s *Server) Choice(w http.ResponseWriter, r *http.Request) {
 	slotID := params[2]
 	segmentID := params[3]
 
-	bannerID, err := core.GetBanner(s.storage, slotID, segmentID)
+	features, err := parseFeatures(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	preview, err := parsePreview(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+	if preview {
+		markPreview(ctx)
+	}
+
+	pixel, err := parseBool(r, "pixel")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	creative, err := parseBool(r, "creative")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	strategy := s.strategies.ForSlot(slotID)
+
+	bannerID, err := core.ChooseBanner(ctx, s.storage, strategy, core.ChoiceRequest{
+		SlotID:    slotID,
+		SegmentID: segmentID,
+		Features:  features,
+		PerSlot:   s.strategies.PerSlot(),
+	})
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
 		WriteResponse(w, &ResponseError{fmt.Sprintf("error when choosing a banner to display %s", err)})
 		return
 	}
 
-	err = s.storage.CreateEvent(slotID, bannerID, segmentID, storage.Show)
+	response := ResponseChoice{ID: bannerID}
+	if creative {
+		banner, err := s.storage.GetBanner(ctx, bannerID)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			WriteResponse(w, &ResponseError{fmt.Sprintf("error when getting banner %s", err)})
+			return
+		}
+		response.Creative = &banner
+	}
+
+	if preview {
+		w.WriteHeader(http.StatusOK)
+		WriteResponse(w, &response)
+		return
+	}
+
+	// показ и событие показа записываются одной операцией, для пикселя показ засчитывается при его загрузке
+	impression, err := s.storage.CreateImpression(ctx, slotID, bannerID, segmentID, s.click.ImpressionTTL, !pixel)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding show event: %s", err)})
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when adding impression %s", err)})
+		return
+	}
+
+	if !pixel {
+		show := newEvent(slotID, bannerID, segmentID, storage.Show)
+		show.ImpressionID = impression.ID
+		s.publishEvents(ctx, show)
+
+		// показ уже учтен, ошибка обучения модели не отменяет выбор
+		err = core.UpdateContext(ctx, s.storage, strategy, bannerID, segmentID, features, storage.Show)
+		if err != nil {
+			log.Printf("error when updating banner model %s", err)
+		}
+	}
+
+	response.ImpressionID = impression.ID
+	if s.signer != nil {
+		response.Token, err = s.signer.Sign(clicktoken.Claims{
+			ImpressionID: impression.ID,
+			SlotID:       impression.SlotID,
+			BannerID:     impression.BannerID,
+			SegmentID:    impression.SegmentID,
+			ExpiresAt:    impression.ExpiresAt.Unix(),
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteResponse(w, &ResponseError{fmt.Sprintf("error when signing click token %s", err)})
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &response)
+}
+
+// curl --request GET 'http://127.0.0.1:8888/choice/1/2/explain'
+
+func (s *Server) Explain(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 5 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	slotID := params[2]
+	segmentID := params[3]
+
+	features, err := parseFeatures(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	explanation, err := core.ExplainBanner(ctx, s.storage, s.strategies.ForSlot(slotID), core.ChoiceRequest{
+		SlotID:    slotID,
+		SegmentID: segmentID,
+		Features:  features,
+		PerSlot:   s.strategies.PerSlot(),
+	})
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when explaining a banner choice %s", err)})
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	WriteResponse(w, &ResponseID{ID: bannerID})
+	WriteResponse(w, &explanation)
+}
+
+// curl --request GET 'http://127.0.0.1:8888/creative/1'
+
+func (s *Server) Creative(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	bannerID := params[2]
+
+	banner, err := s.storage.GetBanner(ctx, bannerID)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error when getting banner %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &banner)
+}
+
+// curl --request GET 'http://127.0.0.1:8888/events/stats'
+
+func (s *Server) EventsStats(w http.ResponseWriter, r *http.Request) {
+	stats := events.Stats{}
+	if reporter, ok := s.publisher.(events.StatsReporter); ok {
+		stats = reporter.Stats()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &stats)
 }
 
 // curl --request GET 'http://127.0.0.1:8888/stat/1/2'
+// curl --request GET 'http://127.0.0.1:8888/stat/0/1/2'
 
 func (s *Server) Stat(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	path := r.URL.Path
 	params := strings.Split(path, "/")
-	if len(params) != 4 {
+	if len(params) != 4 && len(params) != 5 {
 		w.WriteHeader(http.StatusBadRequest)
 		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
 		return
 	}
 
-	bannerID := params[2]
-	segmentID := params[3]
+	var stat storage.Stat
+	var err error
+	if len(params) == 4 {
+		stat, err = s.storage.GetStatForBannerAndSegment(ctx, params[2], params[3])
+	} else {
+		stat, err = s.storage.GetStatForSlotBannerAndSegment(ctx, params[2], params[3], params[4])
+	}
 
-	stat, err := s.storage.GetStatForBannerAndSegment(bannerID, segmentID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		WriteResponse(w, &ResponseError{"error while getting statistics"})
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while getting statistics %s", err)})
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	WriteResponse(w, &ResponseStat{ShowCount: stat.ShowCount, ClickCount: stat.ClickCount})
 }
+
+// curl --request PUT 'http://127.0.0.1:8888/features/1' \
+// --header 'Content-Type: application/json' \
+// --data-raw '{"features": [1, 0.25]}'
+
+func (s *Server) SetFeatures(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	features := Features{}
+	if err := json.NewDecoder(r.Body).Decode(&features); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while converting data from request %s", err)})
+		return
+	}
+
+	err := s.storage.SetSegmentFeatures(ctx, params[2], features.Features)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while setting segment features %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// curl --request GET 'http://127.0.0.1:8888/features/1'
+
+func (s *Server) GetFeatures(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	features, err := s.storage.GetSegmentFeatures(ctx, params[2])
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while getting segment features %s", err)})
+		return
+	}
+
+	if features == nil {
+		features = []float64{}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &Features{Features: features})
+}
+
+// parseFeatures - признаки запроса для контекстного алгоритма из параметра features=0.5,1.
+func parseFeatures(r *http.Request) ([]float64, error) {
+	value := r.URL.Query().Get("features")
+	if value == "" {
+		return nil, nil
+	}
+
+	items := strings.Split(value, ",")
+	features := make([]float64, 0, len(items))
+	for _, item := range items {
+		feature, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, fmt.Errorf("features: %w", err)
+		}
+		features = append(features, feature)
+	}
+
+	return features, nil
+}
+
+// parseBool - логический параметр запроса, по умолчанию false.
+func parseBool(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return result, nil
+}
+
+// parsePreview - признак предпросмотра: баннер выбирается, но показ не записывается.
+func parsePreview(r *http.Request) (bool, error) {
+	return parseBool(r, "preview")
+}
+
+// pixelGIF - прозрачная картинка 1x1.
+var pixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// statusClientClosedRequest - клиент отключился, не дождавшись ответа (код nginx, ответ уже никто не прочитает).
+const statusClientClosedRequest = 499
+
+// newEvent - событие, записанное сейчас, с новым ID для дедупликации у получателей.
+func newEvent(slotID, bannerID, segmentID string, action storage.ActionType) storage.Event {
+	return storage.Event{
+		ID:        storage.NewID(),
+		SlotID:    slotID,
+		BannerID:  bannerID,
+		SegmentID: segmentID,
+		Action:    action,
+		Date:      time.Now().UTC(),
+	}
+}
+
+// publishEvents отправляет записанные события, ошибка отправки не отменяет запрос: событие уже учтено.
+func (s *Server) publishEvents(ctx context.Context, batch ...storage.Event) {
+	if err := s.publisher.Publish(ctx, batch...); err != nil {
+		log.Printf("failed to publish events: %s", err)
+	}
+}
+
+// errorStatus - код ответа на ошибку хранилища, на переход по истекшему или уже использованному показу,
+// по поддельному токену и на истекшее время запроса, остальные ошибки - 500.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrInvalidID), errors.Is(err, storage.ErrInvalidCreative):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrImpressionExpired), errors.Is(err, clicktoken.ErrExpiredToken):
+		return http.StatusGone
+	case errors.Is(err, storage.ErrImpressionClicked), errors.Is(err, clicktoken.ErrInvalidToken),
+		errors.Is(err, clicktoken.ErrUnknownKey):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
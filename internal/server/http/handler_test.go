@@ -0,0 +1,278 @@
+package internalhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/clicktoken"
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	memorystorage "github.com/astrviktor/banner-rotation/internal/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPublisher запоминает отправленные события.
+type recordingPublisher struct {
+	mutex  sync.Mutex
+	events []storage.Event
+}
+
+func (p *recordingPublisher) Connect(context.Context) error { return nil }
+
+func (p *recordingPublisher) Close() {}
+
+func (p *recordingPublisher) Publish(_ context.Context, events ...storage.Event) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.events = append(p.events, events...)
+	return nil
+}
+
+func (p *recordingPublisher) published() []storage.Event {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]storage.Event(nil), p.events...)
+}
+
+// fixture - сервер без токенов перехода и слот с одним баннером в ротации.
+type fixture struct {
+	server    *Server
+	storage   storage.Storage
+	publisher *recordingPublisher
+	slot      string
+	banner    string
+	segment   string
+}
+
+func newFixture(t *testing.T) fixture {
+	t.Helper()
+
+	ctx := context.Background()
+	stor := memorystorage.New()
+	require.NoError(t, stor.Connect(ctx))
+	t.Cleanup(stor.Close)
+
+	strategies, err := core.NewStrategies(config.ChoiceConfig{Seed: 1})
+	require.NoError(t, err)
+
+	publisher := &recordingPublisher{}
+	server := NewServer("", "0", stor, strategies, config.ClickConfig{ImpressionTTL: time.Hour}, nil,
+		config.TimeoutsConfig{}, publisher)
+
+	f := fixture{server: server, storage: stor, publisher: publisher}
+	f.slot, err = stor.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	f.banner, err = stor.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	f.segment, err = stor.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+	require.NoError(t, stor.CreateRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: f.banner}))
+
+	return f
+}
+
+// captureLog перенаправляет лог в буфер до конца теста.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestChoicePreview(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		preview bool
+	}{
+		{name: "normal", query: ""},
+		{name: "preview", query: "?preview=true", preview: true},
+		{name: "preview false", query: "?preview=false"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t)
+			logs := captureLog(t)
+
+			req := httptest.NewRequest(http.MethodPost, "/choice/"+f.slot+"/"+f.segment+tt.query, nil)
+			rec := httptest.NewRecorder()
+			Logging(f.server.handleChoice)(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var response ResponseChoice
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+			require.Equal(t, f.banner, response.ID)
+
+			stat, err := f.storage.GetStatForSlotBannerAndSegment(context.Background(), f.slot, f.banner, f.segment)
+			require.NoError(t, err)
+
+			if tt.preview {
+				// показ не записан, событие не отправлено, запрос отмечен в логе
+				require.Empty(t, response.ImpressionID)
+				require.Zero(t, stat.ShowCount)
+				require.Empty(t, f.publisher.published())
+				require.Contains(t, logs.String(), "[preview]")
+				return
+			}
+
+			require.NotEmpty(t, response.ImpressionID)
+			require.Equal(t, 1, stat.ShowCount)
+			published := f.publisher.published()
+			require.Len(t, published, 1)
+			require.Equal(t, storage.Show, published[0].Action)
+			require.Equal(t, response.ImpressionID, published[0].ImpressionID)
+			require.NotContains(t, logs.String(), "[preview]")
+		})
+	}
+
+	t.Run("invalid preview", func(t *testing.T) {
+		f := newFixture(t)
+		captureLog(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/choice/"+f.slot+"/"+f.segment+"?preview=maybe", nil)
+		rec := httptest.NewRecorder()
+		Logging(f.server.handleChoice)(rec, req)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+// TestRedirectExpired - переход после истечения срока показа не засчитывается, но перенаправляет на сайт.
+func TestRedirectExpired(t *testing.T) {
+	ctx := context.Background()
+	const target = "https://example.com/landing"
+
+	f := newFixture(t)
+	captureLog(t)
+	require.NoError(t, f.storage.UpdateBanner(ctx, storage.Banner{ID: f.banner, Description: "banner",
+		Creative: storage.Creative{Format: storage.CreativeImage, Width: 240, Height: 400,
+			ImageURL: "https://example.com/banner.png", TargetURL: target}}))
+
+	impression, err := f.storage.CreateImpression(ctx, f.slot, f.banner, f.segment, -time.Minute, true)
+	require.NoError(t, err)
+	claims := clicktoken.Claims{ImpressionID: impression.ID, SlotID: f.slot, BannerID: f.banner,
+		SegmentID: f.segment, ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+
+	signer, err := clicktoken.NewSigner(config.ClickConfig{
+		Keys: []config.ClickKeyConfig{{ID: "k1", Secret: "q3Jr0mZ8v1yQb6Yp9xW2tL5nK7dF4hS0aE1cU3iO8gM="}},
+	})
+	require.NoError(t, err)
+	token, err := signer.Sign(claims)
+	require.NoError(t, err)
+
+	for name, tt := range map[string]struct {
+		signer *clicktoken.Signer
+		param  string
+	}{
+		"impression": {param: impression.ID},
+		"token":      {signer: signer, param: token},
+	} {
+		f.server.signer = tt.signer
+
+		req := httptest.NewRequest(http.MethodGet, "/c/"+tt.param, nil)
+		rec := httptest.NewRecorder()
+		f.server.Redirect(rec, req)
+		require.Equal(t, http.StatusFound, rec.Code, name)
+		require.Equal(t, target, rec.Header().Get("Location"), name)
+	}
+
+	stat, err := f.storage.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Zero(t, stat.ClickCount)
+	require.Empty(t, f.publisher.published())
+}
+
+// impressionTimeoutStorage - хранилище, в котором создание показа не укладывается в таймаут.
+type impressionTimeoutStorage struct {
+	storage.Storage
+}
+
+func (s impressionTimeoutStorage) CreateImpression(context.Context, string, string, string, time.Duration,
+	bool) (storage.Impression, error) {
+	return storage.Impression{}, context.DeadlineExceeded
+}
+
+// TestChoiceFailed - если показ не создан, выбор не оставляет ни показа в статистике, ни обучения модели,
+// ни отправленного события.
+func TestChoiceFailed(t *testing.T) {
+	ctx := context.Background()
+
+	f := newFixture(t)
+	captureLog(t)
+	require.NoError(t, f.storage.SetSegmentFeatures(ctx, f.segment, []float64{1, 0.5}))
+
+	strategies, err := core.NewStrategies(config.ChoiceConfig{
+		Seed:     1,
+		Strategy: config.StrategyConfig{Name: config.StrategyLinUCB, Dimension: 2},
+	})
+	require.NoError(t, err)
+	f.server.strategies = strategies
+	f.server.storage = impressionTimeoutStorage{Storage: f.storage}
+
+	req := httptest.NewRequest(http.MethodPost, "/choice/"+f.slot+"/"+f.segment, nil)
+	rec := httptest.NewRecorder()
+	f.server.Choice(rec, req)
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+	stat, err := f.storage.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Zero(t, stat.ShowCount)
+
+	model, err := f.storage.GetModel(ctx, f.banner)
+	require.NoError(t, err)
+	require.Zero(t, model.Dimension)
+	require.Empty(t, f.publisher.published())
+}
+
+// timeoutStorage - хранилище, в котором создание баннера не укладывается в таймаут.
+type timeoutStorage struct {
+	storage.Storage
+}
+
+func (s timeoutStorage) CreateBannerWithCreative(context.Context, string, storage.Creative) (string, error) {
+	return storage.EmptyID, context.DeadlineExceeded
+}
+
+func TestCreateBanner(t *testing.T) {
+	const body = `{"description":"image","format":"image","width":240,"height":400,` +
+		`"imageUrl":"https://example.com/banner.png","targetUrl":"https://example.com/landing"}`
+
+	f := newFixture(t)
+	captureLog(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/banner", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	f.server.CreateItem(Banner, rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response ResponseID
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	banner, err := f.storage.GetBanner(context.Background(), response.ID)
+	require.NoError(t, err)
+	require.Equal(t, storage.Banner{ID: response.ID, Description: "image", Creative: storage.Creative{
+		Format: storage.CreativeImage, Width: 240, Height: 400,
+		ImageURL: "https://example.com/banner.png", TargetURL: "https://example.com/landing",
+	}}, banner)
+
+	// ошибка хранилища - не ошибка запроса
+	f.server.storage = timeoutStorage{Storage: f.storage}
+	req = httptest.NewRequest(http.MethodPost, "/banner", strings.NewReader(body))
+	rec = httptest.NewRecorder()
+	f.server.CreateItem(Banner, rec, req)
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
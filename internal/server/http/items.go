@@ -0,0 +1,274 @@
+package internalhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// ResponseList - страница списка слотов, баннеров или сегментов и общее количество найденных.
+type ResponseList struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+func (s *Server) handleBanners(w http.ResponseWriter, r *http.Request) {
+	s.handleItems(Banner, w, r)
+}
+
+func (s *Server) handleSlots(w http.ResponseWriter, r *http.Request) {
+	s.handleItems(Slot, w, r)
+}
+
+func (s *Server) handleSegments(w http.ResponseWriter, r *http.Request) {
+	s.handleItems(Segment, w, r)
+}
+
+func (s *Server) handleItems(item ItemType, w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.CreateItem(item, w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.ListItems(item, w, r)
+		return
+	}
+}
+
+func (s *Server) handleBanner(w http.ResponseWriter, r *http.Request) {
+	s.handleItem(Banner, w, r)
+}
+
+func (s *Server) handleSlot(w http.ResponseWriter, r *http.Request) {
+	s.handleItem(Slot, w, r)
+}
+
+func (s *Server) handleSegment(w http.ResponseWriter, r *http.Request) {
+	s.handleItem(Segment, w, r)
+}
+
+func (s *Server) handleItem(item ItemType, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.GetItem(item, w, r)
+	case http.MethodPatch:
+		s.UpdateItem(item, w, r)
+	case http.MethodDelete:
+		s.DeleteItem(item, w, r)
+	}
+}
+
+// curl --request GET 'http://127.0.0.1:8888/banner?search=auto&offset=0&limit=20'
+
+func (s *Server) ListItems(item ItemType, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	query, err := parseListQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", err)})
+		return
+	}
+
+	var items interface{}
+	var total int
+	switch item {
+	case Banner:
+		items, total, err = s.storage.ListBanners(ctx, query)
+	case Slot:
+		items, total, err = s.storage.ListSlots(ctx, query)
+	case Segment:
+		var segments []storage.Segment
+		segments, total, err = s.storage.ListSegments(ctx, query)
+		for i := range segments {
+			if segments[i].Features == nil {
+				segments[i].Features = []float64{}
+			}
+		}
+		items = segments
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while listing %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, &ResponseList{Items: items, Total: total, Offset: query.Offset, Limit: query.Limit})
+}
+
+// curl --request GET 'http://127.0.0.1:8888/banner/1'
+
+func (s *Server) GetItem(item ItemType, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	result, err := s.getItem(ctx, item, params[2])
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while getting %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, result)
+}
+
+/*
+curl --request PATCH 'http://127.0.0.1:8888/banner/1' \
+--header 'Content-Type: application/json' \
+--data-raw '{"description": "456", "targetUrl": "https://example.com"}'
+*/
+
+// UpdateItem изменяет только переданные в body поля, ID из body не учитывается.
+func (s *Server) UpdateItem(item ItemType, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	id := params[2]
+
+	result, err := s.getItem(ctx, item, id)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while getting %s", err)})
+		return
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(result); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while converting data from request %s", err)})
+		return
+	}
+
+	switch value := result.(type) {
+	case *storage.Banner:
+		value.ID = id
+		if err = value.Creative.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteResponse(w, &ResponseError{fmt.Sprintf("error while converting data from request %s", err)})
+			return
+		}
+		err = s.storage.UpdateBanner(ctx, *value)
+	case *storage.Slot:
+		value.ID = id
+		err = s.storage.UpdateSlot(ctx, *value)
+	case *storage.Segment:
+		value.ID = id
+		if value.Features == nil {
+			value.Features = []float64{}
+		}
+		err = s.storage.UpdateSegment(ctx, *value)
+	}
+
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while updating %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	WriteResponse(w, result)
+}
+
+// curl --request DELETE 'http://127.0.0.1:8888/banner/1'
+
+// DeleteItem удаляет элемент вместе с ротациями и статистикой, история событий остается.
+func (s *Server) DeleteItem(item ItemType, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	path := r.URL.Path
+	params := strings.Split(path, "/")
+	if len(params) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteResponse(w, &ResponseError{fmt.Sprintf("request format error %s", path)})
+		return
+	}
+
+	var err error
+	switch item {
+	case Banner:
+		err = s.storage.DeleteBanner(ctx, params[2])
+	case Slot:
+		err = s.storage.DeleteSlot(ctx, params[2])
+	case Segment:
+		err = s.storage.DeleteSegment(ctx, params[2])
+	}
+
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		WriteResponse(w, &ResponseError{fmt.Sprintf("error while deleting %s", err)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getItem возвращает указатель на слот, баннер или сегмент, чтобы поверх него можно было разобрать body.
+func (s *Server) getItem(ctx context.Context, item ItemType, id string) (interface{}, error) {
+	switch item {
+	case Banner:
+		banner, err := s.storage.GetBanner(ctx, id)
+		return &banner, err
+	case Slot:
+		slot, err := s.storage.GetSlot(ctx, id)
+		return &slot, err
+	default:
+		segment, err := s.storage.GetSegment(ctx, id)
+		if segment.Features == nil {
+			segment.Features = []float64{}
+		}
+		return &segment, err
+	}
+}
+
+// parseListQuery - страница списка из параметров search, offset и limit (по умолчанию 20, не больше 100).
+func parseListQuery(r *http.Request) (storage.ListQuery, error) {
+	values := r.URL.Query()
+	query := storage.ListQuery{Search: values.Get("search"), Limit: defaultListLimit}
+
+	if value := values.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return storage.ListQuery{}, fmt.Errorf("offset: invalid value %q", value)
+		}
+		query.Offset = offset
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return storage.ListQuery{}, fmt.Errorf("limit: invalid value %q, expected 1..%d", value, maxListLimit)
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
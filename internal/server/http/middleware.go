@@ -1,10 +1,13 @@
 package internalhttp
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
 )
 
 type StatusRecorder struct {
@@ -17,6 +20,48 @@ func (r *StatusRecorder) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Timeout отменяет контекст запроса через timeout, 0 - без ограничения.
+// Контекст отменяется и при отключении клиента.
+func Timeout(timeout time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// ReadWriteTimeout - Timeout с ограничением timeouts.Read для GET и timeouts.Write для остальных запросов.
+func ReadWriteTimeout(timeouts config.TimeoutsConfig, h http.HandlerFunc) http.HandlerFunc {
+	read, write := Timeout(timeouts.Read, h), Timeout(timeouts.Write, h)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			read(w, r)
+			return
+		}
+		write(w, r)
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo - сведения о запросе, которые обработчик передает в лог запросов через контекст.
+type requestInfo struct {
+	preview bool
+}
+
+// markPreview отмечает запрос в логе как предпросмотр: показ не записан.
+func markPreview(ctx context.Context) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.preview = true
+	}
+}
+
 func Logging(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -28,7 +73,14 @@ func Logging(h http.HandlerFunc) http.HandlerFunc {
 			Status:         0,
 		}
 
-		h(recorder, r)
+		info := &requestInfo{}
+		h(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if info.preview {
+			// показ не записан, в логе такие запросы отличаются от обычных
+			log.Println("[preview]", ip, r.Method, r.RequestURI, r.Proto, recorder.Status, time.Since(start), userAgent)
+			return
+		}
 
 		log.Println(ip, r.Method, r.RequestURI, r.Proto, recorder.Status, time.Since(start), userAgent)
 	}
@@ -9,24 +9,69 @@ import (
 	"sync"
 	"time"
 
+	"github.com/astrviktor/banner-rotation/internal/clicktoken"
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/core"
+	"github.com/astrviktor/banner-rotation/internal/events"
 	"github.com/astrviktor/banner-rotation/internal/storage"
 )
 
 // GET     /status                                : Проверка статуса сервиса
-// POST    /banner                                : Добавляет баннер (description из body), возвращает ID
+// POST    /banner                                : Добавляет баннер (description и содержимое из body), возвращает ID
+// Содержимое: format (image или html), width, height, imageUrl или html, targetUrl (адрес перехода), altText.
 // POST    /slot                                  : Добавляет слот (description из body), возвращает ID
 // POST    /segment                               : Добавляет сегмент (description из body), возвращает ID
 
+// GET     /banner?search=&offset=&limit=         : Список баннеров, отсортированный по описанию
+// GET     /slot?search=&offset=&limit=           : Список слотов
+// GET     /segment?search=&offset=&limit=        : Список сегментов
+// search - подстрока описания без учета регистра, limit - по умолчанию 20, не больше 100.
+// Ответ: items, total (всего найдено), offset, limit.
+// GET     /banner/{id}, /slot/{id}, /segment/{id}    : Возвращает элемент
+// PATCH   /banner/{id}, /slot/{id}, /segment/{id}    : Изменяет переданные в body поля, возвращает элемент
+// DELETE  /banner/{id}, /slot/{id}, /segment/{id}    : Удаляет элемент вместе с ротациями и статистикой
+// Несуществующий элемент - 404.
+
 // POST    /rotation/{slotID}/{bannerID}          : Добавляет баннер в ротацию в данном слоте.
 // DELETE  /rotation/{slotID}/{bannerID}          : Удаляет баннер в ротацию в данном слоте.
+// GET     /rotation/{slotID}                     : Возвращает баннеры в ротации слота (bannerIds).
+// PUT     /rotation/{slotID}                     : Заменяет набор баннеров слота целиком (bannerIds из body),
+// возвращает добавленные (added) и удаленные (removed) баннеры. Если слот или баннер не найден - 404,
+// ротация не меняется.
 
 // POST    /click/{slotID}/{bannerID}/{segmentID} : Засчитать переход
 // Увеличивает счетчик переходов на 1 для указанного баннера в данном слоте в указанной группе.
+// POST    /click/{impressionID}                  : Засчитать переход по ID показа из ответа /choice
+// Переход засчитывается для слота, баннера и сегмента этого показа, один раз и не позже click.impressionTTL.
+// Если заданы click.keys, /choice возвращает подписанный токен (token), и переход засчитывается только по нему:
+// /click/{token} или /click/{slotID}/{bannerID}/{segmentID}?token=..., поддельный или повторный токен - 403.
 
 // POST    /choice/{slotID}/{segmentID}           : Возвращает ID баннера который следует показать в данный момент
 // в указанном слоте для указанной соц-дем. группы. Увеличивает число показов баннера в группе.
+// Вместе с ID баннера возвращает ID показа (impressionId) для засчитывания перехода.
+// Алгоритм выбора берется из настроек слота (choice.slots), иначе общий (choice.strategy).
+// С параметром ?preview=true показ не записывается и событие не отправляется (для QA и предпросмотра).
+// С параметром ?pixel=true показ засчитывается при загрузке пикселя /i/{token}.gif.
+// С параметром ?creative=true вместе с ID возвращается баннер с содержимым (creative).
+
+// GET     /creative/{bannerID}                   : Возвращает баннер с содержимым для показа
+
+// GET     /choice/{slotID}/{segmentID}/explain   : Возвращает баннер, который был бы выбран, оценки всех баннеров
+// из ротации (показы, переходы, средний доход, бонус за исследование, вес) и причину выбора. Показ не записывается.
+
+// GET     /i/{token}.gif                         : Засчитывает показ, выбранный с ?pixel=true, возвращает картинку 1x1
+// GET     /c/{token}                             : Засчитывает переход и перенаправляет на targetUrl баннера
+// token - подписанный токен из ответа /choice, если заданы click.keys, иначе ID показа.
 
 // GET     /stat/{bannerID}/{segmentID}           : Возвращает статистику по показам и переходам по баннеру для сегмента
+// GET     /stat/{slotID}/{bannerID}/{segmentID}  : То же только по показам и переходам в слоте
+
+// PUT     /features/{segmentID}                  : Задает признаки сегмента для контекстного алгоритма
+// (features из body).
+// GET     /features/{segmentID}                  : Возвращает признаки сегмента
+// Для /choice и /click признаки запроса можно передать параметром ?features=0.5,1
+
+// GET     /events/stats                          : Статистика отправки событий: очередь, задержка, ошибки
 
 type ItemType int
 
@@ -37,36 +82,64 @@ const (
 )
 
 type Server struct {
-	addr    string
-	wg      *sync.WaitGroup
-	srv     *http.Server
-	storage storage.Storage
+	addr       string
+	wg         *sync.WaitGroup
+	srv        *http.Server
+	storage    storage.Storage
+	strategies *core.Strategies
+	click      config.ClickConfig
+	signer     *clicktoken.Signer
+	timeouts   config.TimeoutsConfig
+	publisher  events.Publisher
+	done       chan struct{}
 }
 
-func NewServer(host string, port string, storage storage.Storage) *Server {
+// NewServer - signer nil, если переходы засчитываются без токена. В publisher отправляются
+// записанные показы и переходы.
+func NewServer(host string, port string, storage storage.Storage, strategies *core.Strategies,
+	click config.ClickConfig, signer *clicktoken.Signer, timeouts config.TimeoutsConfig,
+	publisher events.Publisher) *Server {
 	return &Server{
 		net.JoinHostPort(host, port),
 		&sync.WaitGroup{},
 		&http.Server{},
 		storage,
+		strategies,
+		click,
+		signer,
+		timeouts,
+		publisher,
+		make(chan struct{}),
 	}
 }
 
 func (s *Server) Start() {
-	if err := s.storage.Connect(); err != nil {
+	if err := s.storage.Connect(context.Background()); err != nil {
 		log.Fatalf("Storage Connect(): %v", err)
 	}
 
+	if err := s.publisher.Connect(context.Background()); err != nil {
+		log.Fatalf("Publisher Connect(): %v", err)
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/status", Logging(s.handleStatus))
-	mux.HandleFunc("/banner", Logging(s.handleCreateBanner))
-	mux.HandleFunc("/slot", Logging(s.handleCreateSlot))
-	mux.HandleFunc("/segment", Logging(s.handleCreateSegment))
-	mux.HandleFunc("/rotation/", Logging(s.handleRotation))
-	mux.HandleFunc("/click/", Logging(s.handleClick))
-	mux.HandleFunc("/choice/", Logging(s.handleChoice))
-	mux.HandleFunc("/stat/", Logging(s.handleStat))
+	mux.HandleFunc("/banner", Logging(ReadWriteTimeout(s.timeouts, s.handleBanners)))
+	mux.HandleFunc("/banner/", Logging(ReadWriteTimeout(s.timeouts, s.handleBanner)))
+	mux.HandleFunc("/slot", Logging(ReadWriteTimeout(s.timeouts, s.handleSlots)))
+	mux.HandleFunc("/slot/", Logging(ReadWriteTimeout(s.timeouts, s.handleSlot)))
+	mux.HandleFunc("/segment", Logging(ReadWriteTimeout(s.timeouts, s.handleSegments)))
+	mux.HandleFunc("/segment/", Logging(ReadWriteTimeout(s.timeouts, s.handleSegment)))
+	mux.HandleFunc("/rotation/", Logging(ReadWriteTimeout(s.timeouts, s.handleRotation)))
+	mux.HandleFunc("/click/", Logging(Timeout(s.timeouts.Write, s.handleClick)))
+	mux.HandleFunc("/choice/", Logging(Timeout(s.timeouts.Choice, s.handleChoice)))
+	mux.HandleFunc("/creative/", Logging(Timeout(s.timeouts.Read, s.handleCreative)))
+	mux.HandleFunc("/i/", Logging(Timeout(s.timeouts.Write, s.handlePixel)))
+	mux.HandleFunc("/c/", Logging(Timeout(s.timeouts.Write, s.handleRedirect)))
+	mux.HandleFunc("/stat/", Logging(Timeout(s.timeouts.Read, s.handleStat)))
+	mux.HandleFunc("/features/", Logging(ReadWriteTimeout(s.timeouts, s.handleFeatures)))
+	mux.HandleFunc("/events/stats", Logging(s.handleEventsStats))
 
 	s.srv = &http.Server{
 		Addr:    s.addr,
@@ -85,6 +158,43 @@ func (s *Server) Start() {
 		}
 		log.Println("http server stopped")
 	}()
+
+	if s.click.CleanupInterval > 0 {
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+			s.cleanupImpressions()
+		}()
+	}
+}
+
+// cleanupImpressions периодически удаляет показы, по которым переход уже не засчитывается.
+func (s *Server) cleanupImpressions() {
+	ticker := time.NewTicker(s.click.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.deleteExpiredImpressions(now.UTC())
+		}
+	}
+}
+
+func (s *Server) deleteExpiredImpressions(now time.Time) {
+	ctx := context.Background()
+	if s.timeouts.Write > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeouts.Write)
+		defer cancel()
+	}
+
+	if err := s.storage.DeleteExpiredImpressions(ctx, now); err != nil {
+		log.Printf("failed to delete expired impressions: %s", err)
+	}
 }
 
 func (s *Server) Stop() {
@@ -93,11 +203,13 @@ func (s *Server) Stop() {
 		log.Fatalf("Server Shutdown(): %v", err)
 	}
 
-	s.storage.Close()
-
 	defer cancel()
 
-	// Wait for ListenAndServe goroutine to close.
+	// Wait for ListenAndServe and cleanup goroutines to close.
+	close(s.done)
 	s.wg.Wait()
+
+	s.storage.Close()
+	s.publisher.Close()
 	log.Println("http server gracefully shutdown")
 }
@@ -1,22 +1,65 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Storage interface {
-	Connect() error
+	Connect(ctx context.Context) error
 	Close()
-	CreateSlot(description string) (string, error)
-	CreateBanner(description string) (string, error)
-	CreateSegment(description string) (string, error)
-	CreateRotation(rotation Rotation) error
-	DeleteRotation(rotation Rotation) error
-	CreateEvent(slotID, bannerID, segmentID string, action ActionType) error
-	GetBannersForSlot(slotID string) ([]string, error)
-	GetStatForBannerAndSegment(bannerID, segmentID string) (Stat, error)
+	CreateSlot(ctx context.Context, description string) (string, error)
+	GetSlot(ctx context.Context, slotID string) (Slot, error)
+	UpdateSlot(ctx context.Context, slot Slot) error
+	DeleteSlot(ctx context.Context, slotID string) error
+	ListSlots(ctx context.Context, query ListQuery) ([]Slot, int, error)
+	CreateBanner(ctx context.Context, description string) (string, error)
+	CreateBannerWithCreative(ctx context.Context, description string, creative Creative) (string, error)
+	GetBanner(ctx context.Context, bannerID string) (Banner, error)
+	UpdateBanner(ctx context.Context, banner Banner) error
+	DeleteBanner(ctx context.Context, bannerID string) error
+	ListBanners(ctx context.Context, query ListQuery) ([]Banner, int, error)
+	CreateSegment(ctx context.Context, description string) (string, error)
+	GetSegment(ctx context.Context, segmentID string) (Segment, error)
+	UpdateSegment(ctx context.Context, segment Segment) error
+	DeleteSegment(ctx context.Context, segmentID string) error
+	ListSegments(ctx context.Context, query ListQuery) ([]Segment, int, error)
+	CreateRotation(ctx context.Context, rotation Rotation) error
+	DeleteRotation(ctx context.Context, rotation Rotation) error
+	ReplaceRotations(ctx context.Context, slotID string, bannerIDs []string) (RotationDiff, error)
+	CreateEvent(ctx context.Context, slotID, bannerID, segmentID string, action ActionType) error
+	// RecordEvent учитывает событие из внешнего источника (kafka.consumer) с его ID и временем.
+	// Такое событие не отправляется через events.publisher ни в одном хранилище: оно уже есть в источнике,
+	// и сервис не должен повторять чужой поток событий в свой топик.
+	RecordEvent(ctx context.Context, event Event) error
+	// DeleteEventIDs забывает ID событий, записанных RecordEvent раньше before:
+	// событие с таким ID после этого учитывается снова.
+	DeleteEventIDs(ctx context.Context, before time.Time) error
+	GetBannersForSlot(ctx context.Context, slotID string) ([]string, error)
+	GetStatForBannerAndSegment(ctx context.Context, bannerID, segmentID string) (Stat, error)
+	GetStatForSlotBannerAndSegment(ctx context.Context, slotID, bannerID, segmentID string) (Stat, error)
+	GetStatsForSlotAndSegment(ctx context.Context, slotID, segmentID string, perSlot bool) ([]Stat, error)
+	GetStatBuckets(ctx context.Context, slotID, bannerID, segmentID string, since time.Time) ([]StatBucket, error)
+	GetStatBucketsForSlotAndSegment(ctx context.Context, slotID string, bannersID []string, segmentID string,
+		since time.Time) (map[string][]StatBucket, error)
+	SetSegmentFeatures(ctx context.Context, segmentID string, features []float64) error
+	GetSegmentFeatures(ctx context.Context, segmentID string) ([]float64, error)
+	GetModel(ctx context.Context, bannerID string) (Model, error)
+	GetModels(ctx context.Context, bannersID []string) ([]Model, error)
+	UpdateModel(ctx context.Context, bannerID string, x []float64, action ActionType) error
+	CreateImpression(ctx context.Context, slotID, bannerID, segmentID string, ttl time.Duration,
+		shown bool) (Impression, error)
+	GetImpression(ctx context.Context, impressionID string) (Impression, error)
+	ShowImpression(ctx context.Context, impressionID string) (Impression, error)
+	// ClickImpression засчитывает переход по показу и незасчитанный показ вместе с ним,
+	// shown - показ засчитан этим вызовом.
+	ClickImpression(ctx context.Context, impressionID string) (impression Impression, shown bool, err error)
+	DeleteExpiredImpressions(ctx context.Context, now time.Time) error
 }
 
 // Slot - место на сайте, на котором мы показываем баннер.
@@ -29,12 +72,81 @@ type Slot struct {
 type Banner struct {
 	ID          string `json:"id"`          // ID - уникальный идентификатор баннера (UUID)
 	Description string `json:"description"` // Описание баннера
+	Creative
+}
+
+// Creative - содержимое баннера для показа: картинка или HTML-фрагмент и адрес перехода.
+type Creative struct {
+	Format    string `json:"format"`    // Формат: CreativeImage, CreativeHTML или пустой, если содержимого нет
+	Width     int    `json:"width"`     // Ширина в пикселях
+	Height    int    `json:"height"`    // Высота в пикселях
+	ImageURL  string `json:"imageUrl"`  // Адрес картинки для CreativeImage
+	HTML      string `json:"html"`      // HTML-фрагмент для CreativeHTML
+	TargetURL string `json:"targetUrl"` // Адрес перехода по баннеру (landing)
+	AltText   string `json:"altText"`   // Альтернативный текст
+}
+
+const (
+	CreativeImage string = "image"
+	CreativeHTML  string = "html"
+)
+
+// Validate проверяет, что формат известен, для формата задано содержимое и адреса абсолютные http(s).
+func (c Creative) Validate() error {
+	switch c.Format {
+	case "":
+		if c.ImageURL != "" || c.HTML != "" {
+			return fmt.Errorf("%w: format is required for imageUrl or html", ErrInvalidCreative)
+		}
+	case CreativeImage:
+		if c.ImageURL == "" {
+			return fmt.Errorf("%w: imageUrl is required for image format", ErrInvalidCreative)
+		}
+	case CreativeHTML:
+		if c.HTML == "" {
+			return fmt.Errorf("%w: html is required for html format", ErrInvalidCreative)
+		}
+	default:
+		return fmt.Errorf("%w: unknown format %s", ErrInvalidCreative, c.Format)
+	}
+
+	if c.Width < 0 || c.Height < 0 {
+		return fmt.Errorf("%w: width and height must not be negative", ErrInvalidCreative)
+	}
+
+	if err := validateURL("imageUrl", c.ImageURL); err != nil {
+		return err
+	}
+
+	return validateURL("targetUrl", c.TargetURL)
+}
+
+// validateURL - пустой адрес или абсолютный http(s) адрес.
+func validateURL(name, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %s %s is not an absolute http(s) url", ErrInvalidCreative, name, value)
+	}
+
+	return nil
 }
 
 // Segment - группа пользователей сайта со схожими интересами, например "девушки 20-25" или "дедушки 80+".
 type Segment struct {
-	ID          string `json:"id"`          // ID - уникальный идентификатор сегмента (UUID)
-	Description string `json:"description"` // Описание сегмента
+	ID          string    `json:"id"`          // ID - уникальный идентификатор сегмента (UUID)
+	Description string    `json:"description"` // Описание сегмента
+	Features    []float64 `json:"features"`    // Признаки сегмента для контекстного алгоритма (пол, возраст и т.п.)
+}
+
+// ListQuery - страница списка слотов, баннеров или сегментов, отсортированного по описанию.
+type ListQuery struct {
+	Search string // подстрока описания без учета регистра, пустая - все
+	Offset int    // сколько пропустить
+	Limit  int    // сколько вернуть, 0 - все
 }
 
 // Rotation - баннер в ротации в данном слоте.
@@ -43,21 +155,128 @@ type Rotation struct {
 	BannerID string `json:"bannerId"` // ID баннера
 }
 
+// RotationDiff - баннеры, добавленные в ротацию слота и удаленные из нее при замене набора баннеров.
+type RotationDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// DiffRotations сравнивает текущий и новый наборы баннеров слота, повторы не учитываются.
+// Списки в результате отсортированы и не nil.
+func DiffRotations(current, next []string) RotationDiff {
+	diff := RotationDiff{Added: make([]string, 0), Removed: make([]string, 0)}
+
+	inCurrent := make(map[string]bool, len(current))
+	for _, bannerID := range current {
+		inCurrent[bannerID] = true
+	}
+
+	inNext := make(map[string]bool, len(next))
+	for _, bannerID := range next {
+		if !inNext[bannerID] && !inCurrent[bannerID] {
+			diff.Added = append(diff.Added, bannerID)
+		}
+		inNext[bannerID] = true
+	}
+
+	for bannerID := range inCurrent {
+		if !inNext[bannerID] {
+			diff.Removed = append(diff.Removed, bannerID)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+
+	return diff
+}
+
 // Stat - агрегированная статистика по переходу и показу баннера.
 type Stat struct {
+	SlotID     string `json:"slotId"`     // ID слота, AllSlots - статистика по всем слотам
 	BannerID   string `json:"bannerId"`   // ID баннера
 	SegmentID  string `json:"segmentId"`  // ID сегмента
 	ShowCount  int    `json:"showCount"`  // количество показов
 	ClickCount int    `json:"clickCount"` // количество переходов
 }
 
+// StatBucket - статистика по переходу и показу баннера за интервал времени длиной StatBucketSize.
+type StatBucket struct {
+	SlotID     string    `json:"slotId"`     // ID слота, AllSlots - статистика по всем слотам
+	BannerID   string    `json:"bannerId"`   // ID баннера
+	SegmentID  string    `json:"segmentId"`  // ID сегмента
+	Start      time.Time `json:"start"`      // начало интервала (UTC)
+	ShowCount  int       `json:"showCount"`  // количество показов
+	ClickCount int       `json:"clickCount"` // количество переходов
+}
+
+// StatBucketSize - длина интервала для StatBucket.
+const StatBucketSize = time.Hour
+
+// Model - параметры модели LinUCB для баннера: матрица A (d x d, по строкам) и вектор b (d).
+type Model struct {
+	BannerID  string    `json:"bannerId"`  // ID баннера
+	Dimension int       `json:"dimension"` // размерность вектора признаков d
+	A         []float64 `json:"a"`         // A = I + сумма x * x^T по показам
+	B         []float64 `json:"b"`         // b = сумма x по переходам
+}
+
+// NewModel - модель без наблюдений: A = I, b = 0.
+func NewModel(bannerID string, dimension int) Model {
+	model := Model{
+		BannerID:  bannerID,
+		Dimension: dimension,
+		A:         make([]float64, dimension*dimension),
+		B:         make([]float64, dimension),
+	}
+	for i := 0; i < dimension; i++ {
+		model.A[i*dimension+i] = 1
+	}
+	return model
+}
+
+// Update учитывает в модели показ (A += x * x^T) или переход (b += x) с вектором признаков x.
+// Если размерность признаков изменилась, модель обучается заново.
+func (m *Model) Update(x []float64, action ActionType) {
+	if m.Dimension != len(x) || len(m.A) != len(x)*len(x) || len(m.B) != len(x) {
+		*m = NewModel(m.BannerID, len(x))
+	}
+
+	switch action {
+	case Show:
+		for i := range x {
+			for j := range x {
+				m.A[i*m.Dimension+j] += x[i] * x[j]
+			}
+		}
+	case Click:
+		for i := range x {
+			m.B[i] += x[i]
+		}
+	}
+}
+
+// Impression - показ баннера, по которому можно засчитать один переход до ExpiresAt.
+// Если баннер выбран для пикселя, показ засчитывается при загрузке пикселя (Shown).
+type Impression struct {
+	ID        string    `json:"id"`        // ID - уникальный идентификатор показа (UUID), передается клиенту
+	SlotID    string    `json:"slotId"`    // ID слота
+	BannerID  string    `json:"bannerId"`  // ID баннера
+	SegmentID string    `json:"segmentId"` // ID сегмента
+	ExpiresAt time.Time `json:"expiresAt"` // после этого времени переход не засчитывается (UTC)
+	Shown     bool      `json:"shown"`     // показ уже засчитан
+	Clicked   bool      `json:"clicked"`   // переход по показу уже засчитан
+}
+
 // Event - событие по переходу или показу баннера.
 type Event struct {
-	SlotID    string     `json:"slotId"`    // ID слота
-	BannerID  string     `json:"bannerId"`  // ID баннера
-	SegmentID string     `json:"segmentId"` // ID сегмента
-	Action    ActionType `json:"action"`    // Действие: клик или показ
-	Date      time.Time  `json:"date"`      // Дата и время события
+	ID           string     `json:"id,omitempty"`           // ID события для отправки, пусто в истории событий
+	SlotID       string     `json:"slotId"`                 // ID слота
+	BannerID     string     `json:"bannerId"`               // ID баннера
+	SegmentID    string     `json:"segmentId"`              // ID сегмента
+	Action       ActionType `json:"action"`                 // Действие: клик или показ
+	Date         time.Time  `json:"date"`                   // Дата и время события
+	ImpressionID string     `json:"impressionId,omitempty"` // ID показа, если событие записано по показу
 }
 
 type ActionType int
@@ -71,4 +290,19 @@ func NewID() string {
 	return uuid.New().String()
 }
 
+// ValidateIDs проверяет, что все ID - UUID в том виде, в котором их возвращает NewID
+// (строчные буквы, с дефисами), иначе возвращает ErrInvalidID.
+func ValidateIDs(ids ...string) error {
+	for _, id := range ids {
+		parsed, err := uuid.Parse(id)
+		if err != nil || parsed.String() != id {
+			return fmt.Errorf("%w: %q", ErrInvalidID, id)
+		}
+	}
+	return nil
+}
+
 const EmptyID string = "00000000-0000-0000-0000-000000000000"
+
+// AllSlots - вместо ID слота для статистики, накопленной независимо от слотов.
+const AllSlots string = EmptyID
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// тесты проверки содержимого баннера:
+// - баннер без содержимого, картинка, HTML-фрагмент
+// - неизвестный формат, формат без содержимого, относительные адреса, отрицательный размер
+
+func TestCreativeValidate(t *testing.T) {
+	valid := []Creative{
+		{},
+		{TargetURL: "https://example.com"},
+		{Format: CreativeImage, Width: 240, Height: 400, ImageURL: "https://cdn.example.com/a.png",
+			TargetURL: "https://example.com/a", AltText: "a"},
+		{Format: CreativeHTML, HTML: "<b>a</b>", TargetURL: "http://example.com/a"},
+	}
+	for _, creative := range valid {
+		require.NoError(t, creative.Validate(), creative)
+	}
+
+	invalid := []Creative{
+		{Format: "video", ImageURL: "https://cdn.example.com/a.mp4"},
+		{Format: CreativeImage},
+		{Format: CreativeHTML, ImageURL: "https://cdn.example.com/a.png"},
+		{ImageURL: "https://cdn.example.com/a.png"},
+		{Format: CreativeImage, ImageURL: "/a.png"},
+		{TargetURL: "javascript:alert(1)"},
+		{Format: CreativeImage, ImageURL: "https://cdn.example.com/a.png", Width: -1},
+	}
+	for _, creative := range invalid {
+		require.ErrorIs(t, creative.Validate(), ErrInvalidCreative, creative)
+	}
+}
+
+// тесты сравнения наборов баннеров слота:
+// - добавление, удаление, без изменений, повторы в обоих наборах
+
+func TestDiffRotations(t *testing.T) {
+	diff := DiffRotations([]string{"b", "a", "c"}, []string{"d", "a", "a", "e"})
+	require.Equal(t, RotationDiff{Added: []string{"d", "e"}, Removed: []string{"b", "c"}}, diff)
+
+	diff = DiffRotations([]string{"a", "b"}, []string{"b", "a"})
+	require.Equal(t, RotationDiff{Added: []string{}, Removed: []string{}}, diff)
+
+	diff = DiffRotations(nil, []string{"a"})
+	require.Equal(t, RotationDiff{Added: []string{"a"}, Removed: []string{}}, diff)
+
+	diff = DiffRotations([]string{"a", "a"}, nil)
+	require.Equal(t, RotationDiff{Added: []string{}, Removed: []string{"a"}}, diff)
+}
+
+func TestValidateIDs(t *testing.T) {
+	require.NoError(t, ValidateIDs())
+	require.NoError(t, ValidateIDs(NewID(), EmptyID))
+
+	invalid := []string{"", "1", "not-a-uuid", strings.ToUpper(NewID()), "{" + NewID() + "}",
+		"urn:uuid:" + NewID(), strings.ReplaceAll(NewID(), "-", "")}
+	for _, id := range invalid {
+		require.ErrorIs(t, ValidateIDs(NewID(), id), ErrInvalidID, id)
+	}
+}
@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Общие ошибки хранилища, конкретные ошибки ниже оборачивают их и проверяются через errors.Is.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrInvalidID     = errors.New("invalid id")
+)
+
+var (
+	ErrSlotNotFound       = fmt.Errorf("slot %w", ErrNotFound)
+	ErrBannerNotFound     = fmt.Errorf("banner %w", ErrNotFound)
+	ErrSegmentNotFound    = fmt.Errorf("segment %w", ErrNotFound)
+	ErrRotationNotFound   = fmt.Errorf("rotation %w", ErrNotFound)
+	ErrRotationExists     = fmt.Errorf("rotation %w", ErrAlreadyExists)
+	ErrInvalidCreative    = errors.New("invalid banner creative")
+	ErrImpressionNotFound = fmt.Errorf("impression %w", ErrNotFound)
+	ErrImpressionExpired  = errors.New("impression expired")
+	ErrImpressionShown    = errors.New("impression already shown")
+	ErrImpressionClicked  = errors.New("impression already clicked")
+	ErrEventExists        = fmt.Errorf("event %w", ErrAlreadyExists)
+	ErrClicksExceedShows  = errors.New("clicks exceed shows")
+)
@@ -0,0 +1,132 @@
+package memorystorage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// Время операций не должно зависеть от числа баннеров и слотов: сравнить ns/op для разных размеров.
+//
+//	go test -run=^$ -bench=. -cpu=1,8 ./internal/storage/memory/
+
+var benchSizes = []int{10, 100, 1000}
+
+const benchSegments = 10
+
+// benchData - слоты с rotationSize баннерами в ротации каждый и benchSegments сегментов.
+type benchData struct {
+	slots    []string
+	banners  []string
+	segments []string
+}
+
+func newBenchData(b *testing.B, s *Storage, slotsCount, rotationSize int) benchData {
+	b.Helper()
+
+	ctx := context.Background()
+
+	var data benchData
+	for i := 0; i < benchSegments; i++ {
+		id, err := s.CreateSegment(ctx, fmt.Sprintf("segment %d", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		data.segments = append(data.segments, id)
+	}
+
+	for i := 0; i < slotsCount; i++ {
+		slot, err := s.CreateSlot(ctx, fmt.Sprintf("slot %d", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		data.slots = append(data.slots, slot)
+
+		for j := 0; j < rotationSize; j++ {
+			banner, err := s.CreateBanner(ctx, fmt.Sprintf("banner %d-%d", i, j))
+			if err != nil {
+				b.Fatal(err)
+			}
+			data.banners = append(data.banners, banner)
+
+			if err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: banner}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	return data
+}
+
+func BenchmarkGetStatForBannerAndSegment(b *testing.B) {
+	ctx := context.Background()
+
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("banners=%d", size), func(b *testing.B) {
+			s := New()
+			data := newBenchData(b, s, 1, size)
+
+			var counter uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddUint64(&counter, 1)
+					banner := data.banners[n%uint64(len(data.banners))]
+					segment := data.segments[n%benchSegments]
+					if _, err := s.GetStatForBannerAndSegment(ctx, banner, segment); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetBannersForSlot(b *testing.B) {
+	ctx := context.Background()
+
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("slots=%d", size), func(b *testing.B) {
+			s := New()
+			data := newBenchData(b, s, size, 10)
+
+			var counter uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddUint64(&counter, 1)
+					if _, err := s.GetBannersForSlot(ctx, data.slots[n%uint64(len(data.slots))]); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCreateEvent(b *testing.B) {
+	ctx := context.Background()
+
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("banners=%d", size), func(b *testing.B) {
+			s := New()
+			data := newBenchData(b, s, 1, size)
+
+			var counter uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddUint64(&counter, 1)
+					banner := data.banners[n%uint64(len(data.banners))]
+					segment := data.segments[n%benchSegments]
+					if err := s.CreateEvent(ctx, data.slots[0], banner, segment, storage.Show); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
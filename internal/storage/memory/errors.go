@@ -0,0 +1,7 @@
+package memorystorage
+
+import "errors"
+
+// ErrCorrupted - снимок или журнал изменений поврежден, хранилище не загружается,
+// чтобы не потерять данные молча.
+var ErrCorrupted = errors.New("memory storage data is corrupted")
@@ -0,0 +1,197 @@
+package memorystorage
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// statShardCount - число частей статистики, каждая со своей блокировкой.
+const statShardCount = 64
+
+// statKey - ключ статистики по слоту (или storage.AllSlots), баннеру и сегменту.
+type statKey struct {
+	slotID    string
+	bannerID  string
+	segmentID string
+}
+
+// statShard - часть статистики: вся статистика и интервалы одной пары баннер-сегмент
+// (общая и по слотам) лежат в одной части, поэтому событие меняет ее под одной блокировкой.
+type statShard struct {
+	mutex   sync.RWMutex
+	stats   map[statKey]storage.Stat
+	buckets map[statKey][]storage.StatBucket
+}
+
+func newStatShards() []*statShard {
+	shards := make([]*statShard, statShardCount)
+	for idx := range shards {
+		shards[idx] = &statShard{
+			stats:   make(map[statKey]storage.Stat),
+			buckets: make(map[statKey][]storage.StatBucket),
+		}
+	}
+	return shards
+}
+
+// shard - часть статистики для баннера и сегмента.
+func (s *Storage) shard(bannerID, segmentID string) *statShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(bannerID))
+	_, _ = hash.Write([]byte(segmentID))
+	return s.shards[hash.Sum32()%statShardCount]
+}
+
+// getStat - статистика по ключу, нулевая, если событий не было.
+func (s *Storage) getStat(key statKey) storage.Stat {
+	shard := s.shard(key.bannerID, key.segmentID)
+
+	shard.mutex.RLock()
+	stat := shard.stats[key]
+	shard.mutex.RUnlock()
+
+	stat.SlotID = key.slotID
+	stat.BannerID = key.bannerID
+	stat.SegmentID = key.segmentID
+	return stat
+}
+
+// initStat создает нулевую статистику, если ее нет.
+func (s *Storage) initStat(key statKey) {
+	shard := s.shard(key.bannerID, key.segmentID)
+
+	shard.mutex.Lock()
+	if _, ok := shard.stats[key]; !ok {
+		shard.stats[key] = storage.Stat{SlotID: key.slotID, BannerID: key.bannerID, SegmentID: key.segmentID}
+	}
+	shard.mutex.Unlock()
+}
+
+// deleteStats удаляет статистику и интервалы статистики по условию на ключ, вызывается под блокировкой на запись.
+func (s *Storage) deleteStats(match func(statKey) bool) {
+	for _, shard := range s.shards {
+		shard.mutex.Lock()
+		for key := range shard.stats {
+			if match(key) {
+				delete(shard.stats, key)
+			}
+		}
+		for key := range shard.buckets {
+			if match(key) {
+				delete(shard.buckets, key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// addEvent учитывает событие в статистике, вызывается под блокировкой (достаточно на чтение).
+// Сами события не хранятся: статистика, интервалы и модели - уже их итог.
+// recorded - время записи события, запоминается вместе с ID события.
+func (s *Storage) addEvent(event storage.Event, recorded time.Time) {
+	if event.ID != "" {
+		s.eventIDsMutex.Lock()
+		s.eventIDs[event.ID] = recorded
+		s.eventIDsMutex.Unlock()
+	}
+
+	shard := s.shard(event.BannerID, event.SegmentID)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	for _, slotID := range []string{storage.AllSlots, event.SlotID} {
+		key := statKey{slotID: slotID, bannerID: event.BannerID, segmentID: event.SegmentID}
+
+		stat := shard.stats[key]
+		stat.SlotID, stat.BannerID, stat.SegmentID = key.slotID, key.bannerID, key.segmentID
+		switch event.Action {
+		case storage.Show:
+			stat.ShowCount++
+		case storage.Click:
+			stat.ClickCount++
+		}
+		shard.stats[key] = stat
+
+		shard.addToBucket(key, event)
+	}
+}
+
+// addToBucket учитывает событие в интервале статистики, вызывается под блокировкой части.
+// Интервалы упорядочены по времени. События сервиса приходят по возрастанию времени, поэтому интервал
+// обычно последний или новый; события из kafka могут относиться и к более ранним интервалам.
+func (shard *statShard) addToBucket(key statKey, event storage.Event) {
+	start := event.Date.Truncate(storage.StatBucketSize)
+
+	buckets := shard.buckets[key]
+	idx := len(buckets)
+	for idx > 0 && buckets[idx-1].Start.After(start) {
+		idx--
+	}
+
+	if idx == 0 || !buckets[idx-1].Start.Equal(start) {
+		buckets = append(buckets, storage.StatBucket{})
+		copy(buckets[idx+1:], buckets[idx:])
+		buckets[idx] = storage.StatBucket{
+			SlotID:    key.slotID,
+			BannerID:  key.bannerID,
+			SegmentID: key.segmentID,
+			Start:     start,
+		}
+		idx++
+	}
+
+	switch event.Action {
+	case storage.Show:
+		buckets[idx-1].ShowCount++
+	case storage.Click:
+		buckets[idx-1].ClickCount++
+	}
+	shard.buckets[key] = buckets
+}
+
+// bannerSet - баннеры в ротации слота в порядке добавления с проверкой вхождения за O(1).
+type bannerSet struct {
+	ids   []string
+	index map[string]int
+}
+
+func newBannerSet() *bannerSet {
+	return &bannerSet{index: make(map[string]int)}
+}
+
+func (b *bannerSet) has(bannerID string) bool {
+	_, ok := b.index[bannerID]
+	return ok
+}
+
+func (b *bannerSet) add(bannerID string) {
+	if b.has(bannerID) {
+		return
+	}
+	b.index[bannerID] = len(b.ids)
+	b.ids = append(b.ids, bannerID)
+}
+
+func (b *bannerSet) remove(bannerID string) {
+	idx, ok := b.index[bannerID]
+	if !ok {
+		return
+	}
+
+	delete(b.index, bannerID)
+	b.ids = append(b.ids[:idx], b.ids[idx+1:]...)
+	for ; idx < len(b.ids); idx++ {
+		b.index[b.ids[idx]] = idx
+	}
+}
+
+// list - копия списка баннеров, nil для пустого набора.
+func (b *bannerSet) list() []string {
+	if len(b.ids) == 0 {
+		return nil
+	}
+	return append([]string(nil), b.ids...)
+}
@@ -0,0 +1,529 @@
+package memorystorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+// Файлы в каталоге хранилища: снимок состояния и журналы изменений после него.
+// Снимок хранит номер первого журнала, который нужно применить после снимка.
+const (
+	snapshotFile = "snapshot.dat"
+	walPrefix    = "wal-"
+	walSuffix    = ".log"
+)
+
+// op - изменение состояния хранилища в журнале.
+type op string
+
+const (
+	opCreateSlot       op = "createSlot"
+	opUpdateSlot       op = "updateSlot"
+	opDeleteSlot       op = "deleteSlot"
+	opCreateBanner     op = "createBanner"
+	opUpdateBanner     op = "updateBanner"
+	opDeleteBanner     op = "deleteBanner"
+	opCreateSegment    op = "createSegment"
+	opUpdateSegment    op = "updateSegment"
+	opDeleteSegment    op = "deleteSegment"
+	opSetFeatures      op = "setFeatures"
+	opCreateRotation   op = "createRotation"
+	opDeleteRotation   op = "deleteRotation"
+	opReplaceRotations op = "replaceRotations"
+	opEvent            op = "event"
+	opUpdateModel      op = "updateModel"
+	opCreateImpression op = "createImpression"
+	opShowImpression   op = "showImpression"
+	opClickImpression  op = "clickImpression"
+	opDeleteExpired    op = "deleteExpired"
+	opDeleteEventIDs   op = "deleteEventIds"
+)
+
+// record - запись журнала: изменение со всеми данными, которые нужны, чтобы повторить его без проверок
+// (ID и время уже выбраны, проверки выполнены до записи).
+type record struct {
+	Op         op                  `json:"op"`
+	ID         string              `json:"id,omitempty"`
+	Slot       *storage.Slot       `json:"slot,omitempty"`
+	Banner     *storage.Banner     `json:"banner,omitempty"`
+	Segment    *storage.Segment    `json:"segment,omitempty"`
+	Rotation   *storage.Rotation   `json:"rotation,omitempty"`
+	BannerIDs  []string            `json:"bannerIds,omitempty"`
+	Event      *storage.Event      `json:"event,omitempty"`
+	Features   []float64           `json:"features,omitempty"`
+	Action     storage.ActionType  `json:"action,omitempty"`
+	Impression *storage.Impression `json:"impression,omitempty"`
+	Time       time.Time           `json:"time"`
+}
+
+// snapshot - все состояние хранилища: итоги событий (статистика, интервалы, модели) без самих событий,
+// поэтому размер снимка не растет с числом событий. ID событий RecordEvent хранятся со временем записи
+// не дольше dedupeRetention.
+type snapshot struct {
+	WALSeq      uint64               `json:"walSeq"`
+	Slots       []storage.Slot       `json:"slots"`
+	Banners     []storage.Banner     `json:"banners"`
+	Segments    []storage.Segment    `json:"segments"`
+	Rotations   []storage.Rotation   `json:"rotations"`
+	Stats       []storage.Stat       `json:"stats"`
+	SlotStats   []storage.Stat       `json:"slotStats"`
+	Buckets     []storage.StatBucket `json:"buckets"`
+	EventIDs    []eventID            `json:"eventIds"`
+	Models      []storage.Model      `json:"models"`
+	Impressions []storage.Impression `json:"impressions"`
+}
+
+// eventID - ID события RecordEvent в снимке и время записи события.
+type eventID struct {
+	ID       string    `json:"id"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// commit записывает изменение в журнал и применяет его, вызывается под блокировкой после всех проверок.
+// Изменения применяются в том же порядке, в котором записаны в журнал.
+func (s *Storage) commit(r record) error {
+	if s.wal == nil {
+		return s.apply(r)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+
+	if err = s.wal.append(data); err != nil {
+		return fmt.Errorf("write wal: %w", err)
+	}
+
+	return s.apply(r)
+}
+
+// apply применяет изменение к состоянию, вызывается под той же блокировкой, что и commit.
+func (s *Storage) apply(r record) error {
+	switch r.Op {
+	case opCreateSlot, opUpdateSlot:
+		s.slots[r.Slot.ID] = *r.Slot
+	case opDeleteSlot:
+		delete(s.slots, r.ID)
+		delete(s.rotations, r.ID)
+		s.deleteStats(func(key statKey) bool { return key.slotID == r.ID })
+		s.deleteImpressions(func(impression storage.Impression) bool { return impression.SlotID == r.ID })
+	case opCreateBanner:
+		s.banners[r.Banner.ID] = *r.Banner
+		for _, segment := range s.segments {
+			s.initStat(statKey{slotID: storage.AllSlots, bannerID: r.Banner.ID, segmentID: segment.ID})
+		}
+	case opUpdateBanner:
+		s.banners[r.Banner.ID] = *r.Banner
+	case opDeleteBanner:
+		delete(s.banners, r.ID)
+		delete(s.models, r.ID)
+		for slotID := range s.rotations {
+			s.deleteRotation(storage.Rotation{SlotID: slotID, BannerID: r.ID})
+		}
+		s.deleteStats(func(key statKey) bool { return key.bannerID == r.ID })
+		s.deleteImpressions(func(impression storage.Impression) bool { return impression.BannerID == r.ID })
+	case opCreateSegment:
+		s.segments[r.Segment.ID] = *r.Segment
+		for _, banner := range s.banners {
+			s.initStat(statKey{slotID: storage.AllSlots, bannerID: banner.ID, segmentID: r.Segment.ID})
+		}
+	case opUpdateSegment:
+		segment := *r.Segment
+		segment.Features = append([]float64(nil), segment.Features...)
+		s.segments[segment.ID] = segment
+	case opDeleteSegment:
+		delete(s.segments, r.ID)
+		s.deleteStats(func(key statKey) bool { return key.segmentID == r.ID })
+		s.deleteImpressions(func(impression storage.Impression) bool { return impression.SegmentID == r.ID })
+	case opSetFeatures:
+		segment := s.segments[r.ID]
+		segment.Features = append([]float64(nil), r.Features...)
+		s.segments[r.ID] = segment
+	case opCreateRotation:
+		s.addRotation(*r.Rotation)
+	case opDeleteRotation:
+		s.deleteRotation(*r.Rotation)
+	case opReplaceRotations:
+		s.replaceRotations(r.ID, r.BannerIDs)
+	case opEvent:
+		s.addEvent(*r.Event, r.Time)
+	case opUpdateModel:
+		model, ok := s.models[r.ID]
+		if !ok {
+			model = storage.NewModel(r.ID, len(r.Features))
+		}
+		model.Update(r.Features, r.Action)
+		s.models[r.ID] = model
+	case opCreateImpression:
+		s.impressions[r.Impression.ID] = *r.Impression
+		// показ, засчитанный при создании, записан вместе с событием показа (в прежних журналах - отдельно)
+		if r.Event != nil {
+			s.addEvent(*r.Event, r.Time)
+		}
+	case opShowImpression, opClickImpression:
+		s.updateImpression(r.ID, r.Op == opClickImpression, r.Time)
+	case opDeleteExpired:
+		s.deleteImpressions(func(impression storage.Impression) bool { return !r.Time.Before(impression.ExpiresAt) })
+	case opDeleteEventIDs:
+		s.deleteEventIDs(r.Time)
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+
+	return nil
+}
+
+// load загружает снимок и применяет журналы после него, затем открывает последний журнал на запись.
+func (s *Storage) load() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	walSeq, err := s.loadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	seqs, err := walSeqs(s.dir)
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for idx, seq := range seqs {
+		if seq < walSeq {
+			continue
+		}
+
+		// оборванной может быть только последняя запись последнего журнала
+		err = replayWAL(s.walPath(seq), idx == len(seqs)-1, func(data []byte) error {
+			var r record
+			if err := json.Unmarshal(data, &r); err != nil {
+				return err
+			}
+			replayed++
+			return s.apply(r)
+		})
+		if err != nil {
+			return err
+		}
+		walSeq = seq
+	}
+
+	if walSeq == 0 {
+		walSeq = 1
+	}
+
+	s.wal, err = openWAL(s.walPath(walSeq), s.fsync)
+	if err != nil {
+		return err
+	}
+	s.walSeq = walSeq
+
+	log.Printf("memory storage loaded from %s: %d wal records replayed", s.dir, replayed)
+	return nil
+}
+
+// loadSnapshot загружает снимок, если он есть, и возвращает номер первого журнала после него.
+func (s *Storage) loadSnapshot() (uint64, error) {
+	file, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	data, err := readFrame(file)
+	if errors.Is(err, errTornFrame) || errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("%w: %s: snapshot is truncated", ErrCorrupted, snapshotFile)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", snapshotFile, err)
+	}
+
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("%w: %s: %s", ErrCorrupted, snapshotFile, err)
+	}
+
+	s.restore(snap)
+	return snap.WALSeq, nil
+}
+
+// Snapshot записывает снимок состояния и начинает новый журнал, журналы до снимка удаляются.
+// Состояние копируется под блокировкой, файл снимка пишется без нее.
+func (s *Storage) Snapshot() error {
+	if s.dir == "" {
+		return nil
+	}
+
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	s.mutex.Lock()
+	if s.wal == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	walSeq := s.walSeq + 1
+	data, err := json.Marshal(s.snapshot(walSeq))
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+
+	next, err := openWAL(s.walPath(walSeq), s.fsync)
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+
+	prev := s.wal
+	s.wal, s.walSeq = next, walSeq
+	s.mutex.Unlock()
+
+	if err = prev.close(); err != nil {
+		return err
+	}
+
+	if err = writeSnapshot(s.dir, data); err != nil {
+		return err
+	}
+
+	// после снимка предыдущие журналы не нужны
+	seqs, err := walSeqs(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range seqs {
+		if seq < walSeq {
+			if err = os.Remove(s.walPath(seq)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// snapshotLoop периодически записывает снимок, пока не закрыт done.
+func (s *Storage) snapshotLoop() {
+	ticker := time.NewTicker(s.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("failed to write memory storage snapshot: %s", err)
+			}
+		}
+	}
+}
+
+// writeSnapshot атомарно заменяет файл снимка: запись во временный файл, fsync, rename, fsync каталога.
+func writeSnapshot(dir string, data []byte) error {
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFrame(file, data); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// snapshot копирует состояние, вызывается под блокировкой на запись.
+func (s *Storage) snapshot(walSeq uint64) snapshot {
+	snap := snapshot{
+		WALSeq:      walSeq,
+		Slots:       make([]storage.Slot, 0, len(s.slots)),
+		Banners:     make([]storage.Banner, 0, len(s.banners)),
+		Segments:    make([]storage.Segment, 0, len(s.segments)),
+		Rotations:   make([]storage.Rotation, 0),
+		Stats:       make([]storage.Stat, 0),
+		SlotStats:   make([]storage.Stat, 0),
+		Buckets:     make([]storage.StatBucket, 0),
+		EventIDs:    make([]eventID, 0, len(s.eventIDs)),
+		Models:      make([]storage.Model, 0, len(s.models)),
+		Impressions: make([]storage.Impression, 0, len(s.impressions)),
+	}
+
+	for _, slot := range s.slots {
+		snap.Slots = append(snap.Slots, slot)
+	}
+
+	for _, banner := range s.banners {
+		snap.Banners = append(snap.Banners, banner)
+	}
+
+	for _, segment := range s.segments {
+		snap.Segments = append(snap.Segments, segment)
+	}
+
+	// баннеры слота в порядке добавления
+	for slotID, banners := range s.rotations {
+		for _, bannerID := range banners.ids {
+			snap.Rotations = append(snap.Rotations, storage.Rotation{SlotID: slotID, BannerID: bannerID})
+		}
+	}
+
+	for _, shard := range s.shards {
+		for key, stat := range shard.stats {
+			if key.slotID == storage.AllSlots {
+				snap.Stats = append(snap.Stats, stat)
+			} else {
+				snap.SlotStats = append(snap.SlotStats, stat)
+			}
+		}
+
+		// интервалы одного ключа идут подряд по возрастанию времени
+		for _, buckets := range shard.buckets {
+			snap.Buckets = append(snap.Buckets, buckets...)
+		}
+	}
+
+	// ID старше dedupeRetention не попадают в снимок и забываются, даже если их еще не удалил DeleteEventIDs
+	if s.dedupeRetention > 0 {
+		s.deleteEventIDs(time.Now().UTC().Add(-s.dedupeRetention))
+	}
+
+	for id, recorded := range s.eventIDs {
+		snap.EventIDs = append(snap.EventIDs, eventID{ID: id, Recorded: recorded})
+	}
+
+	for _, model := range s.models {
+		snap.Models = append(snap.Models, model)
+	}
+
+	for _, impression := range s.impressions {
+		snap.Impressions = append(snap.Impressions, impression)
+	}
+
+	return snap
+}
+
+// restore заполняет пустое хранилище снимком, вызывается под блокировкой на запись.
+func (s *Storage) restore(snap snapshot) {
+	for _, slot := range snap.Slots {
+		s.slots[slot.ID] = slot
+	}
+
+	for _, banner := range snap.Banners {
+		s.banners[banner.ID] = banner
+	}
+
+	for _, segment := range snap.Segments {
+		s.segments[segment.ID] = segment
+	}
+
+	for _, rotation := range snap.Rotations {
+		s.addRotation(rotation)
+	}
+
+	for _, event := range snap.EventIDs {
+		s.eventIDs[event.ID] = event.Recorded
+	}
+
+	for _, stat := range append(snap.Stats, snap.SlotStats...) {
+		key := statKey{slotID: stat.SlotID, bannerID: stat.BannerID, segmentID: stat.SegmentID}
+		s.shard(key.bannerID, key.segmentID).stats[key] = stat
+	}
+
+	for _, bucket := range snap.Buckets {
+		key := statKey{slotID: bucket.SlotID, bannerID: bucket.BannerID, segmentID: bucket.SegmentID}
+		shard := s.shard(key.bannerID, key.segmentID)
+		shard.buckets[key] = append(shard.buckets[key], bucket)
+	}
+
+	for _, model := range snap.Models {
+		s.models[model.BannerID] = model
+	}
+
+	for _, impression := range snap.Impressions {
+		s.impressions[impression.ID] = impression
+	}
+}
+
+func (s *Storage) walPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", walPrefix, seq, walSuffix))
+}
+
+// walSeqs - номера журналов в каталоге по возрастанию.
+func walSeqs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, walPrefix) || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walPrefix), walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
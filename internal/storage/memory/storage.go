@@ -1,21 +1,53 @@
 package memorystorage
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/astrviktor/banner-rotation/internal/config"
 	"github.com/astrviktor/banner-rotation/internal/storage"
 )
 
+// Storage хранит данные в памяти.
+//
+// Блокировки: mutex на запись - для изменения слотов, баннеров, сегментов, ротаций и моделей
+// и для удаления, при этом никто другой не работает с хранилищем. События и показы записываются
+// под mutex на чтение, поэтому не мешают друг другу и выбору баннера: ID событий - под eventIDsMutex,
+// показы - под impressionsMutex, статистика - под блокировкой своей части (statShard),
+// запись в журнал - под walMutex. Порядок блокировок: mutex, impressionsMutex, walMutex, остальные.
 type Storage struct {
 	slots     map[string]storage.Slot
 	banners   map[string]storage.Banner
 	segments  map[string]storage.Segment
-	rotations []storage.Rotation
-	stats     []storage.Stat
-	events    []storage.Event
+	rotations map[string]*bannerSet
+	shards    []*statShard
+	eventIDs  map[string]time.Time // ID событий, записанных RecordEvent, и время записи
+	models    map[string]storage.Model
 
-	mutex *sync.RWMutex
+	impressions map[string]storage.Impression
+
+	mutex            *sync.RWMutex
+	eventIDsMutex    sync.Mutex
+	impressionsMutex sync.Mutex
+	walMutex         sync.Mutex
+
+	// сохранение на диск, если задан каталог dir: журнал изменений (WAL) и периодические снимки,
+	// ID событий старше dedupeRetention в снимок не попадают
+	dir              string
+	dedupeRetention  time.Duration
+	snapshotInterval time.Duration
+	fsync            bool
+	wal              *wal
+	walSeq           uint64
+	snapshotMutex    sync.Mutex
+	done             chan struct{}
+	wg               sync.WaitGroup
+	closeOnce        sync.Once
 }
 
 func New() *Storage {
@@ -25,85 +57,476 @@ func New() *Storage {
 		slots:     make(map[string]storage.Slot),
 		banners:   make(map[string]storage.Banner),
 		segments:  make(map[string]storage.Segment),
-		rotations: make([]storage.Rotation, 0),
-		stats:     make([]storage.Stat, 0),
-		events:    make([]storage.Event, 0),
-		mutex:     &mutex,
+		rotations: make(map[string]*bannerSet),
+		shards:    newStatShards(),
+		eventIDs:  make(map[string]time.Time),
+		models:    make(map[string]storage.Model),
+
+		impressions: make(map[string]storage.Impression),
+
+		mutex: &mutex,
+
+		done: make(chan struct{}),
 	}
 }
 
-func (s *Storage) Connect() error {
+// NewPersistent - хранилище, которое при Connect загружает состояние из каталога conf.Dir
+// и записывает туда каждое изменение. С пустым conf.Dir то же, что New.
+// dedupeRetention - сколько ID событий RecordEvent хранятся в снимке (kafka.consumer.dedupeRetention).
+func NewPersistent(conf config.MemoryConfig, dedupeRetention time.Duration) *Storage {
+	s := New()
+	s.dir = conf.Dir
+	s.dedupeRetention = dedupeRetention
+	s.snapshotInterval = conf.SnapshotInterval
+	s.fsync = conf.Fsync
+	return s
+}
+
+// Connect загружает снимок и журнал изменений, если задан каталог, и запускает периодические снимки.
+func (s *Storage) Connect(_ context.Context) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	if err := s.load(); err != nil {
+		return fmt.Errorf("load memory storage from %s: %w", s.dir, err)
+	}
+
+	if s.snapshotInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.snapshotLoop()
+		}()
+	}
+
 	return nil
 }
 
+// Close записывает снимок и сбрасывает журнал на диск, после Close изменения не сохраняются.
+// Повторный Close ничего не делает.
 func (s *Storage) Close() {
+	if s.dir == "" {
+		return
+	}
+
+	s.closeOnce.Do(s.close)
+}
+
+func (s *Storage) close() {
+	close(s.done)
+	s.wg.Wait()
+
+	if err := s.Snapshot(); err != nil {
+		log.Printf("failed to write memory storage snapshot: %s", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.wal == nil {
+		return
+	}
+
+	if err := s.wal.close(); err != nil {
+		log.Printf("failed to close memory storage wal: %s", err)
+	}
+	s.wal = nil
 }
 
-func (s *Storage) CreateSlot(description string) (string, error) {
+func (s *Storage) CreateSlot(_ context.Context, description string) (string, error) {
 	id := storage.NewID()
-	slot := storage.Slot{ID: id, Description: description}
+
 	s.mutex.Lock()
-	s.slots[id] = slot
-	s.mutex.Unlock()
+	defer s.mutex.Unlock()
+
+	slot := storage.Slot{ID: id, Description: description}
+	if err := s.commit(record{Op: opCreateSlot, Slot: &slot}); err != nil {
+		return storage.EmptyID, err
+	}
 	return id, nil
 }
 
-func (s *Storage) CreateBanner(description string) (string, error) {
+func (s *Storage) CreateBanner(ctx context.Context, description string) (string, error) {
+	return s.CreateBannerWithCreative(ctx, description, storage.Creative{})
+}
+
+// CreateBannerWithCreative создает баннер сразу с содержимым одной записью.
+func (s *Storage) CreateBannerWithCreative(_ context.Context, description string,
+	creative storage.Creative) (string, error) {
 	id := storage.NewID()
-	banner := storage.Banner{ID: id, Description: description}
+
 	s.mutex.Lock()
-	s.banners[id] = banner
-	for _, segment := range s.segments {
-		stat := storage.Stat{
-			BannerID:   id,
-			SegmentID:  segment.ID,
-			ShowCount:  0,
-			ClickCount: 0,
-		}
-		s.stats = append(s.stats, stat)
+	defer s.mutex.Unlock()
+
+	banner := storage.Banner{ID: id, Description: description, Creative: creative}
+	if err := s.commit(record{Op: opCreateBanner, Banner: &banner}); err != nil {
+		return storage.EmptyID, err
 	}
-	s.mutex.Unlock()
 	return id, nil
 }
 
-func (s *Storage) CreateSegment(description string) (string, error) {
+func (s *Storage) GetBanner(_ context.Context, bannerID string) (storage.Banner, error) {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return storage.Banner{}, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	banner, ok := s.banners[bannerID]
+	if !ok {
+		return storage.Banner{}, storage.ErrBannerNotFound
+	}
+	return banner, nil
+}
+
+func (s *Storage) CreateSegment(_ context.Context, description string) (string, error) {
 	id := storage.NewID()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	segment := storage.Segment{ID: id, Description: description}
+	if err := s.commit(record{Op: opCreateSegment, Segment: &segment}); err != nil {
+		return storage.EmptyID, err
+	}
+	return id, nil
+}
+
+func (s *Storage) GetSlot(_ context.Context, slotID string) (storage.Slot, error) {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return storage.Slot{}, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	slot, ok := s.slots[slotID]
+	if !ok {
+		return storage.Slot{}, storage.ErrSlotNotFound
+	}
+	return slot, nil
+}
+
+func (s *Storage) UpdateSlot(_ context.Context, slot storage.Slot) error {
+	if err := storage.ValidateIDs(slot.ID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.slots[slot.ID]; !ok {
+		return storage.ErrSlotNotFound
+	}
+
+	return s.commit(record{Op: opUpdateSlot, Slot: &slot})
+}
+
+// DeleteSlot удаляет слот вместе с ротацией и статистикой по слоту, события остаются.
+func (s *Storage) DeleteSlot(_ context.Context, slotID string) error {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.slots[slotID]; !ok {
+		return storage.ErrSlotNotFound
+	}
+
+	return s.commit(record{Op: opDeleteSlot, ID: slotID})
+}
+
+func (s *Storage) ListSlots(_ context.Context, query storage.ListQuery) ([]storage.Slot, int, error) {
+	s.mutex.RLock()
+	slots := make([]storage.Slot, 0, len(s.slots))
+	for _, slot := range s.slots {
+		if matchDescription(slot.Description, query.Search) {
+			slots = append(slots, slot)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(slots, func(i, j int) bool {
+		return lessDescription(slots[i].Description, slots[i].ID, slots[j].Description, slots[j].ID)
+	})
+
+	from, to := page(len(slots), query)
+	return slots[from:to], len(slots), nil
+}
+
+func (s *Storage) UpdateBanner(_ context.Context, banner storage.Banner) error {
+	if err := storage.ValidateIDs(banner.ID); err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
-	s.segments[id] = segment
+	defer s.mutex.Unlock()
+
+	if _, ok := s.banners[banner.ID]; !ok {
+		return storage.ErrBannerNotFound
+	}
+
+	return s.commit(record{Op: opUpdateBanner, Banner: &banner})
+}
+
+// DeleteBanner удаляет баннер из ротаций вместе со статистикой и моделью, события остаются.
+func (s *Storage) DeleteBanner(_ context.Context, bannerID string) error {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.banners[bannerID]; !ok {
+		return storage.ErrBannerNotFound
+	}
+
+	return s.commit(record{Op: opDeleteBanner, ID: bannerID})
+}
+
+func (s *Storage) ListBanners(_ context.Context, query storage.ListQuery) ([]storage.Banner, int, error) {
+	s.mutex.RLock()
+	banners := make([]storage.Banner, 0, len(s.banners))
 	for _, banner := range s.banners {
-		stat := storage.Stat{
-			BannerID:   banner.ID,
-			SegmentID:  id,
-			ShowCount:  0,
-			ClickCount: 0,
+		if matchDescription(banner.Description, query.Search) {
+			banners = append(banners, banner)
 		}
-		s.stats = append(s.stats, stat)
 	}
-	s.mutex.Unlock()
-	return id, nil
+	s.mutex.RUnlock()
+
+	sort.Slice(banners, func(i, j int) bool {
+		return lessDescription(banners[i].Description, banners[i].ID, banners[j].Description, banners[j].ID)
+	})
+
+	from, to := page(len(banners), query)
+	return banners[from:to], len(banners), nil
 }
 
-func (s *Storage) CreateRotation(rotation storage.Rotation) error {
+func (s *Storage) GetSegment(_ context.Context, segmentID string) (storage.Segment, error) {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return storage.Segment{}, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	segment, ok := s.segments[segmentID]
+	if !ok {
+		return storage.Segment{}, storage.ErrSegmentNotFound
+	}
+
+	segment.Features = append([]float64(nil), segment.Features...)
+	return segment, nil
+}
+
+func (s *Storage) UpdateSegment(_ context.Context, segment storage.Segment) error {
+	if err := storage.ValidateIDs(segment.ID); err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
-	s.rotations = append(s.rotations, rotation)
-	s.mutex.Unlock()
-	return nil
+	defer s.mutex.Unlock()
+
+	if _, ok := s.segments[segment.ID]; !ok {
+		return storage.ErrSegmentNotFound
+	}
+
+	return s.commit(record{Op: opUpdateSegment, Segment: &segment})
 }
 
-func (s *Storage) DeleteRotation(rotation storage.Rotation) error {
+// DeleteSegment удаляет сегмент вместе со статистикой по сегменту, события остаются.
+func (s *Storage) DeleteSegment(_ context.Context, segmentID string) error {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
-	for idx, elem := range s.rotations {
-		if elem.SlotID == rotation.SlotID && elem.BannerID == rotation.BannerID {
-			s.rotations = append(s.rotations[:idx], s.rotations[idx+1:]...)
-			break
+	defer s.mutex.Unlock()
+
+	if _, ok := s.segments[segmentID]; !ok {
+		return storage.ErrSegmentNotFound
+	}
+
+	return s.commit(record{Op: opDeleteSegment, ID: segmentID})
+}
+
+func (s *Storage) ListSegments(_ context.Context, query storage.ListQuery) ([]storage.Segment, int, error) {
+	s.mutex.RLock()
+	segments := make([]storage.Segment, 0, len(s.segments))
+	for _, segment := range s.segments {
+		if matchDescription(segment.Description, query.Search) {
+			segment.Features = append([]float64(nil), segment.Features...)
+			segments = append(segments, segment)
 		}
 	}
-	s.mutex.Unlock()
-	return nil
+	s.mutex.RUnlock()
+
+	sort.Slice(segments, func(i, j int) bool {
+		return lessDescription(segments[i].Description, segments[i].ID, segments[j].Description, segments[j].ID)
+	})
+
+	from, to := page(len(segments), query)
+	return segments[from:to], len(segments), nil
+}
+
+// deleteImpressions удаляет показы по условию, вызывается под блокировкой на запись или под impressionsMutex.
+func (s *Storage) deleteImpressions(match func(storage.Impression) bool) {
+	for id, impression := range s.impressions {
+		if match(impression) {
+			delete(s.impressions, id)
+		}
+	}
+}
+
+// matchDescription - описание содержит подстроку search без учета регистра.
+func matchDescription(description, search string) bool {
+	return strings.Contains(strings.ToLower(description), strings.ToLower(search))
+}
+
+// lessDescription - порядок списка: по описанию, при равных описаниях по ID.
+func lessDescription(descriptionA, idA, descriptionB, idB string) bool {
+	if descriptionA != descriptionB {
+		return descriptionA < descriptionB
+	}
+	return idA < idB
 }
 
-func (s *Storage) CreateEvent(slotID, bannerID, segmentID string, action storage.ActionType) error {
+// page - границы страницы списка из total элементов.
+func page(total int, query storage.ListQuery) (int, int) {
+	from := query.Offset
+	if from < 0 {
+		from = 0
+	}
+	if from > total {
+		from = total
+	}
+
+	to := total
+	if query.Limit > 0 && from+query.Limit < total {
+		to = from + query.Limit
+	}
+
+	return from, to
+}
+
+func (s *Storage) CreateRotation(_ context.Context, rotation storage.Rotation) error {
+	if err := storage.ValidateIDs(rotation.SlotID, rotation.BannerID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.slots[rotation.SlotID]; !ok {
+		return storage.ErrSlotNotFound
+	}
+
+	if _, ok := s.banners[rotation.BannerID]; !ok {
+		return storage.ErrBannerNotFound
+	}
+
+	if s.inRotation(rotation) {
+		return storage.ErrRotationExists
+	}
+
+	return s.commit(record{Op: opCreateRotation, Rotation: &rotation})
+}
+
+func (s *Storage) DeleteRotation(_ context.Context, rotation storage.Rotation) error {
+	if err := storage.ValidateIDs(rotation.SlotID, rotation.BannerID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.inRotation(rotation) {
+		return storage.ErrRotationNotFound
+	}
+
+	return s.commit(record{Op: opDeleteRotation, Rotation: &rotation})
+}
+
+// ReplaceRotations заменяет набор баннеров слота под одной блокировкой:
+// если слот или один из баннеров не найден, ротация не меняется.
+func (s *Storage) ReplaceRotations(_ context.Context, slotID string, bannerIDs []string) (storage.RotationDiff, error) {
+	if err := storage.ValidateIDs(append([]string{slotID}, bannerIDs...)...); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.slots[slotID]; !ok {
+		return storage.RotationDiff{}, storage.ErrSlotNotFound
+	}
+
+	for _, bannerID := range bannerIDs {
+		if _, ok := s.banners[bannerID]; !ok {
+			return storage.RotationDiff{}, fmt.Errorf("%w: %s", storage.ErrBannerNotFound, bannerID)
+		}
+	}
+
+	diff := storage.DiffRotations(s.bannersForSlot(slotID), bannerIDs)
+
+	if err := s.commit(record{Op: opReplaceRotations, ID: slotID, BannerIDs: bannerIDs}); err != nil {
+		return storage.RotationDiff{}, err
+	}
+	return diff, nil
+}
+
+// inRotation - баннер в ротации слота, вызывается под блокировкой.
+func (s *Storage) inRotation(rotation storage.Rotation) bool {
+	banners, ok := s.rotations[rotation.SlotID]
+	return ok && banners.has(rotation.BannerID)
+}
+
+// addRotation добавляет баннер в ротацию слота, вызывается под блокировкой на запись.
+func (s *Storage) addRotation(rotation storage.Rotation) {
+	banners, ok := s.rotations[rotation.SlotID]
+	if !ok {
+		banners = newBannerSet()
+		s.rotations[rotation.SlotID] = banners
+	}
+	banners.add(rotation.BannerID)
+}
+
+// deleteRotation удаляет баннер из ротации слота, вызывается под блокировкой на запись.
+func (s *Storage) deleteRotation(rotation storage.Rotation) {
+	banners, ok := s.rotations[rotation.SlotID]
+	if !ok {
+		return
+	}
+
+	banners.remove(rotation.BannerID)
+	if len(banners.ids) == 0 {
+		delete(s.rotations, rotation.SlotID)
+	}
+}
+
+// replaceRotations заменяет набор баннеров слота, вызывается под блокировкой на запись.
+func (s *Storage) replaceRotations(slotID string, bannerIDs []string) {
+	diff := storage.DiffRotations(s.bannersForSlot(slotID), bannerIDs)
+
+	for _, bannerID := range diff.Removed {
+		s.deleteRotation(storage.Rotation{SlotID: slotID, BannerID: bannerID})
+	}
+
+	for _, bannerID := range diff.Added {
+		s.addRotation(storage.Rotation{SlotID: slotID, BannerID: bannerID})
+	}
+}
+
+func (s *Storage) CreateEvent(_ context.Context, slotID, bannerID, segmentID string, action storage.ActionType) error {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return err
+	}
+
 	event := storage.Event{
 		SlotID:    slotID,
 		BannerID:  bannerID,
@@ -112,47 +535,497 @@ func (s *Storage) CreateEvent(slotID, bannerID, segmentID string, action storage
 		Date:      time.Now().UTC(),
 	}
 
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if err := s.checkRefs(slotID, bannerID, segmentID); err != nil {
+		return err
+	}
+
+	return s.commit(record{Op: opEvent, Event: &event})
+}
+
+// RecordEvent записывает событие из внешнего источника с его ID и временем.
+// Событие с уже записанным ID не учитывается повторно (ErrEventExists), переход, после которого
+// переходов в слоте станет больше показов, не записывается (ErrClicksExceedShows).
+func (s *Storage) RecordEvent(_ context.Context, event storage.Event) error {
+	if err := storage.ValidateIDs(event.ID, event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	event.Date = event.Date.UTC()
+
+	// блокировка на запись: проверки и запись событий RecordEvent не перемежаются
 	s.mutex.Lock()
-	s.events = append(s.events, event)
+	defer s.mutex.Unlock()
 
-	for idx, stat := range s.stats {
-		if stat.BannerID == bannerID && stat.SegmentID == segmentID {
-			switch action {
-			case storage.Show:
-				s.stats[idx].ShowCount++
-			case storage.Click:
-				s.stats[idx].ClickCount++
-			}
-			break
+	if err := s.checkRefs(event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	s.eventIDsMutex.Lock()
+	_, exists := s.eventIDs[event.ID]
+	s.eventIDsMutex.Unlock()
+	if exists {
+		return storage.ErrEventExists
+	}
+
+	if event.Action == storage.Click {
+		stat := s.getStat(statKey{slotID: event.SlotID, bannerID: event.BannerID, segmentID: event.SegmentID})
+		if stat.ClickCount >= stat.ShowCount {
+			return storage.ErrClicksExceedShows
 		}
 	}
-	s.mutex.Unlock()
+
+	return s.commit(record{Op: opEvent, Event: &event, Time: time.Now().UTC()})
+}
+
+// checkRefs проверяет, что слот, баннер и сегмент существуют, вызывается под блокировкой.
+func (s *Storage) checkRefs(slotID, bannerID, segmentID string) error {
+	if _, ok := s.slots[slotID]; !ok {
+		return storage.ErrSlotNotFound
+	}
+
+	if _, ok := s.banners[bannerID]; !ok {
+		return storage.ErrBannerNotFound
+	}
+
+	if _, ok := s.segments[segmentID]; !ok {
+		return storage.ErrSegmentNotFound
+	}
+
 	return nil
 }
 
-func (s *Storage) GetBannersForSlot(slotID string) ([]string, error) {
-	var bannersID []string
+func (s *Storage) GetBannersForSlot(_ context.Context, slotID string) ([]string, error) {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.slots[slotID]; !ok {
+		return nil, storage.ErrSlotNotFound
+	}
+
+	return s.bannersForSlot(slotID), nil
+}
+
+// bannersForSlot - баннеры в ротации слота, вызывается под блокировкой.
+func (s *Storage) bannersForSlot(slotID string) []string {
+	banners, ok := s.rotations[slotID]
+	if !ok {
+		return nil
+	}
+	return banners.list()
+}
+
+func (s *Storage) GetStatForBannerAndSegment(_ context.Context, bannerID, segmentID string) (storage.Stat, error) {
+	if err := storage.ValidateIDs(bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
 
 	s.mutex.RLock()
-	for _, rotation := range s.rotations {
-		if rotation.SlotID == slotID {
-			bannersID = append(bannersID, rotation.BannerID)
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.banners[bannerID]; !ok {
+		return storage.Stat{}, storage.ErrBannerNotFound
+	}
+
+	if _, ok := s.segments[segmentID]; !ok {
+		return storage.Stat{}, storage.ErrSegmentNotFound
+	}
+
+	return s.getStat(statKey{slotID: storage.AllSlots, bannerID: bannerID, segmentID: segmentID}), nil
+}
+
+// GetStatsForSlotAndSegment - статистика баннеров из ротации слота для сегмента под одной блокировкой:
+// только по этому слоту, если perSlot, иначе общая.
+func (s *Storage) GetStatsForSlotAndSegment(_ context.Context, slotID, segmentID string,
+	perSlot bool) ([]storage.Stat, error) {
+	if err := storage.ValidateIDs(slotID, segmentID); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.slots[slotID]; !ok {
+		return nil, storage.ErrSlotNotFound
+	}
+
+	statSlotID := storage.AllSlots
+	if perSlot {
+		statSlotID = slotID
+	}
+
+	bannersID := s.bannersForSlot(slotID)
+	stats := make([]storage.Stat, 0, len(bannersID))
+	for _, bannerID := range bannersID {
+		stats = append(stats, s.getStat(statKey{slotID: statSlotID, bannerID: bannerID, segmentID: segmentID}))
+	}
+	return stats, nil
+}
+
+func (s *Storage) GetStatForSlotBannerAndSegment(_ context.Context, slotID, bannerID,
+	segmentID string) (storage.Stat, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if err := s.checkRefs(slotID, bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
+
+	return s.getStat(statKey{slotID: slotID, bannerID: bannerID, segmentID: segmentID}), nil
+}
+
+func (s *Storage) GetStatBuckets(_ context.Context, slotID, bannerID, segmentID string,
+	since time.Time) ([]storage.StatBucket, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return nil, err
+	}
+
+	since = since.Truncate(storage.StatBucketSize)
+	result := make([]storage.StatBucket, 0)
+
+	shard := s.shard(bannerID, segmentID)
+	shard.mutex.RLock()
+	for _, bucket := range shard.buckets[statKey{slotID: slotID, bannerID: bannerID, segmentID: segmentID}] {
+		if !bucket.Start.Before(since) {
+			result = append(result, bucket)
+		}
+	}
+	shard.mutex.RUnlock()
+
+	return result, nil
+}
+
+// GetStatBucketsForSlotAndSegment - интервалы статистики баннеров bannersID для сегмента по ID баннера,
+// у баннера без интервалов - пустой список.
+func (s *Storage) GetStatBucketsForSlotAndSegment(_ context.Context, slotID string, bannersID []string,
+	segmentID string, since time.Time) (map[string][]storage.StatBucket, error) {
+	if err := storage.ValidateIDs(append([]string{slotID, segmentID}, bannersID...)...); err != nil {
+		return nil, err
+	}
+
+	since = since.Truncate(storage.StatBucketSize)
+	result := make(map[string][]storage.StatBucket, len(bannersID))
+
+	for _, bannerID := range bannersID {
+		buckets := make([]storage.StatBucket, 0)
+
+		shard := s.shard(bannerID, segmentID)
+		shard.mutex.RLock()
+		for _, bucket := range shard.buckets[statKey{slotID: slotID, bannerID: bannerID, segmentID: segmentID}] {
+			if !bucket.Start.Before(since) {
+				buckets = append(buckets, bucket)
+			}
+		}
+		shard.mutex.RUnlock()
+
+		result[bannerID] = buckets
+	}
+
+	return result, nil
+}
+
+func (s *Storage) SetSegmentFeatures(_ context.Context, segmentID string, features []float64) error {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.segments[segmentID]; !ok {
+		return storage.ErrSegmentNotFound
+	}
+
+	return s.commit(record{Op: opSetFeatures, ID: segmentID, Features: features})
+}
+
+func (s *Storage) GetSegmentFeatures(_ context.Context, segmentID string) ([]float64, error) {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	segment, ok := s.segments[segmentID]
+	if !ok {
+		return nil, storage.ErrSegmentNotFound
+	}
+
+	return append([]float64(nil), segment.Features...), nil
+}
+
+func (s *Storage) GetModel(_ context.Context, bannerID string) (storage.Model, error) {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return storage.Model{}, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	model, ok := s.models[bannerID]
+	if !ok {
+		return storage.Model{BannerID: bannerID}, nil
+	}
+
+	model.A = append([]float64(nil), model.A...)
+	model.B = append([]float64(nil), model.B...)
+	return model, nil
+}
+
+// GetModels - модели баннеров bannersID в том же порядке под одной блокировкой.
+func (s *Storage) GetModels(_ context.Context, bannersID []string) ([]storage.Model, error) {
+	if err := storage.ValidateIDs(bannersID...); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	models := make([]storage.Model, 0, len(bannersID))
+	for _, bannerID := range bannersID {
+		model, ok := s.models[bannerID]
+		if !ok {
+			models = append(models, storage.Model{BannerID: bannerID})
+			continue
+		}
+
+		model.A = append([]float64(nil), model.A...)
+		model.B = append([]float64(nil), model.B...)
+		models = append(models, model)
+	}
+
+	return models, nil
+}
+
+func (s *Storage) UpdateModel(_ context.Context, bannerID string, x []float64, action storage.ActionType) error {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.banners[bannerID]; !ok {
+		return storage.ErrBannerNotFound
+	}
+
+	return s.commit(record{Op: opUpdateModel, ID: bannerID, Features: x, Action: action})
+}
+
+// CreateImpression создает показ, если shown - вместе с событием показа одной записью журнала.
+func (s *Storage) CreateImpression(_ context.Context, slotID, bannerID, segmentID string, ttl time.Duration,
+	shown bool) (storage.Impression, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	now := time.Now().UTC()
+	impression := storage.Impression{
+		ID:        storage.NewID(),
+		SlotID:    slotID,
+		BannerID:  bannerID,
+		SegmentID: segmentID,
+		ExpiresAt: now.Add(ttl),
+		Shown:     shown,
+	}
+
+	r := record{Op: opCreateImpression, Impression: &impression}
+	if shown {
+		r.Event = &storage.Event{
+			SlotID:       slotID,
+			BannerID:     bannerID,
+			SegmentID:    segmentID,
+			Action:       storage.Show,
+			Date:         now,
+			ImpressionID: impression.ID,
 		}
 	}
-	s.mutex.RUnlock()
 
-	return bannersID, nil
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if err := s.checkRefs(slotID, bannerID, segmentID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	s.impressionsMutex.Lock()
+	defer s.impressionsMutex.Unlock()
+
+	if err := s.commit(r); err != nil {
+		return storage.Impression{}, err
+	}
+	return impression, nil
 }
 
-func (s *Storage) GetStatForBannerAndSegment(bannerID, segmentID string) (storage.Stat, error) {
+func (s *Storage) GetImpression(_ context.Context, impressionID string) (storage.Impression, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, err
+	}
+
 	s.mutex.RLock()
-	for _, stat := range s.stats {
-		if stat.BannerID == bannerID && stat.SegmentID == segmentID {
-			s.mutex.RUnlock()
-			return stat, nil
+	defer s.mutex.RUnlock()
+
+	s.impressionsMutex.Lock()
+	defer s.impressionsMutex.Unlock()
+
+	impression, ok := s.impressions[impressionID]
+	if !ok {
+		return storage.Impression{}, storage.ErrImpressionNotFound
+	}
+	return impression, nil
+}
+
+func (s *Storage) ShowImpression(_ context.Context, impressionID string) (storage.Impression, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	now := time.Now().UTC()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	s.impressionsMutex.Lock()
+	defer s.impressionsMutex.Unlock()
+
+	impression, err := s.getImpression(impressionID, now)
+	if err != nil {
+		return storage.Impression{}, err
+	}
+
+	if impression.Shown {
+		return storage.Impression{}, storage.ErrImpressionShown
+	}
+
+	if err = s.commit(record{Op: opShowImpression, ID: impressionID, Time: now}); err != nil {
+		return storage.Impression{}, err
+	}
+	return s.impressions[impressionID], nil
+}
+
+func (s *Storage) ClickImpression(_ context.Context, impressionID string) (storage.Impression, bool, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	now := time.Now().UTC()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	s.impressionsMutex.Lock()
+	defer s.impressionsMutex.Unlock()
+
+	impression, err := s.getImpression(impressionID, now)
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	if impression.Clicked {
+		return storage.Impression{}, false, storage.ErrImpressionClicked
+	}
+
+	if err = s.commit(record{Op: opClickImpression, ID: impressionID, Time: now}); err != nil {
+		return storage.Impression{}, false, err
+	}
+	return s.impressions[impressionID], !impression.Shown, nil
+}
+
+// getImpression - показ, по которому еще можно засчитать событие, вызывается под impressionsMutex.
+func (s *Storage) getImpression(impressionID string, now time.Time) (storage.Impression, error) {
+	impression, ok := s.impressions[impressionID]
+	if !ok {
+		return storage.Impression{}, storage.ErrImpressionNotFound
+	}
+
+	if !now.Before(impression.ExpiresAt) {
+		return storage.Impression{}, storage.ErrImpressionExpired
+	}
+
+	return impression, nil
+}
+
+// updateImpression засчитывает показ или переход по показу, вызывается под impressionsMutex.
+// Пиксель мог не загрузиться, но переход означает, что баннер показан.
+func (s *Storage) updateImpression(impressionID string, click bool, now time.Time) {
+	impression := s.impressions[impressionID]
+
+	actions := make([]storage.ActionType, 0, 2)
+	if !impression.Shown {
+		impression.Shown = true
+		actions = append(actions, storage.Show)
+	}
+	if click {
+		impression.Clicked = true
+		actions = append(actions, storage.Click)
+	}
+	s.impressions[impressionID] = impression
+
+	for _, action := range actions {
+		s.addEvent(storage.Event{
+			SlotID:    impression.SlotID,
+			BannerID:  impression.BannerID,
+			SegmentID: impression.SegmentID,
+			Action:    action,
+			Date:      now,
+		}, now)
+	}
+}
+
+func (s *Storage) DeleteEventIDs(_ context.Context, before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.eventIDsMutex.Lock()
+	expired := false
+	for _, recorded := range s.eventIDs {
+		if recorded.Before(before) {
+			expired = true
+			break
 		}
 	}
-	s.mutex.RUnlock()
+	s.eventIDsMutex.Unlock()
+
+	if !expired {
+		return nil
+	}
+	return s.commit(record{Op: opDeleteEventIDs, Time: before})
+}
+
+// deleteEventIDs удаляет ID событий, записанных раньше before, вызывается под блокировкой на запись.
+func (s *Storage) deleteEventIDs(before time.Time) {
+	s.eventIDsMutex.Lock()
+	defer s.eventIDsMutex.Unlock()
+
+	for id, recorded := range s.eventIDs {
+		if recorded.Before(before) {
+			delete(s.eventIDs, id)
+		}
+	}
+}
 
-	return storage.Stat{}, nil
+func (s *Storage) DeleteExpiredImpressions(_ context.Context, now time.Time) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	s.impressionsMutex.Lock()
+	defer s.impressionsMutex.Unlock()
+
+	for _, impression := range s.impressions {
+		if !now.Before(impression.ExpiresAt) {
+			return s.commit(record{Op: opDeleteExpired, Time: now})
+		}
+	}
+	return nil
 }
@@ -0,0 +1,378 @@
+package memorystorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/astrviktor/banner-rotation/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+		return New()
+	})
+}
+
+func TestConformancePersistent(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+		return open(t, t.TempDir())
+	})
+}
+
+func TestPersistReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	fill(t, s)
+	expected := state(t, s)
+	s.Close()
+
+	// после Close все состояние в снимке, журнал пустой
+	seqs, err := walSeqs(dir)
+	require.NoError(t, err)
+	require.Len(t, seqs, 1)
+	info, err := os.Stat(s.walPath(seqs[0]))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	require.Equal(t, expected, state(t, open(t, dir)))
+}
+
+func TestCloseTwice(t *testing.T) {
+	s := open(t, t.TempDir())
+	fill(t, s)
+
+	s.Close()
+	require.NotPanics(t, s.Close)
+}
+
+// TestSnapshotSize - снимок хранит итоги событий, а не сами события, и не растет с их числом.
+func TestSnapshotSize(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	// события одного интервала, чтобы число интервалов не менялось
+	date := time.Now().UTC().Truncate(storage.StatBucketSize)
+	addEvents := func(count int) {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+
+		for i := 0; i < count; i++ {
+			event := storage.Event{SlotID: slot, BannerID: banner, SegmentID: segment, Action: storage.Show, Date: date}
+			require.NoError(t, s.commit(record{Op: opEvent, Event: &event}))
+		}
+	}
+
+	snapshotSize := func() int64 {
+		require.NoError(t, s.Snapshot())
+		info, err := os.Stat(filepath.Join(dir, snapshotFile))
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	// счетчики одной длины в JSON
+	addEvents(1000)
+	size := snapshotSize()
+	addEvents(8000)
+	require.Equal(t, size, snapshotSize())
+
+	s.Close()
+	stat, err := open(t, dir).GetStatForSlotBannerAndSegment(ctx, slot, banner, segment)
+	require.NoError(t, err)
+	require.Equal(t, 9000, stat.ShowCount)
+}
+
+// TestPersistEventIDs - после перезапуска повторно доставленное событие тоже не учитывается.
+func TestPersistEventIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	event := storage.Event{ID: storage.NewID(), SlotID: slot, BannerID: banner, SegmentID: segment,
+		Action: storage.Show, Date: time.Now().UTC()}
+	require.NoError(t, s.RecordEvent(ctx, event))
+
+	// из журнала
+	crash(t, s)
+	s = open(t, dir)
+	require.ErrorIs(t, s.RecordEvent(ctx, event), storage.ErrEventExists)
+
+	// из снимка
+	s.Close()
+	s = open(t, dir)
+	require.ErrorIs(t, s.RecordEvent(ctx, event), storage.ErrEventExists)
+}
+
+// TestPersistEventIDsRetention - ID событий старше dedupeRetention не попадают в снимок,
+// удаление ID повторяется из журнала.
+func TestPersistEventIDsRetention(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := NewPersistent(config.MemoryConfig{Dir: dir}, time.Hour)
+	require.NoError(t, s.Connect(ctx))
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	old := storage.Event{ID: storage.NewID(), SlotID: slot, BannerID: banner, SegmentID: segment,
+		Action: storage.Show, Date: now}
+	s.mutex.RLock()
+	require.NoError(t, s.commit(record{Op: opEvent, Event: &old, Time: now.Add(-2 * time.Hour)}))
+	s.mutex.RUnlock()
+
+	event := old
+	event.ID = storage.NewID()
+	require.NoError(t, s.RecordEvent(ctx, event))
+
+	s.Close()
+	s = open(t, dir)
+	require.NoError(t, s.RecordEvent(ctx, old))
+	require.ErrorIs(t, s.RecordEvent(ctx, event), storage.ErrEventExists)
+
+	require.NoError(t, s.DeleteEventIDs(ctx, time.Now().UTC().Add(time.Second)))
+	crash(t, s)
+	s = open(t, dir)
+	require.NoError(t, s.RecordEvent(ctx, event))
+}
+
+func TestPersistReplay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("wal only", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := open(t, dir)
+		fill(t, s)
+		expected := state(t, s)
+		crash(t, s)
+
+		require.Equal(t, expected, state(t, open(t, dir)))
+	})
+
+	t.Run("snapshot and wal", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := open(t, dir)
+		fill(t, s)
+		require.NoError(t, s.Snapshot())
+		fill(t, s)
+		expected := state(t, s)
+		crash(t, s)
+
+		require.Equal(t, expected, state(t, open(t, dir)))
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := open(t, dir)
+		fill(t, s)
+		expected := state(t, s)
+		crash(t, s)
+
+		// процесс упал посреди записи: заголовок есть, данных нет
+		appendFile(t, lastWAL(t, dir), []byte{0, 0, 0, 100, 1, 2, 3, 4, '{'})
+
+		s = open(t, dir)
+		require.Equal(t, expected, state(t, s))
+
+		// журнал обрезан по последней целой записи, новые записи после нее читаются
+		_, err := s.CreateSlot(ctx, "after torn tail")
+		require.NoError(t, err)
+		expected = state(t, s)
+		crash(t, s)
+
+		require.Equal(t, expected, state(t, open(t, dir)))
+	})
+}
+
+func TestPersistCorrupted(t *testing.T) {
+	t.Run("wal", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := open(t, dir)
+		fill(t, s)
+		crash(t, s)
+
+		flipByte(t, lastWAL(t, dir), frameHeaderSize+2)
+
+		err := NewPersistent(config.MemoryConfig{Dir: dir}, 0).Connect(context.Background())
+		require.True(t, errors.Is(err, ErrCorrupted), "expected corrupted, got %v", err)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+
+		s := open(t, dir)
+		fill(t, s)
+		s.Close()
+
+		flipByte(t, filepath.Join(dir, snapshotFile), frameHeaderSize+2)
+
+		err := NewPersistent(config.MemoryConfig{Dir: dir}, 0).Connect(context.Background())
+		require.True(t, errors.Is(err, ErrCorrupted), "expected corrupted, got %v", err)
+	})
+}
+
+func open(t *testing.T, dir string) *Storage {
+	t.Helper()
+
+	ctx := context.Background()
+
+	s := NewPersistent(config.MemoryConfig{Dir: dir}, 0)
+	require.NoError(t, s.Connect(ctx))
+	t.Cleanup(func() {
+		if s.wal != nil {
+			s.Close()
+		}
+	})
+	return s
+}
+
+// fill выполняет все виды изменений.
+func fill(t *testing.T, s *Storage) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	other, err := s.CreateBanner(ctx, "other")
+	require.NoError(t, err)
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	require.NoError(t, s.UpdateSlot(ctx, storage.Slot{ID: slot, Description: "updated slot"}))
+	require.NoError(t, s.UpdateBanner(ctx, storage.Banner{ID: banner, Description: "updated banner"}))
+	require.NoError(t, s.UpdateSegment(ctx, storage.Segment{ID: segment, Description: "updated segment"}))
+	require.NoError(t, s.SetSegmentFeatures(ctx, segment, []float64{0.5, 1}))
+
+	require.NoError(t, s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: banner}))
+	require.NoError(t, s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: other}))
+	require.NoError(t, s.DeleteRotation(ctx, storage.Rotation{SlotID: slot, BannerID: other}))
+	_, err = s.ReplaceRotations(ctx, slot, []string{banner, other})
+	require.NoError(t, err)
+
+	require.NoError(t, s.CreateEvent(ctx, slot, banner, segment, storage.Show))
+	require.NoError(t, s.UpdateModel(ctx, banner, []float64{0.5, 1}, storage.Click))
+
+	shown, err := s.CreateImpression(ctx, slot, banner, segment, time.Hour, false)
+	require.NoError(t, err)
+	_, err = s.ShowImpression(ctx, shown.ID)
+	require.NoError(t, err)
+	clicked, err := s.CreateImpression(ctx, slot, other, segment, time.Hour, false)
+	require.NoError(t, err)
+	_, _, err = s.ClickImpression(ctx, clicked.ID)
+	require.NoError(t, err)
+	_, err = s.CreateImpression(ctx, slot, banner, segment, time.Millisecond, false)
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteExpiredImpressions(ctx, time.Now().Add(time.Minute)))
+
+	deleted, err := s.CreateSegment(ctx, "deleted")
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteSegment(ctx, deleted))
+	require.NoError(t, s.DeleteBanner(ctx, other))
+}
+
+// state - состояние хранилища в JSON без учета порядка элементов.
+func state(t *testing.T, s *Storage) map[string][]string {
+	t.Helper()
+
+	s.mutex.Lock()
+	data, err := json.Marshal(s.snapshot(0))
+	s.mutex.Unlock()
+	require.NoError(t, err)
+
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &fields))
+	delete(fields, "walSeq")
+
+	result := make(map[string][]string, len(fields))
+	for name, field := range fields {
+		var items []json.RawMessage
+		require.NoError(t, json.Unmarshal(field, &items))
+
+		result[name] = make([]string, 0, len(items))
+		for _, item := range items {
+			result[name] = append(result[name], string(item))
+		}
+		sort.Strings(result[name])
+	}
+	return result
+}
+
+// crash закрывает журнал без снимка, как при падении процесса.
+func crash(t *testing.T, s *Storage) {
+	t.Helper()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	require.NoError(t, s.wal.close())
+	s.wal = nil
+}
+
+func lastWAL(t *testing.T, dir string) string {
+	t.Helper()
+
+	seqs, err := walSeqs(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, seqs)
+
+	s := Storage{dir: dir}
+	return s.walPath(seqs[len(seqs)-1])
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
+func flipByte(t *testing.T, path string, offset int) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Greater(t, len(data), offset)
+
+	data[offset] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
@@ -0,0 +1,154 @@
+package memorystorage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Запись в WAL и снимке: длина данных (uint32), CRC32-C данных (uint32), данные (JSON).
+const (
+	frameHeaderSize = 8
+	maxFrameSize    = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornFrame - запись оборвана на конце файла: процесс упал во время записи.
+var errTornFrame = errors.New("torn frame")
+
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(data))
+	}
+
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(data, crcTable))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame читает одну запись: io.EOF - записей больше нет, errTornFrame - запись оборвана,
+// ErrCorrupted - запись целая, но данные не совпадают с контрольной суммой.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, errTornFrame
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("%w: frame size %d", ErrCorrupted, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errTornFrame
+	}
+
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+
+	return data, nil
+}
+
+// wal - открытый на запись журнал изменений.
+type wal struct {
+	file   *os.File
+	writer *bufio.Writer
+	fsync  bool // fsync после каждой записи, иначе только запись в файл (переживает падение процесса)
+}
+
+func openWAL(path string, fsync bool) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{file: file, writer: bufio.NewWriter(file), fsync: fsync}, nil
+}
+
+func (w *wal) append(data []byte) error {
+	if err := writeFrame(w.writer, data); err != nil {
+		return err
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	if w.fsync {
+		return w.file.Sync()
+	}
+
+	return nil
+}
+
+// close сбрасывает журнал на диск и закрывает файл.
+func (w *wal) close() error {
+	if err := w.writer.Flush(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	return w.file.Close()
+}
+
+// replayWAL читает журнал path и передает записи в apply. Оборванная последняя запись отрезается,
+// если truncate, иначе (журнал не последний) это повреждение.
+func replayWAL(path string, truncate bool, apply func(data []byte) error) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		data, err := readFrame(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if errors.Is(err, errTornFrame) {
+			if !truncate {
+				return fmt.Errorf("%w: %s: torn record at offset %d", ErrCorrupted, path, offset)
+			}
+			if err = file.Truncate(offset); err != nil {
+				return err
+			}
+			return file.Sync()
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", path, offset, err)
+		}
+
+		if err = apply(data); err != nil {
+			return fmt.Errorf("%w: %s at offset %d: %s", ErrCorrupted, path, offset, err)
+		}
+
+		offset += frameHeaderSize + int64(len(data))
+	}
+}
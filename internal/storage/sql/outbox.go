@@ -0,0 +1,192 @@
+package sqlstorage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+)
+
+const (
+	defaultOutboxInterval  = time.Second
+	defaultOutboxBatchSize = 100
+
+	// outboxCleanupInterval - как часто удаляются отправленные события старше outbox.retention.
+	outboxCleanupInterval = time.Hour
+)
+
+// addOutbox кладет событие для отправки в транзакции tx, в которой оно записывается.
+func addOutbox(ctx context.Context, tx *sql.Tx, event storage.Event) error {
+	// ID назначается при записи: повторная отправка после сбоя уходит с тем же ID
+	if event.ID == "" {
+		event.ID = storage.NewID()
+	}
+
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO banner_rotation.outbox (payload) VALUES ($1);`
+
+	_, err = tx.ExecContext(ctx, query, string(bytes))
+	return err
+}
+
+// notifyOutbox будит отправку после записи события, не дожидаясь outbox.interval.
+func (s *Storage) notifyOutbox() {
+	if s.publisher == nil {
+		return
+	}
+
+	select {
+	case s.outboxNotify <- struct{}{}:
+	default:
+	}
+}
+
+// relayOutbox отправляет события из outbox через publisher, пока не отменен ctx.
+// После ошибки отправка повторяется с паузой, растущей вдвое до outbox.maxBackoff,
+// событие отправляется хотя бы один раз.
+func (s *Storage) relayOutbox(ctx context.Context) {
+	defer close(s.relayDone)
+
+	interval := s.outbox.Interval
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+	maxBackoff := s.outbox.MaxBackoff
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+	batchSize := s.outbox.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultOutboxBatchSize
+	}
+
+	backoff := interval
+	lastCleanup := time.Time{}
+
+	for {
+		pause := interval
+		notify := s.outboxNotify
+
+		count, err := s.publishOutbox(ctx, batchSize)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("failed to publish outbox: %s", err)
+			pause = backoff
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			// после ошибки не торопимся из-за новых событий
+			notify = nil
+		case count == batchSize:
+			// в outbox могут быть еще события
+			pause = 0
+			backoff = interval
+		default:
+			backoff = interval
+		}
+
+		if s.outbox.Retention > 0 && time.Since(lastCleanup) >= outboxCleanupInterval {
+			if err = s.deleteDeliveredOutbox(ctx, time.Now().Add(-s.outbox.Retention)); err != nil {
+				log.Printf("failed to delete delivered outbox: %s", err)
+			} else {
+				lastCleanup = time.Now()
+			}
+		}
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// publishOutbox отправляет через publisher до batchSize неотправленных событий по порядку записи
+// и отмечает их отправленными. Строки блокируются до конца транзакции, поэтому несколько
+// экземпляров сервиса не отправляют одни и те же события. Если отметить не удалось,
+// события будут отправлены повторно.
+func (s *Storage) publishOutbox(ctx context.Context, batchSize int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `SELECT id, payload
+	FROM banner_rotation.outbox
+	WHERE delivered_at IS NULL
+	ORDER BY id
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED;`
+
+	rows, err := tx.QueryContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ids := make([]interface{}, 0, batchSize)
+	events := make([]storage.Event, 0, batchSize)
+	for rows.Next() {
+		var id int64
+		var payload []byte
+		if err = rows.Scan(&id, &payload); err != nil {
+			return 0, err
+		}
+
+		var event storage.Event
+		if err = json.Unmarshal(payload, &event); err != nil {
+			return 0, fmt.Errorf("outbox %d: %w", id, err)
+		}
+		ids = append(ids, id)
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err = s.publisher.Publish(ctx, events...); err != nil {
+		return 0, err
+	}
+
+	query = `UPDATE banner_rotation.outbox SET delivered_at = now()
+	WHERE id IN (` + placeholders(1, len(ids)) + `);`
+
+	if _, err = tx.ExecContext(ctx, query, ids...); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(events), nil
+}
+
+// deleteDeliveredOutbox удаляет события, отправленные раньше before.
+func (s *Storage) deleteDeliveredOutbox(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM banner_rotation.outbox WHERE delivered_at < $1;`
+
+	_, err := s.db.ExecContext(ctx, query, before)
+	return err
+}
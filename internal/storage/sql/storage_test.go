@@ -0,0 +1,180 @@
+package sqlstorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/astrviktor/banner-rotation/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+// testDSNEnv - переменная окружения с DSN тестовой базы, созданной по migrations/create.sql.
+// Все таблицы базы очищаются перед каждым тестом.
+const testDSNEnv = "BANNER_ROTATION_TEST_DSN"
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+
+		s := New(config.Config{DB: config.DBConfig{DSN: dsn, MaxConnectAttempts: 1}})
+		require.NoError(t, s.Connect(ctx))
+		t.Cleanup(s.Close)
+
+		_, err := s.db.Exec(`TRUNCATE banner_rotation.slot, banner_rotation.banner, banner_rotation.segment,
+		banner_rotation.rotation, banner_rotation.stat, banner_rotation.event, banner_rotation.slot_stat,
+		banner_rotation.stat_bucket, banner_rotation.model, banner_rotation.impression, banner_rotation.outbox,
+		banner_rotation.event_id;`)
+		require.NoError(t, err)
+
+		return s
+	})
+}
+
+// fakePublisher запоминает отправленные события или возвращает err.
+type fakePublisher struct {
+	events []storage.Event
+	err    error
+}
+
+func (p *fakePublisher) Connect(context.Context) error { return nil }
+
+func (p *fakePublisher) Close() {}
+
+func (p *fakePublisher) Publish(_ context.Context, events ...storage.Event) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, events...)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	// publisher задается после Connect: отправку из outbox вызываем сами
+	s := New(config.Config{DB: config.DBConfig{DSN: dsn, MaxConnectAttempts: 1}})
+	require.NoError(t, s.Connect(ctx))
+	defer s.Close()
+
+	publisher := &fakePublisher{err: errors.New("publisher is down")}
+	s.publisher = publisher
+
+	_, err := s.db.Exec(`TRUNCATE banner_rotation.slot, banner_rotation.banner, banner_rotation.segment,
+	banner_rotation.outbox, banner_rotation.event_id CASCADE;`)
+	require.NoError(t, err)
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: banner}))
+
+	require.NoError(t, s.CreateEvent(ctx, slot, banner, segment, storage.Show))
+	require.NoError(t, s.CreateEvent(ctx, slot, banner, segment, storage.Click))
+
+	// событие не записано - в outbox ничего не добавляется
+	require.ErrorIs(t, s.CreateEvent(ctx, slot, storage.NewID(), segment, storage.Show), storage.ErrBannerNotFound)
+
+	// событие из внешнего источника учитывается, но не отправляется повторно
+	require.NoError(t, s.RecordEvent(ctx, storage.Event{ID: storage.NewID(), SlotID: slot, BannerID: banner,
+		SegmentID: segment, Action: storage.Show, Date: time.Now().UTC()}))
+
+	_, err = s.publishOutbox(ctx, 10)
+	require.Error(t, err)
+
+	publisher.err = nil
+	count, err := s.publishOutbox(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	count, err = s.publishOutbox(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	count, err = s.publishOutbox(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	require.Len(t, publisher.events, 2)
+	for idx, action := range []storage.ActionType{storage.Show, storage.Click} {
+		require.Equal(t, action, publisher.events[idx].Action)
+		require.Equal(t, banner, publisher.events[idx].BannerID)
+	}
+}
+
+func TestOutboxImpression(t *testing.T) {
+	ctx := context.Background()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	s := New(config.Config{DB: config.DBConfig{DSN: dsn, MaxConnectAttempts: 1}})
+	require.NoError(t, s.Connect(ctx))
+	defer s.Close()
+
+	publisher := &fakePublisher{}
+	s.publisher = publisher
+
+	_, err := s.db.Exec(`TRUNCATE banner_rotation.slot, banner_rotation.banner, banner_rotation.segment,
+	banner_rotation.outbox, banner_rotation.event_id CASCADE;`)
+	require.NoError(t, err)
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: banner}))
+
+	// показ из /choice записывается вместе с показом, переход - по его ID
+	impression, err := s.CreateImpression(ctx, slot, banner, segment, time.Hour, true)
+	require.NoError(t, err)
+	_, _, err = s.ClickImpression(ctx, impression.ID)
+	require.NoError(t, err)
+
+	rows, err := s.db.Query(`SELECT payload->>'impressionId' FROM banner_rotation.outbox ORDER BY id;`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	ids := make([]string, 0, 2)
+	for rows.Next() {
+		var id sql.NullString
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id.String)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{impression.ID, impression.ID}, ids)
+
+	count, err := s.publishOutbox(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	require.Len(t, publisher.events, 2)
+	for idx, action := range []storage.ActionType{storage.Show, storage.Click} {
+		require.Equal(t, action, publisher.events[idx].Action)
+		require.Equal(t, impression.ID, publisher.events[idx].ImpressionID)
+	}
+}
@@ -5,42 +5,50 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/events"
 	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/jackc/pgx"
 	_ "github.com/jackc/pgx/stdlib" //nolint
-	"github.com/segmentio/kafka-go"
 )
 
 type Storage struct {
-	mode                    string
-	dsn                     string
-	dbMaxConnectAttempts    int
-	db                      *sql.DB
-	kafkaUse                bool
-	kafkaTopic              string
-	kafkaBrokerAddress      string
-	kafkaMaxConnectAttempts int
-	kafka                   *kafka.Conn
+	mode                 string
+	dsn                  string
+	dbMaxConnectAttempts int
+	db                   *sql.DB
+	publisher            events.Publisher
+	outbox               config.OutboxConfig
+	outboxNotify         chan struct{}
+	stopRelay            context.CancelFunc
+	relayDone            chan struct{}
 }
 
 func New(config config.Config) *Storage {
 	return &Storage{
-		mode:                    config.DB.Mode,
-		dsn:                     config.DB.DSN,
-		dbMaxConnectAttempts:    config.DB.MaxConnectAttempts,
-		db:                      nil,
-		kafkaUse:                config.Kafka.Use,
-		kafkaTopic:              config.Kafka.Topic,
-		kafkaBrokerAddress:      config.Kafka.BrokerAddress,
-		kafkaMaxConnectAttempts: config.Kafka.MaxConnectAttempts,
-		kafka:                   nil,
+		mode:                 config.DB.Mode,
+		dsn:                  config.DB.DSN,
+		dbMaxConnectAttempts: config.DB.MaxConnectAttempts,
+		db:                   nil,
+		outbox:               config.Events.Outbox,
+		outboxNotify:         make(chan struct{}, 1),
 	}
 }
 
-func (s *Storage) Connect() error {
+// NewWithOutbox - хранилище, которое кладет события в outbox в одной транзакции с их записью
+// и отправляет их через publisher. Подключает и закрывает publisher само.
+func NewWithOutbox(config config.Config, publisher events.Publisher) *Storage {
+	s := New(config)
+	s.publisher = publisher
+	return s
+}
+
+func (s *Storage) Connect(ctx context.Context) error {
 	db, err := sql.Open("pgx", s.dsn)
 	if err != nil {
 		return err
@@ -48,54 +56,71 @@ func (s *Storage) Connect() error {
 
 	for i := 0; i < s.dbMaxConnectAttempts; i++ {
 		log.Println("trying to connect to db...")
-		err = db.Ping()
+		err = db.PingContext(ctx)
 		if err == nil {
 			break
 		}
-		time.Sleep(5 * time.Second)
+
+		if waitErr := wait(ctx, 5*time.Second); waitErr != nil {
+			_ = db.Close()
+			return waitErr
+		}
 	}
 
 	if err != nil {
+		_ = db.Close()
 		return err
 	}
 	log.Println("connect to db OK")
 	s.db = db
 
-	if s.kafkaUse {
-		var conn *kafka.Conn
-		for i := 0; i < s.kafkaMaxConnectAttempts; i++ {
-			conn, err = kafka.DialLeader(context.Background(), "tcp", s.kafkaBrokerAddress, s.kafkaTopic, 0)
-			if err == nil {
-				break
-			}
-			log.Println("trying to connect to kafka...")
-			time.Sleep(5 * time.Second)
-		}
-
-		if err != nil {
+	if s.publisher != nil {
+		if err = s.publisher.Connect(ctx); err != nil {
 			return err
 		}
 
-		log.Println("connect to kafka OK")
-		s.kafka = conn
+		relayCtx, cancel := context.WithCancel(context.Background())
+		s.stopRelay = cancel
+		s.relayDone = make(chan struct{})
+		go s.relayOutbox(relayCtx)
 	}
 	return nil
 }
 
+// wait ждет перед следующей попыткой подключения, ctx.Err(), если подключение отменено.
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (s *Storage) Close() {
-	if err := s.db.Close(); err != nil {
-		log.Printf("failed to close db: %s", err)
+	if s.stopRelay != nil {
+		s.stopRelay()
+		<-s.relayDone
 	}
 
-	if err := s.kafka.Close(); err != nil {
-		log.Printf("failed to close kafka: %s", err)
+	if s.db != nil {
+		if err := s.db.Close(); err != nil {
+			log.Printf("failed to close db: %s", err)
+		}
+	}
+
+	if s.publisher != nil {
+		s.publisher.Close()
 	}
 }
 
-func (s *Storage) CreateSlot(description string) (string, error) {
+func (s *Storage) CreateSlot(ctx context.Context, description string) (string, error) {
 	id := storage.NewID()
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -104,7 +129,7 @@ func (s *Storage) CreateSlot(description string) (string, error) {
     (id, description)
 	VALUES ($1, $2);`
 
-	_, err = tx.Exec(query, id, description)
+	_, err = tx.ExecContext(ctx, query, id, description)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -117,19 +142,27 @@ func (s *Storage) CreateSlot(description string) (string, error) {
 	return id, nil
 }
 
-func (s *Storage) CreateBanner(description string) (string, error) {
+func (s *Storage) CreateBanner(ctx context.Context, description string) (string, error) {
+	return s.CreateBannerWithCreative(ctx, description, storage.Creative{})
+}
+
+// CreateBannerWithCreative создает баннер сразу с содержимым в одной транзакции.
+func (s *Storage) CreateBannerWithCreative(ctx context.Context, description string,
+	creative storage.Creative) (string, error) {
 	id := storage.NewID()
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return storage.EmptyID, err
 	}
+	defer func() { _ = tx.Rollback() }()
 
 	query := `INSERT INTO banner_rotation.banner
-    (id, description)
-	VALUES ($1, $2);`
+    (id, description, format, width, height, image_url, html, target_url, alt_text)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`
 
-	_, err = tx.Exec(query, id, description)
+	_, err = tx.ExecContext(ctx, query, id, description, creative.Format, creative.Width, creative.Height,
+		creative.ImageURL, creative.HTML, creative.TargetURL, creative.AltText)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -138,7 +171,7 @@ func (s *Storage) CreateBanner(description string) (string, error) {
     (banner_id, segment_id, show_count, click_count)
 	SELECT $1, id, 0, 0 FROM banner_rotation.segment;`
 
-	_, err = tx.Exec(query, id)
+	_, err = tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -151,10 +184,35 @@ func (s *Storage) CreateBanner(description string) (string, error) {
 	return id, nil
 }
 
-func (s *Storage) CreateSegment(description string) (string, error) {
+func (s *Storage) GetBanner(ctx context.Context, bannerID string) (storage.Banner, error) {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return storage.Banner{}, err
+	}
+
+	banner := storage.Banner{ID: bannerID}
+
+	query := `SELECT description, format, width, height, image_url, html, target_url, alt_text
+	FROM banner_rotation.banner
+	WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, bannerID).Scan(
+		&banner.Description, &banner.Format, &banner.Width, &banner.Height,
+		&banner.ImageURL, &banner.HTML, &banner.TargetURL, &banner.AltText)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Banner{}, storage.ErrBannerNotFound
+	}
+
+	if err != nil {
+		return storage.Banner{}, err
+	}
+
+	return banner, nil
+}
+
+func (s *Storage) CreateSegment(ctx context.Context, description string) (string, error) {
 	id := storage.NewID()
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -163,7 +221,7 @@ func (s *Storage) CreateSegment(description string) (string, error) {
     (id, description)
 	VALUES ($1, $2);`
 
-	_, err = tx.Exec(query, id, description)
+	_, err = tx.ExecContext(ctx, query, id, description)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -172,7 +230,7 @@ func (s *Storage) CreateSegment(description string) (string, error) {
     (banner_id, segment_id, show_count, click_count)
 	SELECT id, $1, 0, 0 FROM banner_rotation.banner;`
 
-	_, err = tx.Exec(query, id)
+	_, err = tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return storage.EmptyID, err
 	}
@@ -185,187 +243,1323 @@ func (s *Storage) CreateSegment(description string) (string, error) {
 	return id, nil
 }
 
-func (s *Storage) CreateRotation(rotation storage.Rotation) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
+func (s *Storage) GetSlot(ctx context.Context, slotID string) (storage.Slot, error) {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return storage.Slot{}, err
 	}
 
-	query := `INSERT INTO banner_rotation.rotation
-    (slot_id, banner_id)
-	VALUES ($1, $2);`
+	slot := storage.Slot{ID: slotID}
+
+	query := `SELECT description FROM banner_rotation.slot WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, slotID).Scan(&slot.Description)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Slot{}, storage.ErrSlotNotFound
+	}
 
-	_, err = tx.Exec(query, rotation.SlotID, rotation.BannerID)
 	if err != nil {
+		return storage.Slot{}, err
+	}
+
+	return slot, nil
+}
+
+func (s *Storage) UpdateSlot(ctx context.Context, slot storage.Slot) error {
+	if err := storage.ValidateIDs(slot.ID); err != nil {
 		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	query := `UPDATE banner_rotation.slot SET description = $2 WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, slot.ID, slot.Description)
+	return affectedOne(result, err, storage.ErrSlotNotFound)
+}
+
+// DeleteSlot удаляет слот вместе с ротацией и статистикой по слоту, события остаются.
+func (s *Storage) DeleteSlot(ctx context.Context, slotID string) error {
+	if err := storage.ValidateIDs(slotID); err != nil {
 		return err
 	}
 
-	return nil
+	return s.deleteItem(ctx, slotID, storage.ErrSlotNotFound,
+		`DELETE FROM banner_rotation.rotation WHERE slot_id = $1;`,
+		`DELETE FROM banner_rotation.slot_stat WHERE slot_id = $1;`,
+		`DELETE FROM banner_rotation.stat_bucket WHERE slot_id = $1;`,
+		`DELETE FROM banner_rotation.impression WHERE slot_id = $1;`,
+		`DELETE FROM banner_rotation.slot WHERE id = $1;`)
 }
 
-func (s *Storage) DeleteRotation(rotation storage.Rotation) error {
-	tx, err := s.db.Begin()
+func (s *Storage) ListSlots(ctx context.Context, query storage.ListQuery) ([]storage.Slot, int, error) {
+	slots := make([]storage.Slot, 0)
+
+	total, err := s.listItems(ctx, "banner_rotation.slot", "id, description", query, func(rows *sql.Rows) error {
+		var slot storage.Slot
+		if err := rows.Scan(&slot.ID, &slot.Description); err != nil {
+			return err
+		}
+		slots = append(slots, slot)
+		return nil
+	})
 	if err != nil {
+		return nil, 0, err
+	}
+
+	return slots, total, nil
+}
+
+func (s *Storage) UpdateBanner(ctx context.Context, banner storage.Banner) error {
+	if err := storage.ValidateIDs(banner.ID); err != nil {
 		return err
 	}
 
-	query := `DELETE FROM banner_rotation.rotation WHERE slot_id=$1 AND banner_id = $2;`
+	query := `UPDATE banner_rotation.banner
+	SET description = $2, format = $3, width = $4, height = $5, image_url = $6, html = $7, target_url = $8,
+	alt_text = $9
+	WHERE id = $1;`
 
-	_, err = tx.Exec(query, rotation.SlotID, rotation.BannerID)
-	if err != nil {
+	result, err := s.db.ExecContext(ctx, query, banner.ID, banner.Description, banner.Format, banner.Width, banner.Height,
+		banner.ImageURL, banner.HTML, banner.TargetURL, banner.AltText)
+	return affectedOne(result, err, storage.ErrBannerNotFound)
+}
+
+// DeleteBanner удаляет баннер из ротаций вместе со статистикой и моделью, события остаются.
+func (s *Storage) DeleteBanner(ctx context.Context, bannerID string) error {
+	if err := storage.ValidateIDs(bannerID); err != nil {
 		return err
 	}
 
-	err = tx.Commit()
+	return s.deleteItem(ctx, bannerID, storage.ErrBannerNotFound,
+		`DELETE FROM banner_rotation.rotation WHERE banner_id = $1;`,
+		`DELETE FROM banner_rotation.stat WHERE banner_id = $1;`,
+		`DELETE FROM banner_rotation.slot_stat WHERE banner_id = $1;`,
+		`DELETE FROM banner_rotation.stat_bucket WHERE banner_id = $1;`,
+		`DELETE FROM banner_rotation.model WHERE banner_id = $1;`,
+		`DELETE FROM banner_rotation.impression WHERE banner_id = $1;`,
+		`DELETE FROM banner_rotation.banner WHERE id = $1;`)
+}
+
+func (s *Storage) ListBanners(ctx context.Context, query storage.ListQuery) ([]storage.Banner, int, error) {
+	banners := make([]storage.Banner, 0)
+
+	columns := "id, description, format, width, height, image_url, html, target_url, alt_text"
+	total, err := s.listItems(ctx, "banner_rotation.banner", columns, query, func(rows *sql.Rows) error {
+		var banner storage.Banner
+		err := rows.Scan(&banner.ID, &banner.Description, &banner.Format, &banner.Width, &banner.Height,
+			&banner.ImageURL, &banner.HTML, &banner.TargetURL, &banner.AltText)
+		if err != nil {
+			return err
+		}
+		banners = append(banners, banner)
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	return nil
+	return banners, total, nil
 }
 
-func (s *Storage) CreateEvent(slotID, bannerID, segmentID string, action storage.ActionType) error {
-	event := storage.Event{
-		SlotID:    slotID,
-		BannerID:  bannerID,
-		SegmentID: segmentID,
-		Action:    action,
-		Date:      time.Now().UTC(),
+func (s *Storage) GetSegment(ctx context.Context, segmentID string) (storage.Segment, error) {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return storage.Segment{}, err
+	}
+
+	segment := storage.Segment{ID: segmentID}
+
+	var features []byte
+
+	query := `SELECT description, features FROM banner_rotation.segment WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, segmentID).Scan(&segment.Description, &features)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Segment{}, storage.ErrSegmentNotFound
 	}
 
-	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return storage.Segment{}, err
 	}
 
-	var query string
-	switch action {
-	case storage.Show:
-		query = `INSERT INTO banner_rotation.event
-    (slot_id, banner_id, segment_id, action, date)
-	VALUES ($1, $2, $3, 'show', $4);`
-	case storage.Click:
-		query = `INSERT INTO banner_rotation.event
-    (slot_id, banner_id, segment_id, action, date)
-	VALUES ($1, $2, $3, 'click', $4);`
+	if err = json.Unmarshal(features, &segment.Features); err != nil {
+		return storage.Segment{}, err
 	}
 
-	_, err = tx.Exec(query, event.SlotID, event.BannerID, event.SegmentID, event.Date.Format(time.RFC3339))
-	if err != nil {
+	return segment, nil
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, segment storage.Segment) error {
+	if err := storage.ValidateIDs(segment.ID); err != nil {
 		return err
 	}
 
-	switch action {
-	case storage.Show:
-		query = `UPDATE banner_rotation.stat
-    SET show_count = show_count + 1
-    WHERE banner_id = $1 AND segment_id = $2;`
-	case storage.Click:
-		query = `UPDATE banner_rotation.stat
-    SET click_count = click_count + 1
-    WHERE banner_id = $1 AND segment_id = $2;`
+	features := segment.Features
+	if features == nil {
+		features = []float64{}
 	}
 
-	_, err = tx.Exec(query, event.BannerID, event.SegmentID)
+	bytes, err := json.Marshal(features)
 	if err != nil {
 		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	query := `UPDATE banner_rotation.segment SET description = $2, features = $3 WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, segment.ID, segment.Description, string(bytes))
+	return affectedOne(result, err, storage.ErrSegmentNotFound)
+}
+
+// DeleteSegment удаляет сегмент вместе со статистикой по сегменту, события остаются.
+func (s *Storage) DeleteSegment(ctx context.Context, segmentID string) error {
+	if err := storage.ValidateIDs(segmentID); err != nil {
 		return err
 	}
 
-	// положить event в kafka
-	if s.kafkaUse {
-		bytes, err := json.Marshal(event)
-		if err != nil {
+	return s.deleteItem(ctx, segmentID, storage.ErrSegmentNotFound,
+		`DELETE FROM banner_rotation.stat WHERE segment_id = $1;`,
+		`DELETE FROM banner_rotation.slot_stat WHERE segment_id = $1;`,
+		`DELETE FROM banner_rotation.stat_bucket WHERE segment_id = $1;`,
+		`DELETE FROM banner_rotation.impression WHERE segment_id = $1;`,
+		`DELETE FROM banner_rotation.segment WHERE id = $1;`)
+}
+
+func (s *Storage) ListSegments(ctx context.Context, query storage.ListQuery) ([]storage.Segment, int, error) {
+	segments := make([]storage.Segment, 0)
+
+	columns := "id, description, features"
+	total, err := s.listItems(ctx, "banner_rotation.segment", columns, query, func(rows *sql.Rows) error {
+		var segment storage.Segment
+		var features []byte
+		if err := rows.Scan(&segment.ID, &segment.Description, &features); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(features, &segment.Features); err != nil {
 			return err
 		}
+		segments = append(segments, segment)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
 
-		_, err = s.kafka.WriteMessages(kafka.Message{
-			Value: bytes,
-		})
+	return segments, total, nil
+}
+
+// deleteItem выполняет запросы удаления с параметром id в одной транзакции,
+// последний запрос удаляет сам элемент: если он ничего не удалил, возвращается notFound.
+func (s *Storage) deleteItem(ctx context.Context, id string, notFound error, queries ...string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
 
+	var result sql.Result
+	for _, query := range queries {
+		result, err = tx.ExecContext(ctx, query, id)
 		if err != nil {
 			return err
 		}
+	}
 
-		log.Println("write event to kafka")
+	if err = affectedOne(result, nil, notFound); err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (s *Storage) GetBannersForSlot(slotID string) ([]string, error) {
-	bannersID := make([]string, 0)
+// listItems читает страницу таблицы table, отсортированной по описанию, и возвращает общее количество
+// найденных строк. Порядок сортировки побайтовый (COLLATE "C"), как в memorystorage.
+func (s *Storage) listItems(ctx context.Context, table, columns string, query storage.ListQuery,
+	scan func(rows *sql.Rows) error) (int, error) {
+	pattern := "%" + likeEscaper.Replace(query.Search) + "%"
 
-	query := `SELECT banner_id
-	FROM banner_rotation.rotation 
-	WHERE slot_id = $1;`
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM `+table+` WHERE description ILIKE $1;`, pattern).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	var limit interface{}
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
 
-	rows, err := s.db.Query(query, slotID)
+	offset := query.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+columns+` FROM `+table+`
+	WHERE description ILIKE $1
+	ORDER BY description COLLATE "C", id
+	LIMIT $2 OFFSET $3;`, pattern, limit, offset)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var bannerID string
+		if err = scan(rows); err != nil {
+			return 0, err
+		}
+	}
 
-		err = rows.Scan(&bannerID)
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
 
-		if errors.Is(err, sql.ErrNoRows) {
-			return bannersID, nil
-		}
+	return total, nil
+}
 
-		if err != nil {
-			return bannersID, err
-		}
+// checkRefs проверяет одним запросом, что слот, баннер и сегмент существуют, пустой ID не проверяется.
+func checkRefs(ctx context.Context, queryRow func(ctx context.Context, query string, args ...interface{}) *sql.Row,
+	slotID, bannerID, segmentID string) error {
+	var slotExists, bannerExists, segmentExists bool
 
-		if rows.Err() != nil {
-			return bannersID, err
-		}
+	query := `SELECT $1 = '' OR EXISTS(SELECT 1 FROM banner_rotation.slot WHERE id = NULLIF($1, '')::uuid),
+	$2 = '' OR EXISTS(SELECT 1 FROM banner_rotation.banner WHERE id = NULLIF($2, '')::uuid),
+	$3 = '' OR EXISTS(SELECT 1 FROM banner_rotation.segment WHERE id = NULLIF($3, '')::uuid);`
 
-		bannersID = append(bannersID, bannerID)
+	err := queryRow(ctx, query, slotID, bannerID, segmentID).Scan(&slotExists, &bannerExists, &segmentExists)
+	if err != nil {
+		return err
 	}
 
-	return bannersID, nil
+	switch {
+	case !slotExists:
+		return storage.ErrSlotNotFound
+	case !bannerExists:
+		return storage.ErrBannerNotFound
+	case !segmentExists:
+		return storage.ErrSegmentNotFound
+	}
+
+	return nil
 }
 
-func (s *Storage) GetStatForBannerAndSegment(bannerID, segmentID string) (storage.Stat, error) {
-	var stat storage.Stat
-	stat.BannerID = bannerID
-	stat.SegmentID = segmentID
+// storageError заменяет нарушение внешнего или уникального ключа на ошибку хранилища.
+func storageError(err error) error {
+	var pgErr pgx.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
 
-	query := `SELECT show_count, click_count
-	FROM banner_rotation.stat
-	WHERE banner_id = $1 AND segment_id = $2;`
+	switch pgErr.Code {
+	case foreignKeyViolation:
+		return fmt.Errorf("%w: %s", storage.ErrNotFound, pgErr.Detail)
+	case uniqueViolation:
+		return fmt.Errorf("%w: %s", storage.ErrAlreadyExists, pgErr.Detail)
+	default:
+		return err
+	}
+}
 
-	rows, err := s.db.Query(query, bannerID, segmentID)
+// Коды ошибок PostgreSQL.
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+// likeEscaper экранирует спецсимволы LIKE, чтобы поиск был по подстроке как есть.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// affectedOne возвращает notFound, если запрос не изменил ни одной строки.
+func affectedOne(result sql.Result, err error, notFound error) error {
 	if err != nil {
-		return storage.Stat{}, err
+		return err
 	}
-	defer rows.Close()
 
-	rows.Next()
-	err = rows.Scan(&stat.ShowCount, &stat.ClickCount)
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return notFound
+	}
+
+	return nil
+}
+
+func (s *Storage) CreateRotation(ctx context.Context, rotation storage.Rotation) error {
+	if err := storage.ValidateIDs(rotation.SlotID, rotation.BannerID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var slotExists, bannerExists bool
+
+	query := `SELECT EXISTS(SELECT 1 FROM banner_rotation.slot WHERE id = $1),
+	EXISTS(SELECT 1 FROM banner_rotation.banner WHERE id = $2);`
+
+	err = tx.QueryRowContext(ctx, query, rotation.SlotID, rotation.BannerID).Scan(&slotExists, &bannerExists)
+	if err != nil {
+		return err
+	}
+
+	if !slotExists {
+		return storage.ErrSlotNotFound
+	}
+
+	if !bannerExists {
+		return storage.ErrBannerNotFound
+	}
+
+	query = `INSERT INTO banner_rotation.rotation
+    (slot_id, banner_id)
+	VALUES ($1, $2)
+	ON CONFLICT (slot_id, banner_id) DO NOTHING;`
+
+	result, err := tx.ExecContext(ctx, query, rotation.SlotID, rotation.BannerID)
+	if err = affectedOne(result, storageError(err), storage.ErrRotationExists); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteRotation(ctx context.Context, rotation storage.Rotation) error {
+	if err := storage.ValidateIDs(rotation.SlotID, rotation.BannerID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = tx.Rollback() }()
+
+	query := `DELETE FROM banner_rotation.rotation WHERE slot_id=$1 AND banner_id = $2;`
+
+	result, err := tx.ExecContext(ctx, query, rotation.SlotID, rotation.BannerID)
+	if err = affectedOne(result, err, storage.ErrRotationNotFound); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReplaceRotations заменяет набор баннеров слота в одной транзакции. Строка слота блокируется,
+// чтобы одновременные замены ротации одного слота выполнялись по очереди.
+func (s *Storage) ReplaceRotations(ctx context.Context, slotID string, bannerIDs []string) (storage.RotationDiff,
+	error) {
+	if err := storage.ValidateIDs(append([]string{slotID}, bannerIDs...)...); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.RotationDiff{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var id string
+	err = tx.QueryRowContext(ctx, `SELECT id FROM banner_rotation.slot WHERE id = $1 FOR UPDATE;`, slotID).Scan(&id)
 	if errors.Is(err, sql.ErrNoRows) {
-		return storage.Stat{}, errors.New("stat not found")
+		return storage.RotationDiff{}, storage.ErrSlotNotFound
 	}
 
 	if err != nil {
-		return storage.Stat{}, err
+		return storage.RotationDiff{}, err
 	}
 
-	if rows.Err() != nil {
-		return storage.Stat{}, err
+	rows, err := tx.QueryContext(ctx, `SELECT banner_id FROM banner_rotation.rotation WHERE slot_id = $1;`, slotID)
+	if err != nil {
+		return storage.RotationDiff{}, err
 	}
 
-	return stat, nil
+	current := make([]string, 0)
+	for rows.Next() {
+		var bannerID string
+		if err = rows.Scan(&bannerID); err != nil {
+			rows.Close()
+			return storage.RotationDiff{}, err
+		}
+		current = append(current, bannerID)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	diff := storage.DiffRotations(current, bannerIDs)
+
+	for _, bannerID := range diff.Added {
+		var exists bool
+		query := `SELECT EXISTS(SELECT 1 FROM banner_rotation.banner WHERE id = $1);`
+		if err = tx.QueryRowContext(ctx, query, bannerID).Scan(&exists); err != nil {
+			return storage.RotationDiff{}, err
+		}
+
+		if !exists {
+			return storage.RotationDiff{}, fmt.Errorf("%w: %s", storage.ErrBannerNotFound, bannerID)
+		}
+
+		query = `INSERT INTO banner_rotation.rotation (slot_id, banner_id) VALUES ($1, $2);`
+		if _, err = tx.ExecContext(ctx, query, slotID, bannerID); err != nil {
+			return storage.RotationDiff{}, err
+		}
+	}
+
+	for _, bannerID := range diff.Removed {
+		query := `DELETE FROM banner_rotation.rotation WHERE slot_id = $1 AND banner_id = $2;`
+		if _, err = tx.ExecContext(ctx, query, slotID, bannerID); err != nil {
+			return storage.RotationDiff{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	return diff, nil
+}
+
+func (s *Storage) CreateEvent(ctx context.Context, slotID, bannerID, segmentID string,
+	action storage.ActionType) error {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return err
+	}
+
+	event := storage.Event{
+		SlotID:    slotID,
+		BannerID:  bannerID,
+		SegmentID: segmentID,
+		Action:    action,
+		Date:      time.Now().UTC(),
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = s.addEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	s.notifyOutbox()
+	return nil
+}
+
+// RecordEvent записывает событие из внешнего источника с его ID и временем.
+// Событие с уже записанным ID не учитывается повторно (ErrEventExists), переход, после которого
+// переходов в слоте станет больше показов, не записывается (ErrClicksExceedShows).
+// В outbox событие не кладется: оно уже есть в источнике.
+func (s *Storage) RecordEvent(ctx context.Context, event storage.Event) error {
+	if err := storage.ValidateIDs(event.ID, event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	event.Date = event.Date.UTC()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `INSERT INTO banner_rotation.event_id (id, recorded_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING;`
+
+	result, err := tx.ExecContext(ctx, query, event.ID, time.Now().UTC())
+	if err = affectedOne(result, err, storage.ErrEventExists); err != nil {
+		return err
+	}
+
+	if err = countEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	// строка статистики слота заблокирована обновлением до конца транзакции
+	if event.Action == storage.Click {
+		var shows, clicks int
+		query = `SELECT show_count, click_count
+		FROM banner_rotation.slot_stat
+		WHERE slot_id = $1 AND banner_id = $2 AND segment_id = $3;`
+
+		err = tx.QueryRowContext(ctx, query, event.SlotID, event.BannerID, event.SegmentID).Scan(&shows, &clicks)
+		if err != nil {
+			return err
+		}
+
+		if clicks > shows {
+			return storage.ErrClicksExceedShows
+		}
+	}
+
+	return tx.Commit()
+}
+
+// addEvent записывает событие, учитывает его в статистике и, если задана отправка событий,
+// кладет его в outbox в транзакции tx.
+func (s *Storage) addEvent(ctx context.Context, tx *sql.Tx, event storage.Event) error {
+	if err := countEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	if s.publisher != nil {
+		return addOutbox(ctx, tx, event)
+	}
+	return nil
+}
+
+// countEvent записывает событие и учитывает его в статистике в транзакции tx.
+func countEvent(ctx context.Context, tx *sql.Tx, event storage.Event) error {
+	if err := checkRefs(ctx, tx.QueryRowContext, event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	var query string
+	switch event.Action {
+	case storage.Show:
+		query = `INSERT INTO banner_rotation.event
+    (slot_id, banner_id, segment_id, action, date)
+	VALUES ($1, $2, $3, 'show', $4);`
+	case storage.Click:
+		query = `INSERT INTO banner_rotation.event
+    (slot_id, banner_id, segment_id, action, date)
+	VALUES ($1, $2, $3, 'click', $4);`
+	}
+
+	_, err := tx.ExecContext(ctx, query, event.SlotID, event.BannerID, event.SegmentID, event.Date.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	switch event.Action {
+	case storage.Show:
+		query = `UPDATE banner_rotation.stat
+    SET show_count = show_count + 1
+    WHERE banner_id = $1 AND segment_id = $2;`
+	case storage.Click:
+		query = `UPDATE banner_rotation.stat
+    SET click_count = click_count + 1
+    WHERE banner_id = $1 AND segment_id = $2;`
+	}
+
+	_, err = tx.ExecContext(ctx, query, event.BannerID, event.SegmentID)
+	if err != nil {
+		return err
+	}
+
+	switch event.Action {
+	case storage.Show:
+		query = `INSERT INTO banner_rotation.slot_stat
+    (slot_id, banner_id, segment_id, show_count, click_count)
+	VALUES ($1, $2, $3, 1, 0)
+	ON CONFLICT (slot_id, banner_id, segment_id)
+	DO UPDATE SET show_count = banner_rotation.slot_stat.show_count + 1;`
+	case storage.Click:
+		query = `INSERT INTO banner_rotation.slot_stat
+    (slot_id, banner_id, segment_id, show_count, click_count)
+	VALUES ($1, $2, $3, 0, 1)
+	ON CONFLICT (slot_id, banner_id, segment_id)
+	DO UPDATE SET click_count = banner_rotation.slot_stat.click_count + 1;`
+	}
+
+	_, err = tx.ExecContext(ctx, query, event.SlotID, event.BannerID, event.SegmentID)
+	if err != nil {
+		return err
+	}
+
+	switch event.Action {
+	case storage.Show:
+		query = `INSERT INTO banner_rotation.stat_bucket
+    (slot_id, banner_id, segment_id, start, show_count, click_count)
+	VALUES ($1, $2, $3, $4, 1, 0)
+	ON CONFLICT (slot_id, banner_id, segment_id, start)
+	DO UPDATE SET show_count = banner_rotation.stat_bucket.show_count + 1;`
+	case storage.Click:
+		query = `INSERT INTO banner_rotation.stat_bucket
+    (slot_id, banner_id, segment_id, start, show_count, click_count)
+	VALUES ($1, $2, $3, $4, 0, 1)
+	ON CONFLICT (slot_id, banner_id, segment_id, start)
+	DO UPDATE SET click_count = banner_rotation.stat_bucket.click_count + 1;`
+	}
+
+	// интервал по всем слотам и интервал слота
+	start := event.Date.Truncate(storage.StatBucketSize)
+	for _, slotID := range []string{storage.AllSlots, event.SlotID} {
+		_, err = tx.ExecContext(ctx, query, slotID, event.BannerID, event.SegmentID, start)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) GetBannersForSlot(ctx context.Context, slotID string) ([]string, error) {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return nil, err
+	}
+
+	bannersID := make([]string, 0)
+
+	query := `SELECT banner_id
+	FROM banner_rotation.rotation 
+	WHERE slot_id = $1;`
+
+	rows, err := s.db.QueryContext(ctx, query, slotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bannerID string
+
+		err = rows.Scan(&bannerID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return bannersID, nil
+		}
+
+		if err != nil {
+			return bannersID, err
+		}
+
+		if rows.Err() != nil {
+			return bannersID, err
+		}
+
+		bannersID = append(bannersID, bannerID)
+	}
+
+	// слот проверяется только при пустой ротации, чтобы не делать лишний запрос при каждом выборе
+	if len(bannersID) == 0 {
+		if err = checkRefs(ctx, s.db.QueryRowContext, slotID, "", ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return bannersID, nil
+}
+
+func (s *Storage) GetStatForBannerAndSegment(ctx context.Context, bannerID, segmentID string) (storage.Stat, error) {
+	if err := storage.ValidateIDs(bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
+
+	var stat storage.Stat
+	stat.SlotID = storage.AllSlots
+	stat.BannerID = bannerID
+	stat.SegmentID = segmentID
+
+	query := `SELECT show_count, click_count
+	FROM banner_rotation.stat
+	WHERE banner_id = $1 AND segment_id = $2;`
+
+	// строка создается вместе с баннером и сегментом, ее нет только для неизвестного баннера или сегмента
+	err := s.db.QueryRowContext(ctx, query, bannerID, segmentID).Scan(&stat.ShowCount, &stat.ClickCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = checkRefs(ctx, s.db.QueryRowContext, "", bannerID, segmentID)
+	}
+	if err != nil {
+		return storage.Stat{}, err
+	}
+
+	return stat, nil
+}
+
+// GetStatsForSlotAndSegment - статистика баннеров из ротации слота для сегмента одним запросом:
+// только по этому слоту, если perSlot, иначе общая.
+func (s *Storage) GetStatsForSlotAndSegment(ctx context.Context, slotID, segmentID string,
+	perSlot bool) ([]storage.Stat, error) {
+	if err := storage.ValidateIDs(slotID, segmentID); err != nil {
+		return nil, err
+	}
+
+	statSlotID := storage.AllSlots
+	query := `SELECT r.banner_id, COALESCE(st.show_count, 0), COALESCE(st.click_count, 0)
+	FROM banner_rotation.rotation r
+	LEFT JOIN banner_rotation.stat st ON st.banner_id = r.banner_id AND st.segment_id = $2
+	WHERE r.slot_id = $1;`
+
+	if perSlot {
+		statSlotID = slotID
+		query = `SELECT r.banner_id, COALESCE(st.show_count, 0), COALESCE(st.click_count, 0)
+		FROM banner_rotation.rotation r
+		LEFT JOIN banner_rotation.slot_stat st ON st.slot_id = r.slot_id AND st.banner_id = r.banner_id AND st.segment_id = $2
+		WHERE r.slot_id = $1;`
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, slotID, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]storage.Stat, 0)
+	for rows.Next() {
+		stat := storage.Stat{SlotID: statSlotID, SegmentID: segmentID}
+		if err = rows.Scan(&stat.BannerID, &stat.ShowCount, &stat.ClickCount); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// слот проверяется только при пустой ротации, чтобы не делать лишний запрос при каждом выборе
+	if len(stats) == 0 {
+		if err = checkRefs(ctx, s.db.QueryRowContext, slotID, "", ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *Storage) GetStatForSlotBannerAndSegment(ctx context.Context, slotID, bannerID,
+	segmentID string) (storage.Stat, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
+
+	stat := storage.Stat{SlotID: slotID, BannerID: bannerID, SegmentID: segmentID}
+
+	query := `SELECT show_count, click_count
+	FROM banner_rotation.slot_stat
+	WHERE slot_id = $1 AND banner_id = $2 AND segment_id = $3;`
+
+	// строка появляется с первым событием, до этого статистика нулевая, если слот, баннер и сегмент есть
+	err := s.db.QueryRowContext(ctx, query, slotID, bannerID, segmentID).Scan(&stat.ShowCount, &stat.ClickCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = checkRefs(ctx, s.db.QueryRowContext, slotID, bannerID, segmentID)
+	}
+	if err != nil {
+		return storage.Stat{}, err
+	}
+
+	return stat, nil
+}
+
+func (s *Storage) GetStatBuckets(ctx context.Context, slotID, bannerID, segmentID string,
+	since time.Time) ([]storage.StatBucket, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]storage.StatBucket, 0)
+
+	query := `SELECT start, show_count, click_count
+	FROM banner_rotation.stat_bucket
+	WHERE slot_id = $1 AND banner_id = $2 AND segment_id = $3 AND start >= $4
+	ORDER BY start;`
+
+	rows, err := s.db.QueryContext(ctx, query, slotID, bannerID, segmentID, since.Truncate(storage.StatBucketSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		bucket := storage.StatBucket{SlotID: slotID, BannerID: bannerID, SegmentID: segmentID}
+
+		err = rows.Scan(&bucket.Start, &bucket.ShowCount, &bucket.ClickCount)
+		if err != nil {
+			return buckets, err
+		}
+
+		bucket.Start = bucket.Start.UTC()
+		buckets = append(buckets, bucket)
+	}
+
+	if err = rows.Err(); err != nil {
+		return buckets, err
+	}
+
+	return buckets, nil
+}
+
+// GetStatBucketsForSlotAndSegment - интервалы статистики баннеров bannersID для сегмента одним запросом
+// по ID баннера, у баннера без интервалов - пустой список.
+func (s *Storage) GetStatBucketsForSlotAndSegment(ctx context.Context, slotID string, bannersID []string,
+	segmentID string, since time.Time) (map[string][]storage.StatBucket, error) {
+	if err := storage.ValidateIDs(append([]string{slotID, segmentID}, bannersID...)...); err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string][]storage.StatBucket, len(bannersID))
+	for _, bannerID := range bannersID {
+		buckets[bannerID] = make([]storage.StatBucket, 0)
+	}
+
+	if len(bannersID) == 0 {
+		return buckets, nil
+	}
+
+	args := []interface{}{slotID, segmentID, since.Truncate(storage.StatBucketSize)}
+	for _, bannerID := range bannersID {
+		args = append(args, bannerID)
+	}
+
+	query := `SELECT banner_id, start, show_count, click_count
+	FROM banner_rotation.stat_bucket
+	WHERE slot_id = $1 AND segment_id = $2 AND start >= $3 AND banner_id IN (` + placeholders(4, len(bannersID)) + `)
+	ORDER BY start;`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		bucket := storage.StatBucket{SlotID: slotID, SegmentID: segmentID}
+
+		err = rows.Scan(&bucket.BannerID, &bucket.Start, &bucket.ShowCount, &bucket.ClickCount)
+		if err != nil {
+			return nil, err
+		}
+
+		bucket.Start = bucket.Start.UTC()
+		buckets[bucket.BannerID] = append(buckets[bucket.BannerID], bucket)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// placeholders - параметры запроса $from, $from+1, ... для списка из count значений.
+func placeholders(from, count int) string {
+	result := make([]string, count)
+	for idx := range result {
+		result[idx] = fmt.Sprintf("$%d", from+idx)
+	}
+	return strings.Join(result, ", ")
+}
+
+func (s *Storage) SetSegmentFeatures(ctx context.Context, segmentID string, features []float64) error {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return err
+	}
+
+	if features == nil {
+		features = []float64{}
+	}
+
+	bytes, err := json.Marshal(features)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE banner_rotation.segment SET features = $2 WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, segmentID, string(bytes))
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return storage.ErrSegmentNotFound
+	}
+
+	return nil
+}
+
+func (s *Storage) GetSegmentFeatures(ctx context.Context, segmentID string) ([]float64, error) {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return nil, err
+	}
+
+	var bytes []byte
+
+	query := `SELECT features FROM banner_rotation.segment WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, segmentID).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrSegmentNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var features []float64
+	if err = json.Unmarshal(bytes, &features); err != nil {
+		return nil, err
+	}
+
+	return features, nil
+}
+
+func (s *Storage) GetModel(ctx context.Context, bannerID string) (storage.Model, error) {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return storage.Model{}, err
+	}
+
+	return getModel(ctx, s.db.QueryRowContext, bannerID, ";")
+}
+
+// getModel читает модель баннера через db.QueryRow или tx.QueryRowContext, lock - окончание запроса.
+func getModel(ctx context.Context, queryRow func(ctx context.Context, query string, args ...interface{}) *sql.Row,
+	bannerID, lock string) (storage.Model, error) {
+	model := storage.Model{BannerID: bannerID}
+
+	var a, b []byte
+
+	query := `SELECT dimension, a, b FROM banner_rotation.model WHERE banner_id = $1` + lock
+
+	err := queryRow(ctx, query, bannerID).Scan(&model.Dimension, &a, &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model, nil
+	}
+
+	if err != nil {
+		return storage.Model{}, err
+	}
+
+	if err = json.Unmarshal(a, &model.A); err != nil {
+		return storage.Model{}, err
+	}
+
+	if err = json.Unmarshal(b, &model.B); err != nil {
+		return storage.Model{}, err
+	}
+
+	return model, nil
+}
+
+// GetModels - модели баннеров bannersID одним запросом в том же порядке.
+func (s *Storage) GetModels(ctx context.Context, bannersID []string) ([]storage.Model, error) {
+	if err := storage.ValidateIDs(bannersID...); err != nil {
+		return nil, err
+	}
+
+	models := make([]storage.Model, len(bannersID))
+	args := make([]interface{}, 0, len(bannersID))
+	for idx, bannerID := range bannersID {
+		models[idx] = storage.Model{BannerID: bannerID}
+		args = append(args, bannerID)
+	}
+
+	if len(bannersID) == 0 {
+		return models, nil
+	}
+
+	query := `SELECT banner_id, dimension, a, b
+	FROM banner_rotation.model
+	WHERE banner_id IN (` + placeholders(1, len(bannersID)) + `);`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var model storage.Model
+		var a, b []byte
+		if err = rows.Scan(&model.BannerID, &model.Dimension, &a, &b); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(a, &model.A); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(b, &model.B); err != nil {
+			return nil, err
+		}
+
+		// баннер может повторяться в bannersID
+		for idx, bannerID := range bannersID {
+			if bannerID == model.BannerID {
+				models[idx] = model
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return models, nil
+}
+
+func (s *Storage) UpdateModel(ctx context.Context, bannerID string, x []float64, action storage.ActionType) error {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkRefs(ctx, tx.QueryRowContext, "", bannerID, ""); err != nil {
+		return err
+	}
+
+	// блокируем строку модели, чтобы параллельные обновления не потерялись
+	model, err := getModel(ctx, tx.QueryRowContext, bannerID, " FOR UPDATE;")
+	if err != nil {
+		return err
+	}
+
+	model.Update(x, action)
+
+	a, err := json.Marshal(model.A)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(model.B)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO banner_rotation.model
+    (banner_id, dimension, a, b)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (banner_id)
+	DO UPDATE SET dimension = EXCLUDED.dimension, a = EXCLUDED.a, b = EXCLUDED.b;`
+
+	_, err = tx.ExecContext(ctx, query, bannerID, model.Dimension, string(a), string(b))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateImpression создает показ, если shown - вместе с событием показа в одной транзакции.
+func (s *Storage) CreateImpression(ctx context.Context, slotID, bannerID, segmentID string, ttl time.Duration,
+	shown bool) (storage.Impression, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	now := time.Now().UTC()
+	impression := storage.Impression{
+		ID:        storage.NewID(),
+		SlotID:    slotID,
+		BannerID:  bannerID,
+		SegmentID: segmentID,
+		ExpiresAt: now.Add(ttl),
+		Shown:     shown,
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Impression{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkRefs(ctx, tx.QueryRowContext, slotID, bannerID, segmentID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	query := `INSERT INTO banner_rotation.impression
+    (id, slot_id, banner_id, segment_id, expires_at, shown, clicked)
+	VALUES ($1, $2, $3, $4, $5, $6, false);`
+
+	_, err = tx.ExecContext(ctx, query, impression.ID, impression.SlotID, impression.BannerID, impression.SegmentID,
+		impression.ExpiresAt, impression.Shown)
+	if err != nil {
+		return storage.Impression{}, storageError(err)
+	}
+
+	if shown {
+		err = s.addEvent(ctx, tx, storage.Event{
+			SlotID:       slotID,
+			BannerID:     bannerID,
+			SegmentID:    segmentID,
+			Action:       storage.Show,
+			Date:         now,
+			ImpressionID: impression.ID,
+		})
+		if err != nil {
+			return storage.Impression{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.Impression{}, err
+	}
+
+	if shown {
+		s.notifyOutbox()
+	}
+	return impression, nil
+}
+
+func (s *Storage) GetImpression(ctx context.Context, impressionID string) (storage.Impression, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	impression := storage.Impression{ID: impressionID}
+
+	query := `SELECT slot_id, banner_id, segment_id, expires_at, shown, clicked
+	FROM banner_rotation.impression
+	WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, impressionID).Scan(
+		&impression.SlotID, &impression.BannerID, &impression.SegmentID,
+		&impression.ExpiresAt, &impression.Shown, &impression.Clicked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Impression{}, storage.ErrImpressionNotFound
+	}
+
+	if err != nil {
+		return storage.Impression{}, err
+	}
+
+	impression.ExpiresAt = impression.ExpiresAt.UTC()
+	return impression, nil
+}
+
+func (s *Storage) ShowImpression(ctx context.Context, impressionID string) (storage.Impression, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	impression, _, err := s.updateImpression(ctx, impressionID, storage.Show)
+	return impression, err
+}
+
+func (s *Storage) ClickImpression(ctx context.Context, impressionID string) (storage.Impression, bool, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	return s.updateImpression(ctx, impressionID, storage.Click)
+}
+
+// updateImpression засчитывает показ или переход по показу, переход засчитывает и незасчитанный показ.
+// shown - показ засчитан в этой транзакции.
+func (s *Storage) updateImpression(ctx context.Context, impressionID string,
+	action storage.ActionType) (storage.Impression, bool, error) {
+	now := time.Now().UTC()
+	impression := storage.Impression{ID: impressionID}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// блокируем строку показа, чтобы параллельный запрос по тому же показу не засчитался дважды
+	query := `SELECT slot_id, banner_id, segment_id, expires_at, shown, clicked
+	FROM banner_rotation.impression
+	WHERE id = $1
+	FOR UPDATE;`
+
+	err = tx.QueryRowContext(ctx, query, impressionID).Scan(
+		&impression.SlotID, &impression.BannerID, &impression.SegmentID,
+		&impression.ExpiresAt, &impression.Shown, &impression.Clicked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Impression{}, false, storage.ErrImpressionNotFound
+	}
+
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	impression.ExpiresAt = impression.ExpiresAt.UTC()
+
+	if !now.Before(impression.ExpiresAt) {
+		return storage.Impression{}, false, storage.ErrImpressionExpired
+	}
+
+	if action == storage.Show && impression.Shown {
+		return storage.Impression{}, false, storage.ErrImpressionShown
+	}
+
+	if action == storage.Click && impression.Clicked {
+		return storage.Impression{}, false, storage.ErrImpressionClicked
+	}
+
+	shown := !impression.Shown
+	events := make([]storage.Event, 0, 2)
+	if shown {
+		events = append(events, storage.Event{Action: storage.Show})
+	}
+	if action == storage.Click {
+		events = append(events, storage.Event{Action: storage.Click})
+	}
+
+	query = `UPDATE banner_rotation.impression SET shown = true, clicked = clicked OR $2 WHERE id = $1;`
+
+	_, err = tx.ExecContext(ctx, query, impressionID, action == storage.Click)
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	for idx := range events {
+		events[idx].SlotID = impression.SlotID
+		events[idx].BannerID = impression.BannerID
+		events[idx].SegmentID = impression.SegmentID
+		events[idx].Date = now
+		events[idx].ImpressionID = impressionID
+
+		if err = s.addEvent(ctx, tx, events[idx]); err != nil {
+			return storage.Impression{}, false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	s.notifyOutbox()
+
+	impression.Shown = true
+	impression.Clicked = action == storage.Click
+
+	return impression, shown, nil
+}
+
+func (s *Storage) DeleteEventIDs(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM banner_rotation.event_id WHERE recorded_at < $1;`
+
+	_, err := s.db.ExecContext(ctx, query, before)
+	return err
+}
+
+func (s *Storage) DeleteExpiredImpressions(ctx context.Context, now time.Time) error {
+	query := `DELETE FROM banner_rotation.impression WHERE expires_at <= $1;`
+
+	_, err := s.db.ExecContext(ctx, query, now)
+	return err
 }
@@ -0,0 +1,117 @@
+-- схема migrations/create.sql для SQLite: uuid, jsonb и enum хранятся как text,
+-- время - как text в формате timeFormat (UTC), чтобы сравнение строк совпадало со сравнением времени
+
+CREATE TABLE IF NOT EXISTS banner (
+  id text NOT NULL PRIMARY KEY,
+  description text NOT NULL,
+  format text NOT NULL DEFAULT '',
+  width integer NOT NULL DEFAULT 0,
+  height integer NOT NULL DEFAULT 0,
+  image_url text NOT NULL DEFAULT '',
+  html text NOT NULL DEFAULT '',
+  target_url text NOT NULL DEFAULT '',
+  alt_text text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS banner_description_index ON banner (description);
+
+CREATE TABLE IF NOT EXISTS slot (
+  id text NOT NULL PRIMARY KEY,
+  description text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS slot_description_index ON slot (description);
+
+CREATE TABLE IF NOT EXISTS segment (
+  id text NOT NULL PRIMARY KEY,
+  description text NOT NULL,
+  features text NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX IF NOT EXISTS segment_description_index ON segment (description);
+
+CREATE TABLE IF NOT EXISTS rotation (
+  slot_id text NOT NULL REFERENCES slot (id) ON DELETE CASCADE,
+  banner_id text NOT NULL REFERENCES banner (id) ON DELETE CASCADE,
+  PRIMARY KEY (slot_id, banner_id)
+);
+
+CREATE INDEX IF NOT EXISTS rotation_banner_id_index ON rotation (banner_id);
+
+CREATE TABLE IF NOT EXISTS stat (
+  banner_id text NOT NULL REFERENCES banner (id) ON DELETE CASCADE,
+  segment_id text NOT NULL REFERENCES segment (id) ON DELETE CASCADE,
+  show_count integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (banner_id, segment_id)
+);
+
+CREATE INDEX IF NOT EXISTS stat_segment_id_index ON stat (segment_id);
+
+-- история событий без внешних ключей: сохраняется после удаления слота, баннера или сегмента
+CREATE TABLE IF NOT EXISTS event (
+  slot_id text NOT NULL,
+  banner_id text NOT NULL,
+  segment_id text NOT NULL,
+  action text NOT NULL CHECK (action IN ('show', 'click')),
+  date text NOT NULL
+);
+
+-- ID событий, записанных из kafka: повторно доставленное событие не учитывается,
+-- записи старше kafka.consumer.dedupeRetention удаляются
+CREATE TABLE IF NOT EXISTS event_id (
+  id text NOT NULL PRIMARY KEY,
+  recorded_at text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS event_id_recorded_at_index ON event_id (recorded_at);
+
+CREATE TABLE IF NOT EXISTS slot_stat (
+  slot_id text NOT NULL REFERENCES slot (id) ON DELETE CASCADE,
+  banner_id text NOT NULL REFERENCES banner (id) ON DELETE CASCADE,
+  segment_id text NOT NULL REFERENCES segment (id) ON DELETE CASCADE,
+  show_count integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (slot_id, banner_id, segment_id)
+);
+
+CREATE INDEX IF NOT EXISTS slot_stat_banner_id_index ON slot_stat (banner_id);
+CREATE INDEX IF NOT EXISTS slot_stat_segment_id_index ON slot_stat (segment_id);
+
+-- slot_id = '00000000-0000-0000-0000-000000000000' - интервалы по всем слотам
+CREATE TABLE IF NOT EXISTS stat_bucket (
+  slot_id text NOT NULL,
+  banner_id text NOT NULL REFERENCES banner (id) ON DELETE CASCADE,
+  segment_id text NOT NULL REFERENCES segment (id) ON DELETE CASCADE,
+  start text NOT NULL,
+  show_count integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (slot_id, banner_id, segment_id, start)
+);
+
+CREATE INDEX IF NOT EXISTS stat_bucket_banner_id_index ON stat_bucket (banner_id);
+CREATE INDEX IF NOT EXISTS stat_bucket_segment_id_index ON stat_bucket (segment_id);
+
+CREATE TABLE IF NOT EXISTS model (
+  banner_id text NOT NULL PRIMARY KEY REFERENCES banner (id) ON DELETE CASCADE,
+  dimension integer NOT NULL,
+  a text NOT NULL,
+  b text NOT NULL
+);
+
+-- показ, по которому можно засчитать один переход до expires_at,
+-- shown = 0 - показ засчитывается при загрузке пикселя
+CREATE TABLE IF NOT EXISTS impression (
+  id text NOT NULL PRIMARY KEY,
+  slot_id text NOT NULL REFERENCES slot (id) ON DELETE CASCADE,
+  banner_id text NOT NULL REFERENCES banner (id) ON DELETE CASCADE,
+  segment_id text NOT NULL REFERENCES segment (id) ON DELETE CASCADE,
+  expires_at text NOT NULL,
+  shown integer NOT NULL DEFAULT 1,
+  clicked integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS impression_expires_at_index ON impression (expires_at);
+CREATE INDEX IF NOT EXISTS impression_slot_id_index ON impression (slot_id);
+CREATE INDEX IF NOT EXISTS impression_banner_id_index ON impression (banner_id);
+CREATE INDEX IF NOT EXISTS impression_segment_id_index ON impression (segment_id);
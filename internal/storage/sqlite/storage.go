@@ -0,0 +1,1363 @@
+package sqlitestorage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed" // схема базы
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//go:embed schema.sql
+var schema string
+
+// timeFormat - формат времени в базе: UTC и фиксированная длина, строки сравниваются как время.
+const timeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func init() {
+	// contains_fold(description, search) - поиск подстроки без учета регистра, как в memorystorage:
+	// LIKE и lower в SQLite учитывают регистр только для ASCII
+	sqlite.MustRegisterDeterministicScalarFunction("contains_fold", 2,
+		func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			description, _ := args[0].(string)
+			search, _ := args[1].(string)
+			return strings.Contains(strings.ToLower(description), strings.ToLower(search)), nil
+		})
+}
+
+type Storage struct {
+	path string
+	db   *sql.DB
+}
+
+func New(config config.Config) *Storage {
+	return &Storage{
+		path: config.DB.Path,
+		db:   nil,
+	}
+}
+
+// Connect открывает файл базы (создает, если его нет) и создает недостающие таблицы.
+func (s *Storage) Connect(ctx context.Context) error {
+	dsn := "file:" + s.path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return err
+	}
+
+	// SQLite допускает одного писателя: с одним соединением транзакции выполняются по очереди
+	// и заменяют блокировки строк (FOR UPDATE) из sqlstorage
+	db.SetMaxOpenConns(1)
+
+	if err = createSchema(ctx, db); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	log.Printf("connect to sqlite %s OK", s.path)
+	s.db = db
+	return nil
+}
+
+// createSchema создает недостающие таблицы и индексы в одной транзакции.
+func createSchema(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.ExecContext(ctx, schema); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) Close() {
+	if s.db == nil {
+		return
+	}
+
+	if err := s.db.Close(); err != nil {
+		log.Printf("failed to close db: %s", err)
+	}
+}
+
+func (s *Storage) CreateSlot(ctx context.Context, description string) (string, error) {
+	id := storage.NewID()
+
+	query := `INSERT INTO slot (id, description) VALUES ($1, $2);`
+
+	_, err := s.db.ExecContext(ctx, query, id, description)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	return id, nil
+}
+
+func (s *Storage) CreateBanner(ctx context.Context, description string) (string, error) {
+	return s.CreateBannerWithCreative(ctx, description, storage.Creative{})
+}
+
+// CreateBannerWithCreative создает баннер сразу с содержимым в одной транзакции.
+func (s *Storage) CreateBannerWithCreative(ctx context.Context, description string,
+	creative storage.Creative) (string, error) {
+	id := storage.NewID()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `INSERT INTO banner (id, description, format, width, height, image_url, html, target_url, alt_text)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`
+
+	_, err = tx.ExecContext(ctx, query, id, description, creative.Format, creative.Width, creative.Height,
+		creative.ImageURL, creative.HTML, creative.TargetURL, creative.AltText)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	query = `INSERT INTO stat (banner_id, segment_id, show_count, click_count)
+	SELECT $1, id, 0, 0 FROM segment;`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	return id, nil
+}
+
+func (s *Storage) GetBanner(ctx context.Context, bannerID string) (storage.Banner, error) {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return storage.Banner{}, err
+	}
+
+	banner := storage.Banner{ID: bannerID}
+
+	query := `SELECT description, format, width, height, image_url, html, target_url, alt_text
+	FROM banner
+	WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, bannerID).Scan(
+		&banner.Description, &banner.Format, &banner.Width, &banner.Height,
+		&banner.ImageURL, &banner.HTML, &banner.TargetURL, &banner.AltText)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Banner{}, storage.ErrBannerNotFound
+	}
+
+	if err != nil {
+		return storage.Banner{}, err
+	}
+
+	return banner, nil
+}
+
+func (s *Storage) CreateSegment(ctx context.Context, description string) (string, error) {
+	id := storage.NewID()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `INSERT INTO segment (id, description) VALUES ($1, $2);`
+
+	_, err = tx.ExecContext(ctx, query, id, description)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	query = `INSERT INTO stat (banner_id, segment_id, show_count, click_count)
+	SELECT id, $1, 0, 0 FROM banner;`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return storage.EmptyID, err
+	}
+
+	return id, nil
+}
+
+func (s *Storage) GetSlot(ctx context.Context, slotID string) (storage.Slot, error) {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return storage.Slot{}, err
+	}
+
+	slot := storage.Slot{ID: slotID}
+
+	query := `SELECT description FROM slot WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, slotID).Scan(&slot.Description)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Slot{}, storage.ErrSlotNotFound
+	}
+
+	if err != nil {
+		return storage.Slot{}, err
+	}
+
+	return slot, nil
+}
+
+func (s *Storage) UpdateSlot(ctx context.Context, slot storage.Slot) error {
+	if err := storage.ValidateIDs(slot.ID); err != nil {
+		return err
+	}
+
+	query := `UPDATE slot SET description = $2 WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, slot.ID, slot.Description)
+	return affectedOne(result, err, storage.ErrSlotNotFound)
+}
+
+// DeleteSlot удаляет слот вместе с ротацией и статистикой по слоту, события остаются.
+// Ротация, статистика и показы удаляются внешними ключами, у интервалов статистики ключа на слот нет.
+func (s *Storage) DeleteSlot(ctx context.Context, slotID string) error {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return err
+	}
+
+	return s.deleteItem(ctx, slotID, storage.ErrSlotNotFound,
+		`DELETE FROM stat_bucket WHERE slot_id = $1;`,
+		`DELETE FROM slot WHERE id = $1;`)
+}
+
+func (s *Storage) ListSlots(ctx context.Context, query storage.ListQuery) ([]storage.Slot, int, error) {
+	slots := make([]storage.Slot, 0)
+
+	total, err := s.listItems(ctx, "slot", "id, description", query, func(rows *sql.Rows) error {
+		var slot storage.Slot
+		if err := rows.Scan(&slot.ID, &slot.Description); err != nil {
+			return err
+		}
+		slots = append(slots, slot)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return slots, total, nil
+}
+
+func (s *Storage) UpdateBanner(ctx context.Context, banner storage.Banner) error {
+	if err := storage.ValidateIDs(banner.ID); err != nil {
+		return err
+	}
+
+	query := `UPDATE banner
+	SET description = $2, format = $3, width = $4, height = $5, image_url = $6, html = $7, target_url = $8,
+	alt_text = $9
+	WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, banner.ID, banner.Description, banner.Format, banner.Width, banner.Height,
+		banner.ImageURL, banner.HTML, banner.TargetURL, banner.AltText)
+	return affectedOne(result, err, storage.ErrBannerNotFound)
+}
+
+// DeleteBanner удаляет баннер из ротаций вместе со статистикой и моделью, события остаются.
+func (s *Storage) DeleteBanner(ctx context.Context, bannerID string) error {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return err
+	}
+
+	return s.deleteItem(ctx, bannerID, storage.ErrBannerNotFound, `DELETE FROM banner WHERE id = $1;`)
+}
+
+func (s *Storage) ListBanners(ctx context.Context, query storage.ListQuery) ([]storage.Banner, int, error) {
+	banners := make([]storage.Banner, 0)
+
+	columns := "id, description, format, width, height, image_url, html, target_url, alt_text"
+	total, err := s.listItems(ctx, "banner", columns, query, func(rows *sql.Rows) error {
+		var banner storage.Banner
+		err := rows.Scan(&banner.ID, &banner.Description, &banner.Format, &banner.Width, &banner.Height,
+			&banner.ImageURL, &banner.HTML, &banner.TargetURL, &banner.AltText)
+		if err != nil {
+			return err
+		}
+		banners = append(banners, banner)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return banners, total, nil
+}
+
+func (s *Storage) GetSegment(ctx context.Context, segmentID string) (storage.Segment, error) {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return storage.Segment{}, err
+	}
+
+	segment := storage.Segment{ID: segmentID}
+
+	var features []byte
+
+	query := `SELECT description, features FROM segment WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, segmentID).Scan(&segment.Description, &features)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Segment{}, storage.ErrSegmentNotFound
+	}
+
+	if err != nil {
+		return storage.Segment{}, err
+	}
+
+	if err = json.Unmarshal(features, &segment.Features); err != nil {
+		return storage.Segment{}, err
+	}
+
+	return segment, nil
+}
+
+func (s *Storage) UpdateSegment(ctx context.Context, segment storage.Segment) error {
+	if err := storage.ValidateIDs(segment.ID); err != nil {
+		return err
+	}
+
+	features, err := marshalFeatures(segment.Features)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE segment SET description = $2, features = $3 WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, segment.ID, segment.Description, features)
+	return affectedOne(result, err, storage.ErrSegmentNotFound)
+}
+
+// DeleteSegment удаляет сегмент вместе со статистикой по сегменту, события остаются.
+func (s *Storage) DeleteSegment(ctx context.Context, segmentID string) error {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return err
+	}
+
+	return s.deleteItem(ctx, segmentID, storage.ErrSegmentNotFound, `DELETE FROM segment WHERE id = $1;`)
+}
+
+func (s *Storage) ListSegments(ctx context.Context, query storage.ListQuery) ([]storage.Segment, int, error) {
+	segments := make([]storage.Segment, 0)
+
+	total, err := s.listItems(ctx, "segment", "id, description, features", query, func(rows *sql.Rows) error {
+		var segment storage.Segment
+		var features []byte
+		if err := rows.Scan(&segment.ID, &segment.Description, &features); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(features, &segment.Features); err != nil {
+			return err
+		}
+		segments = append(segments, segment)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return segments, total, nil
+}
+
+// deleteItem выполняет запросы удаления с параметром id в одной транзакции,
+// последний запрос удаляет сам элемент: если он ничего не удалил, возвращается notFound.
+func (s *Storage) deleteItem(ctx context.Context, id string, notFound error, queries ...string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var result sql.Result
+	for _, query := range queries {
+		result, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = affectedOne(result, nil, notFound); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// listItems читает страницу таблицы table, отсортированной по описанию, и возвращает общее количество
+// найденных строк. Порядок сортировки побайтовый (BINARY для UTF-8), как в memorystorage.
+func (s *Storage) listItems(ctx context.Context, table, columns string, query storage.ListQuery,
+	scan func(rows *sql.Rows) error) (int, error) {
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM `+table+` WHERE contains_fold(description, $1);`,
+		query.Search).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	// в SQLite отрицательный LIMIT - без ограничения
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+
+	offset := query.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+columns+` FROM `+table+`
+	WHERE contains_fold(description, $1)
+	ORDER BY description COLLATE BINARY, id
+	LIMIT $2 OFFSET $3;`, query.Search, limit, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// checkRefs проверяет одним запросом, что слот, баннер и сегмент существуют, пустой ID не проверяется.
+func checkRefs(ctx context.Context, queryRow func(ctx context.Context, query string, args ...interface{}) *sql.Row,
+	slotID, bannerID, segmentID string) error {
+	var slotExists, bannerExists, segmentExists bool
+
+	query := `SELECT $1 = '' OR EXISTS(SELECT 1 FROM slot WHERE id = $1),
+	$2 = '' OR EXISTS(SELECT 1 FROM banner WHERE id = $2),
+	$3 = '' OR EXISTS(SELECT 1 FROM segment WHERE id = $3);`
+
+	err := queryRow(ctx, query, slotID, bannerID, segmentID).Scan(&slotExists, &bannerExists, &segmentExists)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !slotExists:
+		return storage.ErrSlotNotFound
+	case !bannerExists:
+		return storage.ErrBannerNotFound
+	case !segmentExists:
+		return storage.ErrSegmentNotFound
+	}
+
+	return nil
+}
+
+// storageError заменяет нарушение внешнего или уникального ключа на ошибку хранилища.
+func storageError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY:
+		return fmt.Errorf("%w: %s", storage.ErrNotFound, sqliteErr)
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return fmt.Errorf("%w: %s", storage.ErrAlreadyExists, sqliteErr)
+	default:
+		return err
+	}
+}
+
+// affectedOne возвращает notFound, если запрос не изменил ни одной строки.
+func affectedOne(result sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return notFound
+	}
+
+	return nil
+}
+
+// marshalFeatures - признаки сегмента в JSON, nil сохраняется как пустой массив.
+func marshalFeatures(features []float64) (string, error) {
+	if features == nil {
+		features = []float64{}
+	}
+
+	bytes, err := json.Marshal(features)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+func parseTime(value string) (time.Time, error) {
+	return time.Parse(timeFormat, value)
+}
+
+func (s *Storage) CreateRotation(ctx context.Context, rotation storage.Rotation) error {
+	if err := storage.ValidateIDs(rotation.SlotID, rotation.BannerID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkRefs(ctx, tx.QueryRowContext, rotation.SlotID, rotation.BannerID, ""); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO rotation (slot_id, banner_id)
+	VALUES ($1, $2)
+	ON CONFLICT (slot_id, banner_id) DO NOTHING;`
+
+	result, err := tx.ExecContext(ctx, query, rotation.SlotID, rotation.BannerID)
+	if err = affectedOne(result, storageError(err), storage.ErrRotationExists); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) DeleteRotation(ctx context.Context, rotation storage.Rotation) error {
+	if err := storage.ValidateIDs(rotation.SlotID, rotation.BannerID); err != nil {
+		return err
+	}
+
+	query := `DELETE FROM rotation WHERE slot_id = $1 AND banner_id = $2;`
+
+	result, err := s.db.ExecContext(ctx, query, rotation.SlotID, rotation.BannerID)
+	return affectedOne(result, err, storage.ErrRotationNotFound)
+}
+
+// ReplaceRotations заменяет набор баннеров слота в одной транзакции.
+func (s *Storage) ReplaceRotations(ctx context.Context, slotID string, bannerIDs []string) (storage.RotationDiff,
+	error) {
+	if err := storage.ValidateIDs(append([]string{slotID}, bannerIDs...)...); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.RotationDiff{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkRefs(ctx, tx.QueryRowContext, slotID, "", ""); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	current, err := getBannersForSlot(ctx, tx.QueryContext, slotID)
+	if err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	diff := storage.DiffRotations(current, bannerIDs)
+
+	for _, bannerID := range diff.Added {
+		if err = checkRefs(ctx, tx.QueryRowContext, "", bannerID, ""); err != nil {
+			return storage.RotationDiff{}, fmt.Errorf("%w: %s", err, bannerID)
+		}
+
+		query := `INSERT INTO rotation (slot_id, banner_id) VALUES ($1, $2);`
+		if _, err = tx.ExecContext(ctx, query, slotID, bannerID); err != nil {
+			return storage.RotationDiff{}, err
+		}
+	}
+
+	for _, bannerID := range diff.Removed {
+		query := `DELETE FROM rotation WHERE slot_id = $1 AND banner_id = $2;`
+		if _, err = tx.ExecContext(ctx, query, slotID, bannerID); err != nil {
+			return storage.RotationDiff{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.RotationDiff{}, err
+	}
+
+	return diff, nil
+}
+
+func (s *Storage) CreateEvent(ctx context.Context, slotID, bannerID, segmentID string,
+	action storage.ActionType) error {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return err
+	}
+
+	event := storage.Event{
+		SlotID:    slotID,
+		BannerID:  bannerID,
+		SegmentID: segmentID,
+		Action:    action,
+		Date:      time.Now().UTC(),
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = addEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecordEvent записывает событие из внешнего источника с его ID и временем.
+// Событие с уже записанным ID не учитывается повторно (ErrEventExists), переход, после которого
+// переходов в слоте станет больше показов, не записывается (ErrClicksExceedShows).
+func (s *Storage) RecordEvent(ctx context.Context, event storage.Event) error {
+	if err := storage.ValidateIDs(event.ID, event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	event.Date = event.Date.UTC()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `INSERT INTO event_id (id, recorded_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING;`
+
+	result, err := tx.ExecContext(ctx, query, event.ID, formatTime(time.Now()))
+	if err = affectedOne(result, err, storage.ErrEventExists); err != nil {
+		return err
+	}
+
+	if err = addEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	if event.Action == storage.Click {
+		var shows, clicks int
+		query = `SELECT show_count, click_count FROM slot_stat WHERE slot_id = $1 AND banner_id = $2 AND segment_id = $3;`
+		err = tx.QueryRowContext(ctx, query, event.SlotID, event.BannerID, event.SegmentID).Scan(&shows, &clicks)
+		if err != nil {
+			return err
+		}
+
+		if clicks > shows {
+			return storage.ErrClicksExceedShows
+		}
+	}
+
+	return tx.Commit()
+}
+
+// addEvent записывает событие и учитывает его в статистике в транзакции tx.
+func addEvent(ctx context.Context, tx *sql.Tx, event storage.Event) error {
+	if err := checkRefs(ctx, tx.QueryRowContext, event.SlotID, event.BannerID, event.SegmentID); err != nil {
+		return err
+	}
+
+	action, shows, clicks := "show", 1, 0
+	if event.Action == storage.Click {
+		action, shows, clicks = "click", 0, 1
+	}
+
+	query := `INSERT INTO event (slot_id, banner_id, segment_id, action, date) VALUES ($1, $2, $3, $4, $5);`
+
+	_, err := tx.ExecContext(ctx, query, event.SlotID, event.BannerID, event.SegmentID, action, formatTime(event.Date))
+	if err != nil {
+		return err
+	}
+
+	query = `UPDATE stat
+	SET show_count = show_count + $3, click_count = click_count + $4
+	WHERE banner_id = $1 AND segment_id = $2;`
+
+	_, err = tx.ExecContext(ctx, query, event.BannerID, event.SegmentID, shows, clicks)
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO slot_stat (slot_id, banner_id, segment_id, show_count, click_count)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (slot_id, banner_id, segment_id)
+	DO UPDATE SET show_count = show_count + excluded.show_count, click_count = click_count + excluded.click_count;`
+
+	_, err = tx.ExecContext(ctx, query, event.SlotID, event.BannerID, event.SegmentID, shows, clicks)
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO stat_bucket (slot_id, banner_id, segment_id, start, show_count, click_count)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (slot_id, banner_id, segment_id, start)
+	DO UPDATE SET show_count = show_count + excluded.show_count, click_count = click_count + excluded.click_count;`
+
+	// интервал по всем слотам и интервал слота
+	start := formatTime(event.Date.Truncate(storage.StatBucketSize))
+	for _, slotID := range []string{storage.AllSlots, event.SlotID} {
+		_, err = tx.ExecContext(ctx, query, slotID, event.BannerID, event.SegmentID, start, shows, clicks)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) GetBannersForSlot(ctx context.Context, slotID string) ([]string, error) {
+	if err := storage.ValidateIDs(slotID); err != nil {
+		return nil, err
+	}
+
+	bannersID, err := getBannersForSlot(ctx, s.db.QueryContext, slotID)
+	if err != nil {
+		return nil, err
+	}
+
+	// слот проверяется только при пустой ротации, чтобы не делать лишний запрос при каждом выборе
+	if len(bannersID) == 0 {
+		if err = checkRefs(ctx, s.db.QueryRowContext, slotID, "", ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return bannersID, nil
+}
+
+// getBannersForSlot читает ротацию слота через db.Query или tx.Query.
+func getBannersForSlot(ctx context.Context, query func(ctx context.Context, query string,
+	args ...interface{}) (*sql.Rows, error),
+	slotID string) ([]string, error) {
+	rows, err := query(ctx, `SELECT banner_id FROM rotation WHERE slot_id = $1;`, slotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bannersID := make([]string, 0)
+	for rows.Next() {
+		var bannerID string
+		if err = rows.Scan(&bannerID); err != nil {
+			return nil, err
+		}
+		bannersID = append(bannersID, bannerID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bannersID, nil
+}
+
+func (s *Storage) GetStatForBannerAndSegment(ctx context.Context, bannerID, segmentID string) (storage.Stat, error) {
+	if err := storage.ValidateIDs(bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
+
+	stat := storage.Stat{SlotID: storage.AllSlots, BannerID: bannerID, SegmentID: segmentID}
+
+	query := `SELECT show_count, click_count FROM stat WHERE banner_id = $1 AND segment_id = $2;`
+
+	// строка создается вместе с баннером и сегментом, ее нет только для неизвестного баннера или сегмента
+	err := s.db.QueryRowContext(ctx, query, bannerID, segmentID).Scan(&stat.ShowCount, &stat.ClickCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = checkRefs(ctx, s.db.QueryRowContext, "", bannerID, segmentID)
+	}
+	if err != nil {
+		return storage.Stat{}, err
+	}
+
+	return stat, nil
+}
+
+// GetStatsForSlotAndSegment - статистика баннеров из ротации слота для сегмента одним запросом:
+// только по этому слоту, если perSlot, иначе общая.
+func (s *Storage) GetStatsForSlotAndSegment(ctx context.Context, slotID, segmentID string,
+	perSlot bool) ([]storage.Stat, error) {
+	if err := storage.ValidateIDs(slotID, segmentID); err != nil {
+		return nil, err
+	}
+
+	statSlotID := storage.AllSlots
+	query := `SELECT r.banner_id, COALESCE(st.show_count, 0), COALESCE(st.click_count, 0)
+	FROM rotation r
+	LEFT JOIN stat st ON st.banner_id = r.banner_id AND st.segment_id = $2
+	WHERE r.slot_id = $1;`
+
+	if perSlot {
+		statSlotID = slotID
+		query = `SELECT r.banner_id, COALESCE(st.show_count, 0), COALESCE(st.click_count, 0)
+		FROM rotation r
+		LEFT JOIN slot_stat st ON st.slot_id = r.slot_id AND st.banner_id = r.banner_id AND st.segment_id = $2
+		WHERE r.slot_id = $1;`
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, slotID, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]storage.Stat, 0)
+	for rows.Next() {
+		stat := storage.Stat{SlotID: statSlotID, SegmentID: segmentID}
+		if err = rows.Scan(&stat.BannerID, &stat.ShowCount, &stat.ClickCount); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// слот проверяется только при пустой ротации, чтобы не делать лишний запрос при каждом выборе
+	if len(stats) == 0 {
+		if err = checkRefs(ctx, s.db.QueryRowContext, slotID, "", ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+func (s *Storage) GetStatForSlotBannerAndSegment(ctx context.Context, slotID, bannerID,
+	segmentID string) (storage.Stat, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return storage.Stat{}, err
+	}
+
+	stat := storage.Stat{SlotID: slotID, BannerID: bannerID, SegmentID: segmentID}
+
+	query := `SELECT show_count, click_count
+	FROM slot_stat
+	WHERE slot_id = $1 AND banner_id = $2 AND segment_id = $3;`
+
+	// строка появляется с первым событием, до этого статистика нулевая, если слот, баннер и сегмент есть
+	err := s.db.QueryRowContext(ctx, query, slotID, bannerID, segmentID).Scan(&stat.ShowCount, &stat.ClickCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = checkRefs(ctx, s.db.QueryRowContext, slotID, bannerID, segmentID)
+	}
+	if err != nil {
+		return storage.Stat{}, err
+	}
+
+	return stat, nil
+}
+
+func (s *Storage) GetStatBuckets(ctx context.Context, slotID, bannerID, segmentID string,
+	since time.Time) ([]storage.StatBucket, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]storage.StatBucket, 0)
+
+	query := `SELECT start, show_count, click_count
+	FROM stat_bucket
+	WHERE slot_id = $1 AND banner_id = $2 AND segment_id = $3 AND start >= $4
+	ORDER BY start;`
+
+	start := formatTime(since.Truncate(storage.StatBucketSize))
+	rows, err := s.db.QueryContext(ctx, query, slotID, bannerID, segmentID, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		bucket := storage.StatBucket{SlotID: slotID, BannerID: bannerID, SegmentID: segmentID}
+
+		var start string
+		if err = rows.Scan(&start, &bucket.ShowCount, &bucket.ClickCount); err != nil {
+			return buckets, err
+		}
+
+		if bucket.Start, err = parseTime(start); err != nil {
+			return buckets, err
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	if err = rows.Err(); err != nil {
+		return buckets, err
+	}
+
+	return buckets, nil
+}
+
+// GetStatBucketsForSlotAndSegment - интервалы статистики баннеров bannersID для сегмента одним запросом
+// по ID баннера, у баннера без интервалов - пустой список.
+func (s *Storage) GetStatBucketsForSlotAndSegment(ctx context.Context, slotID string, bannersID []string,
+	segmentID string, since time.Time) (map[string][]storage.StatBucket, error) {
+	if err := storage.ValidateIDs(append([]string{slotID, segmentID}, bannersID...)...); err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string][]storage.StatBucket, len(bannersID))
+	for _, bannerID := range bannersID {
+		buckets[bannerID] = make([]storage.StatBucket, 0)
+	}
+
+	if len(bannersID) == 0 {
+		return buckets, nil
+	}
+
+	args := []interface{}{slotID, segmentID, formatTime(since.Truncate(storage.StatBucketSize))}
+	for _, bannerID := range bannersID {
+		args = append(args, bannerID)
+	}
+
+	query := `SELECT banner_id, start, show_count, click_count
+	FROM stat_bucket
+	WHERE slot_id = $1 AND segment_id = $2 AND start >= $3 AND banner_id IN (` + placeholders(4, len(bannersID)) + `)
+	ORDER BY start;`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		bucket := storage.StatBucket{SlotID: slotID, SegmentID: segmentID}
+
+		var start string
+		if err = rows.Scan(&bucket.BannerID, &start, &bucket.ShowCount, &bucket.ClickCount); err != nil {
+			return nil, err
+		}
+
+		if bucket.Start, err = parseTime(start); err != nil {
+			return nil, err
+		}
+
+		buckets[bucket.BannerID] = append(buckets[bucket.BannerID], bucket)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// placeholders - параметры запроса $from, $from+1, ... для списка из count значений.
+func placeholders(from, count int) string {
+	result := make([]string, count)
+	for idx := range result {
+		result[idx] = fmt.Sprintf("$%d", from+idx)
+	}
+	return strings.Join(result, ", ")
+}
+
+func (s *Storage) SetSegmentFeatures(ctx context.Context, segmentID string, features []float64) error {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return err
+	}
+
+	value, err := marshalFeatures(features)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE segment SET features = $2 WHERE id = $1;`
+
+	result, err := s.db.ExecContext(ctx, query, segmentID, value)
+	return affectedOne(result, err, storage.ErrSegmentNotFound)
+}
+
+func (s *Storage) GetSegmentFeatures(ctx context.Context, segmentID string) ([]float64, error) {
+	if err := storage.ValidateIDs(segmentID); err != nil {
+		return nil, err
+	}
+
+	var bytes []byte
+
+	query := `SELECT features FROM segment WHERE id = $1;`
+
+	err := s.db.QueryRowContext(ctx, query, segmentID).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrSegmentNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var features []float64
+	if err = json.Unmarshal(bytes, &features); err != nil {
+		return nil, err
+	}
+
+	return features, nil
+}
+
+func (s *Storage) GetModel(ctx context.Context, bannerID string) (storage.Model, error) {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return storage.Model{}, err
+	}
+
+	return getModel(ctx, s.db.QueryRowContext, bannerID)
+}
+
+// getModel читает модель баннера через db.QueryRow или tx.QueryRow.
+func getModel(ctx context.Context, queryRow func(ctx context.Context, query string, args ...interface{}) *sql.Row,
+	bannerID string) (storage.Model, error) {
+	model := storage.Model{BannerID: bannerID}
+
+	var a, b []byte
+
+	query := `SELECT dimension, a, b FROM model WHERE banner_id = $1;`
+
+	err := queryRow(ctx, query, bannerID).Scan(&model.Dimension, &a, &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model, nil
+	}
+
+	if err != nil {
+		return storage.Model{}, err
+	}
+
+	if err = json.Unmarshal(a, &model.A); err != nil {
+		return storage.Model{}, err
+	}
+
+	if err = json.Unmarshal(b, &model.B); err != nil {
+		return storage.Model{}, err
+	}
+
+	return model, nil
+}
+
+// GetModels - модели баннеров bannersID одним запросом в том же порядке.
+func (s *Storage) GetModels(ctx context.Context, bannersID []string) ([]storage.Model, error) {
+	if err := storage.ValidateIDs(bannersID...); err != nil {
+		return nil, err
+	}
+
+	models := make([]storage.Model, len(bannersID))
+	args := make([]interface{}, 0, len(bannersID))
+	for idx, bannerID := range bannersID {
+		models[idx] = storage.Model{BannerID: bannerID}
+		args = append(args, bannerID)
+	}
+
+	if len(bannersID) == 0 {
+		return models, nil
+	}
+
+	query := `SELECT banner_id, dimension, a, b FROM model WHERE banner_id IN (` + placeholders(1, len(bannersID)) + `);`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var model storage.Model
+		var a, b []byte
+		if err = rows.Scan(&model.BannerID, &model.Dimension, &a, &b); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(a, &model.A); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(b, &model.B); err != nil {
+			return nil, err
+		}
+
+		// баннер может повторяться в bannersID
+		for idx, bannerID := range bannersID {
+			if bannerID == model.BannerID {
+				models[idx] = model
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return models, nil
+}
+
+func (s *Storage) UpdateModel(ctx context.Context, bannerID string, x []float64, action storage.ActionType) error {
+	if err := storage.ValidateIDs(bannerID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkRefs(ctx, tx.QueryRowContext, "", bannerID, ""); err != nil {
+		return err
+	}
+
+	model, err := getModel(ctx, tx.QueryRowContext, bannerID)
+	if err != nil {
+		return err
+	}
+
+	model.Update(x, action)
+
+	a, err := json.Marshal(model.A)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(model.B)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO model (banner_id, dimension, a, b)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (banner_id)
+	DO UPDATE SET dimension = excluded.dimension, a = excluded.a, b = excluded.b;`
+
+	_, err = tx.ExecContext(ctx, query, bannerID, model.Dimension, string(a), string(b))
+	if err != nil {
+		return storageError(err)
+	}
+
+	return tx.Commit()
+}
+
+// CreateImpression создает показ, если shown - вместе с событием показа в одной транзакции.
+func (s *Storage) CreateImpression(ctx context.Context, slotID, bannerID, segmentID string, ttl time.Duration,
+	shown bool) (storage.Impression, error) {
+	if err := storage.ValidateIDs(slotID, bannerID, segmentID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	now := time.Now().UTC()
+	impression := storage.Impression{
+		ID:        storage.NewID(),
+		SlotID:    slotID,
+		BannerID:  bannerID,
+		SegmentID: segmentID,
+		ExpiresAt: now.Add(ttl),
+		Shown:     shown,
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Impression{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = checkRefs(ctx, tx.QueryRowContext, slotID, bannerID, segmentID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	query := `INSERT INTO impression (id, slot_id, banner_id, segment_id, expires_at, shown, clicked)
+	VALUES ($1, $2, $3, $4, $5, $6, 0);`
+
+	_, err = tx.ExecContext(ctx, query, impression.ID, impression.SlotID, impression.BannerID, impression.SegmentID,
+		formatTime(impression.ExpiresAt), impression.Shown)
+	if err != nil {
+		return storage.Impression{}, storageError(err)
+	}
+
+	if shown {
+		err = addEvent(ctx, tx, storage.Event{
+			SlotID:       slotID,
+			BannerID:     bannerID,
+			SegmentID:    segmentID,
+			Action:       storage.Show,
+			Date:         now,
+			ImpressionID: impression.ID,
+		})
+		if err != nil {
+			return storage.Impression{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.Impression{}, err
+	}
+
+	return impression, nil
+}
+
+func (s *Storage) GetImpression(ctx context.Context, impressionID string) (storage.Impression, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	return getImpression(ctx, s.db.QueryRowContext, impressionID)
+}
+
+// getImpression читает показ через db.QueryRow или tx.QueryRow.
+func getImpression(ctx context.Context, queryRow func(ctx context.Context, query string, args ...interface{}) *sql.Row,
+	impressionID string) (storage.Impression, error) {
+	impression := storage.Impression{ID: impressionID}
+
+	query := `SELECT slot_id, banner_id, segment_id, expires_at, shown, clicked FROM impression WHERE id = $1;`
+
+	var expiresAt string
+	err := queryRow(ctx, query, impressionID).Scan(&impression.SlotID, &impression.BannerID, &impression.SegmentID,
+		&expiresAt, &impression.Shown, &impression.Clicked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Impression{}, storage.ErrImpressionNotFound
+	}
+
+	if err != nil {
+		return storage.Impression{}, err
+	}
+
+	if impression.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return storage.Impression{}, err
+	}
+
+	return impression, nil
+}
+
+func (s *Storage) ShowImpression(ctx context.Context, impressionID string) (storage.Impression, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, err
+	}
+
+	impression, _, err := s.updateImpression(ctx, impressionID, storage.Show)
+	return impression, err
+}
+
+func (s *Storage) ClickImpression(ctx context.Context, impressionID string) (storage.Impression, bool, error) {
+	if err := storage.ValidateIDs(impressionID); err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	return s.updateImpression(ctx, impressionID, storage.Click)
+}
+
+// updateImpression засчитывает показ или переход по показу, переход засчитывает и незасчитанный показ.
+// shown - показ засчитан в этой транзакции.
+func (s *Storage) updateImpression(ctx context.Context, impressionID string,
+	action storage.ActionType) (storage.Impression, bool, error) {
+	now := time.Now().UTC()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	impression, err := getImpression(ctx, tx.QueryRowContext, impressionID)
+	if err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	if !now.Before(impression.ExpiresAt) {
+		return storage.Impression{}, false, storage.ErrImpressionExpired
+	}
+
+	if action == storage.Show && impression.Shown {
+		return storage.Impression{}, false, storage.ErrImpressionShown
+	}
+
+	if action == storage.Click && impression.Clicked {
+		return storage.Impression{}, false, storage.ErrImpressionClicked
+	}
+
+	shown := !impression.Shown
+	actions := make([]storage.ActionType, 0, 2)
+	if shown {
+		actions = append(actions, storage.Show)
+	}
+	if action == storage.Click {
+		actions = append(actions, storage.Click)
+	}
+
+	query := `UPDATE impression SET shown = 1, clicked = clicked OR $2 WHERE id = $1;`
+
+	if _, err = tx.ExecContext(ctx, query, impressionID, action == storage.Click); err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	for _, eventAction := range actions {
+		err = addEvent(ctx, tx, storage.Event{
+			SlotID:    impression.SlotID,
+			BannerID:  impression.BannerID,
+			SegmentID: impression.SegmentID,
+			Action:    eventAction,
+			Date:      now,
+		})
+		if err != nil {
+			return storage.Impression{}, false, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.Impression{}, false, err
+	}
+
+	impression.Shown = true
+	impression.Clicked = impression.Clicked || action == storage.Click
+	return impression, shown, nil
+}
+
+func (s *Storage) DeleteEventIDs(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM event_id WHERE recorded_at < $1;`
+
+	_, err := s.db.ExecContext(ctx, query, formatTime(before))
+	return err
+}
+
+func (s *Storage) DeleteExpiredImpressions(ctx context.Context, now time.Time) error {
+	query := `DELETE FROM impression WHERE expires_at <= $1;`
+
+	_, err := s.db.ExecContext(ctx, query, formatTime(now))
+	return err
+}
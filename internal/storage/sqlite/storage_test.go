@@ -0,0 +1,48 @@
+package sqlitestorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/astrviktor/banner-rotation/internal/config"
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/astrviktor/banner-rotation/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+
+	s := New(config.Config{DB: config.DBConfig{Path: filepath.Join(t.TempDir(), "banner-rotation.db")}})
+	require.NoError(t, s.Connect(ctx))
+	defer s.Close()
+
+	// одна база на все тесты: очистить таблицы быстрее, чем создать схему заново
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+
+		for _, table := range []string{"impression", "model", "stat_bucket", "slot_stat", "event", "stat", "rotation",
+			"segment", "banner", "slot"} {
+			_, err := s.db.Exec(`DELETE FROM ` + table + `;`)
+			require.NoError(t, err)
+		}
+
+		return s
+	})
+}
+
+func TestCanceledContext(t *testing.T) {
+	s := New(config.Config{DB: config.DBConfig{Path: filepath.Join(t.TempDir(), "banner-rotation.db")}})
+	require.NoError(t, s.Connect(context.Background()))
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.CreateBanner(ctx, "banner")
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, _, err = s.ListBanners(ctx, storage.ListQuery{Limit: 10})
+	require.ErrorIs(t, err, context.Canceled)
+}
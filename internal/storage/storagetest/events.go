@@ -0,0 +1,602 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	concurrency = 8
+	eventsCount = 10
+)
+
+func testEvents(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+	since := time.Now().UTC().Add(-storage.StatBucketSize)
+
+	// до событий статистика нулевая, но с ID
+	stat, err := s.GetStatForBannerAndSegment(ctx, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, storage.Stat{SlotID: storage.AllSlots, BannerID: f.banner, SegmentID: f.segment}, stat)
+
+	stat, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, storage.Stat{SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment}, stat)
+
+	buckets, err := s.GetStatBuckets(ctx, f.slot, f.banner, f.segment, since)
+	require.NoError(t, err)
+	require.Empty(t, buckets)
+
+	for _, action := range []storage.ActionType{storage.Show, storage.Show, storage.Show, storage.Click} {
+		err = s.CreateEvent(ctx, f.slot, f.banner, f.segment, action)
+		require.NoError(t, err)
+	}
+
+	// событие в другом слоте учитывается только в общей статистике
+	otherSlot, err := s.CreateSlot(ctx, "other")
+	require.NoError(t, err)
+
+	err = s.CreateEvent(ctx, otherSlot, f.banner, f.segment, storage.Show)
+	require.NoError(t, err)
+
+	stat, err = s.GetStatForBannerAndSegment(ctx, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, storage.Stat{
+		SlotID: storage.AllSlots, BannerID: f.banner, SegmentID: f.segment, ShowCount: 4, ClickCount: 1,
+	}, stat)
+
+	stat, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, storage.Stat{
+		SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment, ShowCount: 3, ClickCount: 1,
+	}, stat)
+
+	for _, slotID := range []string{f.slot, storage.AllSlots} {
+		buckets, err = s.GetStatBuckets(ctx, slotID, f.banner, f.segment, since)
+		require.NoError(t, err)
+		require.NotEmpty(t, buckets)
+
+		shows, clicks := 0, 0
+		for _, bucket := range buckets {
+			require.Equal(t, slotID, bucket.SlotID)
+			require.Equal(t, f.banner, bucket.BannerID)
+			require.Equal(t, f.segment, bucket.SegmentID)
+			require.Equal(t, bucket.Start.Truncate(storage.StatBucketSize), bucket.Start)
+			shows += bucket.ShowCount
+			clicks += bucket.ClickCount
+		}
+
+		require.Equal(t, 1, clicks)
+		if slotID == storage.AllSlots {
+			require.Equal(t, 4, shows)
+		} else {
+			require.Equal(t, 3, shows)
+		}
+	}
+
+	buckets, err = s.GetStatBuckets(ctx, f.slot, f.banner, f.segment, time.Now().UTC().Add(storage.StatBucketSize))
+	require.NoError(t, err)
+	require.Empty(t, buckets)
+}
+
+func testStatsForSlot(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	other, err := s.CreateBanner(ctx, "other")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: other})
+	require.NoError(t, err)
+
+	// баннер вне ротации слота не возвращается
+	outside, err := s.CreateBanner(ctx, "outside")
+	require.NoError(t, err)
+
+	for _, bannerID := range []string{f.banner, f.banner, outside} {
+		err = s.CreateEvent(ctx, f.slot, bannerID, f.segment, storage.Show)
+		require.NoError(t, err)
+	}
+
+	// общая статистика, в том числе по событиям в других слотах
+	otherSlot, err := s.CreateSlot(ctx, "other")
+	require.NoError(t, err)
+
+	err = s.CreateEvent(ctx, otherSlot, f.banner, f.segment, storage.Click)
+	require.NoError(t, err)
+
+	stats, err := s.GetStatsForSlotAndSegment(ctx, f.slot, f.segment, false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.Stat{
+		{SlotID: storage.AllSlots, BannerID: f.banner, SegmentID: f.segment, ShowCount: 2, ClickCount: 1},
+		{SlotID: storage.AllSlots, BannerID: other, SegmentID: f.segment},
+	}, stats)
+
+	// статистика только по этому слоту
+	stats, err = s.GetStatsForSlotAndSegment(ctx, f.slot, f.segment, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.Stat{
+		{SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment, ShowCount: 2},
+		{SlotID: f.slot, BannerID: other, SegmentID: f.segment},
+	}, stats)
+
+	// слот с пустой ротацией
+	for _, perSlot := range []bool{false, true} {
+		stats, err = s.GetStatsForSlotAndSegment(ctx, otherSlot, f.segment, perSlot)
+		require.NoError(t, err)
+		require.Empty(t, stats)
+
+		_, err = s.GetStatsForSlotAndSegment(ctx, f.banner, f.segment, perSlot)
+		requireNotFound(t, err, storage.ErrSlotNotFound)
+	}
+
+	_, err = s.GetStatsForSlotAndSegment(ctx, f.slot, "not-a-uuid", false)
+	require.ErrorIs(t, err, storage.ErrInvalidID)
+}
+
+func testEventsNotFound(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	// ID существуют, но принадлежат другим сущностям
+	err := s.CreateEvent(ctx, f.banner, f.banner, f.segment, storage.Show)
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	err = s.CreateEvent(ctx, f.slot, f.slot, f.segment, storage.Show)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	err = s.CreateEvent(ctx, f.slot, f.banner, f.slot, storage.Click)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	_, err = s.CreateImpression(ctx, f.segment, f.banner, f.segment, time.Minute, false)
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	_, err = s.CreateImpression(ctx, f.slot, f.segment, f.segment, time.Minute, false)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	_, err = s.CreateImpression(ctx, f.slot, f.banner, f.banner, time.Minute, false)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	_, err = s.GetImpression(ctx, storage.NewID())
+	requireNotFound(t, err, storage.ErrImpressionNotFound)
+
+	_, _, err = s.ClickImpression(ctx, storage.NewID())
+	requireNotFound(t, err, storage.ErrImpressionNotFound)
+
+	_, err = s.GetStatForBannerAndSegment(ctx, f.slot, f.segment)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	_, err = s.GetStatForBannerAndSegment(ctx, f.banner, f.slot)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	_, err = s.GetStatForSlotBannerAndSegment(ctx, f.banner, f.banner, f.segment)
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	_, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.segment, f.segment)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	_, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.banner)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	// модель для неизвестного баннера не создается
+	err = s.UpdateModel(ctx, f.slot, []float64{1}, storage.Show)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	model, err := s.GetModel(ctx, f.slot)
+	require.NoError(t, err)
+	require.Zero(t, model.Dimension)
+
+	// ни одно событие не учтено
+	stat, err := s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Zero(t, stat.ShowCount)
+	require.Zero(t, stat.ClickCount)
+}
+
+func testDeleteCascade(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	err := s.CreateEvent(ctx, f.slot, f.banner, f.segment, storage.Show)
+	require.NoError(t, err)
+
+	err = s.UpdateModel(ctx, f.banner, []float64{1}, storage.Show)
+	require.NoError(t, err)
+
+	impression, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Minute, true)
+	require.NoError(t, err)
+
+	err = s.DeleteBanner(ctx, f.banner)
+	require.NoError(t, err)
+
+	banners, err := s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.Empty(t, banners)
+
+	_, err = s.GetStatForBannerAndSegment(ctx, f.banner, f.segment)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	_, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	buckets, err := s.GetStatBuckets(ctx, f.slot, f.banner, f.segment, time.Time{})
+	require.NoError(t, err)
+	require.Empty(t, buckets)
+
+	model, err := s.GetModel(ctx, f.banner)
+	require.NoError(t, err)
+	require.Zero(t, model.Dimension)
+
+	_, err = s.GetImpression(ctx, impression.ID)
+	requireNotFound(t, err, storage.ErrImpressionNotFound)
+
+	// удаление слота и сегмента удаляет их показы
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+
+	bySlot, err := s.CreateImpression(ctx, f.slot, banner, f.segment, time.Minute, false)
+	require.NoError(t, err)
+
+	err = s.DeleteSlot(ctx, f.slot)
+	require.NoError(t, err)
+
+	_, err = s.GetImpression(ctx, bySlot.ID)
+	requireNotFound(t, err, storage.ErrImpressionNotFound)
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	bySegment, err := s.CreateImpression(ctx, slot, banner, f.segment, time.Minute, false)
+	require.NoError(t, err)
+
+	err = s.DeleteSegment(ctx, f.segment)
+	require.NoError(t, err)
+
+	_, err = s.GetImpression(ctx, bySegment.ID)
+	requireNotFound(t, err, storage.ErrImpressionNotFound)
+}
+
+func testImpressions(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	created, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Minute, false)
+	require.NoError(t, err)
+	require.NoError(t, storage.ValidateIDs(created.ID))
+	require.WithinDuration(t, time.Now().UTC().Add(time.Minute), created.ExpiresAt, 5*time.Second)
+	require.False(t, created.Shown)
+	require.False(t, created.Clicked)
+
+	impression, err := s.GetImpression(ctx, created.ID)
+	require.NoError(t, err)
+	require.WithinDuration(t, created.ExpiresAt, impression.ExpiresAt, time.Millisecond)
+	impression.ExpiresAt = created.ExpiresAt
+	require.Equal(t, created, impression)
+
+	impression, err = s.ShowImpression(ctx, created.ID)
+	require.NoError(t, err)
+	require.True(t, impression.Shown)
+	require.False(t, impression.Clicked)
+
+	_, err = s.ShowImpression(ctx, created.ID)
+	require.ErrorIs(t, err, storage.ErrImpressionShown)
+
+	impression, shownWithClick, err := s.ClickImpression(ctx, created.ID)
+	require.NoError(t, err)
+	require.True(t, impression.Shown)
+	require.True(t, impression.Clicked)
+	require.False(t, shownWithClick)
+
+	_, _, err = s.ClickImpression(ctx, created.ID)
+	require.ErrorIs(t, err, storage.ErrImpressionClicked)
+
+	impression, err = s.GetImpression(ctx, created.ID)
+	require.NoError(t, err)
+	require.True(t, impression.Shown)
+	require.True(t, impression.Clicked)
+
+	// переход без загруженного пикселя засчитывает и показ
+	notShown, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Minute, false)
+	require.NoError(t, err)
+
+	_, shownWithClick, err = s.ClickImpression(ctx, notShown.ID)
+	require.NoError(t, err)
+	require.True(t, shownWithClick)
+
+	// показ, засчитанный при создании, записывается вместе с событием показа и повторно не засчитывается
+	shown, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Minute, true)
+	require.NoError(t, err)
+	require.True(t, shown.Shown)
+
+	_, err = s.ShowImpression(ctx, shown.ID)
+	require.ErrorIs(t, err, storage.ErrImpressionShown)
+
+	stat, err := s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 3, stat.ShowCount)
+	require.Equal(t, 2, stat.ClickCount)
+
+	stat, err = s.GetStatForBannerAndSegment(ctx, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 3, stat.ShowCount)
+	require.Equal(t, 2, stat.ClickCount)
+
+	// показ неизвестного баннера не создается и не засчитывается
+	_, err = s.CreateImpression(ctx, f.slot, storage.NewID(), f.segment, time.Minute, true)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	stat, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 3, stat.ShowCount)
+}
+
+func testExpiredImpressions(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	expired, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, -time.Minute, false)
+	require.NoError(t, err)
+
+	active, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Hour, false)
+	require.NoError(t, err)
+
+	_, err = s.ShowImpression(ctx, expired.ID)
+	require.ErrorIs(t, err, storage.ErrImpressionExpired)
+
+	_, _, err = s.ClickImpression(ctx, expired.ID)
+	require.ErrorIs(t, err, storage.ErrImpressionExpired)
+
+	// истекший показ виден, пока его не удалили
+	_, err = s.GetImpression(ctx, expired.ID)
+	require.NoError(t, err)
+
+	err = s.DeleteExpiredImpressions(ctx, time.Now().UTC())
+	require.NoError(t, err)
+
+	_, err = s.GetImpression(ctx, expired.ID)
+	requireNotFound(t, err, storage.ErrImpressionNotFound)
+
+	_, err = s.GetImpression(ctx, active.ID)
+	require.NoError(t, err)
+
+	stat, err := s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Zero(t, stat.ShowCount)
+	require.Zero(t, stat.ClickCount)
+}
+
+func testRecordEvent(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+	now := time.Now().UTC().Truncate(storage.StatBucketSize)
+
+	// события из kafka учитываются по своему времени, в том числе в более ранних интервалах
+	show := storage.Event{ID: storage.NewID(), SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment,
+		Action: storage.Show, Date: now.Add(-time.Hour)}
+	err := s.RecordEvent(ctx, show)
+	require.NoError(t, err)
+
+	earlier := show
+	earlier.ID = storage.NewID()
+	earlier.Date = now.Add(-3 * time.Hour)
+	err = s.RecordEvent(ctx, earlier)
+	require.NoError(t, err)
+
+	// повторно доставленное событие не учитывается
+	err = s.RecordEvent(ctx, show)
+	require.ErrorIs(t, err, storage.ErrEventExists)
+	require.ErrorIs(t, err, storage.ErrAlreadyExists)
+
+	click := storage.Event{SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment, Action: storage.Click, Date: now}
+	for i := 0; i < 2; i++ {
+		click.ID = storage.NewID()
+		err = s.RecordEvent(ctx, click)
+		require.NoError(t, err)
+	}
+
+	// переходов не может стать больше показов, отклоненный переход можно записать после показа
+	rejected := click
+	rejected.ID = storage.NewID()
+	err = s.RecordEvent(ctx, rejected)
+	require.ErrorIs(t, err, storage.ErrClicksExceedShows)
+
+	stat, err := s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 2, stat.ShowCount)
+	require.Equal(t, 2, stat.ClickCount)
+
+	show.ID = storage.NewID()
+	show.Date = now
+	err = s.RecordEvent(ctx, show)
+	require.NoError(t, err)
+	err = s.RecordEvent(ctx, rejected)
+	require.NoError(t, err)
+
+	stat, err = s.GetStatForBannerAndSegment(ctx, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 3, stat.ShowCount)
+	require.Equal(t, 3, stat.ClickCount)
+
+	buckets, err := s.GetStatBuckets(ctx, f.slot, f.banner, f.segment, now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, buckets, 3)
+	for idx, bucket := range []struct {
+		start  time.Time
+		shows  int
+		clicks int
+	}{
+		{start: now.Add(-3 * time.Hour), shows: 1},
+		{start: now.Add(-time.Hour), shows: 1},
+		{start: now, shows: 1, clicks: 3},
+	} {
+		require.True(t, bucket.start.Equal(buckets[idx].Start), "%s, got %s", bucket.start, buckets[idx].Start)
+		require.Equal(t, bucket.shows, buckets[idx].ShowCount)
+		require.Equal(t, bucket.clicks, buckets[idx].ClickCount)
+	}
+
+	err = s.RecordEvent(ctx, storage.Event{ID: storage.NewID(), SlotID: f.slot, BannerID: f.slot,
+		SegmentID: f.segment, Action: storage.Show, Date: now})
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	err = s.RecordEvent(ctx, storage.Event{SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment,
+		Action: storage.Show, Date: now})
+	require.ErrorIs(t, err, storage.ErrInvalidID)
+}
+
+func testDeleteEventIDs(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+	recorded := time.Now().UTC()
+
+	show := storage.Event{ID: storage.NewID(), SlotID: f.slot, BannerID: f.banner, SegmentID: f.segment,
+		Action: storage.Show, Date: recorded.Add(-time.Hour)}
+	require.NoError(t, s.RecordEvent(ctx, show))
+
+	// ID считается по времени записи, а не по времени события
+	require.NoError(t, s.DeleteEventIDs(ctx, recorded.Add(-time.Minute)))
+	require.ErrorIs(t, s.RecordEvent(ctx, show), storage.ErrEventExists)
+
+	// забытое событие учитывается снова
+	require.NoError(t, s.DeleteEventIDs(ctx, time.Now().UTC().Add(time.Second)))
+	require.NoError(t, s.RecordEvent(ctx, show))
+	require.ErrorIs(t, s.RecordEvent(ctx, show), storage.ErrEventExists)
+
+	stat, err := s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 2, stat.ShowCount)
+}
+
+func testConcurrentEvents(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	errs := make(chan error, concurrency*eventsCount)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < eventsCount; j++ {
+				action := storage.Show
+				if (i+j)%5 == 0 {
+					action = storage.Click
+				}
+				errs <- s.CreateEvent(ctx, f.slot, f.banner, f.segment, action)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	clicks := 0
+	for i := 0; i < concurrency; i++ {
+		for j := 0; j < eventsCount; j++ {
+			if (i+j)%5 == 0 {
+				clicks++
+			}
+		}
+	}
+	shows := concurrency*eventsCount - clicks
+
+	stat, err := s.GetStatForBannerAndSegment(ctx, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, shows, stat.ShowCount)
+	require.Equal(t, clicks, stat.ClickCount)
+
+	stat, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, shows, stat.ShowCount)
+	require.Equal(t, clicks, stat.ClickCount)
+}
+
+func testConcurrentClicks(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	impression, err := s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Minute, false)
+	require.NoError(t, err)
+
+	errs := make(chan error, concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := s.ClickImpression(ctx, impression.ID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// засчитывается ровно один переход, остальные получают ErrImpressionClicked
+	clicked := 0
+	for err := range errs {
+		if err == nil {
+			clicked++
+			continue
+		}
+		require.True(t, errors.Is(err, storage.ErrImpressionClicked), "unexpected error %v", err)
+	}
+	require.Equal(t, 1, clicked)
+
+	stat, err := s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 1, stat.ShowCount)
+	require.Equal(t, 1, stat.ClickCount)
+
+	// пиксель и переход одновременно: показ засчитывается ровно одним из них
+	impression, err = s.CreateImpression(ctx, f.slot, f.banner, f.segment, time.Minute, false)
+	require.NoError(t, err)
+
+	shows := make(chan bool, 2*concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := s.ShowImpression(ctx, impression.ID)
+			shows <- err == nil
+		}()
+		go func() {
+			defer wg.Done()
+			_, shown, _ := s.ClickImpression(ctx, impression.ID)
+			shows <- shown
+		}()
+	}
+	wg.Wait()
+	close(shows)
+
+	shown := 0
+	for ok := range shows {
+		if ok {
+			shown++
+		}
+	}
+	require.Equal(t, 1, shown)
+
+	stat, err = s.GetStatForSlotBannerAndSegment(ctx, f.slot, f.banner, f.segment)
+	require.NoError(t, err)
+	require.Equal(t, 2, stat.ShowCount)
+	require.Equal(t, 2, stat.ClickCount)
+}
@@ -0,0 +1,508 @@
+// Package storagetest - общие тесты для реализаций storage.Storage: каждое хранилище должно вести себя одинаково.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/astrviktor/banner-rotation/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// NewStorage создает пустое подключенное хранилище для одного теста.
+type NewStorage func(t *testing.T) storage.Storage
+
+// Run запускает все тесты для хранилища, каждый тест со своим пустым хранилищем.
+func Run(t *testing.T, newStorage NewStorage) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"slots", testSlots},
+		{"banners", testBanners},
+		{"segments", testSegments},
+		{"list", testList},
+		{"invalid id", testInvalidID},
+		{"rotations", testRotations},
+		{"replace rotations", testReplaceRotations},
+		{"events", testEvents},
+		{"events for unknown items", testEventsNotFound},
+		{"recorded events", testRecordEvent},
+		{"delete event ids", testDeleteEventIDs},
+		{"stats for slot", testStatsForSlot},
+		{"delete cascade", testDeleteCascade},
+		{"models", testModels},
+		{"rotation buckets and models", testRotationReads},
+		{"impressions", testImpressions},
+		{"expired impressions", testExpiredImpressions},
+		{"concurrent events", testConcurrentEvents},
+		{"concurrent clicks", testConcurrentClicks},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// fixture - слот, баннер в его ротации и сегмент.
+type fixture struct {
+	slot    string
+	banner  string
+	segment string
+}
+
+func newFixture(t *testing.T, s storage.Storage) fixture {
+	t.Helper()
+
+	ctx := context.Background()
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	banner, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: slot, BannerID: banner})
+	require.NoError(t, err)
+
+	return fixture{slot: slot, banner: banner, segment: segment}
+}
+
+// requireNotFound проверяет, что ошибка - конкретная ошибка хранилища и вместе с тем storage.ErrNotFound.
+func requireNotFound(t *testing.T, err, target error) {
+	t.Helper()
+
+	require.True(t, errors.Is(err, target), "expected %v, got %v", target, err)
+	require.True(t, errors.Is(err, storage.ErrNotFound), "expected not found, got %v", err)
+}
+
+func testSlots(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	id, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+	require.NoError(t, storage.ValidateIDs(id))
+
+	slot, err := s.GetSlot(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, storage.Slot{ID: id, Description: "slot"}, slot)
+
+	err = s.UpdateSlot(ctx, storage.Slot{ID: id, Description: "renamed"})
+	require.NoError(t, err)
+
+	slot, err = s.GetSlot(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, "renamed", slot.Description)
+
+	err = s.DeleteSlot(ctx, id)
+	require.NoError(t, err)
+
+	_, err = s.GetSlot(ctx, id)
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	err = s.UpdateSlot(ctx, storage.Slot{ID: id, Description: "slot"})
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	err = s.DeleteSlot(ctx, id)
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+}
+
+func testBanners(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	id, err := s.CreateBanner(ctx, "banner")
+	require.NoError(t, err)
+
+	banner, err := s.GetBanner(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, storage.Banner{ID: id, Description: "banner"}, banner)
+
+	creative := storage.Creative{
+		Format:    storage.CreativeImage,
+		Width:     240,
+		Height:    400,
+		ImageURL:  "https://cdn.example.com/a.png",
+		TargetURL: "https://example.com/a",
+		AltText:   "a",
+	}
+	err = s.UpdateBanner(ctx, storage.Banner{ID: id, Description: "image", Creative: creative})
+	require.NoError(t, err)
+
+	banner, err = s.GetBanner(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, storage.Banner{ID: id, Description: "image", Creative: creative}, banner)
+
+	withCreative, err := s.CreateBannerWithCreative(ctx, "with creative", creative)
+	require.NoError(t, err)
+
+	created, err := s.GetBanner(ctx, withCreative)
+	require.NoError(t, err)
+	require.Equal(t, storage.Banner{ID: withCreative, Description: "with creative", Creative: creative}, created)
+
+	err = s.DeleteBanner(ctx, id)
+	require.NoError(t, err)
+
+	_, err = s.GetBanner(ctx, id)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	err = s.UpdateBanner(ctx, banner)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	err = s.DeleteBanner(ctx, id)
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+}
+
+func testSegments(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	id, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	segment, err := s.GetSegment(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, id, segment.ID)
+	require.Equal(t, "segment", segment.Description)
+	require.Empty(t, segment.Features)
+
+	features, err := s.GetSegmentFeatures(ctx, id)
+	require.NoError(t, err)
+	require.Empty(t, features)
+
+	err = s.SetSegmentFeatures(ctx, id, []float64{1, 0.5})
+	require.NoError(t, err)
+
+	features, err = s.GetSegmentFeatures(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, []float64{1, 0.5}, features)
+
+	err = s.UpdateSegment(ctx, storage.Segment{ID: id, Description: "renamed", Features: []float64{0.25}})
+	require.NoError(t, err)
+
+	segment, err = s.GetSegment(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, storage.Segment{ID: id, Description: "renamed", Features: []float64{0.25}}, segment)
+
+	err = s.DeleteSegment(ctx, id)
+	require.NoError(t, err)
+
+	_, err = s.GetSegment(ctx, id)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	_, err = s.GetSegmentFeatures(ctx, id)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	err = s.SetSegmentFeatures(ctx, id, []float64{1})
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	err = s.UpdateSegment(ctx, segment)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+
+	err = s.DeleteSegment(ctx, id)
+	requireNotFound(t, err, storage.ErrSegmentNotFound)
+}
+
+func testList(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	ids := make(map[string]string)
+	for _, description := range []string{"Banner B", "banner a", "other", "BANNER_C", "banner a"} {
+		id, err := s.CreateBanner(ctx, description)
+		require.NoError(t, err)
+		ids[id] = description
+	}
+
+	banners, total, err := s.ListBanners(ctx, storage.ListQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Len(t, banners, 5)
+
+	// сортировка по описанию побайтово, при равных описаниях - по ID
+	for i := 1; i < len(banners); i++ {
+		prev, next := banners[i-1], banners[i]
+		require.True(t, prev.Description < next.Description ||
+			prev.Description == next.Description && prev.ID < next.ID, "%v before %v", prev, next)
+	}
+	for _, banner := range banners {
+		require.Equal(t, ids[banner.ID], banner.Description)
+	}
+
+	// поиск по подстроке без учета регистра, спецсимволы LIKE ищутся как есть
+	banners, total, err = s.ListBanners(ctx, storage.ListQuery{Search: "banner", Offset: 1, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 4, total)
+	require.Len(t, banners, 2)
+	require.Equal(t, "Banner B", banners[0].Description)
+	require.Equal(t, "banner a", banners[1].Description)
+
+	banners, total, err = s.ListBanners(ctx, storage.ListQuery{Search: "_"})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, "BANNER_C", banners[0].Description)
+
+	banners, total, err = s.ListBanners(ctx, storage.ListQuery{Search: "%"})
+	require.NoError(t, err)
+	require.Equal(t, 0, total)
+	require.Empty(t, banners)
+
+	banners, total, err = s.ListBanners(ctx, storage.ListQuery{Offset: 10, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Empty(t, banners)
+
+	slot, err := s.CreateSlot(ctx, "slot")
+	require.NoError(t, err)
+
+	slots, total, err := s.ListSlots(ctx, storage.ListQuery{Search: "SLO"})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, []storage.Slot{{ID: slot, Description: "slot"}}, slots)
+
+	segment, err := s.CreateSegment(ctx, "segment")
+	require.NoError(t, err)
+
+	err = s.SetSegmentFeatures(ctx, segment, []float64{1})
+	require.NoError(t, err)
+
+	segments, total, err := s.ListSegments(ctx, storage.ListQuery{Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, []storage.Segment{{ID: segment, Description: "segment", Features: []float64{1}}}, segments)
+}
+
+func testInvalidID(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	for _, id := range []string{"", "1", "not-a-uuid", "{" + f.slot + "}"} {
+		_, err := s.GetSlot(ctx, id)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		_, err = s.GetBanner(ctx, id)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		_, err = s.GetSegment(ctx, id)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		err = s.DeleteBanner(ctx, id)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		err = s.CreateRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: id})
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		_, err = s.ReplaceRotations(ctx, f.slot, []string{f.banner, id})
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		err = s.CreateEvent(ctx, f.slot, f.banner, id, storage.Show)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		_, err = s.GetBannersForSlot(ctx, id)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		_, err = s.GetStatForBannerAndSegment(ctx, id, f.segment)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+
+		_, err = s.GetImpression(ctx, id)
+		require.ErrorIs(t, err, storage.ErrInvalidID, id)
+	}
+
+	// ротация не изменилась
+	banners, err := s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.Equal(t, []string{f.banner}, banners)
+}
+
+func testRotations(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: bannerB})
+	require.NoError(t, err)
+
+	banners, err := s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{f.banner, bannerB}, banners)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: bannerB})
+	require.ErrorIs(t, err, storage.ErrRotationExists)
+	require.ErrorIs(t, err, storage.ErrAlreadyExists)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: f.segment, BannerID: bannerB})
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	err = s.CreateRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: f.segment})
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	err = s.DeleteRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: f.banner})
+	require.NoError(t, err)
+
+	err = s.DeleteRotation(ctx, storage.Rotation{SlotID: f.slot, BannerID: f.banner})
+	requireNotFound(t, err, storage.ErrRotationNotFound)
+
+	banners, err = s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.Equal(t, []string{bannerB}, banners)
+
+	// слот без баннеров и несуществующий слот различаются
+	emptySlot, err := s.CreateSlot(ctx, "empty")
+	require.NoError(t, err)
+
+	banners, err = s.GetBannersForSlot(ctx, emptySlot)
+	require.NoError(t, err)
+	require.Empty(t, banners)
+
+	_, err = s.GetBannersForSlot(ctx, f.segment)
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+}
+
+func testReplaceRotations(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	bannerB, err := s.CreateBanner(ctx, "bannerB")
+	require.NoError(t, err)
+
+	bannerC, err := s.CreateBanner(ctx, "bannerC")
+	require.NoError(t, err)
+
+	diff, err := s.ReplaceRotations(ctx, f.slot, []string{bannerB, bannerC, bannerB})
+	require.NoError(t, err)
+	require.Equal(t, storage.DiffRotations([]string{f.banner}, []string{bannerB, bannerC}), diff)
+
+	banners, err := s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{bannerB, bannerC}, banners)
+
+	diff, err = s.ReplaceRotations(ctx, f.slot, []string{bannerC, bannerB})
+	require.NoError(t, err)
+	require.Equal(t, storage.RotationDiff{Added: []string{}, Removed: []string{}}, diff)
+
+	// неизвестный баннер - ротация не меняется
+	_, err = s.ReplaceRotations(ctx, f.slot, []string{f.banner, f.segment})
+	requireNotFound(t, err, storage.ErrBannerNotFound)
+
+	banners, err = s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{bannerB, bannerC}, banners)
+
+	_, err = s.ReplaceRotations(ctx, f.segment, []string{f.banner})
+	requireNotFound(t, err, storage.ErrSlotNotFound)
+
+	diff, err = s.ReplaceRotations(ctx, f.slot, nil)
+	require.NoError(t, err)
+	require.Empty(t, diff.Added)
+	require.ElementsMatch(t, []string{bannerB, bannerC}, diff.Removed)
+
+	banners, err = s.GetBannersForSlot(ctx, f.slot)
+	require.NoError(t, err)
+	require.Empty(t, banners)
+}
+
+func testModels(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	model, err := s.GetModel(ctx, f.banner)
+	require.NoError(t, err)
+	require.Equal(t, f.banner, model.BannerID)
+	require.Zero(t, model.Dimension)
+
+	err = s.UpdateModel(ctx, f.banner, []float64{1, 2}, storage.Show)
+	require.NoError(t, err)
+
+	err = s.UpdateModel(ctx, f.banner, []float64{1, 2}, storage.Click)
+	require.NoError(t, err)
+
+	expected := storage.NewModel(f.banner, 2)
+	expected.Update([]float64{1, 2}, storage.Show)
+	expected.Update([]float64{1, 2}, storage.Click)
+
+	model, err = s.GetModel(ctx, f.banner)
+	require.NoError(t, err)
+	require.Equal(t, expected, model)
+}
+
+func testRotationReads(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	f := newFixture(t, s)
+
+	other, err := s.CreateBanner(ctx, "other")
+	require.NoError(t, err)
+	empty, err := s.CreateBanner(ctx, "empty")
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	since := now.Add(-storage.StatBucketSize)
+	for _, event := range []storage.Event{
+		{ID: storage.NewID(), BannerID: f.banner, Action: storage.Show, Date: now},
+		{ID: storage.NewID(), BannerID: f.banner, Action: storage.Show, Date: now.Add(-2 * storage.StatBucketSize)},
+		{ID: storage.NewID(), BannerID: other, Action: storage.Show, Date: now},
+		{ID: storage.NewID(), BannerID: other, Action: storage.Click, Date: now},
+	} {
+		event.SlotID, event.SegmentID = f.slot, f.segment
+		require.NoError(t, s.RecordEvent(ctx, event))
+	}
+
+	// каждый баннер - с теми же интервалами, что и GetStatBuckets, баннер без событий - с пустым списком
+	bannersID := []string{f.banner, other, empty}
+	for _, slotID := range []string{storage.AllSlots, f.slot} {
+		buckets, err := s.GetStatBucketsForSlotAndSegment(ctx, slotID, bannersID, f.segment, since)
+		require.NoError(t, err)
+		require.Len(t, buckets, len(bannersID))
+
+		for _, bannerID := range bannersID {
+			expected, err := s.GetStatBuckets(ctx, slotID, bannerID, f.segment, since)
+			require.NoError(t, err)
+			require.Equal(t, expected, buckets[bannerID])
+		}
+		require.Len(t, buckets[f.banner], 1)
+		require.Equal(t, 1, buckets[other][0].ClickCount)
+		require.Empty(t, buckets[empty])
+	}
+
+	buckets, err := s.GetStatBucketsForSlotAndSegment(ctx, f.slot, nil, f.segment, since)
+	require.NoError(t, err)
+	require.Empty(t, buckets)
+
+	_, err = s.GetStatBucketsForSlotAndSegment(ctx, f.slot, []string{f.banner, "not-a-uuid"}, f.segment, since)
+	require.ErrorIs(t, err, storage.ErrInvalidID)
+
+	// модели в порядке баннеров, у баннера без модели - модель без наблюдений
+	require.NoError(t, s.UpdateModel(ctx, f.banner, []float64{1, 2}, storage.Show))
+	require.NoError(t, s.UpdateModel(ctx, other, []float64{0.5}, storage.Click))
+
+	models, err := s.GetModels(ctx, []string{other, empty, f.banner})
+	require.NoError(t, err)
+	require.Len(t, models, 3)
+	for idx, bannerID := range []string{other, empty, f.banner} {
+		expected, err := s.GetModel(ctx, bannerID)
+		require.NoError(t, err)
+		require.Equal(t, expected, models[idx])
+	}
+	require.Equal(t, 2, models[2].Dimension)
+	require.Zero(t, models[1].Dimension)
+
+	models, err = s.GetModels(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, models)
+
+	_, err = s.GetModels(ctx, []string{f.banner, "not-a-uuid"})
+	require.ErrorIs(t, err, storage.ErrInvalidID)
+}
@@ -6,7 +6,14 @@ CREATE SCHEMA banner_rotation;
 
 CREATE TABLE banner_rotation.banner (
   id uuid NOT NULL unique,
-  description text NOT NULL
+  description text NOT NULL,
+  format text NOT NULL DEFAULT '',
+  width integer NOT NULL DEFAULT 0,
+  height integer NOT NULL DEFAULT 0,
+  image_url text NOT NULL DEFAULT '',
+  html text NOT NULL DEFAULT '',
+  target_url text NOT NULL DEFAULT '',
+  alt_text text NOT NULL DEFAULT ''
 );
 
 CREATE INDEX banner_id_index ON banner_rotation.banner (id);
@@ -22,15 +29,16 @@ CREATE INDEX slot_description_index ON banner_rotation.slot (description);
 
 CREATE TABLE banner_rotation.segment (
   id uuid NOT NULL unique,
-  description text NOT NULL
+  description text NOT NULL,
+  features jsonb NOT NULL DEFAULT '[]'
 );
 
 CREATE INDEX segment_id_index ON banner_rotation.segment (id);
 CREATE INDEX segment_description_index ON banner_rotation.segment (description);
 
 CREATE TABLE banner_rotation.rotation (
-  slot_id uuid NOT NULL,
-  banner_id uuid NOT NULL,
+  slot_id uuid NOT NULL REFERENCES banner_rotation.slot (id) ON DELETE CASCADE,
+  banner_id uuid NOT NULL REFERENCES banner_rotation.banner (id) ON DELETE CASCADE,
   PRIMARY KEY (slot_id, banner_id)
 );
 
@@ -38,8 +46,8 @@ CREATE INDEX rotation_slot_id_index ON banner_rotation.rotation (slot_id);
 CREATE INDEX rotation_banner_id_index ON banner_rotation.rotation (banner_id);
 
 CREATE TABLE banner_rotation.stat (
-  banner_id uuid NOT NULL,
-  segment_id uuid NOT NULL,
+  banner_id uuid NOT NULL REFERENCES banner_rotation.banner (id) ON DELETE CASCADE,
+  segment_id uuid NOT NULL REFERENCES banner_rotation.segment (id) ON DELETE CASCADE,
   show_count  integer,
   click_count integer,
   PRIMARY KEY (banner_id, segment_id)
@@ -50,6 +58,7 @@ CREATE INDEX stat_segment_id_index ON banner_rotation.stat (segment_id);
 
 CREATE TYPE action_type AS ENUM ('show', 'click');
 
+-- история событий без внешних ключей: сохраняется после удаления слота, баннера или сегмента
 CREATE TABLE banner_rotation.event (
   slot_id uuid NOT NULL,
   banner_id uuid NOT NULL,
@@ -57,3 +66,69 @@ CREATE TABLE banner_rotation.event (
   action action_type,
   date timestamp with time zone NOT NULL
 );
+
+-- ID событий, записанных из kafka: повторно доставленное событие не учитывается,
+-- записи старше kafka.consumer.dedupeRetention удаляются
+CREATE TABLE banner_rotation.event_id (
+  id uuid NOT NULL,
+  recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX event_id_recorded_at_index ON banner_rotation.event_id (recorded_at);
+
+CREATE TABLE banner_rotation.slot_stat (
+  slot_id uuid NOT NULL REFERENCES banner_rotation.slot (id) ON DELETE CASCADE,
+  banner_id uuid NOT NULL REFERENCES banner_rotation.banner (id) ON DELETE CASCADE,
+  segment_id uuid NOT NULL REFERENCES banner_rotation.segment (id) ON DELETE CASCADE,
+  show_count  integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (slot_id, banner_id, segment_id)
+);
+
+-- slot_id = '00000000-0000-0000-0000-000000000000' - интервалы по всем слотам
+CREATE TABLE banner_rotation.stat_bucket (
+  slot_id uuid NOT NULL,
+  banner_id uuid NOT NULL REFERENCES banner_rotation.banner (id) ON DELETE CASCADE,
+  segment_id uuid NOT NULL REFERENCES banner_rotation.segment (id) ON DELETE CASCADE,
+  start timestamp with time zone NOT NULL,
+  show_count  integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (slot_id, banner_id, segment_id, start)
+);
+
+CREATE TABLE banner_rotation.model (
+  banner_id uuid NOT NULL REFERENCES banner_rotation.banner (id) ON DELETE CASCADE,
+  dimension integer NOT NULL,
+  a jsonb NOT NULL,
+  b jsonb NOT NULL,
+  PRIMARY KEY (banner_id)
+);
+
+-- показ, по которому можно засчитать один переход до expires_at,
+-- shown = false - показ засчитывается при загрузке пикселя
+CREATE TABLE banner_rotation.impression (
+  id uuid NOT NULL,
+  slot_id uuid NOT NULL REFERENCES banner_rotation.slot (id) ON DELETE CASCADE,
+  banner_id uuid NOT NULL REFERENCES banner_rotation.banner (id) ON DELETE CASCADE,
+  segment_id uuid NOT NULL REFERENCES banner_rotation.segment (id) ON DELETE CASCADE,
+  expires_at timestamp with time zone NOT NULL,
+  shown boolean NOT NULL DEFAULT true,
+  clicked boolean NOT NULL DEFAULT false,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX impression_expires_at_index ON banner_rotation.impression (expires_at);
+
+-- события для отправки в kafka, записываются в одной транзакции с событием,
+-- delivered_at IS NULL - еще не отправлено
+CREATE TABLE banner_rotation.outbox (
+  id bigserial NOT NULL,
+  payload jsonb NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT now(),
+  delivered_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX outbox_undelivered_index ON banner_rotation.outbox (id) WHERE delivered_at IS NULL;
+CREATE INDEX outbox_delivered_at_index ON banner_rotation.outbox (delivered_at);
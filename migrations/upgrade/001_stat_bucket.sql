@@ -0,0 +1,19 @@
+-- Обновление существующей базы: почасовая статистика для sliding-window-ucb и discounted-ucb,
+-- заполняется по уже накопленным событиям из banner_rotation.event.
+
+CREATE TABLE IF NOT EXISTS banner_rotation.stat_bucket (
+  banner_id uuid NOT NULL,
+  segment_id uuid NOT NULL,
+  start timestamp with time zone NOT NULL,
+  show_count  integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (banner_id, segment_id, start)
+);
+
+INSERT INTO banner_rotation.stat_bucket (banner_id, segment_id, start, show_count, click_count)
+SELECT banner_id, segment_id, date_trunc('hour', date),
+  count(*) FILTER (WHERE action = 'show'),
+  count(*) FILTER (WHERE action = 'click')
+FROM banner_rotation.event
+GROUP BY banner_id, segment_id, date_trunc('hour', date)
+ON CONFLICT (banner_id, segment_id, start) DO NOTHING;
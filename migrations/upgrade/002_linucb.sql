@@ -0,0 +1,11 @@
+-- Обновление существующей базы: признаки сегментов и модели баннеров для linucb.
+
+ALTER TABLE banner_rotation.segment ADD COLUMN IF NOT EXISTS features jsonb NOT NULL DEFAULT '[]';
+
+CREATE TABLE IF NOT EXISTS banner_rotation.model (
+  banner_id uuid NOT NULL,
+  dimension integer NOT NULL,
+  a jsonb NOT NULL,
+  b jsonb NOT NULL,
+  PRIMARY KEY (banner_id)
+);
@@ -0,0 +1,38 @@
+-- Обновление существующей базы: статистика по слоту, баннеру и сегменту,
+-- заполняется по уже накопленным событиям из banner_rotation.event.
+
+CREATE TABLE IF NOT EXISTS banner_rotation.slot_stat (
+  slot_id uuid NOT NULL,
+  banner_id uuid NOT NULL,
+  segment_id uuid NOT NULL,
+  show_count  integer NOT NULL DEFAULT 0,
+  click_count integer NOT NULL DEFAULT 0,
+  PRIMARY KEY (slot_id, banner_id, segment_id)
+);
+
+INSERT INTO banner_rotation.slot_stat (slot_id, banner_id, segment_id, show_count, click_count)
+SELECT slot_id, banner_id, segment_id,
+  count(*) FILTER (WHERE action = 'show'),
+  count(*) FILTER (WHERE action = 'click')
+FROM banner_rotation.event
+GROUP BY slot_id, banner_id, segment_id
+ON CONFLICT (slot_id, banner_id, segment_id)
+DO UPDATE SET show_count = EXCLUDED.show_count, click_count = EXCLUDED.click_count;
+
+-- почасовые интервалы тоже по слотам: имеющиеся строки становятся интервалами по всем слотам
+-- (slot_id = '00000000-0000-0000-0000-000000000000'), интервалы слотов заполняются по событиям
+
+ALTER TABLE banner_rotation.stat_bucket
+  ADD COLUMN IF NOT EXISTS slot_id uuid NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000';
+ALTER TABLE banner_rotation.stat_bucket ALTER COLUMN slot_id DROP DEFAULT;
+ALTER TABLE banner_rotation.stat_bucket DROP CONSTRAINT IF EXISTS stat_bucket_pkey;
+ALTER TABLE banner_rotation.stat_bucket ADD PRIMARY KEY (slot_id, banner_id, segment_id, start);
+
+INSERT INTO banner_rotation.stat_bucket (slot_id, banner_id, segment_id, start, show_count, click_count)
+SELECT slot_id, banner_id, segment_id, date_trunc('hour', date),
+  count(*) FILTER (WHERE action = 'show'),
+  count(*) FILTER (WHERE action = 'click')
+FROM banner_rotation.event
+GROUP BY slot_id, banner_id, segment_id, date_trunc('hour', date)
+ON CONFLICT (slot_id, banner_id, segment_id, start)
+DO UPDATE SET show_count = EXCLUDED.show_count, click_count = EXCLUDED.click_count;
@@ -0,0 +1,13 @@
+-- Обновление существующей базы: показы для засчитывания перехода по ID показа.
+
+CREATE TABLE IF NOT EXISTS banner_rotation.impression (
+  id uuid NOT NULL,
+  slot_id uuid NOT NULL,
+  banner_id uuid NOT NULL,
+  segment_id uuid NOT NULL,
+  expires_at timestamp with time zone NOT NULL,
+  clicked boolean NOT NULL DEFAULT false,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS impression_expires_at_index ON banner_rotation.impression (expires_at);
@@ -0,0 +1,5 @@
+-- Обновление существующей базы: адрес перехода по баннеру и показы, засчитываемые при загрузке пикселя.
+
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS target_url text NOT NULL DEFAULT '';
+
+ALTER TABLE banner_rotation.impression ADD COLUMN IF NOT EXISTS shown boolean NOT NULL DEFAULT true;
@@ -0,0 +1,8 @@
+-- Обновление существующей базы: содержимое баннера (картинка или HTML-фрагмент) для показа.
+
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS format text NOT NULL DEFAULT '';
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS width integer NOT NULL DEFAULT 0;
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS height integer NOT NULL DEFAULT 0;
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS image_url text NOT NULL DEFAULT '';
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS html text NOT NULL DEFAULT '';
+ALTER TABLE banner_rotation.banner ADD COLUMN IF NOT EXISTS alt_text text NOT NULL DEFAULT '';
@@ -0,0 +1,54 @@
+-- Обновление существующей базы: внешние ключи на слоты, баннеры и сегменты.
+-- Строки, ссылающиеся на несуществующие слоты, баннеры и сегменты, удаляются. История событий не меняется.
+
+DELETE FROM banner_rotation.rotation
+WHERE slot_id NOT IN (SELECT id FROM banner_rotation.slot)
+   OR banner_id NOT IN (SELECT id FROM banner_rotation.banner);
+
+DELETE FROM banner_rotation.stat
+WHERE banner_id NOT IN (SELECT id FROM banner_rotation.banner)
+   OR segment_id NOT IN (SELECT id FROM banner_rotation.segment);
+
+DELETE FROM banner_rotation.slot_stat
+WHERE slot_id NOT IN (SELECT id FROM banner_rotation.slot)
+   OR banner_id NOT IN (SELECT id FROM banner_rotation.banner)
+   OR segment_id NOT IN (SELECT id FROM banner_rotation.segment);
+
+DELETE FROM banner_rotation.stat_bucket
+WHERE banner_id NOT IN (SELECT id FROM banner_rotation.banner)
+   OR segment_id NOT IN (SELECT id FROM banner_rotation.segment);
+
+DELETE FROM banner_rotation.model
+WHERE banner_id NOT IN (SELECT id FROM banner_rotation.banner);
+
+DELETE FROM banner_rotation.impression
+WHERE slot_id NOT IN (SELECT id FROM banner_rotation.slot)
+   OR banner_id NOT IN (SELECT id FROM banner_rotation.banner)
+   OR segment_id NOT IN (SELECT id FROM banner_rotation.segment);
+
+-- имена ограничений те же, что создает create.sql: {таблица}_{столбец}_fkey
+DO $$
+DECLARE
+  fk text[];
+BEGIN
+  FOREACH fk SLICE 1 IN ARRAY ARRAY[
+    ['rotation', 'slot_id', 'slot'],
+    ['rotation', 'banner_id', 'banner'],
+    ['stat', 'banner_id', 'banner'],
+    ['stat', 'segment_id', 'segment'],
+    ['slot_stat', 'slot_id', 'slot'],
+    ['slot_stat', 'banner_id', 'banner'],
+    ['slot_stat', 'segment_id', 'segment'],
+    ['stat_bucket', 'banner_id', 'banner'],
+    ['stat_bucket', 'segment_id', 'segment'],
+    ['model', 'banner_id', 'banner'],
+    ['impression', 'slot_id', 'slot'],
+    ['impression', 'banner_id', 'banner'],
+    ['impression', 'segment_id', 'segment']
+  ] LOOP
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = fk[1] || '_' || fk[2] || '_fkey') THEN
+      EXECUTE format('ALTER TABLE banner_rotation.%I ADD CONSTRAINT %I FOREIGN KEY (%I) '
+        'REFERENCES banner_rotation.%I (id) ON DELETE CASCADE', fk[1], fk[1] || '_' || fk[2] || '_fkey', fk[2], fk[3]);
+    END IF;
+  END LOOP;
+END $$;
@@ -0,0 +1,12 @@
+-- Обновление существующей базы: события для отправки в kafka (outbox).
+
+CREATE TABLE IF NOT EXISTS banner_rotation.outbox (
+  id bigserial NOT NULL,
+  payload jsonb NOT NULL,
+  created_at timestamp with time zone NOT NULL DEFAULT now(),
+  delivered_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS outbox_undelivered_index ON banner_rotation.outbox (id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_delivered_at_index ON banner_rotation.outbox (delivered_at);
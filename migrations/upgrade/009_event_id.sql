@@ -0,0 +1,9 @@
+-- Обновление существующей базы: ID событий, записанных из kafka.
+
+CREATE TABLE IF NOT EXISTS banner_rotation.event_id (
+  id uuid NOT NULL,
+  recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS event_id_recorded_at_index ON banner_rotation.event_id (recorded_at);
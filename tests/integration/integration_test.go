@@ -3,11 +3,14 @@
 package integration_test
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	internalhttp "github.com/astrviktor/banner-rotation/internal/server/http"
+	"github.com/astrviktor/banner-rotation/internal/storage"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -36,6 +39,14 @@ func (s *BannerRotationSuite) SetupSuite() {
 func (s *BannerRotationSuite) SetupTest() {
 }
 
+// clickToken - токен для перехода и пикселя: подписанный токен, если заданы click.keys, иначе ID показа.
+func clickToken(choice internalhttp.ResponseChoice) string {
+	if choice.Token != "" {
+		return choice.Token
+	}
+	return choice.ImpressionID
+}
+
 func (s *BannerRotationSuite) TestTwoBannersAndNoClicks() {
 	err := s.client.GetStatus()
 	s.Require().NoError(err)
@@ -94,10 +105,10 @@ func (s *BannerRotationSuite) TestTwoBannersAndAllClicks() {
 	s.Require().NoError(err)
 
 	for i := 0; i < 1000; i++ {
-		bannerID, err := s.client.Choice(slot, segment)
+		choice, err := s.client.ChoiceImpression(slot, segment)
 		s.Require().NoError(err)
 
-		err = s.client.Click(slot, bannerID, segment)
+		err = s.client.Click(slot, choice.ID, segment, internalhttp.WithToken(choice.Token))
 		s.Require().NoError(err)
 	}
 
@@ -134,11 +145,11 @@ func (s *BannerRotationSuite) TestTwoBannersAndOneClicks() {
 	s.Require().NoError(err)
 
 	for i := 0; i < 1000; i++ {
-		bannerID, err := s.client.Choice(slot, segment)
+		choice, err := s.client.ChoiceImpression(slot, segment)
 		s.Require().NoError(err)
 
-		if bannerID == bannerA {
-			err = s.client.Click(slot, bannerID, segment)
+		if choice.ID == bannerA {
+			err = s.client.Click(slot, choice.ID, segment, internalhttp.WithToken(choice.Token))
 			s.Require().NoError(err)
 		}
 	}
@@ -225,10 +236,10 @@ func (s *BannerRotationSuite) TestThreeBannersAndAllClicks() {
 	s.Require().NoError(err)
 
 	for i := 0; i < 900; i++ {
-		bannerID, err := s.client.Choice(slot, segment)
+		choice, err := s.client.ChoiceImpression(slot, segment)
 		s.Require().NoError(err)
 
-		err = s.client.Click(slot, bannerID, segment)
+		err = s.client.Click(slot, choice.ID, segment, internalhttp.WithToken(choice.Token))
 		s.Require().NoError(err)
 	}
 
@@ -273,11 +284,11 @@ func (s *BannerRotationSuite) TestThreeBannersAndOneClicks() {
 	s.Require().NoError(err)
 
 	for i := 0; i < 1000; i++ {
-		bannerID, err := s.client.Choice(slot, segment)
+		choice, err := s.client.ChoiceImpression(slot, segment)
 		s.Require().NoError(err)
 
-		if bannerID == bannerA {
-			err = s.client.Click(slot, bannerID, segment)
+		if choice.ID == bannerA {
+			err = s.client.Click(slot, choice.ID, segment, internalhttp.WithToken(choice.Token))
 			s.Require().NoError(err)
 		}
 	}
@@ -353,6 +364,331 @@ func (s *BannerRotationSuite) ClicksMoreThenShows() {
 	s.Require().Error(err)
 }
 
+func (s *BannerRotationSuite) TestClickImpression() {
+	err := s.client.GetStatus()
+	s.Require().NoError(err)
+
+	segment, err := s.client.CreateSegment("segment")
+	s.Require().NoError(err)
+
+	slot, err := s.client.CreateSlot("slot")
+	s.Require().NoError(err)
+
+	bannerA, err := s.client.CreateBanner("bannerA")
+	s.Require().NoError(err)
+
+	err = s.client.CreateRotation(slot, bannerA)
+	s.Require().NoError(err)
+
+	choice, err := s.client.ChoiceImpression(slot, segment)
+	s.Require().NoError(err)
+	s.Require().Equal(bannerA, choice.ID)
+	s.Require().NotEmpty(choice.ImpressionID)
+
+	err = s.client.ClickImpression(clickToken(choice))
+	s.Require().NoError(err)
+
+	// повторный переход не засчитывается
+	err = s.client.ClickImpression(clickToken(choice))
+	s.Require().Error(err)
+
+	// с click.keys не засчитываются токен другого баннера, ID показа вместо токена и переход без токена
+	if choice.Token != "" {
+		err = s.client.Click(slot, segment, segment, internalhttp.WithToken(choice.Token))
+		s.Require().Error(err)
+
+		err = s.client.ClickImpression(choice.ImpressionID)
+		s.Require().Error(err)
+
+		err = s.client.Click(slot, bannerA, segment)
+		s.Require().Error(err)
+	}
+
+	statBannerA, err := s.client.GetSlotStat(slot, bannerA, segment)
+	s.Require().NoError(err)
+
+	s.Require().Equal(1, statBannerA.ShowCount)
+	s.Require().Equal(1, statBannerA.ClickCount)
+}
+
+func (s *BannerRotationSuite) TestPixelAndRedirect() {
+	err := s.client.GetStatus()
+	s.Require().NoError(err)
+
+	segment, err := s.client.CreateSegment("segment")
+	s.Require().NoError(err)
+
+	slot, err := s.client.CreateSlot("slot")
+	s.Require().NoError(err)
+
+	bannerA, err := s.client.CreateBannerWithTargetURL("bannerA", "https://example.com/a")
+	s.Require().NoError(err)
+
+	err = s.client.CreateRotation(slot, bannerA)
+	s.Require().NoError(err)
+
+	// показ засчитывается один раз при загрузке пикселя
+	choice, err := s.client.ChoiceImpression(slot, segment, internalhttp.WithPixel())
+	s.Require().NoError(err)
+
+	statBannerA, err := s.client.GetSlotStat(slot, bannerA, segment)
+	s.Require().NoError(err)
+	s.Require().Equal(0, statBannerA.ShowCount)
+
+	err = s.client.Pixel(clickToken(choice))
+	s.Require().NoError(err)
+	err = s.client.Pixel(clickToken(choice))
+	s.Require().NoError(err)
+
+	// переход засчитывается один раз, но перенаправление работает и при повторном переходе
+	location, err := s.client.Redirect(clickToken(choice))
+	s.Require().NoError(err)
+	s.Require().Equal("https://example.com/a", location)
+
+	location, err = s.client.Redirect(clickToken(choice))
+	s.Require().NoError(err)
+	s.Require().Equal("https://example.com/a", location)
+
+	statBannerA, err = s.client.GetSlotStat(slot, bannerA, segment)
+	s.Require().NoError(err)
+	s.Require().Equal(1, statBannerA.ShowCount)
+	s.Require().Equal(1, statBannerA.ClickCount)
+
+	// пиксель не загрузился: переход засчитывает и показ
+	choice, err = s.client.ChoiceImpression(slot, segment, internalhttp.WithPixel())
+	s.Require().NoError(err)
+
+	_, err = s.client.Redirect(clickToken(choice))
+	s.Require().NoError(err)
+
+	statBannerA, err = s.client.GetSlotStat(slot, bannerA, segment)
+	s.Require().NoError(err)
+	s.Require().Equal(2, statBannerA.ShowCount)
+	s.Require().Equal(2, statBannerA.ClickCount)
+
+	if choice.Token != "" {
+		_, err = s.client.Redirect(choice.ImpressionID)
+		s.Require().Error(err)
+	}
+}
+
+func (s *BannerRotationSuite) TestCreative() {
+	err := s.client.GetStatus()
+	s.Require().NoError(err)
+
+	segment, err := s.client.CreateSegment("segment")
+	s.Require().NoError(err)
+
+	slot, err := s.client.CreateSlot("slot")
+	s.Require().NoError(err)
+
+	creative := storage.Creative{
+		Format:    storage.CreativeImage,
+		Width:     240,
+		Height:    400,
+		ImageURL:  "https://cdn.example.com/a.png",
+		TargetURL: "https://example.com/a",
+		AltText:   "bannerA",
+	}
+
+	bannerA, err := s.client.CreateBannerWithCreative("bannerA", creative)
+	s.Require().NoError(err)
+
+	_, err = s.client.CreateBannerWithCreative("bannerB", storage.Creative{Format: storage.CreativeHTML})
+	s.Require().Error(err)
+
+	err = s.client.CreateRotation(slot, bannerA)
+	s.Require().NoError(err)
+
+	banner, err := s.client.GetCreative(bannerA)
+	s.Require().NoError(err)
+	s.Require().Equal(storage.Banner{ID: bannerA, Description: "bannerA", Creative: creative}, banner)
+
+	choice, err := s.client.ChoiceImpression(slot, segment, internalhttp.WithCreative())
+	s.Require().NoError(err)
+	s.Require().Equal(&banner, choice.Creative)
+
+	_, err = s.client.GetCreative(segment)
+	s.Require().Error(err)
+}
+
+func (s *BannerRotationSuite) TestItems() {
+	err := s.client.GetStatus()
+	s.Require().NoError(err)
+
+	// описания уникальны, чтобы поиск не находил элементы других тестов
+	prefix := fmt.Sprintf("items-%d-", time.Now().UnixNano())
+
+	slot, err := s.client.CreateSlot(prefix + "slot")
+	s.Require().NoError(err)
+
+	segment, err := s.client.CreateSegment(prefix + "segment")
+	s.Require().NoError(err)
+
+	banners := make([]string, 0, 3)
+	for _, name := range []string{"c", "a", "b"} {
+		banner, err := s.client.CreateBanner(prefix + name)
+		s.Require().NoError(err)
+		banners = append(banners, banner)
+	}
+
+	list, total, err := s.client.ListBanners(strings.ToUpper(prefix), 1, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(3, total)
+	s.Require().Equal([]storage.Banner{{ID: banners[2], Description: prefix + "b"}}, list)
+
+	banner, err := s.client.UpdateBanner(banners[0], map[string]interface{}{"targetUrl": "https://example.com/c"})
+	s.Require().NoError(err)
+	s.Require().Equal(prefix+"c", banner.Description)
+	s.Require().Equal("https://example.com/c", banner.TargetURL)
+
+	_, err = s.client.UpdateBanner(banners[0], map[string]interface{}{"targetUrl": "javascript:alert(1)"})
+	s.Require().Error(err)
+
+	updatedSlot, err := s.client.UpdateSlot(slot, map[string]interface{}{"description": prefix + "renamed"})
+	s.Require().NoError(err)
+	s.Require().Equal(storage.Slot{ID: slot, Description: prefix + "renamed"}, updatedSlot)
+
+	gotSlot, err := s.client.GetSlot(slot)
+	s.Require().NoError(err)
+	s.Require().Equal(updatedSlot, gotSlot)
+
+	err = s.client.SetSegmentFeatures(segment, []float64{1, 0.5})
+	s.Require().NoError(err)
+
+	gotSegment, err := s.client.GetSegment(segment)
+	s.Require().NoError(err)
+	s.Require().Equal(storage.Segment{ID: segment, Description: prefix + "segment", Features: []float64{1, 0.5}},
+		gotSegment)
+
+	segments, total, err := s.client.ListSegments(prefix, 0, 0)
+	s.Require().NoError(err)
+	s.Require().Equal(1, total)
+	s.Require().Equal([]storage.Segment{gotSegment}, segments)
+
+	err = s.client.CreateRotation(slot, banners[0])
+	s.Require().NoError(err)
+
+	err = s.client.DeleteBanner(banners[0])
+	s.Require().NoError(err)
+
+	_, err = s.client.GetBanner(banners[0])
+	s.Require().Error(err)
+
+	err = s.client.DeleteBanner(banners[0])
+	s.Require().Error(err)
+
+	// баннер удален и из ротации
+	_, err = s.client.Choice(slot, segment)
+	s.Require().Error(err)
+
+	err = s.client.DeleteSlot(slot)
+	s.Require().NoError(err)
+
+	err = s.client.DeleteSegment(segment)
+	s.Require().NoError(err)
+
+	slots, total, err := s.client.ListSlots(prefix, 0, 0)
+	s.Require().NoError(err)
+	s.Require().Equal(0, total)
+	s.Require().Empty(slots)
+}
+
+func (s *BannerRotationSuite) TestReplaceRotation() {
+	err := s.client.GetStatus()
+	s.Require().NoError(err)
+
+	slot, err := s.client.CreateSlot("slot")
+	s.Require().NoError(err)
+
+	banners := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		banner, err := s.client.CreateBanner(fmt.Sprintf("banner%d", i))
+		s.Require().NoError(err)
+		banners = append(banners, banner)
+	}
+
+	err = s.client.CreateRotation(slot, banners[0])
+	s.Require().NoError(err)
+
+	diff, err := s.client.ReplaceRotation(slot, []string{banners[1], banners[2], banners[1]})
+	s.Require().NoError(err)
+	s.Require().Equal(storage.DiffRotations([]string{banners[0]}, []string{banners[1], banners[2]}), diff)
+
+	rotation, err := s.client.GetRotation(slot)
+	s.Require().NoError(err)
+	s.Require().ElementsMatch([]string{banners[1], banners[2]}, rotation)
+
+	// неизвестный баннер - ротация не меняется
+	_, err = s.client.ReplaceRotation(slot, []string{banners[0], slot})
+	s.Require().Error(err)
+
+	rotation, err = s.client.GetRotation(slot)
+	s.Require().NoError(err)
+	s.Require().ElementsMatch([]string{banners[1], banners[2]}, rotation)
+
+	diff, err = s.client.ReplaceRotation(slot, nil)
+	s.Require().NoError(err)
+	s.Require().Empty(diff.Added)
+	s.Require().Len(diff.Removed, 2)
+
+	rotation, err = s.client.GetRotation(slot)
+	s.Require().NoError(err)
+	s.Require().Empty(rotation)
+
+	_, err = s.client.GetRotation(banners[0])
+	s.Require().Error(err)
+}
+
+func (s *BannerRotationSuite) TestReferentialIntegrity() {
+	err := s.client.GetStatus()
+	s.Require().NoError(err)
+
+	segment, err := s.client.CreateSegment("segment")
+	s.Require().NoError(err)
+
+	slot, err := s.client.CreateSlot("slot")
+	s.Require().NoError(err)
+
+	banner, err := s.client.CreateBanner("banner")
+	s.Require().NoError(err)
+
+	// несуществующие слот и баннер
+	err = s.client.CreateRotation(banner, banner)
+	s.Require().Error(err)
+
+	err = s.client.CreateRotation(slot, slot)
+	s.Require().Error(err)
+
+	err = s.client.CreateRotation(slot, banner)
+	s.Require().NoError(err)
+
+	// повторное добавление
+	err = s.client.CreateRotation(slot, banner)
+	s.Require().Error(err)
+
+	_, err = s.client.GetSlot("not-a-uuid")
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "400")
+
+	_, err = s.client.GetSlot(banner)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "404")
+
+	_, err = s.client.ReplaceRotation(slot, []string{strings.ToUpper(banner)})
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "400")
+
+	err = s.client.DeleteRotation(slot, banner)
+	s.Require().NoError(err)
+
+	err = s.client.DeleteRotation(slot, banner)
+	s.Require().Error(err)
+
+	_, err = s.client.Choice(banner, segment)
+	s.Require().Error(err)
+}
+
 func (s *BannerRotationSuite) TearDownTest() {
 }
 